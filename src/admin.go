@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// slowestKept is how many of the slowest book requests /admin/stats lists.
+const slowestKept = 10
+
+// rateWindow is the number of seconds that ops per second average over.
+const rateWindow = 60
+
+// opCounter counts requests in total and per second over the last
+// rateWindow seconds.
+type opCounter struct {
+	total   uint64
+	counts  [rateWindow]uint64
+	seconds [rateWindow]int64
+}
+
+func (c *opCounter) add(now int64) {
+	i := now % rateWindow
+	if c.seconds[i] != now {
+		c.seconds[i], c.counts[i] = now, 0
+	}
+	c.counts[i]++
+	c.total++
+}
+
+func (c *opCounter) rate(now int64) float64 {
+	var sum uint64
+	for i, second := range c.seconds {
+		if now-second < rateWindow {
+			sum += c.counts[i]
+		}
+	}
+	return float64(sum) / rateWindow
+}
+
+type SlowKey struct {
+	Id        string  `json:"id"`
+	Op        string  `json:"op"`
+	LatencyMs float64 `json:"latency_ms"`
+	RequestID string  `json:"request_id"`
+}
+
+// OpStats collects the request rates and slowest keys of /admin/stats.
+type OpStats struct {
+	mu      sync.Mutex
+	ops     map[string]*opCounter
+	slowest []SlowKey
+}
+
+// Observe records a request by its method and route. Requests for a
+// single book also compete for the slowest keys, each id listed once at
+// its slowest.
+func (st *OpStats) Observe(r *http.Request, d time.Duration) {
+	op := r.Method + " " + r.Pattern
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	counter, ok := st.ops[op]
+	if !ok {
+		counter = &opCounter{}
+		st.ops[op] = counter
+	}
+	counter.add(time.Now().Unix())
+
+	id := strings.TrimPrefix(r.URL.Path, "/book/")
+	if r.Pattern != "/book/" || id == "" {
+		return
+	}
+
+	slow := SlowKey{Id: id, Op: r.Method, LatencyMs: float64(d.Microseconds()) / 1000, RequestID: requestID(r.Context())}
+	i := slices.IndexFunc(st.slowest, func(kept SlowKey) bool { return kept.Id == id })
+
+	if i < 0 {
+		st.slowest = append(st.slowest, slow)
+	} else if slow.LatencyMs > st.slowest[i].LatencyMs {
+		st.slowest[i] = slow
+	}
+
+	sort.Slice(st.slowest, func(i, j int) bool { return st.slowest[i].LatencyMs > st.slowest[j].LatencyMs })
+
+	if len(st.slowest) > slowestKept {
+		st.slowest = st.slowest[:slowestKept]
+	}
+}
+
+// Reset forgets the requests observed so far.
+func (st *OpStats) Reset() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.ops = make(map[string]*opCounter)
+	st.slowest = nil
+}
+
+type OpRate struct {
+	Total     uint64  `json:"total"`
+	PerSecond float64 `json:"per_second"`
+}
+
+type AdminStats struct {
+	Books         int               `json:"books"`
+	KeyBytes      int               `json:"key_bytes"`
+	ValueBytes    int               `json:"value_bytes"`
+	HeapBytes     uint64            `json:"heap_bytes"`
+	UptimeSeconds float64           `json:"uptime_seconds"`
+	Goroutines    int               `json:"goroutines"`
+	Ops           map[string]OpRate `json:"ops"`
+	SlowestKeys   []SlowKey         `json:"slowest_keys"`
+}
+
+func (st *OpStats) fill(stats *AdminStats) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := time.Now().Unix()
+
+	stats.Ops = make(map[string]OpRate)
+	for op, counter := range st.ops {
+		stats.Ops[op] = OpRate{Total: counter.total, PerSecond: counter.rate(now)}
+	}
+
+	stats.SlowestKeys = append([]SlowKey{}, st.slowest...)
+}
+
+// HandleAdminStats reports the size of the store, the process and the
+// request rates by method and route over the last minute.
+func (s *Server) HandleAdminStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	books, err := s.store.GetBooks(r.Context())
+	if !handleCanceled(w, err) {
+		return
+	}
+
+	stats := AdminStats{
+		Books:         len(books),
+		HeapBytes:     mem.HeapAlloc,
+		UptimeSeconds: time.Since(s.startedAt).Seconds(),
+		Goroutines:    runtime.NumGoroutine(),
+	}
+	stats.KeyBytes, stats.ValueBytes = s.store.SizeBytes()
+	s.opStats.fill(&stats)
+
+	w.WriteHeader(http.StatusOK)
+	body, _ := json.Marshal(stats)
+
+	w.Write(body)
+}
+
+// HandleFlush deletes every book, bucket books included, after the backup
+// -backup-before-destructive asks for. It deletes them as DELETE does, so
+// the hooks, watchers, webhooks and replicas see each one.
+func (s *Server) HandleFlush(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	if reason := s.writesRefused(); reason != "" {
+		writeError(w, http.StatusForbidden, CodeReadOnly, reason)
+		return
+	}
+
+	if !s.handleBackup(w) {
+		return
+	}
+
+	books, err := s.store.GetBooks(r.Context())
+	if !handleCanceled(w, err) {
+		return
+	}
+
+	ids := make([]string, 0, len(books))
+	for _, book := range books {
+		ids = append(ids, book.Id)
+	}
+
+	flushed, err := s.store.DrainBooks(ids, s.prepareDrain(r))
+	if !handleWriteError(w, err) {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	body, _ := json.Marshal(map[string]int{"flushed": len(flushed)})
+
+	w.Write(body)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Error codes of APIError. The client package lists the same codes for
+// callers; keep the two in step.
+const (
+	CodeBadRequest          = "bad_request"          // 400, malformed input
+	CodeScriptError         = "script_error"         // 400, a script does not parse or failed while running
+	CodeInvalidId           = "invalid_id"           // 400, id breaks -id-charset or -id-prefixes, or is blank
+	CodeUnauthorized        = "unauthorized"         // 401, missing or wrong credentials
+	CodeForbidden           = "forbidden"            // 403, credentials or origin not allowed
+	CodeReadOnly            = "read_only"            // 403, replica or -read-only
+	CodeReservedId          = "reserved_id"          // 403, id matches -reserved-ids
+	CodeNotFound            = "not_found"            // 404, anything but a book
+	CodeBookNotFound        = "book_not_found"       // 404
+	CodeVersionNotFound     = "version_not_found"    // 404, not in the book's history
+	CodeMethodNotAllowed    = "method_not_allowed"   // 405
+	CodeConflict            = "conflict"             // 409, e.g. a version that no longer matches
+	CodeBookExists          = "book_exists"          // 409, POST or ?if=absent of an id already stored
+	CodeWrongType           = "wrong_type"           // 409, book holds another kind of value
+	CodeStaleFenceToken     = "stale_fence_token"    // 409
+	CodeNotReplica          = "not_replica"          // 409
+	CodePrimaryClaimed      = "primary_claimed"      // 409, promotion while another member is primary
+	CodeLockHeld            = "lock_held"            // 409, POST /locks/ of a lock with a live lease
+	CodeIdempotencyConflict = "idempotency_conflict" // 409, Idempotency-Key reused for another request or still in flight
+	CodeBookDeleted         = "book_deleted"         // 410, deleted within -tombstone-ttl
+	CodePreconditionFailed  = "precondition_failed"  // 412, If-Match or ?if= not met
+	CodeTooLarge            = "too_large"            // 413, past a size limit
+	CodeRateLimited         = "rate_limited"         // 429
+	CodeQuotaExceeded       = "quota_exceeded"       // 507, past a -bucket-quotas quota
+	CodeCanceled            = "canceled"             // 499, client went away
+	CodeInternal            = "internal"             // 500
+	CodeUnavailable         = "unavailable"          // 503, warming up, timed out or backend down
+	CodeNoLeader            = "no_leader"            // 503, the raft cluster is electing a leader
+)
+
+// statusCodes are the codes used when a caller gives none, which is the
+// case for statuses chosen at runtime, like badBodyStatus.
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            CodeBadRequest,
+	http.StatusUnauthorized:          CodeUnauthorized,
+	http.StatusForbidden:             CodeForbidden,
+	http.StatusNotFound:              CodeNotFound,
+	http.StatusMethodNotAllowed:      CodeMethodNotAllowed,
+	http.StatusConflict:              CodeConflict,
+	http.StatusGone:                  CodeBookDeleted,
+	http.StatusPreconditionFailed:    CodePreconditionFailed,
+	http.StatusRequestEntityTooLarge: CodeTooLarge,
+	http.StatusTooManyRequests:       CodeRateLimited,
+	http.StatusInsufficientStorage:   CodeQuotaExceeded,
+	statusClientClosedRequest:        CodeCanceled,
+	http.StatusInternalServerError:   CodeInternal,
+	http.StatusServiceUnavailable:    CodeUnavailable,
+}
+
+// APIError is the body of every error answer. RequestID repeats the
+// X-Request-ID header, so it survives when only the body is logged.
+type APIError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func newAPIError(w http.ResponseWriter, status int, code string, message string) APIError {
+	if code == "" {
+		code = statusCodes[status]
+	}
+	return APIError{Code: code, Message: message, RequestID: w.Header().Get("X-Request-ID")}
+}
+
+// writeError answers with an APIError. An empty code picks the generic one
+// for the status.
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	error, _ := json.Marshal(newAPIError(w, status, code, message))
+	w.Write(error)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// EnableArchive keeps the books that expire in an archive keyspace apart
+// from the live books, one per id, the last to expire.
+func (s *MemoryStore) EnableArchive() {
+	unlock := s.lock(nil, true)
+	defer unlock()
+
+	for _, sh := range s.shards {
+		sh.archived = make(map[string]Book)
+	}
+}
+
+// ArchivedBook returns the last book with id to expire, nil when none did
+// or archiving is off.
+func (s *MemoryStore) ArchivedBook(id string) *Book {
+	sh := s.shardFor(id)
+
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	book, ok := sh.archived[id]
+	if !ok {
+		return nil
+	}
+	return &book
+}
+
+// HandleArchive serves GET /archive/<id>, the book with id as it was when
+// it expired.
+func (s *Server) HandleArchive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	bookid := s.cfg.normalizeId(strings.TrimPrefix(r.URL.Path, "/archive/"))
+
+	if s.cfg.isReservedId(bookid) {
+		HandleReservedId(w, bookid)
+		return
+	}
+
+	stop := startTiming(r, "store")
+	book := s.store.ArchivedBook(bookid)
+	stop()
+
+	if book == nil {
+		writeError(w, http.StatusNotFound, CodeBookNotFound, fmt.Sprintf("There is no archived book with id %s", bookid))
+		return
+	}
+
+	s.serveBook(w, r, book)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestArchiveExpired(t *testing.T) {
+	tests := []struct {
+		name     string
+		archived bool
+		status   int // of GET /archive/a once a expired
+	}{
+		{name: "archived", archived: true, status: http.StatusOK},
+		{name: "without -archive-expired", status: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.ArchiveExpired = tt.archived
+			store := NewMemoryStore(4, 0)
+			if tt.archived {
+				store.EnableArchive()
+			}
+			s, ts := newTestServer(t, WithConfig(cfg), WithStore(store))
+
+			expires := time.Now().Add(10 * time.Millisecond)
+			s.store.AddBook(Book{Id: "a", Name: "1", ExpiresAt: &expires})
+			s.store.AddBook(Book{Id: "b", Name: "2"})
+
+			if status, _ := send(t, http.MethodGet, ts.URL+"/archive/a", ""); status != http.StatusNotFound {
+				t.Errorf("GET /archive/a before it expired = %d, want 404", status)
+			}
+
+			store.sweepDue(expires, time.Hour)
+
+			if status, _ := send(t, http.MethodGet, ts.URL+"/book/a", ""); status != http.StatusNotFound {
+				t.Errorf("GET /book/a after it expired = %d, want 404", status)
+			}
+			if status, _ := send(t, http.MethodGet, ts.URL+"/archive/b", ""); status != http.StatusNotFound {
+				t.Errorf("GET /archive/b, which did not expire = %d, want 404", status)
+			}
+
+			status, body := send(t, http.MethodGet, ts.URL+"/archive/a", "")
+			if status != tt.status {
+				t.Fatalf("GET /archive/a = %d %s, want %d", status, body, tt.status)
+			}
+			if status != http.StatusOK {
+				return
+			}
+
+			var book Book
+			if err := json.Unmarshal([]byte(body), &book); err != nil {
+				t.Fatal(err)
+			}
+			if book.Id != "a" || book.Name != "1" {
+				t.Errorf("archived %+v, want a=1", book)
+			}
+		})
+	}
+}
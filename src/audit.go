@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// auditBatchSize is how many records go out in one write or POST.
+const auditBatchSize = 512
+
+// AuditRecord is one line of the audit log. Who is the user of Basic
+// credentials or a fingerprint of the API key, never the key itself. The
+// hashes are of the book content before and after the request, empty
+// where there was no book; requests changing many ids at once, like
+// /import, have no key.
+//
+// Writes over WebSocket, gRPC, memcached and RESP name their protocol,
+// with the command as the method, and have the reply in the place of the
+// HTTP status: the gRPC code, the memcached or RESP reply line, or the
+// error of a WebSocket message, "OK" when it had none.
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	Who       string    `json:"who"`
+	SourceIP  string    `json:"source_ip"`
+	Protocol  string    `json:"protocol,omitempty"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Key       string    `json:"key,omitempty"`
+	OldHash   string    `json:"old_hash,omitempty"`
+	NewHash   string    `json:"new_hash,omitempty"`
+	Status    int       `json:"status,omitempty"`
+	Reply     string    `json:"reply,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// auditor hands the records to a single writer, so they stay in order.
+// Writes wait for room in the queue rather than go unrecorded.
+type auditor struct {
+	queue chan AuditRecord
+	done  chan struct{}
+
+	path    string // the file, "" when posting to url
+	url     string
+	file    *os.File
+	opened  time.Time // day the file was started
+	retains time.Duration
+}
+
+func newAuditor(target string, retention time.Duration) (*auditor, error) {
+	au := &auditor{queue: make(chan AuditRecord, 4*auditBatchSize), done: make(chan struct{}), retains: retention}
+
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		au.url = target
+	} else {
+		au.path = target
+		if err := au.open(); err != nil {
+			return nil, err
+		}
+	}
+
+	go au.run()
+
+	return au, nil
+}
+
+func (au *auditor) open() error {
+	file, err := os.OpenFile(au.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	au.file = file
+	au.opened = info.ModTime()
+	if info.Size() == 0 {
+		au.opened = time.Now()
+	}
+	return nil
+}
+
+// rotate moves a file started on an earlier day aside as <file>.<date> and
+// removes the rotated files past -audit-retention.
+func (au *auditor) rotate(now time.Time) {
+	if au.opened.Format(time.DateOnly) == now.Format(time.DateOnly) {
+		return
+	}
+
+	au.file.Close()
+
+	if err := os.Rename(au.path, au.path+"."+au.opened.Format(time.DateOnly)); err != nil {
+		log.Printf("rotate -audit-log %s: %v", au.path, err)
+	}
+
+	if err := au.open(); err != nil {
+		log.Fatalf("open -audit-log %s: %v", au.path, err)
+	}
+
+	if au.retains <= 0 {
+		return
+	}
+
+	rotated, _ := filepath.Glob(au.path + ".*")
+	for _, name := range rotated {
+		if info, err := os.Stat(name); err == nil && now.Sub(info.ModTime()) > au.retains {
+			os.Remove(name)
+		}
+	}
+}
+
+func (au *auditor) run() {
+	defer close(au.done)
+
+	for record := range au.queue {
+		batch := []AuditRecord{record}
+
+	more:
+		for len(batch) < auditBatchSize {
+			select {
+			case record, ok := <-au.queue:
+				if !ok {
+					break more
+				}
+				batch = append(batch, record)
+			default:
+				break more
+			}
+		}
+
+		au.write(batch)
+	}
+}
+
+func (au *auditor) write(batch []AuditRecord) {
+	data := make([]byte, 0)
+	for _, record := range batch {
+		line, _ := json.Marshal(record)
+		data = append(data, line...)
+		data = append(data, '\n')
+	}
+
+	if au.url != "" {
+		if err := postAudit(au.url, data); err != nil {
+			log.Printf("audit post of %d records: %v", len(batch), err)
+		}
+		return
+	}
+
+	au.rotate(time.Now())
+
+	_, err := au.file.Write(data)
+	if err == nil {
+		err = au.file.Sync()
+	}
+	if err != nil {
+		log.Printf("audit append %s: %v", au.path, err)
+	}
+}
+
+func postAudit(url string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(fmt.Sprintf("audit endpoint answered %s", resp.Status))
+	}
+	return nil
+}
+
+// Close writes the queued records. Only call it once no more requests are
+// served. A nil auditor does nothing.
+func (au *auditor) Close() {
+	if au == nil {
+		return
+	}
+
+	close(au.queue)
+	<-au.done
+
+	if au.file != nil {
+		au.file.Close()
+	}
+}
+
+// Audit records every write request once it has been answered. It wraps
+// the whole mux, so the admin routes and requests refused on the way, say
+// for bad credentials, are recorded as well.
+func (s *Server) Audit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if s.audit == nil || !isWriteMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		done := s.auditWrite(r, s.auditKeys(r))
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r)
+
+		done(rec.status, "")
+	}
+}
+
+// auditWrite hashes the books under keys before the write r makes and
+// returns the func recording it once answered, with the HTTP status or,
+// for the other protocols, the status 0 and their reply. Without
+// -audit-log it records nothing.
+func (s *Server) auditWrite(r *http.Request, keys []string) func(status int, reply string) {
+	if s.audit == nil {
+		return func(int, string) {}
+	}
+
+	before := make([]string, len(keys))
+	for i, key := range keys {
+		before[i] = valueHash(s.store.FindBookById(key))
+	}
+
+	return func(status int, reply string) {
+		record := AuditRecord{
+			Time:      time.Now(),
+			Who:       s.auditWho(r),
+			SourceIP:  r.RemoteAddr,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Status:    status,
+			Reply:     reply,
+			RequestID: requestID(r.Context()),
+		}
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			record.SourceIP = host
+		}
+		if r.ProtoMajor == 0 {
+			// the request of another protocol, see lineRequest
+			record.Protocol = r.Proto
+		}
+
+		if len(keys) == 0 {
+			s.audit.queue <- record
+		}
+		for i, key := range keys {
+			record.Key, record.OldHash, record.NewHash = key, before[i], valueHash(s.store.FindBookById(key))
+			s.audit.queue <- record
+		}
+	}
+}
+
+// auditWho names the caller the way rate limits tell callers apart,
+// with API keys fingerprinted.
+func (s *Server) auditWho(r *http.Request) string {
+	if _, ok := s.apiKeys.authenticate(r); !ok {
+		if hasCredentials(r) {
+			return "invalid credentials"
+		}
+		return "anonymous"
+	}
+
+	who := s.apiKeys.rateLimitClient(r)
+	if key, ok := strings.CutPrefix(who, "key "); ok {
+		sum := sha256.Sum256([]byte(key))
+		return "key " + hex.EncodeToString(sum[:6])
+	}
+	return who
+}
+
+// valueHash is the SHA-256 of what a book holds, leaving out the fields the
+// store sets on every write, or "" for no book.
+func valueHash(book *Book) string {
+	if book == nil {
+		return ""
+	}
+
+	value := *book
+	value.Version, value.CreatedAt, value.UpdatedAt = 0, time.Time{}, time.Time{}
+
+	data, _ := json.Marshal(value)
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// auditKeys returns the store ids a write request names: in its path, or
+// in the body of POST /book/, /batch and /txn.
+func (s *Server) auditKeys(r *http.Request) []string {
+	path := r.URL.Path
+
+	switch {
+	case path == "/book/" && r.Method == http.MethodPost:
+		var book Book
+		if s.peekBody(r, &book) && book.Id != "" {
+			return []string{s.cfg.normalizeId(book.Id)}
+		}
+
+	case strings.HasPrefix(path, "/book/"):
+		id, _, _ := splitBookPath(strings.TrimPrefix(path, "/book/"))
+		return []string{s.cfg.normalizeId(id)}
+
+	case path == "/batch" || path == "/txn":
+		var body TxnRequest
+		var ops []BatchOp
+		if path == "/batch" {
+			if !s.peekBody(r, &ops) {
+				return nil
+			}
+		} else if s.peekBody(r, &body) {
+			ops = append(body.Success, body.Failure...)
+		}
+
+		keys := make([]string, 0, len(ops))
+		for _, op := range ops {
+			if op.Op != "get" {
+				keys = append(keys, s.cfg.normalizeId(op.Book.Id))
+			}
+		}
+		return keys
+
+	case strings.HasPrefix(path, "/bucket/"):
+		bucket, rest, _ := strings.Cut(strings.TrimPrefix(path, "/bucket/"), "/")
+		if id, ok := strings.CutPrefix(rest, "book/"); ok && id != "" {
+			return []string{bucketStoreId(bucket, s.cfg.normalizeId(id))}
+		}
+
+	case strings.HasPrefix(path, "/locks/"):
+		return []string{lockIdPrefix + strings.TrimPrefix(path, "/locks/")}
+	}
+
+	return nil
+}
+
+// peekBody decodes a JSON body and puts it back for the handler. Bodies
+// that are compressed, too large or not JSON of v decode to nothing.
+func (s *Server) peekBody(r *http.Request, v any) bool {
+	if r.Header.Get("Content-Encoding") != "" {
+		return false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, s.cfg.MaxBodyBytes+1))
+	r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	if err != nil || int64(len(body)) > s.cfg.MaxBodyBytes {
+		return false
+	}
+
+	return json.Unmarshal(body, v) == nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
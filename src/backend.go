@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// newMemoryStore returns an empty MemoryStore with the features cfg turns
+// on, loading its encryption keys. It starts no sweeper, see OpenStore.
+func newMemoryStore(cfg Config) (*MemoryStore, error) {
+	quotas, err := parseBucketQuotas(cfg.BucketQuotas)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid -bucket-quotas: %v", err))
+	}
+
+	memory := NewMemoryStore(cfg.Shards, cfg.TombstoneTTL)
+
+	if err := memory.Keyring().Load(cfg); err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid encryption keys: %v", err))
+	}
+
+	if cfg.MaxStoreBytes > 0 || len(quotas) > 0 {
+		memory.LimitBytes(cfg.MaxStoreBytes, quotas)
+	}
+
+	if cfg.ValueIndex {
+		memory.EnableValueIndex()
+	}
+
+	if cfg.HistoryDepth > 0 {
+		memory.KeepHistory(cfg.HistoryDepth)
+	}
+
+	if cfg.SoftDelete {
+		memory.EnableSoftDelete()
+	}
+
+	if cfg.ArchiveExpired {
+		memory.EnableArchive()
+	}
+
+	if cfg.VerifyReads {
+		memory.VerifyReads()
+	}
+
+	memory.UseETagAlgo(cfg.ETagAlgo)
+
+	return memory, nil
+}
+
+// OpenStore opens the -backend of cfg over a memory store from
+// newMemoryStore, whose sweepers and eviction it starts. The caller closes
+// the store.
+func OpenStore(cfg Config) (Store, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	memory, err := newMemoryStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.TombstoneTTL > 0 {
+		go memory.SweepTombstones(cfg.TombstoneTTL)
+	}
+
+	go memory.SweepExpired(cfg.TTLSweepInterval)
+
+	if cfg.MaxMemory > 0 {
+		memory.StartEviction(cfg.MaxMemory, cfg.EvictionPolicy)
+	}
+
+	switch cfg.Backend {
+	case "file":
+		fileStore, err := NewFileStore(cfg.DataFile, memory)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("open -data-file %s: %v", cfg.DataFile, err))
+		}
+		go fileStore.FlushEvery(cfg.FlushInterval)
+		return fileStore, nil
+
+	case "wal":
+		walStore, err := NewWALStore(cfg.WALFile, cfg.WALMaxBytes, memory)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("open -wal-file %s: %v", cfg.WALFile, err))
+		}
+		if cfg.WriteBehind {
+			walStore.WriteBehind(cfg.WriteBehindInterval, cfg.WriteBehindBatch)
+		}
+		return walStore, nil
+
+	case "redis":
+		upstream, err := newRedisUpstream(cfg.UpstreamURL, cfg.UpstreamPrefix)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("connect to -upstream: %v", err))
+		}
+		cacheStore := NewCacheStore(upstream, cfg.CacheTTL, memory)
+		if cfg.WriteBehind {
+			cacheStore.WriteBehind(cfg.WriteBehindInterval, cfg.WriteBehindBatch)
+		}
+		return cacheStore, nil
+
+	case "raft":
+		raftStore, err := openRaftStore(memory, cfg)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("start raft member %s: %v", cfg.RaftID, err))
+		}
+		return raftStore, nil
+	}
+
+	return memory, nil
+}
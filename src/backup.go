@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// handleBackup takes the -backup-before-destructive snapshot, reporting its
+// path in X-Backup-Path. It reports false after answering the request when
+// the backup fails, in which case the destructive operation must not run.
+// Only operations that can delete many books at once call it.
+func (s *Server) handleBackup(w http.ResponseWriter) bool {
+	if !s.cfg.BackupBeforeDestructive {
+		return true
+	}
+
+	path, err := s.writeSnapshot(s.cfg.SnapshotDir)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("Backup failed. %v", err))
+		return false
+	}
+
+	w.Header().Set("X-Backup-Path", path)
+
+	return true
+}
+
+// bulkDelete reports whether ops delete more than one book, which makes a
+// batch a bulk delete.
+func bulkDelete(ops []BatchOp) bool {
+	deletes := 0
+	for _, op := range ops {
+		if op.Op == "delete" {
+			deletes++
+		}
+	}
+	return deletes > 1
+}
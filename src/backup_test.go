@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestBackupBeforeDestructive(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{name: "delete matching ids", method: "DELETE", path: "/list?match=*", status: 200},
+		{name: "drain", method: "POST", path: "/drain/", body: `["a"]`, status: 200},
+		{name: "a batch deleting several books", method: "POST", path: "/batch", body: `[{"op":"delete","book":{"id":"a"}},{"op":"delete","book":{"id":"b"}}]`, status: 200},
+		{name: "a txn deleting several books", method: "POST", path: "/txn", body: `{"success":[{"op":"delete","book":{"id":"a"}},{"op":"delete","book":{"id":"b"}}]}`, status: 200},
+		{name: "flush", method: "POST", path: "/admin/flush", status: 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.BackupBeforeDestructive, cfg.SnapshotDir = true, t.TempDir()
+
+			s, ts := newTestServer(t, WithConfig(cfg))
+			s.store.AddBook(Book{Id: "a", Author: "A", Name: "1"})
+			s.store.AddBook(Book{Id: "b", Author: "B", Name: "2"})
+
+			req, _ := http.NewRequest(tt.method, ts.URL+tt.path, strings.NewReader(tt.body))
+			req.SetBasicAuth("test", "test")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if s.store.FindBookById("a") != nil {
+				t.Fatal("the operation did not delete a")
+			}
+
+			path := resp.Header.Get("X-Backup-Path")
+			if filepath.Dir(path) != cfg.SnapshotDir {
+				t.Fatalf("X-Backup-Path %q, want a file in %s", path, cfg.SnapshotDir)
+			}
+
+			backup, err := s.readSnapshot(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := make([]string, 0)
+			for _, book := range backup {
+				ids = append(ids, book.Id)
+			}
+			slices.Sort(ids)
+			if !slices.Equal(ids, []string{"a", "b"}) {
+				t.Errorf("the backup holds %v, want the books before the operation", ids)
+			}
+		})
+	}
+}
+
+func TestBackupFailureStopsTheOperation(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.BackupBeforeDestructive = true
+
+	// a file where the snapshot directory should be
+	cfg.SnapshotDir = filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(cfg.SnapshotDir, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, ts := newTestServer(t, WithConfig(cfg))
+	s.store.AddBook(Book{Id: "a", Name: "1"})
+
+	if status, body := send(t, http.MethodPost, ts.URL+"/drain/", `["a"]`); status != http.StatusInternalServerError {
+		t.Errorf("status %d: %s", status, body)
+	}
+	if s.store.FindBookById("a") == nil {
+		t.Error("a was deleted without a backup")
+	}
+}
+
+func TestNoBackup(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		method  string
+		path    string
+		body    string
+	}{
+		{name: "without the flag", enabled: false, method: "POST", path: "/drain/", body: `["a"]`},
+		{name: "a single delete", enabled: true, method: "DELETE", path: "/book/a"},
+		{name: "an empty-value delete", enabled: true, method: "PUT", path: "/book/a", body: `{}`},
+		{name: "a batch deleting one book", enabled: true, method: "POST", path: "/batch", body: `[{"op":"delete","book":{"id":"a"}}]`},
+		{name: "a batch of puts", enabled: true, method: "POST", path: "/batch", body: `[{"op":"put","book":{"id":"a","name":"2"}},{"op":"put","book":{"id":"b","name":"2"}}]`},
+		{name: "a merging import", enabled: true, method: "POST", path: "/import", body: `{"id":"b","name":"2"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.EmptyValuePolicy = "delete"
+			cfg.BackupBeforeDestructive, cfg.SnapshotDir = tt.enabled, t.TempDir()
+
+			s, ts := newTestServer(t, WithConfig(cfg))
+			s.store.AddBook(Book{Id: "a", Name: "1"})
+
+			if status, body := send(t, tt.method, ts.URL+tt.path, tt.body); status != http.StatusOK {
+				t.Fatalf("status %d: %s", status, body)
+			}
+			if entries, _ := os.ReadDir(cfg.SnapshotDir); len(entries) != 0 {
+				t.Errorf("backups written: %v", entries)
+			}
+		})
+	}
+}
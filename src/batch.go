@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// HandleBatch applies a JSON array of put and delete ops all or nothing.
+// The response lists one result per op. When any op fails, nothing is
+// written and the failing ops carry an error.
+func (s *Server) HandleBatch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	w, ok := s.handleFenceToken(w, r)
+	if !ok {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.MaxBodyBytes)
+
+	var ops []BatchOp
+
+	err := s.decodeBody(r, &ops)
+	if err != nil {
+		writeError(w, badBodyStatus(err), "", err.Error())
+		return
+	}
+
+	if !s.handleOps(w, r, ops) {
+		return
+	}
+
+	if bulkDelete(ops) && !s.handleBackup(w) {
+		return
+	}
+
+	stop := startTiming(r, "store")
+	results, applied := s.store.ApplyBatch(ops)
+	stop()
+
+	stop = startTiming(r, "serialize")
+	body, _ := json.Marshal(results)
+	stop()
+
+	if applied {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusConflict)
+	}
+
+	w.Write(body)
+}
+
+// handleOps normalizes the ids of ops in place and applies the reserved
+// id, empty value and size rules and the hooks to them, answering the
+// request when one is broken.
+func (s *Server) handleOps(w http.ResponseWriter, r *http.Request, ops []BatchOp) bool {
+	if !s.normalizeOps(w, ops) {
+		return false
+	}
+
+	for i := range ops {
+		switch ops[i].Op {
+		case "put":
+			if !s.handlePutHooks(w, r, &ops[i].Book) {
+				return false
+			}
+		case "delete":
+			if !s.handleDeleteHooks(w, r, ops[i].Book.Id) {
+				return false
+			}
+		}
+	}
+
+	return s.handleLimits(w, opPuts(ops)...)
+}
+
+// normalizeOps is handleOps without the hooks and the size limits.
+func (s *Server) normalizeOps(w http.ResponseWriter, ops []BatchOp) bool {
+	for i, op := range ops {
+		ops[i].Book.Id = s.cfg.normalizeId(op.Book.Id)
+
+		if s.cfg.isReservedId(ops[i].Book.Id) {
+			HandleReservedId(w, ops[i].Book.Id)
+			return false
+		}
+
+		if op.Op != "put" || op.Book.Author != "" || op.Book.Name != "" {
+			continue
+		}
+
+		switch s.cfg.EmptyValuePolicy {
+		case "reject":
+			writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("book %s has no author and name", ops[i].Book.Id))
+			return false
+		case "delete":
+			ops[i].Op = "delete"
+		}
+	}
+	return true
+}
+
+// opPuts returns the books the puts of ops write.
+func opPuts(ops []BatchOp) []Book {
+	puts := make([]Book, 0, len(ops))
+	for _, op := range ops {
+		if op.Op == "put" {
+			puts = append(puts, op.Book)
+		}
+	}
+	return puts
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// benchResult is what one worker measured for one kind of request.
+type benchResult struct {
+	latencies []time.Duration
+	errors    int
+}
+
+// commandBench load-tests the server with a mix of GET and PUT requests on
+// a set of books it creates under prefix first and deletes afterwards, and
+// prints throughput and latency percentiles per request kind.
+func (c Config) commandBench(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	workers := flags.Int("c", 16, "concurrent requests")
+	duration := flags.Duration("d", 10*time.Second, "how long to run")
+	keys := flags.Int("keys", 1000, "how many books to spread the requests over")
+	valueSize := flags.Int("value-size", 64, "bytes of each book name written")
+	reads := flags.Float64("reads", 0.9, "fraction of requests that are GETs, the rest are PUTs")
+	prefix := flags.String("prefix", "bench/", "id prefix of the books used")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 || *workers <= 0 || *duration <= 0 || *keys <= 0 || *valueSize < 0 || *reads < 0 || *reads > 1 {
+		return errors.New("invalid bench flags")
+	}
+
+	http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost = *workers
+
+	value := strings.Repeat("x", *valueSize)
+	ids := make([]string, *keys)
+	for i := range ids {
+		ids[i] = *prefix + strconv.Itoa(i)
+	}
+
+	if err := c.benchBatch("put", ids, value); err != nil {
+		return errors.New(fmt.Sprintf("create books: %v", err))
+	}
+	defer func() {
+		if err := c.benchBatch("delete", ids, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "delete books: %v\n", err)
+		}
+	}()
+
+	gets := make([]benchResult, *workers)
+	puts := make([]benchResult, *workers)
+	deadline := time.Now().Add(*duration)
+
+	var wg sync.WaitGroup
+
+	for worker := range *workers {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for time.Now().Before(deadline) {
+				id := ids[rand.IntN(len(ids))]
+				path := "/book/" + url.PathEscape(id)
+
+				result, method, body := &gets[worker], http.MethodGet, []byte(nil)
+				if rand.Float64() >= *reads {
+					result, method = &puts[worker], http.MethodPut
+					body, _ = json.Marshal(Book{Id: id, Name: value})
+				}
+
+				start := time.Now()
+				_, err := c.commandDo(method, path, body)
+				result.latencies = append(result.latencies, time.Since(start))
+
+				if err != nil {
+					result.errors++
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	fmt.Printf("%d workers for %v on %d books of %d bytes, %.0f%% reads\n\n", *workers, *duration, *keys, *valueSize, *reads*100)
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(out, "request\trequests\terrors\treq/s\tp50\tp90\tp99\tmax\t")
+
+	all := slices.Concat(gets, puts)
+	for _, row := range []struct {
+		name    string
+		results []benchResult
+	}{{"GET", gets}, {"PUT", puts}, {"all", all}} {
+		benchRow(out, row.name, row.results, *duration)
+	}
+
+	return out.Flush()
+}
+
+func benchRow(out *tabwriter.Writer, name string, results []benchResult, duration time.Duration) {
+	latencies := make([]time.Duration, 0)
+	errors := 0
+
+	for _, result := range results {
+		latencies = append(latencies, result.latencies...)
+		errors += result.errors
+	}
+
+	if len(latencies) == 0 {
+		fmt.Fprintf(out, "%s\t0\t0\t0\t-\t-\t-\t-\t\n", name)
+		return
+	}
+
+	slices.Sort(latencies)
+
+	percentile := func(p float64) time.Duration {
+		return latencies[min(len(latencies)-1, int(p*float64(len(latencies))))].Round(time.Microsecond)
+	}
+
+	fmt.Fprintf(out, "%s\t%d\t%d\t%.0f\t%v\t%v\t%v\t%v\t\n", name, len(latencies), errors,
+		float64(len(latencies))/duration.Seconds(), percentile(0.5), percentile(0.9), percentile(0.99), latencies[len(latencies)-1].Round(time.Microsecond))
+}
+
+// benchBatch puts or deletes the books with ids through /batch, in chunks
+// that stay well below the body limit.
+func (c Config) benchBatch(op string, ids []string, value string) error {
+	for start := 0; start < len(ids); start += 500 {
+		ops := make([]BatchOp, 0, 500)
+		for _, id := range ids[start:min(start+500, len(ids))] {
+			ops = append(ops, BatchOp{Op: op, Book: Book{Id: id, Name: value}})
+		}
+
+		body, _ := json.Marshal(ops)
+		if _, err := c.commandDo(http.MethodPost, "/batch", body); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"text/tabwriter"
+	"time"
+)
+
+// captureStdout returns what f printed to standard output.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	printed := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		printed <- string(data)
+	}()
+
+	defer func(old *os.File) { os.Stdout = old }(os.Stdout)
+	os.Stdout = w
+	f()
+	w.Close()
+
+	return <-printed
+}
+
+// benchRows returns the fields of each row of a bench report by request
+// kind.
+func benchRows(report string) map[string][]string {
+	rows := make(map[string][]string)
+	for _, line := range strings.Split(report, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 8 {
+			rows[fields[0]] = fields
+		}
+	}
+	return rows
+}
+
+func TestCommandBenchFlags(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{name: "no workers", args: []string{"-c=0"}},
+		{name: "no duration", args: []string{"-d=0s"}},
+		{name: "no books", args: []string{"-keys=0"}},
+		{name: "a negative value size", args: []string{"-value-size=-1"}},
+		{name: "a read fraction below zero", args: []string{"-reads=-0.1"}},
+		{name: "a read fraction above one", args: []string{"-reads=1.5"}},
+		{name: "an argument", args: []string{"extra"}},
+		{name: "an unknown flag", args: []string{"-rate=5"}},
+	}
+
+	cfg := DefaultConfig()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := cfg.commandBench(tt.args); err == nil {
+				t.Errorf("bench %v ran, want an error", tt.args)
+			}
+		})
+	}
+}
+
+func TestCommandBench(t *testing.T) {
+	tests := []struct {
+		name       string
+		reads      string
+		gets, puts bool // whether any are sent
+	}{
+		{name: "only reads", reads: "1", gets: true},
+		{name: "only writes", reads: "0", puts: true},
+		{name: "a mix", reads: "0.5", gets: true, puts: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ts := newTestServer(t)
+			s.store.AddBook(Book{Id: "other", Name: "kept"})
+			cfg := DefaultConfig()
+			cfg.CommandServer, cfg.CommandUser = ts.URL, "test:test"
+
+			var err error
+			report := captureStdout(t, func() {
+				err = cfg.commandBench([]string{"-c=4", "-d=200ms", "-keys=20", "-value-size=8", "-reads=" + tt.reads, "-prefix=bench/"})
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rows := benchRows(report)
+			for kind, sent := range map[string]bool{"GET": tt.gets, "PUT": tt.puts, "all": true} {
+				row, ok := rows[kind]
+				if !ok {
+					t.Fatalf("no %s row in %q", kind, report)
+				}
+				if requests, _ := strconv.Atoi(row[1]); (requests > 0) != sent {
+					t.Errorf("%d %s requests", requests, kind)
+				}
+				if row[2] != "0" {
+					t.Errorf("%s errors %s, want none", kind, row[2])
+				}
+			}
+
+			books, _ := s.store.GetBooks(context.Background())
+			if len(books) != 1 || books[0].Id != "other" {
+				t.Errorf("after the bench the store holds %d books, want only the one it did not create", len(books))
+			}
+		})
+	}
+}
+
+func TestBenchRow(t *testing.T) {
+	tests := []struct {
+		name      string
+		latencies []time.Duration
+		errors    int
+		want      []string // requests, errors, req/s, p50, p90, p99, max
+	}{
+		{name: "no requests", want: []string{"0", "0", "0", "-", "-", "-", "-"}},
+		{name: "one request", latencies: []time.Duration{time.Millisecond}, want: []string{"1", "0", "1", "1ms", "1ms", "1ms", "1ms"}},
+		{
+			name:      "a hundred requests",
+			latencies: hundredLatencies(),
+			errors:    3,
+			want:      []string{"100", "3", "100", "51ms", "91ms", "100ms", "100ms"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var report bytes.Buffer
+			out := tabwriter.NewWriter(&report, 0, 0, 2, ' ', tabwriter.AlignRight)
+
+			// split over two workers, unsorted
+			half := len(tt.latencies) / 2
+			results := []benchResult{
+				{latencies: tt.latencies[half:], errors: tt.errors},
+				{latencies: tt.latencies[:half]},
+			}
+			benchRow(out, "GET", results, time.Second)
+			out.Flush()
+
+			row := benchRows(report.String())["GET"]
+			if strings.Join(row[1:], " ") != strings.Join(tt.want, " ") {
+				t.Errorf("row %v, want %v", row[1:], tt.want)
+			}
+		})
+	}
+}
+
+func hundredLatencies() []time.Duration {
+	latencies := make([]time.Duration, 100)
+	for i := range latencies {
+		latencies[i] = time.Duration(100-i) * time.Millisecond
+	}
+	return latencies
+}
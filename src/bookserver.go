@@ -0,0 +1,526 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// Server is the book server: the routes over the store and the HTTP
+// server serving them. Handlers are its methods and reach the store, the
+// hooks and the middleware through it, so servers built by New do not
+// share them.
+type Server struct {
+	cfg Config
+
+	// the -bucket-ttls and -bucket-quotas of cfg, parsed
+	bucketTTLs   map[string]time.Duration
+	bucketQuotas map[string]Quota
+
+	http        *http.Server
+	store       Store
+	hooks       []Hooks
+	middlewares map[string]Middleware
+
+	// the pub/sub channels, apart from the watchers of the store
+	channels *Channels
+
+	// ready is set once the store has been loaded and cleared again when
+	// shutdown starts, so load balancers stop sending traffic first.
+	ready atomic.Bool
+
+	// readOnly is set while writes are switched off by -read-only or
+	// /admin/read-only, replicating while the server follows a primary,
+	// and fenced once a primary sees another member be primary in a later
+	// term, so two primaries never both take writes.
+	readOnly    atomic.Bool
+	replicating atomic.Bool
+	fenced      atomic.Bool
+
+	// promoted is done once the replica has been promoted, which ends the
+	// stream from the primary.
+	promoted context.Context
+	promote  context.CancelFunc
+
+	// the keys the server accepts and the TLS config last built from the
+	// files; reloads swap both
+	apiKeys *APIKeys
+	tls     atomic.Pointer[tls.Config]
+
+	// what the middleware counts, keeps and limits
+	metrics        *Metrics
+	opStats        *OpStats
+	warnings       *Warnings
+	idempotency    *IdempotencyCache
+	rateLimiter    *RateLimiter
+	recentRequests *RequestRing
+	spans          *spanExporter
+	keyLocks       *stripedLocks
+	startedAt      time.Time
+
+	// the streaming responses being written
+	openStreams atomic.Int64
+
+	// highestFenceToken is the largest X-Fence-Token any successful write
+	// has carried.
+	highestFenceToken atomic.Uint64
+
+	// the audit log and the webhooks, nil unless enabled
+	audit    *auditor
+	webhooks *Webhooks
+
+	// the listeners of the other protocols, nil unless enabled
+	memcached *tcpServer
+	redis     *tcpServer
+	grpc      *grpc.Server
+}
+
+// ServerOption sets up the server New builds. Settings without an
+// option keep their default, see DefaultConfig.
+type ServerOption func(*serverOptions)
+
+type serverOptions struct {
+	cfg         Config
+	store       Store
+	routeOrders map[string]string
+	middlewares map[string]Middleware
+	hooks       []Hooks
+}
+
+// WithConfig sets every setting of the server, as main reads them from
+// the flags.
+func WithConfig(cfg Config) ServerOption {
+	return func(options *serverOptions) {
+		options.cfg = cfg
+	}
+}
+
+// WithAddr sets the address the server listens on, -addr by default.
+func WithAddr(addr string) ServerOption {
+	return func(options *serverOptions) {
+		options.cfg.Addr = addr
+	}
+}
+
+// WithStore sets the store the server serves, by default a new empty
+// MemoryStore with the features the config enables, see newMemoryStore.
+func WithStore(store Store) ServerOption {
+	return func(options *serverOptions) {
+		options.store = store
+	}
+}
+
+// WithMiddlewareOrder sets the order of the middleware around the book
+// routes, -middleware-order by default.
+func WithMiddlewareOrder(order string) ServerOption {
+	return func(options *serverOptions) {
+		options.cfg.MiddlewareOrder = order
+	}
+}
+
+// WithRouteMiddleware gives the routes whose pattern starts with prefix
+// their own middleware order, on top of -route-middleware.
+func WithRouteMiddleware(prefix, order string) ServerOption {
+	return func(options *serverOptions) {
+		options.routeOrders[prefix] = order
+	}
+}
+
+// WithMiddleware adds a middleware layer that the orders can name, next
+// to the built-in ones.
+func WithMiddleware(name string, layer Middleware) ServerOption {
+	return func(options *serverOptions) {
+		options.middlewares[name] = layer
+	}
+}
+
+// WithHooks adds hooks run around the book reads and writes, in the order
+// given, see Hooks.
+func WithHooks(hooks ...Hooks) ServerOption {
+	return func(options *serverOptions) {
+		options.hooks = append(options.hooks, hooks...)
+	}
+}
+
+// New returns the server with every route, or the error of the first
+// setting that is not valid.
+func New(opts ...ServerOption) (*Server, error) {
+	options := serverOptions{cfg: DefaultConfig(), routeOrders: make(map[string]string), middlewares: make(map[string]Middleware)}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	cfg := options.cfg
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	routeOrders, err := parseRouteMiddleware(cfg.RouteMiddleware)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid -route-middleware: %v", err))
+	}
+	maps.Copy(routeOrders, options.routeOrders)
+
+	if options.store == nil {
+		options.store, err = newMemoryStore(cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s := &Server{
+		cfg:            cfg,
+		store:          options.store,
+		hooks:          options.hooks,
+		channels:       NewChannels(),
+		apiKeys:        &APIKeys{authReads: cfg.AuthReads},
+		metrics:        NewMetrics(),
+		opStats:        &OpStats{ops: make(map[string]*opCounter)},
+		warnings:       &Warnings{slow: make(map[[2]string]uint64), large: make(map[[2]string]uint64), slowAfter: cfg.SlowRequestThreshold, largeAfter: cfg.LargeValueThreshold},
+		idempotency:    &IdempotencyCache{answers: make(map[string]*idempotentAnswer), ttl: cfg.IdempotencyTTL, maxKeys: cfg.IdempotencyMaxKeys},
+		rateLimiter:    NewRateLimiter(),
+		recentRequests: NewRequestRing(cfg.TraceRequests),
+		spans:          &spanExporter{endpoint: cfg.OTLPEndpoint, service: cfg.OTelServiceName, queue: make(chan *span, 4*spanBatchSize), done: make(chan struct{})},
+		keyLocks:       newStripedLocks(cfg.KeyLockStripes),
+		startedAt:      time.Now(),
+	}
+	s.promoted, s.promote = context.WithCancel(context.Background())
+	s.middlewares = s.builtinMiddlewares()
+
+	// validate has parsed these already
+	s.bucketTTLs, _ = parseBucketTTLs(cfg.BucketTTLs)
+	s.bucketQuotas, _ = parseBucketQuotas(cfg.BucketQuotas)
+	limits, _ := cfg.rateLimits()
+	s.rateLimiter.Configure(limits)
+
+	s.readOnly.Store(cfg.ReadOnly)
+
+	for name, layer := range options.middlewares {
+		if _, ok := s.middlewares[name]; ok {
+			return nil, errors.New(fmt.Sprintf("middleware %s already exists", name))
+		}
+		s.middlewares[name] = layer
+	}
+
+	// ServerTiming and Tracing, when enabled, cover every other layer
+	always := []Middleware{s.ReadOnly}
+	if s.cfg.tracingEnabled() {
+		always = append(always, s.Tracing)
+	}
+	if s.cfg.ServerTiming {
+		always = append(always, ServerTiming)
+	}
+
+	chain, err := NewRouteChains(cfg.MiddlewareOrder, routeOrders, s.middlewares, always...)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid middleware order: %v", err))
+	}
+
+	handler := http.NewServeMux()
+
+	handler.HandleFunc("/book/", chain.Then(s.HandleBook))
+
+	handler.HandleFunc("/books/", chain.Then(s.HandleBooks))
+
+	handler.HandleFunc("/drain/", chain.Then(s.HandleDrainBooks))
+
+	handler.HandleFunc("/list", chain.Then(s.HandleList))
+
+	handler.HandleFunc("/diff/", chain.Then(s.HandleDiffBooks))
+
+	handler.HandleFunc("/batch", chain.Then(s.HandleBatch))
+
+	handler.HandleFunc("/txn", chain.Then(s.HandleTxn))
+
+	handler.HandleFunc("/search", chain.Then(s.HandleSearch))
+
+	handler.HandleFunc("/export", chain.Then(s.HandleExport))
+
+	handler.HandleFunc("/import", chain.Then(s.HandleImport))
+
+	handler.HandleFunc("/watch", chain.Then(s.HandleWatch))
+
+	handler.HandleFunc("/watch/", chain.Then(s.HandleWatch))
+
+	handler.HandleFunc("/ws", chain.Then(s.HandleWebSocket))
+
+	handler.HandleFunc("/publish/", chain.Then(s.HandlePublish))
+
+	handler.HandleFunc("/subscribe/", chain.Then(s.HandleSubscribe))
+
+	handler.HandleFunc("/bucket/", chain.Then(s.HandleBucket))
+
+	handler.HandleFunc("/locks/", chain.Then(s.HandleLock))
+
+	handler.HandleFunc("/leases/", chain.Then(s.HandleLease))
+
+	handler.HandleFunc("/scripts/", chain.Then(s.HandleScripts))
+
+	handler.HandleFunc("/eval", chain.Then(s.HandleEval))
+
+	handler.HandleFunc("/snapshot", chain.Then(s.HandleSnapshot))
+
+	handler.HandleFunc("/restore", chain.Then(s.HandleRestore))
+
+	handler.HandleFunc("/size-bytes", chain.Then(s.HandleSizeBytes))
+
+	handler.HandleFunc("/capabilities", chain.Then(s.HandleCapabilities))
+
+	handler.HandleFunc("/replication/stream", chain.Then(s.HandleReplicationStream))
+
+	handler.HandleFunc("/admin/promote", Recovery(s.apiKeys.Auth(s.HandlePromote)))
+
+	handler.HandleFunc("/admin/purge", Recovery(s.apiKeys.Auth(s.HandlePurge)))
+
+	handler.HandleFunc("/admin/set-ttl", Recovery(s.apiKeys.Auth(s.HandleSetTTL)))
+
+	handler.HandleFunc("/admin/stats", Recovery(s.apiKeys.Auth(s.HandleAdminStats)))
+
+	handler.HandleFunc("/admin/flush", Recovery(s.apiKeys.Auth(s.HandleFlush)))
+
+	handler.HandleFunc("/admin/read-only", Recovery(s.apiKeys.Auth(s.HandleReadOnly)))
+
+	handler.HandleFunc("/admin/reencrypt", Recovery(s.apiKeys.Auth(s.HandleReencrypt)))
+
+	handler.HandleFunc("/admin/verify", Recovery(s.apiKeys.Auth(s.HandleVerify)))
+
+	handler.HandleFunc("/admin/quotas", Recovery(s.apiKeys.Auth(s.HandleQuotas)))
+
+	handler.HandleFunc("/admin/preload", Recovery(s.apiKeys.Auth(s.HandlePreload)))
+
+	handler.HandleFunc("/admin/raft", Recovery(s.apiKeys.Auth(s.HandleRaft)))
+
+	handler.HandleFunc("/admin/raft/", Recovery(s.apiKeys.Auth(s.HandleRaft)))
+
+	handler.HandleFunc("/metrics", Recovery(s.HandleMetrics))
+
+	handler.HandleFunc("/healthz", Recovery(HandleHealthz))
+
+	handler.HandleFunc("/readyz", Recovery(s.HandleReadyz))
+
+	handler.HandleFunc("/openapi.json", Recovery(s.HandleOpenAPI))
+
+	handler.HandleFunc("/docs", Recovery(s.HandleDocs))
+
+	handler.HandleFunc("/", Recovery(s.HandleUI))
+
+	if s.cfg.TraceRequests > 0 {
+		handler.HandleFunc("/debug/requests", Recovery(s.apiKeys.Auth(s.HandleRecentRequests)))
+	}
+
+	if s.cfg.ArchiveExpired {
+		handler.HandleFunc("/archive/", chain.Then(s.HandleArchive))
+	}
+
+	if s.cfg.AllowMetricsReset {
+		handler.HandleFunc("/metrics/reset", Recovery(s.apiKeys.Auth(s.HandleMetricsReset)))
+	}
+
+	// Recovery also wraps the layers in front of the routes, so a panic in
+	// any of them is answered with a 500 too.
+	s.http = &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           Recovery(RequestID(s.RaftForward(s.CORS(s.Tenants(s.Audit(handler.ServeHTTP)))))), // if nil use default http.DefaultServeMux
+		ReadTimeout:       s.cfg.ReadTimeout,                                                                 // max duration reading entire request
+		ReadHeaderTimeout: s.cfg.ReadHeaderTimeout,                                                           // max duration reading the headers
+		WriteTimeout:      s.cfg.WriteTimeout,                                                                // max timing write response
+		IdleTimeout:       s.cfg.IdleTimeout,                                                                 // max time wait for the next request
+		MaxHeaderBytes:    1 << 20,                                                                           // 2^20 or 128kbytes
+	}
+
+	s.http.Protocols, s.http.HTTP2 = s.cfg.serverProtocols(), s.cfg.http2Config()
+	s.http.SetKeepAlivesEnabled(s.cfg.KeepAlives)
+
+	s.http.RegisterOnShutdown(s.store.Watchers().CloseAll)
+	s.http.RegisterOnShutdown(s.channels.CloseAll)
+
+	if s.cfg.tlsEnabled() {
+		s.http.TLSConfig, err = s.cfg.serverTLSConfig(&s.tls)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid TLS settings: %v", err))
+		}
+	}
+
+	return s, nil
+}
+
+// Handler returns the routes, e.g. for httptest.NewServer.
+func (s *Server) Handler() http.Handler {
+	return s.http.Handler
+}
+
+// ServeHTTP serves the routes, so the server is an http.Handler itself.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.http.Handler.ServeHTTP(w, r)
+}
+
+// ListenAndServe listens on the server's address, see listen, starts what
+// the settings enable, see Start, and serves until ctx is done.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	ln, err := listen(s.http.Addr, s.cfg.TCPKeepAlive)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Start(); err != nil {
+		ln.Close()
+		s.Stop()
+		return err
+	}
+	defer s.Stop()
+
+	return s.Serve(ctx, ln)
+}
+
+// Start brings up what the settings enable next to the routes: the span
+// exporter, the audit log, the API keys file, replication and the term
+// watch, the snapshots restored, taken and preloaded, the debug endpoints,
+// the listeners of the other protocols and the webhooks. After an error,
+// Stop ends what was started.
+func (s *Server) Start() error {
+	if s.cfg.tracingEnabled() {
+		go s.spans.run()
+	}
+
+	var err error
+
+	if s.cfg.AuditLog != "" {
+		s.audit, err = newAuditor(s.cfg.AuditLog, s.cfg.AuditRetention)
+		if err != nil {
+			return errors.New(fmt.Sprintf("open -audit-log %s: %v", s.cfg.AuditLog, err))
+		}
+	}
+
+	if s.cfg.APIKeysFile != "" {
+		keys, err := loadAPIKeys(s.cfg.APIKeysFile)
+		if err != nil {
+			return errors.New(fmt.Sprintf("load -api-keys-file: %v", err))
+		}
+		s.apiKeys.Set(keys)
+	}
+
+	if s.cfg.ReplicaOf != "" {
+		s.replicating.Store(true)
+		go s.replicate(s.cfg.ReplicaOf)
+
+		if s.cfg.FailoverAfter > 0 {
+			go s.watchPrimary(s.cfg.ReplicaOf)
+		}
+	}
+
+	if s.cfg.PeersSpec != "" {
+		go s.watchTerm()
+	}
+
+	if s.cfg.RestoreFrom != "" {
+		source, restored, err := s.restoreSnapshot(s.cfg.RestoreFrom)
+		if err != nil {
+			return errors.New(fmt.Sprintf("load -restore-from: %v", err))
+		}
+		log.Printf("restored %d books from %s", restored, source)
+	}
+
+	if s.cfg.SnapshotInterval > 0 {
+		go s.snapshotEvery(s.cfg.SnapshotInterval)
+	}
+
+	if s.cfg.PreloadFile != "" {
+		loaded, err := s.preload(s.cfg.PreloadFile)
+		if err != nil {
+			return errors.New(fmt.Sprintf("load -preload: %v", err))
+		}
+		log.Printf("preloaded %d books from %s", loaded, s.cfg.PreloadFile)
+	}
+
+	if s.cfg.DebugAddr != "" {
+		go serveDebug(s)
+	}
+
+	if s.cfg.MemcachedAddr != "" {
+		s.memcached, err = serveTCP("memcached", s.cfg.MemcachedAddr, s.serveMemcachedConn)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.cfg.RedisAddr != "" {
+		s.redis, err = serveTCP("redis", s.cfg.RedisAddr, s.serveRedisConn)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.cfg.GRPCAddr != "" {
+		s.grpc, err = serveGRPC(s, s.cfg.GRPCAddr)
+		if err != nil {
+			return err
+		}
+	}
+
+	// validate has already parsed them
+	if hooks, _ := parseWebhooks(s.cfg.Webhooks); len(hooks) > 0 {
+		s.webhooks = StartWebhooks(s.store, hooks, &s.ready, s.cfg)
+	}
+
+	return nil
+}
+
+// Stop ends what Start brought up, once Serve has returned. The store
+// stays open for the caller to close.
+func (s *Server) Stop() {
+	s.memcached.Close()
+	s.redis.Close()
+	if s.grpc != nil {
+		s.grpc.Stop()
+	}
+	s.webhooks.Close()
+	s.audit.Close()
+
+	if s.cfg.tracingEnabled() {
+		s.spans.Close()
+	}
+}
+
+// Serve serves on ln until ctx is done and then waits up to
+// -shutdown-timeout for the requests under way. It reports ready while
+// serving. The store stays open for the caller to close.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	served := make(chan error, 1)
+
+	go func() {
+		if s.http.TLSConfig != nil {
+			log.Printf("Listening on https://%s\n", ln.Addr())
+			served <- s.http.ServeTLS(ln, "", "")
+		} else {
+			log.Printf("Listening on http://%s\n", ln.Addr())
+			served <- s.http.Serve(ln)
+		}
+	}()
+
+	s.ready.Store(true)
+
+	select {
+	case err := <-served:
+		s.ready.Store(false)
+		return err
+	case <-ctx.Done():
+	}
+
+	s.ready.Store(false)
+
+	log.Printf("Shutting down, waiting up to %v for requests to finish", s.cfg.ShutdownTimeout)
+
+	shutdown, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
+	defer cancel()
+
+	return s.http.Shutdown(shutdown)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// bucketIdPrefix starts the store ids of books kept in a bucket. The flat
+// API treats such ids as reserved, so a bucket is only reachable through
+// /bucket/<bucket>/.
+const bucketIdPrefix = "\x00"
+
+var bucketNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+func parseBucketTTLs(value string) (map[string]time.Duration, error) {
+	ttls := make(map[string]time.Duration)
+
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		bucket, lifetime, ok := strings.Cut(part, "=")
+		if !ok || (bucket != "*" && !bucketNamePattern.MatchString(bucket)) {
+			return nil, errors.New(fmt.Sprintf("expected <bucket>=<ttl>, got %q", part))
+		}
+
+		ttl, err := time.ParseDuration(lifetime)
+		if err != nil || ttl <= 0 {
+			return nil, errors.New(fmt.Sprintf("invalid ttl in %q", part))
+		}
+
+		ttls[bucket] = ttl
+	}
+
+	return ttls, nil
+}
+
+// bucketTTL returns the default lifetime of the books of bucket and
+// whether it has one.
+func (s *Server) bucketTTL(bucket string) (time.Duration, bool) {
+	if ttl, ok := s.bucketTTLs[bucket]; ok {
+		return ttl, true
+	}
+	ttl, ok := s.bucketTTLs["*"]
+	return ttl, ok
+}
+
+// handleBucketTTL is handleTTL for a book put into bucket, which without
+// ?ttl= expires after the -bucket-ttls lifetime of the bucket.
+func (s *Server) handleBucketTTL(w http.ResponseWriter, r *http.Request, bucket string, book *Book) bool {
+	if !handleTTL(w, r, book) {
+		return false
+	}
+
+	if ttl, ok := s.bucketTTL(bucket); ok && !r.URL.Query().Has("ttl") {
+		expiresAt := time.Now().Add(ttl)
+		book.ExpiresAt = &expiresAt
+	}
+	return true
+}
+
+func bucketStoreId(bucket, id string) string {
+	return bucketIdPrefix + bucket + "/" + id
+}
+
+func inBucket(id string) bool {
+	return strings.HasPrefix(id, bucketIdPrefix)
+}
+
+// withoutBuckets drops the books kept in buckets from a flat listing.
+func withoutBuckets(books []Book) []Book {
+	flat := books[:0]
+
+	for _, book := range books {
+		if !inBucket(book.Id) {
+			flat = append(flat, book)
+		}
+	}
+	return flat
+}
+
+// BucketStats is the body of GET /bucket/<bucket>/stats. Key bytes count
+// the ids as clients see them.
+type BucketStats struct {
+	Bucket     string `json:"bucket"`
+	Books      int    `json:"books"`
+	KeyBytes   int    `json:"key_bytes"`
+	ValueBytes int    `json:"value_bytes"`
+}
+
+// bucketBooks returns the books in bucket with the ids clients see. Once
+// ctx is done it stops early with the books read so far, which nobody is
+// waiting for any more.
+func (s *Server) bucketBooks(ctx context.Context, bucket string) []Book {
+	prefix := bucketStoreId(bucket, "")
+	books := make([]Book, 0)
+
+	for after := ""; ; {
+		page, more, err := s.store.BooksAfter(ctx, prefix, after, 1000)
+		if err != nil {
+			return books
+		}
+
+		for _, book := range page {
+			book.Id = strings.TrimPrefix(book.Id, prefix)
+			books = append(books, book)
+		}
+
+		if !more {
+			return books
+		}
+		after = prefix + books[len(books)-1].Id
+	}
+}
+
+// HandleBucket serves one bucket:
+//
+//	GET, PUT, DELETE /bucket/<bucket>/book/<id>, PUT taking ?ttl=
+//	GET              /bucket/<bucket>/books/
+//	GET              /bucket/<bucket>/stats
+//	GET              /bucket/<bucket>/export
+//	DELETE           /bucket/<bucket>
+func (s *Server) HandleBucket(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	bucket, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/bucket/"), "/")
+
+	if !bucketNamePattern.MatchString(bucket) {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("invalid bucket name %s", bucket))
+		return
+	}
+
+	w, ok := s.handleFenceToken(w, r)
+	if !ok {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.MaxBodyBytes)
+
+	if id, ok := strings.CutPrefix(rest, "book/"); ok && id != "" {
+		s.HandleBucketBook(w, r, bucket, s.cfg.normalizeId(id))
+
+	} else if rest == "books/" && r.Method == http.MethodGet {
+		w.WriteHeader(http.StatusOK)
+		books, _ := json.Marshal(s.bucketBooks(r.Context(), bucket))
+
+		w.Write(books)
+
+	} else if rest == "stats" && r.Method == http.MethodGet {
+		w.WriteHeader(http.StatusOK)
+		body, _ := json.Marshal(s.bucketStats(r.Context(), bucket))
+
+		w.Write(body)
+
+	} else if rest == "export" && r.Method == http.MethodGet {
+		if format, ok := exportFormat(w, r, "csv", "sql", "tar"); ok {
+			s.writeExport(w, r, format, bucket, s.bucketBooks(r.Context(), bucket), nil)
+		}
+
+	} else if rest == "" && r.Method == http.MethodDelete {
+		if !s.handleBackup(w) {
+			return
+		}
+
+		ids := make([]string, 0)
+		for _, book := range s.bucketBooks(context.Background(), bucket) {
+			ids = append(ids, bucketStoreId(bucket, book.Id))
+		}
+
+		drained, err := s.store.DrainBooks(ids, s.prepareDrain(r))
+		if !handleWriteError(w, err) {
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		body, _ := json.Marshal(map[string]int{"deleted": len(drained)})
+
+		w.Write(body)
+
+	} else {
+		HandleMethodIsNotAllowed(w, r)
+
+	}
+}
+
+func (s *Server) writeBucketBook(w http.ResponseWriter, bucket, id string) {
+	book := s.store.FindBookById(bucketStoreId(bucket, id))
+	if book == nil {
+		writeError(w, http.StatusNotFound, CodeBookNotFound, fmt.Sprintf("Book with id %s not found in bucket %s", id, bucket))
+		return
+	}
+
+	book.Id = id
+
+	w.Header().Set("ETag", book.ETag(s.cfg.ETagAlgo))
+	w.WriteHeader(http.StatusOK)
+	body, _ := json.Marshal(book)
+
+	w.Write(body)
+}
+
+func (s *Server) HandleBucketBook(w http.ResponseWriter, r *http.Request, bucket, id string) {
+	storeId := bucketStoreId(bucket, id)
+
+	switch r.Method {
+	case http.MethodGet:
+		s.writeBucketBook(w, bucket, id)
+
+	case http.MethodPut:
+		var book Book
+
+		err := s.decodeBook(r, &book)
+		if err != nil {
+			writeError(w, badBodyStatus(err), "", err.Error())
+			return
+		}
+
+		book.Id, book.Version = storeId, 0
+
+		if !s.handleBucketTTL(w, r, bucket, &book) {
+			return
+		}
+
+		if book.Author == "" && book.Name == "" && s.cfg.EmptyValuePolicy == "reject" {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("book %s has no author and name", id))
+			return
+		}
+
+		op := BatchOp{Op: "put", Book: book}
+		if book.Author == "" && book.Name == "" && s.cfg.EmptyValuePolicy == "delete" {
+			op.Op = "delete"
+		}
+
+		if op.Op == "put" && (!s.handlePutHooks(w, r, &op.Book) || !s.handleLimits(w, op.Book)) {
+			return
+		}
+		if op.Op == "delete" && !s.handleDeleteHooks(w, r, storeId) {
+			return
+		}
+
+		if op.Op == "put" {
+			_, _, err = s.store.Txn(nil, []BatchOp{op}, nil, nil)
+			if !handleWriteError(w, err) {
+				return
+			}
+
+			s.writeBucketBook(w, bucket, id)
+			return
+		}
+
+		results, _ := s.store.ApplyBatch([]BatchOp{op})
+		if results[0].Error != "" {
+			writeError(w, http.StatusNotFound, CodeBookNotFound, results[0].Error)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		books, _ := json.Marshal(s.bucketBooks(r.Context(), bucket))
+
+		w.Write(books)
+
+	case http.MethodDelete:
+		drained, err := s.store.DrainBooks([]string{storeId}, s.prepareDrain(r))
+		if !handleWriteError(w, err) {
+			return
+		}
+		if len(drained) == 0 {
+			writeError(w, http.StatusNotFound, CodeBookNotFound, fmt.Sprintf("Book with id %s not found in bucket %s", id, bucket))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		books, _ := json.Marshal(s.bucketBooks(r.Context(), bucket))
+
+		w.Write(books)
+
+	default:
+		HandleMethodIsNotAllowed(w, r)
+	}
+}
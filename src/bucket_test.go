@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBucketTTLs(t *testing.T) {
+	tests := []struct {
+		name    string
+		ttls    string
+		path    string
+		expires time.Duration // from now, 0 for never
+		status  int
+	}{
+		{name: "a bucket with a default", ttls: "sessions=1h", path: "/bucket/sessions/book/a", expires: time.Hour, status: http.StatusOK},
+		{name: "an explicit ttl", ttls: "sessions=1h", path: "/bucket/sessions/book/a?ttl=10m", expires: 10 * time.Minute, status: http.StatusOK},
+		{name: "a bucket without a default", ttls: "sessions=1h", path: "/bucket/carts/book/a", status: http.StatusOK},
+		{name: "the default of every other bucket", ttls: "sessions=1h,*=2h", path: "/bucket/carts/book/a", expires: 2 * time.Hour, status: http.StatusOK},
+		{name: "a bucket default over that of every other", ttls: "sessions=1h,*=2h", path: "/bucket/sessions/book/a", expires: time.Hour, status: http.StatusOK},
+		{name: "an explicit ttl without defaults", path: "/bucket/carts/book/a?ttl=10m", expires: 10 * time.Minute, status: http.StatusOK},
+		{name: "a bad explicit ttl", ttls: "sessions=1h", path: "/bucket/sessions/book/a?ttl=soon", status: http.StatusBadRequest},
+		{name: "a flat book", ttls: "*=1h", path: "/book/a", status: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.BucketTTLs = tt.ttls
+			s, ts := newTestServer(t, WithConfig(cfg))
+			s.store.AddBook(Book{Id: "a", Name: "0"})
+
+			status, body := send(t, http.MethodPut, ts.URL+tt.path, `{"name":"x"}`)
+			if status != tt.status {
+				t.Fatalf("status %d %s, want %d", status, body, tt.status)
+			}
+			if status != http.StatusOK {
+				return
+			}
+
+			var book Book
+			if err := json.Unmarshal([]byte(body), &book); err != nil {
+				t.Fatal(err)
+			}
+
+			switch {
+			case tt.expires == 0 && book.ExpiresAt != nil:
+				t.Errorf("expires at %v, want never", book.ExpiresAt)
+			case tt.expires != 0 && book.ExpiresAt == nil:
+				t.Errorf("never expires, want in %v", tt.expires)
+			case tt.expires != 0:
+				if left := time.Until(*book.ExpiresAt); left > tt.expires || left < tt.expires-time.Minute {
+					t.Errorf("expires in %v, want %v", left, tt.expires)
+				}
+			}
+		})
+	}
+}
+
+func TestParseBucketTTLs(t *testing.T) {
+	tests := []struct {
+		value string
+		fails bool
+	}{
+		{value: ""},
+		{value: "a=1h, b.c=30s ,*=5m"},
+		{value: "a", fails: true},
+		{value: "a=forever", fails: true},
+		{value: "a=0s", fails: true},
+		{value: "a/b=1h", fails: true},
+	}
+
+	for _, tt := range tests {
+		if _, err := parseBucketTTLs(tt.value); (err != nil) != tt.fails {
+			t.Errorf("parseBucketTTLs(%q) error %v", tt.value, err)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// charsetEncoders convert UTF-8 text into the named charset. Only charsets
+// that map runes one to one onto bytes are supported.
+var charsetEncoders = map[string]func(string) ([]byte, error){
+	"utf-8":      func(s string) ([]byte, error) { return []byte(s), nil },
+	"iso-8859-1": encodeSingleByte(0xff),
+	"latin1":     encodeSingleByte(0xff),
+	"us-ascii":   encodeSingleByte(0x7f),
+}
+
+func encodeSingleByte(max rune) func(string) ([]byte, error) {
+	return func(s string) ([]byte, error) {
+		encoded := make([]byte, 0, len(s))
+
+		for _, r := range s {
+			if r > max {
+				return nil, errors.New(fmt.Sprintf("character %q cannot be represented", r))
+			}
+			encoded = append(encoded, byte(r))
+		}
+
+		return encoded, nil
+	}
+}
+
+// transcode returns s encoded in charset and the canonical charset name
+// to report in Content-Type.
+func transcode(s string, charset string) ([]byte, string, error) {
+	charset = strings.ToLower(charset)
+
+	encode, ok := charsetEncoders[charset]
+	if !ok {
+		return nil, "", errors.New(fmt.Sprintf("unsupported charset %s", charset))
+	}
+
+	if charset == "latin1" {
+		charset = "iso-8859-1"
+	}
+
+	encoded, err := encode(s)
+
+	return encoded, charset, err
+}
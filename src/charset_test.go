@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTranscode(t *testing.T) {
+	tests := []struct {
+		charset  string
+		in       string
+		want     string
+		wantName string
+		err      bool
+	}{
+		{charset: "utf-8", in: "café", want: "café", wantName: "utf-8"},
+		{charset: "ISO-8859-1", in: "café", want: "caf\xe9", wantName: "iso-8859-1"},
+		{charset: "latin1", in: "ÿ", want: "\xff", wantName: "iso-8859-1"},
+		{charset: "us-ascii", in: "cafe", want: "cafe", wantName: "us-ascii"},
+		{charset: "us-ascii", in: "café", err: true},
+		{charset: "iso-8859-1", in: "€", err: true},
+		{charset: "ebcdic", in: "cafe", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.charset+" "+tt.in, func(t *testing.T) {
+			got, name, err := transcode(tt.in, tt.charset)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("transcode(%q, %s) = %q, want an error", tt.in, tt.charset, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want || name != tt.wantName {
+				t.Errorf("transcode(%q, %s) = %q, %s, want %q, %s", tt.in, tt.charset, got, name, tt.want, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestCharsetParameter(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		status      int
+		contentType string
+		contains    string
+	}{
+		{name: "no charset", query: "", status: 200, contentType: "application/json", contains: "café"},
+		{name: "a supported charset", query: "?charset=iso-8859-1", status: 200, contentType: "application/json; charset=iso-8859-1", contains: "caf\xe9"},
+		{name: "an alias", query: "?charset=latin1", status: 200, contentType: "application/json; charset=iso-8859-1", contains: "caf\xe9"},
+		{name: "a charset without the characters", query: "?charset=us-ascii", status: 400, contains: "cannot be represented"},
+		{name: "an unsupported charset", query: "?charset=ebcdic", status: 400, contains: "unsupported charset"},
+	}
+
+	s, ts := newTestServer(t)
+	s.store.AddBook(Book{Id: "a", Name: "café"})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, ts.URL+"/book/a"+tt.query, nil)
+			req.SetBasicAuth("test", "test")
+			req.Header.Set("Accept", "application/json")
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d: %s", resp.StatusCode, tt.status, body)
+			}
+			if tt.contentType != "" && resp.Header.Get("Content-Type") != tt.contentType {
+				t.Errorf("Content-Type %s, want %s", resp.Header.Get("Content-Type"), tt.contentType)
+			}
+			if !strings.Contains(string(body), tt.contains) {
+				t.Errorf("body %q, want it to contain %q", body, tt.contains)
+			}
+		})
+	}
+}
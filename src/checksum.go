@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"net/http"
+	"os"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// checksum is the CRC-32C of everything the book holds. Each field goes in
+// with its length, so moving bytes from one field to the next changes it.
+func (b Book) checksum() uint32 {
+	crc := uint32(0)
+
+	field := func(data []byte) {
+		crc = crc32.Update(crc, castagnoli, binary.AppendUvarint(nil, uint64(len(data))))
+		crc = crc32.Update(crc, castagnoli, data)
+	}
+
+	field([]byte(b.Id))
+	field([]byte(b.Author))
+	field([]byte(b.Name))
+	field(binary.AppendUvarint(nil, b.Version))
+	field(binary.AppendVarint(nil, b.CreatedAt.UnixNano()))
+	field(binary.AppendVarint(nil, b.UpdatedAt.UnixNano()))
+	if b.ExpiresAt != nil {
+		field(binary.AppendVarint(nil, b.ExpiresAt.UnixNano()))
+	} else {
+		field(nil)
+	}
+	field(b.Content)
+	field([]byte(b.ContentType))
+	for _, items := range [][]string{b.List, b.Set} {
+		field(binary.AppendUvarint(nil, uint64(len(items))))
+		for _, item := range items {
+			field([]byte(item))
+		}
+	}
+
+	return crc
+}
+
+// storedBook is a book as the data file and snapshots keep it, with its
+// checksum next to the other fields. Files written before checksums have
+// none and are taken as they are.
+type storedBook struct {
+	Book
+	CRC uint32 `json:"crc,omitempty"`
+}
+
+func storedBooks(books []Book) []storedBook {
+	stored := make([]storedBook, 0, len(books))
+	for _, book := range books {
+		stored = append(stored, storedBook{Book: book, CRC: book.checksum()})
+	}
+	return stored
+}
+
+// CorruptEntry is a book, or a line of the log, failing verification.
+type CorruptEntry struct {
+	Source string `json:"source"` // memory, or the file it was read from
+	Id     string `json:"id,omitempty"`
+	Line   int    `json:"line,omitempty"`
+	Error  string `json:"error"`
+}
+
+// loadStoredBooks decodes a data file or snapshot. Books whose checksum
+// does not match are left out and returned as corrupt.
+func loadStoredBooks(source string, data []byte) ([]Book, []CorruptEntry, error) {
+	var stored []storedBook
+
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, nil, err
+	}
+
+	books := make([]Book, 0, len(stored))
+	corrupt := make([]CorruptEntry, 0)
+
+	for _, sb := range stored {
+		if sb.CRC != 0 && sb.CRC != sb.Book.checksum() {
+			corrupt = append(corrupt, CorruptEntry{Source: source, Id: sb.Id, Error: "checksum mismatch"})
+			continue
+		}
+		books = append(books, sb.Book)
+	}
+
+	return books, corrupt, nil
+}
+
+// readStoredBooks is loadStoredBooks for a file sealed with keys, failing
+// on the first corrupt book, so a damaged file is never loaded in part.
+func readStoredBooks(keys *Keyring, path string) ([]Book, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeStoredBooks(keys, path, data)
+}
+
+// decodeStoredBooks is readStoredBooks for a file already read, say from
+// object storage.
+func decodeStoredBooks(keys *Keyring, source string, data []byte) ([]Book, error) {
+	data, err := keys.openFile(data)
+	if err != nil {
+		return nil, err
+	}
+
+	books, corrupt, err := loadStoredBooks(source, data)
+	if err == nil && len(corrupt) > 0 {
+		err = errors.New(fmt.Sprintf("book %s: %s", corrupt[0].Id, corrupt[0].Error))
+	}
+	return books, err
+}
+
+// VerifyReads checks the checksum of every book read from now on,
+// counting and logging the corrupt ones, see -verify-reads.
+func (s *MemoryStore) VerifyReads() {
+	unlock := s.lock(nil, true)
+	defer unlock()
+
+	for _, sh := range s.shards {
+		sh.verifyReads = true
+	}
+}
+
+// verifyRead checks an entry about to be read, when VerifyReads is on.
+func (sh *shard) verifyRead(e *entry) {
+	if sh.verifyReads && e.crc != e.book.checksum() {
+		sh.corruptReads.Add(1)
+		log.Printf("corrupt book %s: checksum mismatch", e.book.Id)
+	}
+}
+
+// Verify checks every book held in memory against the checksum taken when
+// it was stored.
+func (s *MemoryStore) Verify() []CorruptEntry {
+	corrupt := make([]CorruptEntry, 0)
+
+	views, _, release := s.views()
+	defer release()
+
+	for _, books := range views {
+		for _, e := range books {
+			if e.crc != e.book.checksum() {
+				corrupt = append(corrupt, CorruptEntry{Source: "memory", Id: e.book.Id, Error: "checksum mismatch"})
+			}
+		}
+	}
+
+	return corrupt
+}
+
+// verifier is a store keeping its books in memory, as every store does.
+type verifier interface {
+	Verify() []CorruptEntry
+}
+
+// fileVerifier is a store that can check what it has persisted.
+type fileVerifier interface {
+	VerifyFiles() ([]CorruptEntry, error)
+}
+
+// VerifyReport is the body of POST /admin/verify.
+type VerifyReport struct {
+	Books        int            `json:"books"`
+	Corrupt      []CorruptEntry `json:"corrupt"`
+	CorruptReads uint64         `json:"corrupt_reads"`
+}
+
+// HandleVerify scans the books in memory and the store's files and reports
+// the entries whose checksums do not match. It answers 200 either way;
+// the report says whether anything is corrupt.
+func (s *Server) HandleVerify(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	books, err := s.store.GetBooks(r.Context())
+	if !handleCanceled(w, err) {
+		return
+	}
+
+	report := VerifyReport{Books: len(books), Corrupt: make([]CorruptEntry, 0)}
+
+	if counters, ok := s.store.(storeCounters); ok {
+		_, report.CorruptReads = counters.Counters()
+	}
+
+	if memory, ok := s.store.(verifier); ok {
+		report.Corrupt = append(report.Corrupt, memory.Verify()...)
+	}
+
+	if store, ok := s.store.(fileVerifier); ok {
+		corrupt, err := store.VerifyFiles()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("Verify failed. %v", err))
+			return
+		}
+		report.Corrupt = append(report.Corrupt, corrupt...)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	body, _ := json.Marshal(report)
+
+	w.Write(body)
+}
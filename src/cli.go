@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const commandUsage = `usage:
+  %[1]s [flags] get ID
+  %[1]s [flags] put ID AUTHOR NAME
+  %[1]s [flags] del ID
+  %[1]s [flags] list [-prefix=P]
+  %[1]s [flags] bench [-c=16] [-d=10s] [-keys=1000] [-value-size=64] [-reads=0.9] [-prefix=bench/]
+`
+
+// runCommand runs one client command against a running server and returns
+// the process exit code.
+func (c Config) runCommand(args []string) int {
+	var err error
+
+	switch {
+	case args[0] == "get" && len(args) == 2:
+		err = c.commandRequest(http.MethodGet, "/book/"+url.PathEscape(args[1]), nil)
+
+	case args[0] == "put" && len(args) == 4:
+		ops := []BatchOp{{Op: "put", Book: Book{Id: args[1], Author: args[2], Name: args[3]}}}
+		body, _ := json.Marshal(ops)
+
+		err = c.commandRequest(http.MethodPost, "/batch", body)
+
+	case args[0] == "del" && len(args) == 2:
+		err = c.commandRequest(http.MethodDelete, "/book/"+url.PathEscape(args[1]), nil)
+
+	case args[0] == "list":
+		flags := flag.NewFlagSet("list", flag.ContinueOnError)
+		prefix := flags.String("prefix", "", "only list books whose id starts with this")
+
+		if flags.Parse(args[1:]) != nil || flags.NArg() > 0 {
+			fmt.Fprintf(os.Stderr, commandUsage, filepath.Base(os.Args[0]))
+			return 2
+		}
+
+		err = c.commandList(*prefix)
+
+	case args[0] == "bench":
+		err = c.commandBench(args[1:])
+
+	default:
+		fmt.Fprintf(os.Stderr, commandUsage, filepath.Base(os.Args[0]))
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
+
+// commandRequest sends one request and prints the JSON answer.
+func (c Config) commandRequest(method, path string, body []byte) error {
+	data, err := c.commandDo(method, path, body)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(data))
+	return nil
+}
+
+func (c Config) commandDo(method, path string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.CommandServer, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	if user, password, ok := strings.Cut(c.CommandUser, ":"); ok {
+		req.SetBasicAuth(user, password)
+	} else if c.CommandToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.CommandToken)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var apiErr APIError
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Code != "" {
+			return nil, errors.New(fmt.Sprintf("%s: %s (%s)", resp.Status, apiErr.Message, apiErr.Code))
+		}
+		return nil, errors.New(fmt.Sprintf("%s: %s", resp.Status, strings.TrimSpace(string(data))))
+	}
+
+	return data, nil
+}
+
+// commandList follows the pages of /books/ and prints one book per line.
+func (c Config) commandList(prefix string) error {
+	cursor := ""
+
+	for {
+		query := url.Values{"prefix": {prefix}}
+		if cursor != "" {
+			query.Set("cursor", cursor)
+		}
+
+		data, err := c.commandDo(http.MethodGet, "/books/?"+query.Encode(), nil)
+		if err != nil {
+			return err
+		}
+
+		var page BooksPage
+
+		err = json.Unmarshal(data, &page)
+		if err != nil {
+			return err
+		}
+
+		for _, book := range page.Books {
+			line, _ := json.Marshal(book)
+			fmt.Println(string(line))
+		}
+
+		if page.NextCursor == "" {
+			return nil
+		}
+		cursor = page.NextCursor
+	}
+}
@@ -0,0 +1,301 @@
+// Package client is a typed Go client for the book store HTTP API.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type Book struct {
+	Id        string     `json:"id"`
+	Author    string     `json:"author"`
+	Name      string     `json:"name"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Version   uint64     `json:"version"`
+	CreatedAt time.Time  `json:"created_at,omitzero"`
+	UpdatedAt time.Time  `json:"updated_at,omitzero"`
+
+	Content     []byte `json:"content,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+
+	List []string `json:"list,omitempty"`
+	Set  []string `json:"set,omitempty"`
+}
+
+// ChangeEvent is one change streamed by Watch. Old is nil for inserts and
+// New is nil for deletes and expiries.
+type ChangeEvent struct {
+	Op  string `json:"op"` // put, delete, expire or evict
+	Id  string `json:"id"`
+	Old *Book  `json:"old,omitempty"`
+	New *Book  `json:"new,omitempty"`
+}
+
+type Client struct {
+	BaseURL string
+
+	// Username and Password are sent as basic auth when Username is set,
+	// otherwise APIKey is sent as a bearer token when set.
+	Username string
+	Password string
+	APIKey   string
+
+	HTTPClient *http.Client
+
+	// Retries is how often a request failing with a network error or a
+	// 502, 503 or 504 is retried, waiting RetryWait, then twice as long,
+	// between attempts. Every attempt of a write carries the same
+	// Idempotency-Key, so a write the server applied before the failure is
+	// not applied twice.
+	Retries   int
+	RetryWait time.Duration
+}
+
+func NewClient(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: http.DefaultClient,
+		Retries:    2,
+		RetryWait:  100 * time.Millisecond,
+	}
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+
+	if c.Username != "" {
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Password)))
+	} else if c.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+
+	return req, nil
+}
+
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// do sends the request, retrying as configured, and decodes a 2xx JSON
+// answer into out when out is not nil.
+func (c *Client) do(ctx context.Context, method, path string, body []byte, out any) error {
+	wait := c.RetryWait
+
+	var idempotencyKey string
+	if method != http.MethodGet && method != http.MethodHead {
+		key := make([]byte, 16)
+		rand.Read(key)
+		idempotencyKey = hex.EncodeToString(key)
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := c.newRequest(ctx, method, path, body)
+		if err != nil {
+			return err
+		}
+
+		if idempotencyKey != "" {
+			req.Header.Set("Idempotency-Key", idempotencyKey)
+		}
+
+		resp, err := c.HTTPClient.Do(req)
+
+		if attempt < c.Retries && retryable(resp, err) && ctx.Err() == nil {
+			if resp != nil {
+				resp.Body.Close()
+			}
+
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+
+			wait *= 2
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return decodeResponse(resp, out)
+	}
+}
+
+func decodeResponse(resp *http.Response, out any) error {
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := &Error{Status: resp.StatusCode, RequestID: resp.Header.Get("X-Request-ID")}
+
+		if json.Unmarshal(data, apiErr) != nil || apiErr.Code == "" {
+			apiErr.Message = strings.TrimSpace(string(data))
+		}
+		return apiErr
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.Unmarshal(data, out)
+}
+
+func bookPath(id string) string {
+	return "/book/" + url.PathEscape(id)
+}
+
+func (c *Client) Get(ctx context.Context, id string) (*Book, error) {
+	var book Book
+
+	err := c.do(ctx, http.MethodGet, bookPath(id), nil, &book)
+	if err != nil {
+		return nil, err
+	}
+
+	return &book, nil
+}
+
+// Put inserts the book or replaces the stored one and returns the version
+// the server assigned.
+func (c *Client) Put(ctx context.Context, book Book) (uint64, error) {
+	type op struct {
+		Op   string `json:"op"`
+		Book Book   `json:"book"`
+	}
+
+	var results []struct {
+		Version uint64 `json:"version"`
+		Error   string `json:"error"`
+	}
+
+	body, _ := json.Marshal([]op{{Op: "put", Book: book}})
+
+	err := c.do(ctx, http.MethodPost, "/batch", body, &results)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(results) != 1 {
+		return 0, errors.New(fmt.Sprintf("expected one batch result, got %d", len(results)))
+	}
+
+	return results[0].Version, nil
+}
+
+func (c *Client) Delete(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, bookPath(id), nil, nil)
+}
+
+// List returns every book whose id starts with prefix, in id order,
+// following the server's pages.
+func (c *Client) List(ctx context.Context, prefix string) ([]Book, error) {
+	books := make([]Book, 0)
+	cursor := ""
+
+	for {
+		query := url.Values{"prefix": {prefix}, "limit": {"100"}}
+		if cursor != "" {
+			query.Set("cursor", cursor)
+		}
+
+		var page struct {
+			Books      []Book `json:"books"`
+			NextCursor string `json:"next_cursor"`
+		}
+
+		err := c.do(ctx, http.MethodGet, "/books/?"+query.Encode(), nil, &page)
+		if err != nil {
+			return nil, err
+		}
+
+		books = append(books, page.Books...)
+
+		if page.NextCursor == "" {
+			return books, nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+// Watch streams changes to books whose ids start with prefix until ctx is
+// done or the server ends the stream, at which point the channel closes.
+func (c *Client) Watch(ctx context.Context, prefix string) (<-chan ChangeEvent, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/watch?"+url.Values{"prefix": {prefix}}.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeResponse(resp, nil)
+	}
+
+	events := make(chan ChangeEvent)
+
+	go func() {
+		defer close(events)
+		defer resp.Body.Close()
+
+		scanner := bufio.NewScanner(resp.Body)
+
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+
+			var event ChangeEvent
+			if json.Unmarshal([]byte(data), &event) != nil {
+				continue
+			}
+
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events, nil
+}
@@ -0,0 +1,68 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Error codes the server puts in its error answers, Error.Code here.
+const (
+	CodeBadRequest          = "bad_request"          // 400, malformed input
+	CodeScriptError         = "script_error"         // 400, a script does not parse or failed while running
+	CodeInvalidId           = "invalid_id"           // 400, the id breaks the server's id policy
+	CodeUnauthorized        = "unauthorized"         // 401, missing or wrong credentials
+	CodeForbidden           = "forbidden"            // 403, credentials or origin not allowed
+	CodeReadOnly            = "read_only"            // 403, the server takes no writes
+	CodeReservedId          = "reserved_id"          // 403, the id is reserved on the server
+	CodeNotFound            = "not_found"            // 404, anything but a book
+	CodeBookNotFound        = "book_not_found"       // 404
+	CodeVersionNotFound     = "version_not_found"    // 404, not in the book's history
+	CodeMethodNotAllowed    = "method_not_allowed"   // 405
+	CodeConflict            = "conflict"             // 409, e.g. a version that no longer matches
+	CodeBookExists          = "book_exists"          // 409, POST or ?if=absent of an id already stored
+	CodeWrongType           = "wrong_type"           // 409, book holds another kind of value
+	CodeStaleFenceToken     = "stale_fence_token"    // 409
+	CodeNotReplica          = "not_replica"          // 409
+	CodePrimaryClaimed      = "primary_claimed"      // 409, promotion while another member is primary
+	CodeIdempotencyConflict = "idempotency_conflict" // 409, Idempotency-Key reused for another request or still in flight
+	CodeLockHeld            = "lock_held"            // 409, someone else holds the lock
+	CodeBookDeleted         = "book_deleted"         // 410, deleted a moment ago
+	CodePreconditionFailed  = "precondition_failed"  // 412, If-Match or ?if= not met
+	CodeTooLarge            = "too_large"            // 413, past a size limit
+	CodeRateLimited         = "rate_limited"         // 429
+	CodeQuotaExceeded       = "quota_exceeded"       // 507, past the quota of a bucket
+	CodeCanceled            = "canceled"             // 499, the request was abandoned
+	CodeInternal            = "internal"             // 500
+	CodeUnavailable         = "unavailable"          // 503, warming up, timed out or backend down
+	CodeNoLeader            = "no_leader"            // 503, the cluster has no leader to take the write
+)
+
+// Error is a non 2xx answer from the server. Code is one of the codes
+// above, empty when the server sent no error body. RequestID is the
+// X-Request-ID the server logged the request under.
+type Error struct {
+	Status    int    `json:"-"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+}
+
+func (e *Error) Error() string {
+	if e.RequestID != "" {
+		return fmt.Sprintf("%d %s: %s (request %s)", e.Status, http.StatusText(e.Status), e.Message, e.RequestID)
+	}
+	return fmt.Sprintf("%d %s: %s", e.Status, http.StatusText(e.Status), e.Message)
+}
+
+// IsNotFound reports whether err is a 404 from the server.
+func IsNotFound(err error) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound
+}
+
+// HasCode reports whether err is an answer from the server with code.
+func HasCode(err error, code string) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.Code == code
+}
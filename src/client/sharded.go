@@ -0,0 +1,208 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// virtualNodes is how many points each server gets on the hash ring,
+// which evens out the share of ids each one owns.
+const virtualNodes = 64
+
+var errNoServers = errors.New("no servers configured")
+
+type ringPoint struct {
+	hash   uint32
+	client int
+}
+
+// ShardedClient spreads books over several servers by consistent hashing
+// of their ids, so adding a server only moves the ids it takes over. Each
+// book is written to Replicas servers, the next distinct ones clockwise on
+// the ring, and reads fall back along the same servers.
+type ShardedClient struct {
+	// Clients are the servers, one per address, and may be configured
+	// individually, e.g. with credentials, before use.
+	Clients []*Client
+
+	// Replicas is how many servers hold each book, at most len(Clients).
+	Replicas int
+
+	ring []ringPoint
+}
+
+func NewShardedClient(baseURLs ...string) *ShardedClient {
+	sc := &ShardedClient{Replicas: 1}
+
+	for i, baseURL := range baseURLs {
+		sc.Clients = append(sc.Clients, NewClient(baseURL))
+
+		for v := 0; v < virtualNodes; v++ {
+			sc.ring = append(sc.ring, ringPoint{hash: hashKey(baseURL + "#" + strconv.Itoa(v)), client: i})
+		}
+	}
+
+	sort.Slice(sc.ring, func(i, j int) bool { return sc.ring[i].hash < sc.ring[j].hash })
+
+	return sc
+}
+
+// hashKey places key on the ring. FNV leaves similar short ids bunched
+// together, so the ring uses the leading bytes of SHA-256 instead.
+func hashKey(key string) uint32 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// Owners returns the clients holding id, the primary owner first.
+func (sc *ShardedClient) Owners(id string) []*Client {
+	n := min(max(sc.Replicas, 1), len(sc.Clients))
+	owners := make([]*Client, 0, n)
+	seen := make(map[int]bool)
+
+	hash := hashKey(id)
+	start := sort.Search(len(sc.ring), func(i int) bool { return sc.ring[i].hash >= hash })
+
+	for i := 0; len(owners) < n; i++ {
+		point := sc.ring[(start+i)%len(sc.ring)]
+
+		if !seen[point.client] {
+			seen[point.client] = true
+			owners = append(owners, sc.Clients[point.client])
+		}
+	}
+
+	return owners
+}
+
+// fallBack reports whether a read should move on to the next owner: the
+// server was unreachable, failed, or does not have the book, which it may
+// have missed while down.
+func fallBack(err error) bool {
+	var apiErr *Error
+	return !errors.As(err, &apiErr) || apiErr.Status >= 500 || apiErr.Status == http.StatusNotFound
+}
+
+// Get reads the book from the first owner that has it.
+func (sc *ShardedClient) Get(ctx context.Context, id string) (*Book, error) {
+	err := errNoServers
+
+	for _, c := range sc.Owners(id) {
+		var book *Book
+
+		book, err = c.Get(ctx, id)
+		if err == nil || !fallBack(err) {
+			return book, err
+		}
+	}
+
+	return nil, err
+}
+
+// Put writes the book to every owner and returns the version assigned by
+// the primary owner. Versions are per server, so they may differ between
+// replicas. Any failed write is returned as an error.
+func (sc *ShardedClient) Put(ctx context.Context, book Book) (uint64, error) {
+	owners := sc.Owners(book.Id)
+	if len(owners) == 0 {
+		return 0, errNoServers
+	}
+
+	versions := make([]uint64, len(owners))
+
+	err := sc.each(owners, func(i int, c *Client) error {
+		var err error
+
+		versions[i], err = c.Put(ctx, book)
+		return err
+	})
+
+	return versions[0], err
+}
+
+// Delete deletes the book from every owner. It reports not found only when
+// no owner had the book.
+func (sc *ShardedClient) Delete(ctx context.Context, id string) error {
+	owners := sc.Owners(id)
+	if len(owners) == 0 {
+		return errNoServers
+	}
+
+	missing := make([]bool, len(owners))
+
+	err := sc.each(owners, func(i int, c *Client) error {
+		err := c.Delete(ctx, id)
+		if IsNotFound(err) {
+			missing[i] = true
+			return nil
+		}
+		return err
+	})
+
+	if err == nil && !slices.Contains(missing, false) {
+		return &Error{Status: http.StatusNotFound, Message: "Book with id " + id + " not found"}
+	}
+
+	return err
+}
+
+// List merges the books with ids starting with prefix from every server,
+// in id order. A book held by several replicas is listed once.
+func (sc *ShardedClient) List(ctx context.Context, prefix string) ([]Book, error) {
+	lists := make([][]Book, len(sc.Clients))
+
+	err := sc.each(sc.Clients, func(i int, c *Client) error {
+		var err error
+
+		lists[i], err = c.List(ctx, prefix)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	byId := make(map[string]Book)
+	for _, list := range lists {
+		for _, book := range list {
+			if _, ok := byId[book.Id]; !ok {
+				byId[book.Id] = book
+			}
+		}
+	}
+
+	books := make([]Book, 0, len(byId))
+	for _, book := range byId {
+		books = append(books, book)
+	}
+	sort.Slice(books, func(i, j int) bool { return books[i].Id < books[j].Id })
+
+	return books, nil
+}
+
+// each calls f for every client concurrently and joins their errors.
+func (sc *ShardedClient) each(clients []*Client, f func(i int, c *Client) error) error {
+	errs := make([]error, len(clients))
+
+	var wg sync.WaitGroup
+
+	for i, c := range clients {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			errs[i] = f(i, c)
+		}()
+	}
+
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,340 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeServer keeps books in memory and answers the requests the client
+// sends, or fails them with status when status is set.
+type fakeServer struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	books  map[string]Book
+	status int
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	fs := &fakeServer{books: make(map[string]Book)}
+	fs.Server = httptest.NewServer(http.HandlerFunc(fs.serve))
+	t.Cleanup(fs.Close)
+	return fs
+}
+
+func (fs *fakeServer) serve(w http.ResponseWriter, r *http.Request) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.status != 0 {
+		http.Error(w, "failing", fs.status)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/book/")
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/books/":
+		page := struct {
+			Books []Book `json:"books"`
+		}{Books: make([]Book, 0)}
+		for _, book := range fs.books {
+			if strings.HasPrefix(book.Id, r.URL.Query().Get("prefix")) {
+				page.Books = append(page.Books, book)
+			}
+		}
+		json.NewEncoder(w).Encode(page)
+
+	case r.Method == http.MethodPost && r.URL.Path == "/batch":
+		var ops []struct {
+			Book Book `json:"book"`
+		}
+		json.NewDecoder(r.Body).Decode(&ops)
+		ops[0].Book.Version = uint64(len(fs.books) + 1)
+		fs.books[ops[0].Book.Id] = ops[0].Book
+		fmt.Fprintf(w, `[{"version":%d}]`, ops[0].Book.Version)
+
+	case r.Method == http.MethodGet:
+		book, ok := fs.books[id]
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(book)
+
+	case r.Method == http.MethodDelete:
+		if _, ok := fs.books[id]; !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		delete(fs.books, id)
+	}
+}
+
+func (fs *fakeServer) has(id string) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	_, ok := fs.books[id]
+	return ok
+}
+
+// newFakeCluster starts n fake servers and a client sharding over them
+// without retries.
+func newFakeCluster(t *testing.T, n, replicas int) (*ShardedClient, map[string]*fakeServer) {
+	servers := make(map[string]*fakeServer)
+	urls := make([]string, 0, n)
+
+	for range n {
+		fs := newFakeServer(t)
+		servers[fs.URL] = fs
+		urls = append(urls, fs.URL)
+	}
+
+	sc := NewShardedClient(urls...)
+	sc.Replicas = replicas
+	for _, c := range sc.Clients {
+		c.Retries = 0
+	}
+
+	return sc, servers
+}
+
+func ownerURLs(sc *ShardedClient, id string) []string {
+	urls := make([]string, 0)
+	for _, c := range sc.Owners(id) {
+		urls = append(urls, c.BaseURL)
+	}
+	return urls
+}
+
+func serverURLs(n int) []string {
+	urls := make([]string, n)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("http://server-%d", i)
+	}
+	return urls
+}
+
+func TestOwners(t *testing.T) {
+	tests := []struct {
+		name     string
+		servers  int
+		replicas int
+		owners   int
+	}{
+		{name: "no servers", servers: 0, replicas: 1, owners: 0},
+		{name: "one server", servers: 1, replicas: 1, owners: 1},
+		{name: "no replication", servers: 5, replicas: 1, owners: 1},
+		{name: "replicas below one count as one", servers: 5, replicas: 0, owners: 1},
+		{name: "three replicas", servers: 5, replicas: 3, owners: 3},
+		{name: "every server", servers: 5, replicas: 5, owners: 5},
+		{name: "more replicas than servers", servers: 2, replicas: 3, owners: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := NewShardedClient(serverURLs(tt.servers)...)
+			sc.Replicas = tt.replicas
+
+			for i := range 100 {
+				id := fmt.Sprint("book-", i)
+				owners := ownerURLs(sc, id)
+
+				if len(owners) != tt.owners {
+					t.Fatalf("%s has %d owners, want %d", id, len(owners), tt.owners)
+				}
+				if len(slices.Compact(slices.Sorted(slices.Values(owners)))) != len(owners) {
+					t.Fatalf("%s is owned twice by one server: %v", id, owners)
+				}
+				if again := ownerURLs(sc, id); !slices.Equal(again, owners) {
+					t.Fatalf("%s is owned by %v, then by %v", id, owners, again)
+				}
+
+				// a higher replication factor adds owners after the same ones
+				sc.Replicas++
+				if more := ownerURLs(sc, id); !slices.Equal(more[:len(owners)], owners) {
+					t.Fatalf("%s is owned by %v, with one more replica by %v", id, owners, more)
+				}
+				sc.Replicas--
+			}
+		})
+	}
+}
+
+func TestConsistentHashing(t *testing.T) {
+	tests := []struct {
+		name    string
+		servers int
+	}{
+		{name: "a second server", servers: 1},
+		{name: "a third server", servers: 2},
+		{name: "a fifth server", servers: 4},
+		{name: "an eleventh server", servers: 10},
+	}
+
+	const ids = 10000
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := NewShardedClient(serverURLs(tt.servers)...)
+			after := NewShardedClient(serverURLs(tt.servers + 1)...)
+			added := after.Clients[tt.servers].BaseURL
+
+			moved := 0
+			owned := make(map[string]int)
+
+			for i := range ids {
+				id := fmt.Sprint("book-", i)
+				from, to := ownerURLs(before, id)[0], ownerURLs(after, id)[0]
+				owned[to]++
+
+				if from != to {
+					moved++
+					if to != added {
+						t.Fatalf("%s moved from %s to %s, not to the added server", id, from, to)
+					}
+				}
+			}
+
+			// the added server takes over about its share of the ids, and
+			// every server keeps at least half of its share
+			share := ids / (tt.servers + 1)
+			if moved < share/2 || moved > share*2 {
+				t.Errorf("%d of %d ids moved, want about %d", moved, ids, share)
+			}
+			for url, n := range owned {
+				if n < share/2 {
+					t.Errorf("%s owns %d ids, want about %d", url, n, share)
+				}
+			}
+		})
+	}
+}
+
+func TestShardedReadFallback(t *testing.T) {
+	forget := func(fs *fakeServer) { delete(fs.books, "book") }
+	keep := func(fs *fakeServer) {}
+
+	tests := []struct {
+		name             string
+		primary, replica func(fs *fakeServer)
+		found            bool
+		status           int // of the error when the book is not found
+	}{
+		{name: "the primary has the book", primary: keep, replica: keep, found: true},
+		{name: "the primary failed", primary: func(fs *fakeServer) { fs.status = http.StatusInternalServerError }, replica: keep, found: true},
+		{name: "the primary is unavailable", primary: func(fs *fakeServer) { fs.status = http.StatusServiceUnavailable }, replica: keep, found: true},
+		{name: "the primary is down", primary: func(fs *fakeServer) { fs.Close() }, replica: keep, found: true},
+		{name: "the primary missed the write", primary: forget, replica: keep, found: true},
+		{name: "the primary refused the read", primary: func(fs *fakeServer) { fs.status = http.StatusForbidden }, replica: keep, status: http.StatusForbidden},
+		{name: "no owner has the book", primary: forget, replica: forget, status: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, servers := newFakeCluster(t, 3, 2)
+			if _, err := sc.Put(context.Background(), Book{Id: "book", Name: "x"}); err != nil {
+				t.Fatal(err)
+			}
+
+			owners := ownerURLs(sc, "book")
+			tt.primary(servers[owners[0]])
+			tt.replica(servers[owners[1]])
+
+			book, err := sc.Get(context.Background(), "book")
+			if tt.found {
+				if err != nil || book.Name != "x" {
+					t.Fatalf("Get = %v, %v, want the replica's book", book, err)
+				}
+				return
+			}
+
+			var apiErr *Error
+			if !errors.As(err, &apiErr) || apiErr.Status != tt.status {
+				t.Errorf("Get = %v, %v, want a %d", book, err, tt.status)
+			}
+		})
+	}
+}
+
+func TestShardedWrites(t *testing.T) {
+	tests := []struct {
+		name     string
+		servers  int
+		replicas int
+	}{
+		{name: "no replication", servers: 3, replicas: 1},
+		{name: "two replicas", servers: 3, replicas: 2},
+		{name: "every server", servers: 3, replicas: 3},
+	}
+
+	ctx := context.Background()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, servers := newFakeCluster(t, tt.servers, tt.replicas)
+
+			ids := make([]string, 0)
+			for i := range 20 {
+				id := fmt.Sprintf("book-%02d", i)
+				ids = append(ids, id)
+				if _, err := sc.Put(ctx, Book{Id: id, Name: "x"}); err != nil {
+					t.Fatal(err)
+				}
+
+				owners := ownerURLs(sc, id)
+				for url, fs := range servers {
+					if fs.has(id) != slices.Contains(owners, url) {
+						t.Fatalf("%s on %s is %v, want it only on its owners %v", id, url, fs.has(id), owners)
+					}
+				}
+			}
+
+			listed, err := sc.List(ctx, "book-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			listedIds := make([]string, 0)
+			for _, book := range listed {
+				listedIds = append(listedIds, book.Id)
+			}
+			if !slices.Equal(listedIds, ids) {
+				t.Errorf("listed %v, want every book once in id order", listedIds)
+			}
+
+			if err := sc.Delete(ctx, ids[0]); err != nil {
+				t.Fatal(err)
+			}
+			for url, fs := range servers {
+				if fs.has(ids[0]) {
+					t.Errorf("%s still has %s", url, ids[0])
+				}
+			}
+			if err := sc.Delete(ctx, ids[0]); !IsNotFound(err) {
+				t.Errorf("deleting %s again = %v, want not found", ids[0], err)
+			}
+		})
+	}
+}
+
+func TestShardedWriteFailure(t *testing.T) {
+	sc, servers := newFakeCluster(t, 3, 2)
+	owners := ownerURLs(sc, "book")
+	servers[owners[1]].status = http.StatusInternalServerError
+
+	if _, err := sc.Put(context.Background(), Book{Id: "book", Name: "x"}); err == nil {
+		t.Error("a write a replica failed succeeded")
+	}
+	if !servers[owners[0]].has("book") {
+		t.Error("the primary did not get the write")
+	}
+}
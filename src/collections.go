@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// HandleBookList keeps the list of a book at /book/<id>/list: POST pushes
+// the JSON array of strings in the body, DELETE pops one item and GET
+// returns ?start= to ?end=. Pushes and pops take ?side=left or right, the
+// default. A book holding a set has no list.
+func (s *Server) HandleBookList(w http.ResponseWriter, r *http.Request) {
+	bookid := s.cfg.normalizeId(r.PathValue("id"))
+
+	if s.cfg.isReservedId(bookid) {
+		HandleReservedId(w, bookid)
+		return
+	}
+
+	side := r.URL.Query().Get("side")
+	if side == "" {
+		side = "right"
+	}
+
+	if side != "left" && side != "right" {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("invalid side %q", side))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		book := s.store.FindBookById(bookid)
+		if book == nil {
+			writeError(w, http.StatusNotFound, CodeBookNotFound, fmt.Sprintf("Book with id %s not found", bookid))
+			return
+		}
+
+		if handleWrongType(w, *book, "list") {
+			return
+		}
+
+		start, end, ok := handleRange(w, r, len(book.List))
+		if !ok {
+			return
+		}
+
+		w.Header().Set("ETag", book.ETag(s.cfg.ETagAlgo))
+		w.WriteHeader(http.StatusOK)
+		items, _ := json.Marshal(append([]string{}, book.List[start:end]...))
+
+		w.Write(items)
+
+	case http.MethodPost:
+		items, ok := s.decodeItems(w, r)
+		if !ok {
+			return
+		}
+
+		stored, ok := s.modifyBook(w, r, bookid, func(book *Book) bool {
+			if handleWrongType(w, *book, "list") {
+				return false
+			}
+
+			if side == "left" {
+				pushed := slices.Clone(items)
+				slices.Reverse(pushed)
+				book.List = append(pushed, book.List...)
+			} else {
+				book.List = append(slices.Clone(book.List), items...)
+			}
+			return true
+		})
+		if !ok {
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		length, _ := json.Marshal(LengthResult{Length: len(stored.List), Version: stored.Version})
+
+		w.Write(length)
+
+	case http.MethodDelete:
+		var popped string
+
+		_, ok := s.modifyBook(w, r, bookid, func(book *Book) bool {
+			if handleWrongType(w, *book, "list") {
+				return false
+			}
+
+			if len(book.List) == 0 {
+				writeError(w, http.StatusNotFound, CodeNotFound, fmt.Sprintf("Book with id %s has an empty list", bookid))
+				return false
+			}
+
+			if side == "left" {
+				popped, book.List = book.List[0], book.List[1:]
+			} else {
+				popped, book.List = book.List[len(book.List)-1], book.List[:len(book.List)-1]
+			}
+			return true
+		})
+		if !ok {
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		item, _ := json.Marshal(popped)
+
+		w.Write(item)
+
+	default:
+		HandleMethodIsNotAllowed(w, r)
+	}
+}
+
+// HandleBookSet keeps the set of a book at /book/<id>/set: POST adds the
+// JSON array of strings in the body, DELETE removes them and GET returns
+// the members in order. A book holding a list has no set.
+func (s *Server) HandleBookSet(w http.ResponseWriter, r *http.Request) {
+	bookid := s.cfg.normalizeId(r.PathValue("id"))
+
+	if s.cfg.isReservedId(bookid) {
+		HandleReservedId(w, bookid)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		book := s.store.FindBookById(bookid)
+		if book == nil {
+			writeError(w, http.StatusNotFound, CodeBookNotFound, fmt.Sprintf("Book with id %s not found", bookid))
+			return
+		}
+
+		if handleWrongType(w, *book, "set") {
+			return
+		}
+
+		w.Header().Set("ETag", book.ETag(s.cfg.ETagAlgo))
+		w.WriteHeader(http.StatusOK)
+		members, _ := json.Marshal(append([]string{}, book.Set...))
+
+		w.Write(members)
+
+	case http.MethodPost, http.MethodDelete:
+		items, ok := s.decodeItems(w, r)
+		if !ok {
+			return
+		}
+
+		stored, ok := s.modifyBook(w, r, bookid, func(book *Book) bool {
+			if handleWrongType(w, *book, "set") {
+				return false
+			}
+
+			if r.Method == http.MethodPost {
+				book.Set = append(slices.Clone(book.Set), items...)
+				slices.Sort(book.Set)
+				book.Set = slices.Compact(book.Set)
+			} else {
+				book.Set = slices.DeleteFunc(slices.Clone(book.Set), func(member string) bool {
+					return slices.Contains(items, member)
+				})
+			}
+			return true
+		})
+		if !ok {
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		length, _ := json.Marshal(LengthResult{Length: len(stored.Set), Version: stored.Version})
+
+		w.Write(length)
+
+	default:
+		HandleMethodIsNotAllowed(w, r)
+	}
+}
+
+// handleWrongType answers 409 when the book holds the other kind of
+// collection and reports whether it did.
+func handleWrongType(w http.ResponseWriter, book Book, kind string) bool {
+	other := ""
+
+	if kind == "list" && len(book.Set) > 0 {
+		other = "set"
+	}
+	if kind == "set" && len(book.List) > 0 {
+		other = "list"
+	}
+
+	if other == "" {
+		return false
+	}
+
+	writeError(w, http.StatusConflict, CodeWrongType, fmt.Sprintf("Book with id %s holds a %s, not a %s", book.Id, other, kind))
+	return true
+}
+
+func (s *Server) decodeItems(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	var items []string
+
+	err := s.decodeBody(r, &items)
+	if err != nil {
+		writeError(w, badBodyStatus(err), "", fmt.Sprintf("expected a JSON array of strings. %v", err))
+		return nil, false
+	}
+
+	return items, true
+}
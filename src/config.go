@@ -0,0 +1,619 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is every setting of the server, one per flag, see RegisterFlags.
+// DefaultConfig has the defaults of the flags.
+type Config struct {
+	// where and how the server listens
+	Addr              string
+	TCPKeepAlive      time.Duration
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	KeepAlives        bool
+	HTTP2             bool
+	H2C               bool
+	HTTP2MaxStreams   int
+	HTTP2PingInterval time.Duration
+	HTTP2PingTimeout  time.Duration
+	TLSCert           string
+	TLSKey            string
+	ClientCA          string
+	ShutdownTimeout   time.Duration
+	LogFormat         string
+
+	// the store and its backend
+	Backend             string
+	Shards              int
+	DataFile            string
+	FlushInterval       time.Duration
+	WALFile             string
+	WALMaxBytes         int64
+	UpstreamURL         string
+	UpstreamPrefix      string
+	CacheTTL            time.Duration
+	WriteBehind         bool
+	WriteBehindInterval time.Duration
+	WriteBehindBatch    int
+	RaftID              string
+	RaftAddr            string
+	RaftDir             string
+	RaftBootstrap       bool
+	TombstoneTTL        time.Duration
+	TTLSweepInterval    time.Duration
+	HistoryDepth        int
+	SoftDelete          bool
+	ArchiveExpired      bool
+	ValueIndex          bool
+	VerifyReads         bool
+	EncryptionKey       string
+	EncryptionKeyFile   string
+	MaxMemory           int64
+	EvictionPolicy      string
+	MaxStoreBytes       int64
+	BucketQuotas        string
+
+	// what the books and the requests may hold
+	MaxIdBytes              int
+	MaxValueBytes           int
+	MaxBodyBytes            int64
+	ReservedIds             string
+	RequireUTF8             bool
+	EmptyValuePolicy        string
+	NormalizeIds            string
+	IdCharset               string
+	IdPrefixes              string
+	ETagAlgo                string
+	DefaultFormat           string
+	BucketTTLs              string
+	BulkDeleteMax           int
+	ScriptMaxSteps          int
+	LockTTL                 time.Duration
+	KeyLockStripes          int
+	BackupBeforeDestructive bool
+
+	// who may call, and how often
+	APIKeysFile        string
+	AuthReads          bool
+	RateLimit          float64
+	WriteRateLimit     float64
+	RateLimitRoutes    string
+	RateBurst          int
+	CORSOrigins        string
+	CORSMethods        string
+	CORSHeaders        string
+	MiddlewareOrder    string
+	RouteMiddleware    string
+	SlowStart          time.Duration
+	IdempotencyTTL     time.Duration
+	IdempotencyMaxKeys int
+	ReadOnly           bool
+
+	// what is logged, measured and sent on
+	AuditLog              string
+	AuditRetention        time.Duration
+	AllowMetricsReset     bool
+	SlowRequestThreshold  time.Duration
+	LargeValueThreshold   int64
+	TraceRequests         int
+	OTLPEndpoint          string
+	OTelServiceName       string
+	ServerTiming          bool
+	GzipMinBytes          int
+	Webhooks              string
+	WebhookRetries        int
+	WebhookBackoff        time.Duration
+	WebhookDeadLetterFile string
+	DebugAddr             string
+
+	// replicas, failover and clusters
+	ReplicaOf          string
+	ReplicaCredentials string
+	FailoverAfter      time.Duration
+	FailoverCommand    string
+	PeersSpec          string
+	PeersInterval      time.Duration
+	PeersScheme        string
+	ProxyMembers       string
+	ProxyProbeInterval time.Duration
+
+	// snapshots and the books loaded at start
+	SnapshotDir      string
+	SnapshotInterval time.Duration
+	S3URL            string
+	S3Region         string
+	S3AccessKey      string
+	S3SecretKey      string
+	RestoreFrom      string
+	PreloadFile      string
+
+	// the listeners of the other protocols
+	MemcachedAddr string
+	RedisAddr     string
+	GRPCAddr      string
+
+	// the client commands
+	CommandServer string
+	CommandUser   string
+	CommandToken  string
+
+	// the file the settings not given as flags are read from, and the
+	// flags given on the command line, which neither it nor the
+	// environment may change
+	ConfigFile string
+	given      map[string]bool
+}
+
+// RegisterFlags binds every setting of c to its flag in fs, with its
+// default.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Addr, "addr", ":8080", "address to listen on: host:port, or unix:///path/to.sock for a Unix domain socket; ignored under systemd socket activation")
+	fs.DurationVar(&c.TCPKeepAlive, "tcp-keepalive", 15*time.Second, "interval of TCP keep-alive probes on accepted connections, finding peers that vanished without closing; negative disables")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", 10*time.Second, "max time to read a whole request, body included; 0 means no limit")
+	fs.DurationVar(&c.ReadHeaderTimeout, "read-header-timeout", 5*time.Second, "max time to read the request headers; 0 means -read-timeout applies")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", 10*time.Second, "max time from the end of the request headers to the end of the response; streams like /watch and /export lift it; 0 means no limit")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", 15*time.Second, "max time a keep-alive connection waits for its next request; 0 means -read-timeout applies")
+	fs.BoolVar(&c.KeepAlives, "keep-alives", true, "keep HTTP/1.1 connections open for further requests; HTTP/2 connections always are")
+	fs.BoolVar(&c.HTTP2, "http2", true, "offer HTTP/2 to TLS clients through ALPN next to HTTP/1.1")
+	fs.BoolVar(&c.H2C, "h2c", false, "also serve HTTP/2 in the clear to clients that start with it, as curl --http2-prior-knowledge does; meant for local use behind a proxy")
+	fs.IntVar(&c.HTTP2MaxStreams, "http2-max-streams", 250, "max concurrent streams a client may open on one HTTP/2 connection, each /watch or /export holding one")
+	fs.DurationVar(&c.HTTP2PingInterval, "http2-ping-interval", 30*time.Second, "ping an HTTP/2 connection that has been silent this long, so dead peers of long streams are found; 0 disables")
+	fs.DurationVar(&c.HTTP2PingTimeout, "http2-ping-timeout", 15*time.Second, "close an HTTP/2 connection whose ping is not answered in time")
+	fs.StringVar(&c.TLSCert, "tls-cert", "", "certificate file; serve HTTPS when set together with -tls-key")
+	fs.StringVar(&c.TLSKey, "tls-key", "", "private key file for -tls-cert")
+	fs.StringVar(&c.ClientCA, "client-ca", "", "CA bundle used to require and verify client certificates (mTLS)")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", 10*time.Second, "how long to wait for in-flight requests on SIGINT or SIGTERM")
+	fs.StringVar(&c.LogFormat, "log-format", "text", "log output format: text or json")
+
+	fs.StringVar(&c.Backend, "backend", "memory", "book storage backend: memory, file, wal, redis or raft, see -raft-id")
+	fs.IntVar(&c.Shards, "shards", 16, "number of independently locked partitions of the in-memory store")
+	fs.StringVar(&c.DataFile, "data-file", "books.json", "file the file backend keeps books in")
+	fs.DurationVar(&c.FlushInterval, "flush-interval", time.Second, "how often the file backend writes changes to -data-file")
+	fs.StringVar(&c.WALFile, "wal-file", "books.wal", "append-only log the wal backend writes every change to")
+	fs.Int64Var(&c.WALMaxBytes, "wal-max-bytes", 64<<20, "compact the wal once it grows past this size (0 never compacts)")
+	fs.StringVar(&c.UpstreamURL, "upstream", "redis://localhost:6379/0", "Redis server the redis backend caches, as redis://[:password@]host:port/db")
+	fs.StringVar(&c.UpstreamPrefix, "upstream-prefix", "books:", "prefix of the keys the redis backend keeps books under")
+	fs.DurationVar(&c.CacheTTL, "cache-ttl", time.Minute, "how long the redis backend serves a cached book before reading it from -upstream again (0 always reads through)")
+	fs.BoolVar(&c.WriteBehind, "write-behind", false, "acknowledge writes of the wal and redis backends once in memory and persist them in batches in the background; a crash loses the changes not flushed yet")
+	fs.DurationVar(&c.WriteBehindInterval, "write-behind-interval", 100*time.Millisecond, "how often -write-behind flushes pending changes")
+	fs.IntVar(&c.WriteBehindBatch, "write-behind-batch", 1000, "flush -write-behind changes early once this many books are pending")
+	fs.StringVar(&c.RaftID, "raft-id", "", "with -backend raft, the URL other members reach the HTTP API of this server at, which is also its id in the cluster, e.g. http://10.0.0.1:8080")
+	fs.StringVar(&c.RaftAddr, "raft-addr", "", "with -backend raft, the address of the Raft transport of this server, as the other members reach it, e.g. 10.0.0.1:7000")
+	fs.StringVar(&c.RaftDir, "raft-dir", "raft", "with -backend raft, the directory of the Raft log and snapshots")
+	fs.BoolVar(&c.RaftBootstrap, "raft-bootstrap", false, "with -backend raft, start a new cluster with this server as its only member, unless -raft-dir already holds one; the others join it at POST /admin/raft/join")
+	fs.DurationVar(&c.TombstoneTTL, "tombstone-ttl", 0, "answer 410 Gone for books deleted within this window (0 disables)")
+	fs.DurationVar(&c.TTLSweepInterval, "ttl-sweep-interval", time.Second, "the longest the sweeper removing expired books sleeps; it otherwise wakes when the next book expires")
+	fs.IntVar(&c.HistoryDepth, "history-depth", 0, "how many replaced versions of each book to keep in memory for /book/<id>/history, rollback and reads with ?at=, which reach no further back, 0 for none")
+	fs.BoolVar(&c.SoftDelete, "soft-delete", false, "keep deleted books in memory for -tombstone-ttl, so POST /book/<id>/restore can bring them back")
+	fs.BoolVar(&c.ArchiveExpired, "archive-expired", false, "keep expired books in memory instead of dropping them, so GET /archive/<id> still returns the last one to expire under each id")
+	fs.BoolVar(&c.ValueIndex, "value-index", false, "index books by name, so /search answers from the index instead of scanning every book")
+	fs.BoolVar(&c.VerifyReads, "verify-reads", false, "check the checksum of every book read by id and log the corrupt ones")
+	fs.StringVar(&c.EncryptionKey, "encryption-key", "", "comma-separated AES-256 keys, 64 hex digits or base64 each, encrypting -data-file, -wal-file and snapshots; the first encrypts and the rest only decrypt; also read from $BOOKS_ENCRYPTION_KEY, which keeps them out of the process list")
+	fs.StringVar(&c.EncryptionKeyFile, "encryption-key-file", "", "file with one -encryption-key per line, reloaded on SIGHUP; takes precedence over -encryption-key")
+	fs.Int64Var(&c.MaxMemory, "max-memory", 0, "evict books once their ids and values take more than this many bytes, like a bounded cache (0 disables)")
+	fs.StringVar(&c.EvictionPolicy, "eviction-policy", "lru", "which books -max-memory evicts first: lru (least recently used) or lfu (least frequently used)")
+	fs.Int64Var(&c.MaxStoreBytes, "max-store-bytes", 0, "total id and value bytes the store may hold, checked with each write (0 disables)")
+	fs.StringVar(&c.BucketQuotas, "bucket-quotas", "", "comma-separated <bucket>=<max books>/<max bytes> quotas, with * for every bucket not listed; 0 leaves either unlimited")
+
+	fs.IntVar(&c.MaxIdBytes, "max-id-bytes", 256, "longest book id accepted, in bytes")
+	fs.IntVar(&c.MaxValueBytes, "max-value-bytes", 64<<10, "largest author plus name accepted, in bytes, and largest string or list a script may build")
+	fs.Int64Var(&c.MaxBodyBytes, "max-body-bytes", 1<<20, "maximum size of a request body")
+	fs.StringVar(&c.ReservedIds, "reserved-ids", "", "comma-separated glob patterns of book ids reserved for internal use")
+	fs.BoolVar(&c.RequireUTF8, "require-utf8", false, "reject book writes whose body is not valid UTF-8")
+	fs.StringVar(&c.EmptyValuePolicy, "empty-value-policy", "allow", "how to treat writes of a book without author and name: allow, reject or delete")
+	fs.StringVar(&c.NormalizeIds, "normalize-ids", "", "comma-separated book id normalizations applied on every read and write: trim, collapse-slashes, lowercase")
+	fs.StringVar(&c.IdCharset, "id-charset", "any", "characters a written book id may hold: any, printable (no control characters, valid UTF-8), safe (ASCII letters, digits and . _ ~ - / only) or alnum (ASCII letters and digits)")
+	fs.StringVar(&c.IdPrefixes, "id-prefixes", "", "comma-separated prefixes one of which every written book id must start with (empty allows any)")
+	fs.StringVar(&c.ETagAlgo, "etag-algo", "fnv", "hash of the book ETags: fnv, the fast 64 bit FNV-1a, or sha256")
+	fs.StringVar(&c.DefaultFormat, "default-format", "json", "response format when the client sends no Accept header or */*: json, text, csv, msgpack or protobuf")
+	fs.StringVar(&c.BucketTTLs, "bucket-ttls", "", "comma-separated <bucket>=<ttl> lifetimes of the books put into a bucket without ?ttl=, with * for every bucket not listed; books of other buckets never expire by default")
+	fs.IntVar(&c.BulkDeleteMax, "bulk-delete-max", 1000, "most books one DELETE /list may remove; a pattern matching more is refused before anything is deleted")
+	fs.IntVar(&c.ScriptMaxSteps, "script-max-steps", 100000, "most expressions one run of a script may evaluate, so a runaway loop ends with an error")
+	fs.DurationVar(&c.LockTTL, "lock-ttl", 15*time.Second, "lease of a lock taken at POST /locks/<name> without ?ttl=")
+	fs.IntVar(&c.KeyLockStripes, "key-lock-stripes", 1024, "number of mutexes read-modify-write updates like incr, append and the list and set operations take by book id")
+	fs.BoolVar(&c.BackupBeforeDestructive, "backup-before-destructive", false, "write a snapshot of all books to -snapshot-dir before clear-all, bulk and prefix deletes")
+
+	fs.StringVar(&c.APIKeysFile, "api-keys-file", "", "file with one API key per line, optionally followed by its access, read or write (default), and the tenant it is confined to")
+	fs.BoolVar(&c.AuthReads, "auth-reads", true, "require credentials for reads as well as writes")
+	fs.Float64Var(&c.RateLimit, "rate-limit", 0, "requests per second each client may make (0 disables)")
+	fs.Float64Var(&c.WriteRateLimit, "write-rate-limit", 0, "requests per second each client may make with write methods (0 uses -rate-limit)")
+	fs.StringVar(&c.RateLimitRoutes, "rate-limit-routes", "", "comma-separated pattern=rate overrides for single routes, e.g. /batch=1")
+	fs.IntVar(&c.RateBurst, "rate-burst", 10, "requests a client may make at once before its rate limit applies")
+	fs.StringVar(&c.CORSOrigins, "cors-origins", "", "comma-separated origins browsers may call the API from, or * for any (empty disables CORS)")
+	fs.StringVar(&c.CORSMethods, "cors-methods", "GET,POST,PUT,DELETE", "comma-separated methods allowed in cross-origin requests")
+	fs.StringVar(&c.CORSHeaders, "cors-headers", "Authorization,Content-Type,X-API-Key,If-Match,If-None-Match,X-Fence-Token,X-Request-ID,Idempotency-Key,traceparent", "comma-separated request headers allowed in cross-origin requests")
+	fs.StringVar(&c.MiddlewareOrder, "middleware-order", "trace,logger,metrics,rate-limit,slow-start,auth,gzip,idempotency", "comma-separated middleware layers, outermost first; leave a layer out to disable it (recovery always runs outermost)")
+	fs.StringVar(&c.RouteMiddleware, "route-middleware", "", "semicolon-separated route groups with their own -middleware-order, as prefix=layers, e.g. /watch=trace,logger,auth; a route takes the longest prefix of its pattern")
+	fs.DurationVar(&c.SlowStart, "slow-start", 0, "ramp accepted traffic from 0 to 100% over this window after startup")
+	fs.DurationVar(&c.IdempotencyTTL, "idempotency-ttl", 24*time.Hour, "how long the answer to a write sent with an Idempotency-Key header is kept and replayed to retries of it (0 disables)")
+	fs.IntVar(&c.IdempotencyMaxKeys, "idempotency-max-keys", 10000, "most Idempotency-Key answers kept at once; the oldest are dropped first")
+	fs.BoolVar(&c.ReadOnly, "read-only", false, "start rejecting every write with 403, e.g. for a maintenance window or a demo; /admin/read-only switches it at runtime")
+
+	fs.StringVar(&c.AuditLog, "audit-log", "", "file to append a JSON line for every write request to, over HTTP or the other protocols, or an http(s) URL to POST them to as JSON lines; empty disables auditing")
+	fs.DurationVar(&c.AuditRetention, "audit-retention", 0, "how long the daily rotated -audit-log files are kept, 0 keeps them forever")
+	fs.BoolVar(&c.AllowMetricsReset, "allow-metrics-reset", false, "serve POST /metrics/reset, which zeroes every counter and histogram of /metrics and /admin/stats; meant for test harnesses, not production")
+	fs.DurationVar(&c.SlowRequestThreshold, "slow-request-threshold", time.Second, "log a warning for every request that takes longer, and count it in /metrics; streams like /watch are left out (0 disables)")
+	fs.Int64Var(&c.LargeValueThreshold, "large-value-threshold", 0, "log a warning for every request whose body or answer is larger, in bytes, and count it in /metrics (0 disables)")
+	fs.IntVar(&c.TraceRequests, "trace-requests", 0, "keep the last N request summaries and serve them at /debug/requests (0 disables)")
+	fs.StringVar(&c.OTLPEndpoint, "otlp-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "OTLP/HTTP collector to send trace spans to, e.g. http://localhost:4318; defaults to $OTEL_EXPORTER_OTLP_ENDPOINT and empty disables tracing")
+	fs.StringVar(&c.OTelServiceName, "otel-service-name", envOr("OTEL_SERVICE_NAME", "books"), "service.name of the exported spans; defaults to $OTEL_SERVICE_NAME")
+	fs.BoolVar(&c.ServerTiming, "server-timing", false, "report per-phase durations in a Server-Timing response header")
+	fs.IntVar(&c.GzipMinBytes, "gzip-min-bytes", 1024, "compress responses of at least this many bytes when the client accepts gzip")
+	fs.StringVar(&c.Webhooks, "webhooks", "", "comma-separated URLs sent a JSON POST of every change, each as url or <id prefix>=url to only hear about those ids")
+	fs.IntVar(&c.WebhookRetries, "webhook-retries", 5, "retries of a failed webhook delivery before it goes to -webhook-dead-letter-file")
+	fs.DurationVar(&c.WebhookBackoff, "webhook-backoff", 500*time.Millisecond, "wait before the first webhook retry, doubling up to 30s for each further one")
+	fs.StringVar(&c.WebhookDeadLetterFile, "webhook-dead-letter-file", "webhooks-dead.jsonl", "JSON lines of the webhook deliveries that failed every retry")
+	fs.StringVar(&c.DebugAddr, "debug-addr", "", "address of a separate listener serving /debug/pprof/ and /debug/vars, e.g. localhost:6060; it has no auth, so keep it private")
+
+	fs.StringVar(&c.ReplicaOf, "replica-of", "", "URL of a primary to replicate from, or peers to follow whichever member found by -peers is primary; the server then serves reads and rejects writes until promoted")
+	fs.StringVar(&c.ReplicaCredentials, "replica-credentials", "", "credentials for the primary, `user:password` for Basic auth or else an API key")
+	fs.DurationVar(&c.FailoverAfter, "failover-after", 0, "with -replica-of, promote the replica once the primary has been down this long, so it takes over the writes (0 disables)")
+	fs.StringVar(&c.FailoverCommand, "failover-command", "", "shell command run once the replica has taken over with -failover-after, e.g. to move a virtual address to it; BOOKS_ADDR and BOOKS_PRIMARY name the server and the primary it replaces")
+	fs.StringVar(&c.PeersSpec, "peers", "", "where the members of the cluster are found when -replica-of or -proxy is peers: srv:<name> for the targets of a DNS SRV record, or file:<path> for a seeds file with one member per line; any member given it also asks them for the primary, so a promotion waits while another member is primary and a primary that comes back after a failover fences itself")
+	fs.DurationVar(&c.PeersInterval, "peers-interval", 30*time.Second, "how often -proxy peers and -replica-of peers look the members up again")
+	fs.StringVar(&c.PeersScheme, "peers-scheme", "http", "scheme of the members found by -peers, for SRV targets and seeds without one")
+	fs.StringVar(&c.ProxyMembers, "proxy", "", "comma-separated base URLs of the members of a cluster, or peers to find them with -peers; when set the binary holds no books and serves the API by proxying it to them, writes to the primary and reads across the replicas")
+	fs.DurationVar(&c.ProxyProbeInterval, "proxy-probe-interval", time.Second, "how often -proxy asks every member for its role and readiness on /readyz")
+
+	fs.StringVar(&c.SnapshotDir, "snapshot-dir", "snapshots", "directory POST /snapshot writes to and POST /restore reads from")
+	fs.DurationVar(&c.SnapshotInterval, "snapshot-interval", 0, "write a snapshot to -snapshot-dir this often, uploaded to -s3-url when set (0 disables)")
+	fs.StringVar(&c.S3URL, "s3-url", "", "S3-compatible location snapshots are uploaded to, path-style with the bucket and an optional key prefix, e.g. https://s3.eu-west-1.amazonaws.com/my-bucket/books (empty disables uploads)")
+	fs.StringVar(&c.S3Region, "s3-region", "us-east-1", "region requests to -s3-url are signed for")
+	fs.StringVar(&c.S3AccessKey, "s3-access-key", "", "access key id signing requests to -s3-url; empty falls back to $AWS_ACCESS_KEY_ID, and without either they are sent unsigned")
+	fs.StringVar(&c.S3SecretKey, "s3-secret-key", "", "secret access key signing requests to -s3-url; empty falls back to $AWS_SECRET_ACCESS_KEY")
+	fs.StringVar(&c.RestoreFrom, "restore-from", "", "snapshot object loaded into the store at startup, replacing every book: its URL, or latest for the newest snapshot under -s3-url")
+	fs.StringVar(&c.PreloadFile, "preload", "", "file of books put into the store before the server listens and again on POST /admin/preload: CSV when named .csv, else a JSON array or JSON lines; stored books with the same ids are replaced")
+
+	fs.StringVar(&c.MemcachedAddr, "memcached-addr", "", "address of a listener speaking the memcached text protocol on the same books, e.g. 127.0.0.1:11211; it has no auth, so it may only listen on loopback")
+	fs.StringVar(&c.RedisAddr, "redis-addr", "", "address of a listener speaking a subset of the Redis protocol (RESP) on the same books, e.g. :6379; clients AUTH with an API key, or a user and password, under the same rules as HTTP requests")
+	fs.StringVar(&c.GRPCAddr, "grpc-addr", "", "address of a listener serving the Books gRPC service of books.proto on the same books, e.g. :9090; calls authenticate, are rate limited and use -tls-cert under the same rules as HTTP requests")
+
+	fs.StringVar(&c.CommandServer, "server", "http://localhost:8080", "base URL of the server the get, put, del, list and bench commands talk to")
+	fs.StringVar(&c.CommandUser, "user", "", "user:password the commands authenticate with")
+	fs.StringVar(&c.CommandToken, "token", "", "API key the commands authenticate with when -user is not set")
+
+	fs.StringVar(&c.ConfigFile, "config", "", "file of `name = value` lines, a flat TOML subset, setting any flag by name")
+}
+
+// DefaultConfig returns the settings of a server started without flags.
+func DefaultConfig() Config {
+	var c Config
+	c.RegisterFlags(flag.NewFlagSet("", flag.ContinueOnError))
+	return c
+}
+
+// ParseFlags reads the settings from the command line args into the flags
+// of fs, then fills in those not given, see apply. It returns the
+// arguments left after the flags, which name a client command.
+func ParseFlags(fs *flag.FlagSet, args []string) (Config, []string, error) {
+	var c Config
+	c.RegisterFlags(fs)
+
+	if err := fs.Parse(args); err != nil {
+		return c, nil, err
+	}
+
+	c.given = make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { c.given[f.Name] = true })
+
+	return c, fs.Args(), c.apply()
+}
+
+// flagSet returns the flags of c bound to its settings as they are, so
+// setting a flag changes c.
+func (c *Config) flagSet() *flag.FlagSet {
+	current := *c
+
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	c.RegisterFlags(fs)
+
+	*c = current
+	return fs
+}
+
+// envPrefix starts the environment variables that override the config
+// file, e.g. BOOKS_MAX_BODY_BYTES for -max-body-bytes.
+const envPrefix = "BOOKS_"
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// apply fills in the settings not given on the command line, first from
+// the environment and then from -config, so flags win over the environment
+// and the environment wins over the file. When names are given only those
+// flags are applied, which is how reloads pick up changed settings.
+func (c *Config) apply(names ...string) error {
+	fs := c.flagSet()
+	settings := make(map[string]string)
+
+	if c.ConfigFile != "" {
+		var err error
+
+		settings, err = readConfig(fs, c.ConfigFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	var err error
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || c.given[f.Name] || f.Name == "config" {
+			return
+		}
+
+		if len(names) > 0 && !slices.Contains(names, f.Name) {
+			return
+		}
+
+		value, ok := os.LookupEnv(envName(f.Name))
+		source := envName(f.Name)
+
+		if !ok {
+			value, ok = settings[f.Name]
+			source = c.ConfigFile + ": " + f.Name
+		}
+
+		if ok {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = errors.New(fmt.Sprintf("%s: %v", source, setErr))
+			}
+		}
+	})
+
+	return err
+}
+
+// readConfig parses name = value lines naming flags of fs. Blank lines and
+// # comments are ignored, names may use _ or - and quoted values are
+// unquoted.
+func readConfig(fs *flag.FlagSet, path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	settings := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		name, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("%s:%d: expected name = value", path, line))
+		}
+
+		name = strings.ReplaceAll(strings.TrimSpace(name), "_", "-")
+		value = strings.TrimSpace(value)
+
+		if strings.HasPrefix(value, `"`) {
+			value, err = strconv.Unquote(value)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("%s:%d: bad quoted value", path, line))
+			}
+		} else if i := strings.Index(value, "#"); i >= 0 {
+			value = strings.TrimSpace(value[:i])
+		}
+
+		if fs.Lookup(name) == nil || name == "config" {
+			return nil, errors.New(fmt.Sprintf("%s:%d: unknown setting %s", path, line, name))
+		}
+
+		settings[name] = value
+	}
+
+	return settings, scanner.Err()
+}
+
+// validate reports the first setting of c that is not valid, or that does
+// not go with the others.
+func (c Config) validate() error {
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		return errors.New(fmt.Sprintf("invalid -log-format %q", c.LogFormat))
+	}
+
+	if c.PeersSpec != "" {
+		if err := c.checkPeersSpec(c.PeersSpec); err != nil {
+			return err
+		}
+	}
+
+	if c.PeersInterval <= 0 {
+		return errors.New(fmt.Sprintf("invalid -peers-interval %v", c.PeersInterval))
+	}
+
+	if c.MemcachedAddr != "" && !isLoopbackAddr(c.MemcachedAddr) {
+		return errors.New(fmt.Sprintf("-memcached-addr %s is not a loopback address; the memcached text protocol has no auth", c.MemcachedAddr))
+	}
+
+	if c.EmptyValuePolicy != "allow" && c.EmptyValuePolicy != "reject" && c.EmptyValuePolicy != "delete" {
+		return errors.New(fmt.Sprintf("invalid -empty-value-policy %q", c.EmptyValuePolicy))
+	}
+
+	if !validETagAlgo(c.ETagAlgo) {
+		return errors.New(fmt.Sprintf("invalid -etag-algo %q", c.ETagAlgo))
+	}
+
+	for _, step := range c.normalizeSteps() {
+		if _, ok := idNormalizers[step]; !ok {
+			return errors.New(fmt.Sprintf("invalid -normalize-ids step %q", step))
+		}
+	}
+
+	if _, ok := idCharsets[c.IdCharset]; !ok {
+		return errors.New(fmt.Sprintf("invalid -id-charset %q", c.IdCharset))
+	}
+
+	for _, pattern := range c.reservedPatterns() {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.New(fmt.Sprintf("invalid -reserved-ids pattern %q: %v", pattern, err))
+		}
+	}
+
+	if _, ok := formatContentTypes[c.DefaultFormat]; !ok {
+		return errors.New(fmt.Sprintf("invalid -default-format %q", c.DefaultFormat))
+	}
+
+	if c.MaxBodyBytes <= 0 {
+		return errors.New(fmt.Sprintf("invalid -max-body-bytes %d", c.MaxBodyBytes))
+	}
+
+	if c.TTLSweepInterval <= 0 {
+		return errors.New(fmt.Sprintf("invalid -ttl-sweep-interval %v", c.TTLSweepInterval))
+	}
+
+	if c.TraceRequests < 0 {
+		return errors.New(fmt.Sprintf("invalid -trace-requests %d", c.TraceRequests))
+	}
+
+	if c.SoftDelete && c.TombstoneTTL <= 0 {
+		return errors.New("-soft-delete needs -tombstone-ttl as its retention window")
+	}
+
+	if c.HistoryDepth < 0 {
+		return errors.New(fmt.Sprintf("invalid -history-depth %d", c.HistoryDepth))
+	}
+
+	if c.Shards <= 0 {
+		return errors.New(fmt.Sprintf("invalid -shards %d", c.Shards))
+	}
+
+	switch c.Backend {
+	case "memory", "file", "wal", "redis":
+	case "raft":
+		if err := c.checkRaft(); err != nil {
+			return err
+		}
+	default:
+		return errors.New(fmt.Sprintf("invalid -backend %q", c.Backend))
+	}
+
+	if c.EvictionPolicy != "lru" && c.EvictionPolicy != "lfu" {
+		return errors.New(fmt.Sprintf("invalid -eviction-policy %q", c.EvictionPolicy))
+	}
+
+	if c.MaxMemory < 0 || (c.MaxMemory > 0 && c.Backend != "memory") {
+		return errors.New("-max-memory needs -backend memory, as evicting would lose persisted books")
+	}
+
+	if c.WriteBehind && c.Backend != "wal" && c.Backend != "redis" {
+		return errors.New("-write-behind needs -backend wal or redis")
+	}
+
+	if c.WriteBehindInterval <= 0 || c.WriteBehindBatch <= 0 {
+		return errors.New("invalid -write-behind-interval or -write-behind-batch")
+	}
+
+	if c.KeyLockStripes <= 0 {
+		return errors.New(fmt.Sprintf("invalid -key-lock-stripes %d", c.KeyLockStripes))
+	}
+
+	if c.LockTTL <= 0 {
+		return errors.New(fmt.Sprintf("invalid -lock-ttl %s", c.LockTTL))
+	}
+
+	if _, err := parseWebhooks(c.Webhooks); err != nil {
+		return errors.New(fmt.Sprintf("invalid -webhooks: %v", err))
+	}
+
+	if c.WebhookRetries < 0 || c.WebhookBackoff <= 0 {
+		return errors.New("invalid -webhook-retries or -webhook-backoff")
+	}
+
+	if c.AuditRetention < 0 {
+		return errors.New(fmt.Sprintf("invalid -audit-retention %s", c.AuditRetention))
+	}
+
+	if _, err := parseBucketQuotas(c.BucketQuotas); err != nil {
+		return errors.New(fmt.Sprintf("invalid -bucket-quotas: %v", err))
+	}
+
+	if _, err := parseBucketTTLs(c.BucketTTLs); err != nil {
+		return errors.New(fmt.Sprintf("invalid -bucket-ttls: %v", err))
+	}
+
+	if c.MaxIdBytes <= 0 || c.MaxValueBytes <= 0 || c.MaxStoreBytes < 0 {
+		return errors.New("invalid -max-id-bytes, -max-value-bytes or -max-store-bytes")
+	}
+
+	if c.ScriptMaxSteps <= 0 {
+		return errors.New(fmt.Sprintf("invalid -script-max-steps %d", c.ScriptMaxSteps))
+	}
+
+	if c.SlowRequestThreshold < 0 || c.LargeValueThreshold < 0 {
+		return errors.New("invalid -slow-request-threshold or -large-value-threshold")
+	}
+
+	if c.IdempotencyTTL < 0 || c.IdempotencyMaxKeys <= 0 {
+		return errors.New("invalid -idempotency-ttl or -idempotency-max-keys")
+	}
+
+	if c.BulkDeleteMax <= 0 {
+		return errors.New(fmt.Sprintf("invalid -bulk-delete-max %d", c.BulkDeleteMax))
+	}
+
+	if c.PreloadFile != "" && c.ReplicaOf != "" {
+		return errors.New("-preload cannot be used with -replica-of")
+	}
+
+	if c.RestoreFrom != "" && c.ReplicaOf != "" {
+		return errors.New("-restore-from cannot be used with -replica-of")
+	}
+
+	if c.SnapshotInterval < 0 {
+		return errors.New(fmt.Sprintf("invalid -snapshot-interval %v", c.SnapshotInterval))
+	}
+
+	if c.s3Enabled() {
+		if location, err := url.Parse(c.S3URL); err != nil || (location.Scheme != "http" && location.Scheme != "https") || strings.Trim(location.Path, "/") == "" {
+			return errors.New(fmt.Sprintf("invalid -s3-url %q: want http(s)://host/bucket[/prefix]", c.S3URL))
+		}
+	}
+
+	if c.HTTP2MaxStreams < 0 || c.HTTP2PingInterval < 0 || c.HTTP2PingTimeout < 0 {
+		return errors.New("invalid -http2-max-streams, -http2-ping-interval or -http2-ping-timeout")
+	}
+
+	if c.ClientCA != "" && !c.tlsEnabled() {
+		return errors.New("-client-ca requires -tls-cert and -tls-key")
+	}
+
+	if _, err := c.rateLimits(); err != nil {
+		return errors.New(fmt.Sprintf("invalid rate limits: %v", err))
+	}
+
+	if c.ReplicaOf == discoveredPeers && c.PeersSpec == "" {
+		return errors.New("-replica-of peers needs -peers")
+	}
+
+	if c.FailoverAfter < 0 {
+		return errors.New(fmt.Sprintf("invalid -failover-after %v", c.FailoverAfter))
+	}
+
+	if c.FailoverAfter > 0 && c.ReplicaOf == "" {
+		return errors.New("-failover-after needs -replica-of")
+	}
+
+	return nil
+}
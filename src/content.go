@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// HandleBookContent serves the binary attachment of a book: GET returns it
+// with the Content-Type it was stored with, PUT stores the request body
+// and its Content-Type, DELETE drops it.
+func (s *Server) HandleBookContent(w http.ResponseWriter, r *http.Request) {
+	bookid := s.cfg.normalizeId(r.PathValue("id"))
+
+	if s.cfg.isReservedId(bookid) {
+		HandleReservedId(w, bookid)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		book := s.store.FindBookById(bookid)
+		if book == nil || book.ContentType == "" {
+			writeError(w, http.StatusNotFound, CodeNotFound, fmt.Sprintf("Book with id %s has no content", bookid))
+			return
+		}
+
+		w.Header().Set("Content-Type", book.ContentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(book.Content)))
+		w.Header().Set("ETag", book.ETag(s.cfg.ETagAlgo))
+		w.WriteHeader(http.StatusOK)
+
+		w.Write(book.Content)
+
+	case http.MethodPut, http.MethodDelete:
+		var content []byte
+		contentType := ""
+
+		if r.Method == http.MethodPut {
+			var err error
+
+			content, err = io.ReadAll(r.Body)
+			if err != nil {
+				writeError(w, badBodyStatus(err), "", err.Error())
+				return
+			}
+
+			contentType = r.Header.Get("Content-Type")
+			if contentType == "" {
+				contentType = "application/octet-stream"
+			}
+		}
+
+		s.setBookContent(w, r, bookid, content, contentType)
+
+	default:
+		HandleMethodIsNotAllowed(w, r)
+	}
+}
+
+// setBookContent swaps the content into the stored book, retrying when a
+// concurrent write changes the book in between, so no other field is lost.
+// The hooks see the book once, on the write that goes in.
+func (s *Server) setBookContent(w http.ResponseWriter, r *http.Request, bookid string, content []byte, contentType string) {
+	for {
+		book := s.store.FindBookById(bookid)
+		if book == nil {
+			writeError(w, http.StatusNotFound, CodeBookNotFound, fmt.Sprintf("Book with id %s not found", bookid))
+			return
+		}
+
+		cond := "version:" + strconv.FormatUint(book.Version, 10)
+		book.Content, book.ContentType = content, contentType
+
+		if !s.handleLimits(w, *book) {
+			return
+		}
+
+		stop := startTiming(r, "store")
+		written, err := s.setBookIf(r, *book, cond)
+		stop()
+
+		if !handleWriteError(w, err) {
+			return
+		}
+		if written {
+			break
+		}
+	}
+
+	stored := s.store.FindBookById(bookid)
+	if stored != nil {
+		w.Header().Set("ETag", stored.ETag(s.cfg.ETagAlgo))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
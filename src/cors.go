@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// corsExposedHeaders are the response headers scripts may read.
+const corsExposedHeaders = "ETag, Retry-After, X-Backup-Path, X-Snapshot-Revision, Server-Timing, X-Request-ID, Idempotent-Replayed, traceparent"
+
+func (s *Server) corsOriginAllowed(origin string) bool {
+	for _, allowed := range strings.Split(s.cfg.CORSOrigins, ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// CORS runs in front of every route. It answers preflight requests itself,
+// since browsers send them without credentials, and adds the CORS headers
+// to actual requests from allowed origins.
+func (s *Server) CORS(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		origin := r.Header.Get("Origin")
+
+		if s.cfg.CORSOrigins == "" || origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+
+		if !s.corsOriginAllowed(origin) {
+			if r.Method == http.MethodOptions {
+				writeError(w, http.StatusForbidden, CodeForbidden, "origin not allowed")
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+
+		method := r.Header.Get("Access-Control-Request-Method")
+
+		if r.Method != http.MethodOptions || method == "" {
+			w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		methods := strings.Split(strings.ReplaceAll(s.cfg.CORSMethods, " ", ""), ",")
+		if !slices.Contains(methods, method) {
+			writeError(w, http.StatusForbidden, CodeForbidden, "method not allowed for cross-origin requests")
+			return
+		}
+
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		w.Header().Set("Access-Control-Allow-Methods", s.cfg.CORSMethods)
+		w.Header().Set("Access-Control-Allow-Headers", s.cfg.CORSHeaders)
+		w.Header().Set("Access-Control-Max-Age", "600")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// HandleIncrBook adds ?delta= (1 by default) to the integer held in the
+// book name at POST /book/<id>/incr, or subtracts it at /decr, and answers
+// with the updated book. A missing book starts at zero. Like content
+// updates it retries on the stored version, so concurrent increments are
+// never lost.
+func (s *Server) HandleIncrBook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	decr := r.PathValue("op") == "decr"
+	bookid := s.cfg.normalizeId(r.PathValue("id"))
+
+	if s.cfg.isReservedId(bookid) {
+		HandleReservedId(w, bookid)
+		return
+	}
+
+	delta := int64(1)
+
+	if value := r.URL.Query().Get("delta"); value != "" {
+		var err error
+
+		delta, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || (decr && delta == math.MinInt64) {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("invalid delta %q", value))
+			return
+		}
+	}
+
+	if decr {
+		delta = -delta
+	}
+
+	stored, ok := s.modifyBook(w, r, bookid, func(book *Book) bool {
+		current := int64(0)
+
+		if book.Version != 0 {
+			var err error
+
+			current, err = strconv.ParseInt(book.Name, 10, 64)
+			if err != nil {
+				writeError(w, http.StatusConflict, CodeWrongType, fmt.Sprintf("Book with id %s does not hold an integer", bookid))
+				return false
+			}
+		}
+
+		if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+			writeError(w, http.StatusConflict, CodeConflict, fmt.Sprintf("Book with id %s would overflow", bookid))
+			return false
+		}
+
+		book.Name = strconv.FormatInt(current+delta, 10)
+		return true
+	})
+	if !ok {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	body, _ := json.Marshal(stored)
+
+	w.Write(body)
+}
+
+// modifyBook applies change to the stored book, or to an empty one with
+// version 0 when it is missing, and writes the result only if the book
+// has not changed meanwhile, retrying otherwise. Updates of the same id
+// take turns on its key lock, so they only retry after a plain write.
+// The hooks see the book once, on the write that goes in. change answers
+// the request itself when it returns false. It returns the stored book
+// with its ETag set, and false once the request has been answered.
+func (s *Server) modifyBook(w http.ResponseWriter, r *http.Request, bookid string, change func(book *Book) bool) (*Book, bool) {
+	unlock := s.keyLocks.lock(bookid)
+	defer unlock()
+
+	for {
+		book := s.store.FindBookById(bookid)
+		cond := "absent"
+
+		if book == nil {
+			book = &Book{Id: bookid}
+		} else {
+			cond = "version:" + strconv.FormatUint(book.Version, 10)
+		}
+
+		if !change(book) || !s.handleLimits(w, *book) {
+			return nil, false
+		}
+
+		stop := startTiming(r, "store")
+		written, err := s.setBookIf(r, *book, cond)
+		stop()
+
+		if !handleWriteError(w, err) {
+			return nil, false
+		}
+		if written {
+			break
+		}
+	}
+
+	stored := s.store.FindBookById(bookid)
+	if stored != nil {
+		w.Header().Set("ETag", stored.ETag(s.cfg.ETagAlgo))
+	}
+
+	return stored, true
+}
+
+// setBookIf writes book if cond holds for the stored one, running the
+// hooks only when it does. It reports whether the book was written, and
+// the error of a hook or limit that refused it.
+func (s *Server) setBookIf(r *http.Request, book Book, cond string) (bool, error) {
+	written, _, err := s.store.Txn([]TxnCompare{{Id: book.Id, If: cond}}, []BatchOp{{Op: "put", Book: book}}, nil, s.prepareWrites(r))
+	return written, err
+}
+
+// changeBook is modifyBook for the line protocols. change returns the
+// reply that leaves the book as it is, or "" to have it written. changeBook
+// returns that reply, or the error of the hook or limit that refused the
+// write.
+func (s *Server) changeBook(r *http.Request, bookid string, change func(book *Book) string) (string, error) {
+	unlock := s.keyLocks.lock(bookid)
+	defer unlock()
+
+	for {
+		book := s.store.FindBookById(bookid)
+		cond := "absent"
+
+		if book == nil {
+			book = &Book{Id: bookid}
+		} else {
+			cond = "version:" + strconv.FormatUint(book.Version, 10)
+		}
+
+		if reply := change(book); reply != "" {
+			return reply, nil
+		}
+
+		if status, limitError := s.checkLimits(*book); limitError != nil {
+			return "", &limitExceeded{status, limitError}
+		}
+
+		written, err := s.setBookIf(r, *book, cond)
+		if err != nil || written {
+			return "", err
+		}
+	}
+}
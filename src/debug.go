@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"net/http"
+	"net/http/pprof"
+)
+
+// serveDebug serves the profiling and expvar endpoints on -debug-addr, away
+// from the API listener and its middleware. The books var counts the
+// books of s.
+func serveDebug(s *Server) {
+	expvar.Publish("books", expvar.Func(func() any {
+		books, _ := s.store.GetBooks(context.Background())
+		return len(books)
+	}))
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	log.Printf("Debug endpoints on http://%s/debug/\n", s.cfg.DebugAddr)
+
+	err := http.ListenAndServe(s.cfg.DebugAddr, mux)
+	if err != nil {
+		log.Fatalf("debug listener: %v", err)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// encryptedMagic starts a whole encrypted file. Files without it are read
+// as plain JSON, so turning encryption on needs no migration.
+const encryptedMagic = "BKENC1\n"
+
+// encryptedKeyIdSize is how many bytes of the SHA-256 of a key name it in
+// front of everything it sealed, so data sealed before a rotation can
+// still be opened.
+const encryptedKeyIdSize = 4
+
+type encryptionKeyring struct {
+	aeads map[string]cipher.AEAD // by key id
+	id    string                 // of the key that seals
+}
+
+// Keyring holds the keys a store seals its files with. Its keyring is nil
+// while encryption is off.
+type Keyring struct {
+	ring atomic.Pointer[encryptionKeyring]
+}
+
+func (k *Keyring) Enabled() bool {
+	return k.ring.Load() != nil
+}
+
+// parseEncryptionKeys builds a keyring from keys, the sealing one first.
+func parseEncryptionKeys(keys []string) (*encryptionKeyring, error) {
+	ring := &encryptionKeyring{aeads: make(map[string]cipher.AEAD)}
+
+	for _, key := range keys {
+		key = strings.TrimSpace(key)
+		if key == "" || strings.HasPrefix(key, "#") {
+			continue
+		}
+
+		raw, err := hex.DecodeString(key)
+		if err != nil {
+			raw, err = base64.StdEncoding.DecodeString(key)
+		}
+		if err != nil || len(raw) != 32 {
+			return nil, errors.New("keys must be 32 bytes, as 64 hex digits or base64")
+		}
+
+		block, _ := aes.NewCipher(raw)
+		aead, _ := cipher.NewGCM(block)
+
+		sum := sha256.Sum256(raw)
+		id := string(sum[:encryptedKeyIdSize])
+
+		ring.aeads[id] = aead
+		if ring.id == "" {
+			ring.id = id
+		}
+	}
+
+	if ring.id == "" {
+		return nil, nil
+	}
+	return ring, nil
+}
+
+// Load reads -encryption-key-file, or else -encryption-key, and installs
+// the keys. No keys at all turns encryption off.
+func (k *Keyring) Load(cfg Config) error {
+	keys := strings.Split(cfg.EncryptionKey, ",")
+
+	if cfg.EncryptionKeyFile != "" {
+		data, err := os.ReadFile(cfg.EncryptionKeyFile)
+		if err != nil {
+			return err
+		}
+		keys = strings.Split(string(data), "\n")
+	}
+
+	ring, err := parseEncryptionKeys(keys)
+	if err != nil {
+		return err
+	}
+
+	if ring == nil && k.Enabled() {
+		return errors.New("no keys left to read the encrypted files with")
+	}
+
+	k.ring.Store(ring)
+	return nil
+}
+
+// seal encrypts data with the first key as key id, nonce and ciphertext.
+func (ring *encryptionKeyring) seal(data []byte) []byte {
+	aead := ring.aeads[ring.id]
+
+	sealed := make([]byte, 0, encryptedKeyIdSize+aead.NonceSize()+len(data)+aead.Overhead())
+	sealed = append(sealed, ring.id...)
+
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	sealed = append(sealed, nonce...)
+
+	return aead.Seal(sealed, nonce, data, []byte(ring.id))
+}
+
+func (ring *encryptionKeyring) open(sealed []byte) ([]byte, error) {
+	if len(sealed) < encryptedKeyIdSize {
+		return nil, errors.New("encrypted data is cut short")
+	}
+
+	id := string(sealed[:encryptedKeyIdSize])
+	aead, ok := ring.aeads[id]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("encrypted with unknown key %x", id))
+	}
+
+	sealed = sealed[encryptedKeyIdSize:]
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted data is cut short")
+	}
+
+	data, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(id))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("decrypt: %v", err))
+	}
+	return data, nil
+}
+
+// sealFile encrypts the content of a whole file, when encryption is on.
+func (k *Keyring) sealFile(data []byte) []byte {
+	ring := k.ring.Load()
+	if ring == nil {
+		return data
+	}
+
+	return append([]byte(encryptedMagic), ring.seal(data)...)
+}
+
+// openFile returns a file content written by sealFile in the clear.
+func (k *Keyring) openFile(data []byte) ([]byte, error) {
+	sealed, ok := bytes.CutPrefix(data, []byte(encryptedMagic))
+	if !ok {
+		return data, nil
+	}
+
+	ring := k.ring.Load()
+	if ring == nil {
+		return nil, errors.New("file is encrypted but no -encryption-key is set")
+	}
+	return ring.open(sealed)
+}
+
+// sealLine encrypts one line of an append-only file into base64, which
+// holds no newline, when encryption is on.
+func (k *Keyring) sealLine(line []byte) []byte {
+	ring := k.ring.Load()
+	if ring == nil {
+		return line
+	}
+
+	return []byte(base64.StdEncoding.EncodeToString(ring.seal(line)))
+}
+
+// openLine reverses sealLine. Lines of JSON were written in the clear.
+func (k *Keyring) openLine(line []byte) ([]byte, error) {
+	if len(line) > 0 && line[0] == '{' {
+		return line, nil
+	}
+
+	ring := k.ring.Load()
+	if ring == nil {
+		return nil, errors.New("line is encrypted but no -encryption-key is set")
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(string(line))
+	if err != nil {
+		return nil, err
+	}
+	return ring.open(sealed)
+}
+
+// reencrypter is a store whose files can be rewritten with the current key.
+type reencrypter interface {
+	Reencrypt() error
+}
+
+// reencryptDir rewrites every snapshot in dir with the current key of k.
+// It returns how many files it rewrote.
+func (k *Keyring) reencryptDir(dir string) (int, error) {
+	names, _ := filepath.Glob(filepath.Join(dir, "books-*.json"))
+
+	for i, name := range names {
+		data, err := os.ReadFile(name)
+		if err == nil {
+			data, err = k.openFile(data)
+		}
+		if err == nil {
+			err = writeFileAtomic(name, k.sealFile(data))
+		}
+		if err != nil {
+			return i, errors.New(fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+
+	return len(names), nil
+}
+
+// HandleReencrypt rewrites the store's files, the snapshots and the
+// backups with the first key, so a key dropped from the list afterwards is
+// no longer needed. Rotate by
+// putting the new key first, reloading with SIGHUP and then calling
+// POST /admin/reencrypt.
+func (s *Server) HandleReencrypt(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	if store, ok := s.store.(reencrypter); ok {
+		if err := store.Reencrypt(); err != nil {
+			writeError(w, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("Reencrypt failed. %v", err))
+			return
+		}
+	}
+
+	snapshots, err := s.store.Keyring().reencryptDir(s.cfg.SnapshotDir)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("Reencrypt failed. %v", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	body, _ := json.Marshal(map[string]any{"encrypted": s.store.Keyring().Enabled(), "snapshots": snapshots})
+
+	w.Write(body)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// validETagAlgo reports whether algo is a value of -etag-algo.
+func validETagAlgo(algo string) bool {
+	return algo == "fnv" || algo == "sha256"
+}
+
+// ETag is the strong entity tag of the book as stored, a hash of it with
+// algo, a value of -etag-algo. The version is part of what is hashed, so
+// the tag changes on every write and is the same for the same stored book.
+func (b Book) ETag(algo string) string {
+	data, _ := json.Marshal(b)
+
+	if algo == "sha256" {
+		sum := sha256.Sum256(data)
+		return strconv.Quote(hex.EncodeToString(sum[:]))
+	}
+
+	h := fnv.New64a()
+	h.Write(data)
+	return strconv.Quote(hex.EncodeToString(h.Sum(nil)))
+}
+
+// UseETagAlgo makes the etag: conditions of the store compare tags hashed
+// with algo, fnv until set.
+func (s *MemoryStore) UseETagAlgo(algo string) {
+	unlock := s.lock(nil, true)
+	defer unlock()
+
+	s.etagAlgo = algo
+}
+
+// notModified reports whether the If-None-Match header already names the
+// book's current version.
+func (s *Server) notModified(r *http.Request, book Book) bool {
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == book.ETag(s.cfg.ETagAlgo) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleIfMatch turns the If-Match header into a store condition, so the
+// check and the write happen under one lock. It returns "" when the header
+// is absent and reports whether the request may go ahead.
+func handleIfMatch(w http.ResponseWriter, r *http.Request) (string, bool) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" {
+		return "", true
+	}
+
+	if header == "*" {
+		return "exists", true
+	}
+
+	tag, err := strconv.Unquote(header)
+	if err != nil || !strings.HasPrefix(header, `"`) || strings.ContainsAny(tag, `",`) {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("invalid If-Match %s", header))
+		return "", false
+	}
+
+	return "etag:" + tag, true
+}
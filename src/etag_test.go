@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// sendWith is send with one more header.
+func sendWith(t *testing.T, method, url, body, header, value string) (int, http.Header) {
+	t.Helper()
+
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	req.SetBasicAuth("test", "test")
+	if value != "" {
+		req.Header.Set(header, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode, resp.Header
+}
+
+func TestETagAlgos(t *testing.T) {
+	tests := []struct {
+		algo   string
+		digits int // hex digits of a tag
+	}{
+		{algo: "fnv", digits: 16},
+		{algo: "sha256", digits: 64},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.algo, func(t *testing.T) {
+			book := Book{Id: "a", Author: "A", Name: "1", Version: 3}
+
+			tag := book.ETag(tt.algo)
+			if unquoted, err := strconv.Unquote(tag); err != nil || len(unquoted) != tt.digits {
+				t.Fatalf("ETag %s, want %d quoted hex digits", tag, tt.digits)
+			}
+			if again := book.ETag(tt.algo); again != tag {
+				t.Errorf("the same book has ETags %s and %s", tag, again)
+			}
+			for _, changed := range []Book{{Id: "a", Author: "A", Name: "2", Version: 3}, {Id: "a", Author: "A", Name: "1", Version: 4}} {
+				if changed.ETag(tt.algo) == tag {
+					t.Errorf("%+v has the ETag of %+v", changed, book)
+				}
+			}
+
+			cfg := DefaultConfig()
+			cfg.ETagAlgo = tt.algo
+			s, ts := newTestServer(t, WithConfig(cfg))
+			s.store.AddBook(Book{Id: "a", Name: "1"})
+			url := ts.URL + "/book/a"
+
+			_, header := sendWith(t, http.MethodGet, url, "", "", "")
+			current := header.Get("ETag")
+			if current != s.store.FindBookById("a").ETag(tt.algo) {
+				t.Fatalf("GET answered ETag %s, want the stored book's", current)
+			}
+
+			steps := []struct {
+				name, method, header, value string
+				status                      int
+			}{
+				{name: "a read of the current tag", method: http.MethodGet, header: "If-None-Match", value: current, status: http.StatusNotModified},
+				{name: "a read of a weak current tag", method: http.MethodGet, header: "If-None-Match", value: "W/" + current, status: http.StatusNotModified},
+				{name: "a read of another tag", method: http.MethodGet, header: "If-None-Match", value: `"other"`, status: http.StatusOK},
+				{name: "a write over another tag", method: http.MethodPut, header: "If-Match", value: `"other"`, status: http.StatusPreconditionFailed},
+				{name: "a write over a version", method: http.MethodPut, header: "If-Match", value: `"1"`, status: http.StatusPreconditionFailed},
+				{name: "a write over a tag that is not quoted", method: http.MethodPut, header: "If-Match", value: "other", status: http.StatusBadRequest},
+				{name: "a write over the current tag", method: http.MethodPut, header: "If-Match", value: current, status: http.StatusOK},
+				{name: "a write over the tag it replaced", method: http.MethodPut, header: "If-Match", value: current, status: http.StatusPreconditionFailed},
+				{name: "a delete over the tag it replaced", method: http.MethodDelete, header: "If-Match", value: current, status: http.StatusPreconditionFailed},
+			}
+
+			for _, step := range steps {
+				status, _ := sendWith(t, step.method, url, `{"name":"2"}`, step.header, step.value)
+				if status != step.status {
+					t.Errorf("%s = %d, want %d", step.name, status, step.status)
+				}
+			}
+
+			_, header = sendWith(t, http.MethodGet, url, "", "", "")
+			if status, _ := sendWith(t, http.MethodDelete, url, "", "If-Match", header.Get("ETag")); status != http.StatusOK && status != http.StatusNoContent {
+				t.Errorf("a delete over the current tag = %d", status)
+			}
+			if s.store.FindBookById("a") != nil {
+				t.Error("the book is still there after the delete")
+			}
+		})
+	}
+}
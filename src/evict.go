@@ -0,0 +1,111 @@
+package main
+
+import (
+	"math/rand"
+)
+
+// evictionSamples is how many books are compared per eviction. Like Redis,
+// the policy is approximated by sampling rather than by keeping a global
+// order that every read would have to lock.
+const evictionSamples = 16
+
+// Counters returns how many books were evicted and how many reads
+// -verify-reads found corrupt.
+func (s *MemoryStore) Counters() (evicted, corruptReads uint64) {
+	return s.evicted.Load(), s.corruptReads.Load()
+}
+
+// ResetCounters zeroes the counts of Counters.
+func (s *MemoryStore) ResetCounters() {
+	s.evicted.Store(0)
+	s.corruptReads.Store(0)
+}
+
+// StartEviction evicts books in the background whenever writes push the
+// store past maxBytes.
+func (s *MemoryStore) StartEviction(maxBytes int64, policy string) {
+	s.evictions = make(chan struct{}, 1)
+
+	go func() {
+		for range s.evictions {
+			for s.overBytes(maxBytes) && s.evictOne(policy) {
+			}
+		}
+	}()
+}
+
+func (s *MemoryStore) wakeEvictor() {
+	if s.evictions == nil {
+		return
+	}
+
+	select {
+	case s.evictions <- struct{}{}:
+	default:
+	}
+}
+
+func (s *MemoryStore) overBytes(maxBytes int64) bool {
+	keyBytes, valueBytes := s.SizeBytes()
+	return int64(keyBytes+valueBytes) > maxBytes
+}
+
+// evictOne samples books from random shards and evicts the one the policy
+// ranks lowest. It reports whether anything was evicted.
+func (s *MemoryStore) evictOne(policy string) bool {
+	var (
+		victim      string
+		victimShard *shard
+		victimScore int64
+	)
+
+	perShard := max(1, evictionSamples/len(s.shards))
+	start := rand.Intn(len(s.shards))
+	samples := 0
+
+	// map iteration starts at a random book, which makes the samples random
+	for i := 0; i < len(s.shards) && samples < evictionSamples; i++ {
+		sh := s.shards[(start+i)%len(s.shards)]
+
+		sh.mu.RLock()
+		taken := 0
+		for id, e := range sh.books {
+			if taken == perShard {
+				break
+			}
+			taken++
+
+			score := e.used.Load()
+			if policy == "lfu" {
+				score = int64(e.hits.Load())
+			}
+
+			if victimShard == nil || score < victimScore {
+				victim, victimShard, victimScore = id, sh, score
+			}
+		}
+		sh.mu.RUnlock()
+
+		samples += taken
+	}
+
+	if victimShard == nil {
+		return false
+	}
+
+	victimShard.mu.Lock()
+	defer victimShard.mu.Unlock()
+
+	e, ok := victimShard.books[victim]
+	if !ok {
+		return true
+	}
+
+	old := e.book
+	victimShard.remove(victim)
+	s.evicted.Add(1)
+
+	s.watchers.Publish(ChangeEvent{Op: "evict", Id: victim, Old: &old})
+
+	return true
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"container/heap"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// expirySweeper is woken for expiries due before next, the unix nanoseconds
+// it sleeps until.
+type expirySweeper struct {
+	wake chan struct{}
+	next atomic.Int64
+}
+
+// expiry is when the book with id expires, as it was when scheduled. A
+// book written again since leaves a stale expiry behind, which the sweep
+// skips.
+type expiry struct {
+	at time.Time
+	id string
+}
+
+// expiryHeap orders the scheduled expiries of a shard, soonest first.
+type expiryHeap []expiry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x any)        { *h = append(*h, x.(expiry)) }
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// scheduleExpiry adds the expiry of book to the heap of sh and wakes the
+// sweeper when it is due before the sweeper would wake. Once stale
+// expiries make up most of the heap, it is rebuilt from the books. Callers
+// hold the write lock.
+func (sh *shard) scheduleExpiry(book Book) {
+	if book.ExpiresAt == nil {
+		return
+	}
+
+	heap.Push(&sh.expiries, expiry{at: *book.ExpiresAt, id: book.Id})
+
+	if len(sh.expiries) > 2*len(sh.books)+64 {
+		sh.expiries = sh.expiries[:0]
+		for id, e := range sh.books {
+			if e.book.ExpiresAt != nil {
+				sh.expiries = append(sh.expiries, expiry{at: *e.book.ExpiresAt, id: id})
+			}
+		}
+		heap.Init(&sh.expiries)
+	}
+
+	if book.ExpiresAt.UnixNano() < sh.sweeper.next.Load() {
+		select {
+		case sh.sweeper.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// sweepDue expires the books of sh whose expiry has come, in the order
+// they expire, and returns the next expiry, zero when none is scheduled.
+// Callers hold the write lock.
+func (sh *shard) sweepDue(now time.Time) time.Time {
+	for len(sh.expiries) > 0 && !now.Before(sh.expiries[0].at) {
+		due := heap.Pop(&sh.expiries).(expiry)
+
+		if e, ok := sh.books[due.id]; ok && e.book.ExpiresAt != nil && e.book.ExpiresAt.Equal(due.at) {
+			sh.expire(due.id)
+		}
+	}
+
+	if len(sh.expiries) == 0 {
+		return time.Time{}
+	}
+	return sh.expiries[0].at
+}
+
+// SweepExpired drops expired books as they expire. It sleeps until the
+// soonest expiry of any shard, or for at most interval, so the work done
+// is about the books that expire rather than all that are stored.
+func (s *MemoryStore) SweepExpired(interval time.Duration) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-s.sweeper.wake:
+		}
+
+		wait := s.sweepDue(time.Now(), interval)
+		timer.Reset(wait)
+	}
+}
+
+// sweepDue sweeps every shard once and returns how long to sleep before
+// the next expiry, at most interval.
+func (s *MemoryStore) sweepDue(now time.Time, interval time.Duration) time.Duration {
+	// writes meanwhile wake the sweeper for any expiry, as next is not
+	// known yet
+	s.sweeper.next.Store(math.MaxInt64)
+
+	next := now.Add(interval)
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		if at := sh.sweepDue(now); !at.IsZero() && at.Before(next) {
+			next = at
+		}
+		sh.mu.Unlock()
+	}
+
+	s.sweeper.next.Store(next.UnixNano())
+	return max(next.Sub(now), 0)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sqlTablePattern is what a table name of ?format=sql may look like,
+// optionally under a schema, so it needs no quoting.
+var sqlTablePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// exportFormat picks ?format=, jsonl by default, or one of formats.
+func exportFormat(w http.ResponseWriter, r *http.Request, formats ...string) (string, bool) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "jsonl"
+	}
+
+	if format != "jsonl" && !slices.Contains(formats, format) {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("invalid format %q, expected jsonl or %s", format, strings.Join(formats, " or ")))
+		return "", false
+	}
+	return format, true
+}
+
+// tarName is the file of the book with id in ?format=tar: id with every
+// byte but letters, digits, '-', '_' and a '.' after the first byte
+// escaped as %XX, so names stay apart and never leave the archive's
+// directory.
+func tarName(id string) string {
+	var name strings.Builder
+
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '_', c == '.' && i > 0:
+			name.WriteByte(c)
+		default:
+			fmt.Fprintf(&name, "%%%02X", c)
+		}
+	}
+	return name.String()
+}
+
+// sqlString quotes s as a standard SQL string literal, doubling its
+// single quotes. Backslashes and newlines need no escaping there.
+func sqlString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// ExportSnapshot leads a jsonl export of /export: the revision of the store
+// its books were read at, so changes with higher versions follow it.
+type ExportSnapshot struct {
+	SnapshotRevision uint64 `json:"snapshot_revision"`
+}
+
+// HandleExport streams every book outside buckets, one JSON object per
+// line, as CSV rows of id, author and name, as SQL inserts of the id and
+// the JSON object into the table of ?table=, kv by default, or as a tar
+// archive of one file per book holding the JSON object, named by tarName,
+// stopping when the client goes away. The X-Snapshot-Revision header, and
+// in jsonl a leading ExportSnapshot, carry the revision of the store the
+// books were read at.
+func (s *Server) HandleExport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	format, ok := exportFormat(w, r, "csv", "sql", "tar")
+	if !ok {
+		return
+	}
+
+	all, revision, err := s.store.SnapshotBooks(r.Context())
+	if !handleCanceled(w, err) {
+		return
+	}
+
+	s.writeExport(w, r, format, "books", withoutBuckets(all), &ExportSnapshot{SnapshotRevision: revision})
+}
+
+// writeExport streams books as an attachment named <name>.<format>,
+// giving up between two books once the client went away. A snapshot, when
+// not nil, goes into the header and ahead of the books in jsonl.
+func (s *Server) writeExport(w http.ResponseWriter, r *http.Request, format, name string, books []Book, snapshot *ExportSnapshot) {
+	table := r.URL.Query().Get("table")
+	if table == "" {
+		table = "kv"
+	}
+
+	if format == "sql" && !sqlTablePattern.MatchString(table) {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("invalid table %q", table))
+		return
+	}
+
+	defer s.streaming()()
+
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+	case "sql":
+		w.Header().Set("Content-Type", "application/sql")
+	case "tar":
+		w.Header().Set("Content-Type", "application/x-tar")
+	default:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.%s", name, format))
+	if snapshot != nil {
+		w.Header().Set("X-Snapshot-Revision", strconv.FormatUint(snapshot.SnapshotRevision, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+
+	out := bufio.NewWriter(w)
+	writer := csv.NewWriter(out)
+	archive := tar.NewWriter(out)
+
+	if format == "csv" {
+		writer.Write([]string{"id", "author", "name"})
+	}
+	if format == "jsonl" && snapshot != nil {
+		line, _ := json.Marshal(snapshot)
+		out.Write(append(line, '\n'))
+	}
+
+	for _, book := range books {
+		if r.Context().Err() != nil {
+			return
+		}
+
+		switch format {
+		case "csv":
+			writer.Write([]string{book.Id, book.Author, book.Name})
+			writer.Flush()
+		case "sql":
+			value, _ := json.Marshal(book)
+			fmt.Fprintf(out, "INSERT INTO %s (key, value) VALUES (%s, %s);\n", table, sqlString(book.Id), sqlString(string(value)))
+		case "tar":
+			value, _ := json.Marshal(book)
+			archive.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: tarName(book.Id), Mode: 0o644, Size: int64(len(value)), ModTime: book.UpdatedAt})
+			archive.Write(value)
+		default:
+			line, _ := json.Marshal(book)
+			out.Write(append(line, '\n'))
+		}
+	}
+
+	if format == "tar" {
+		archive.Close()
+	}
+	out.Flush()
+}
+
+// HandleImport loads books in the format of /export. With ?mode=merge, the
+// default, they are put next to the stored books; with ?mode=replace every
+// other book outside buckets is deleted. Either way the import is applied
+// all or nothing like a batch, and the books get new versions.
+func (s *Server) HandleImport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	format, ok := exportFormat(w, r, "csv")
+	if !ok {
+		return
+	}
+
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = "merge"
+	}
+
+	if mode != "merge" && mode != "replace" {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("invalid mode %q, expected merge or replace", mode))
+		return
+	}
+
+	w, ok = s.handleFenceToken(w, r)
+	if !ok {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.MaxBodyBytes)
+
+	books, err := readImport(r.Body, format)
+	if err != nil {
+		writeError(w, badBodyStatus(err), "", err.Error())
+		return
+	}
+
+	ops := make([]BatchOp, 0, len(books))
+	for _, book := range books {
+		book.Version = 0
+		ops = append(ops, BatchOp{Op: "put", Book: book})
+	}
+
+	if mode == "replace" {
+		s.handleImportReplace(w, r, ops)
+		return
+	}
+
+	if !s.handleOps(w, r, ops) {
+		return
+	}
+
+	stop := startTiming(r, "store")
+	results, applied := s.store.ApplyBatch(ops)
+	stop()
+
+	if !applied {
+		w.WriteHeader(http.StatusConflict)
+		body, _ := json.Marshal(results)
+
+		w.Write(body)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	body, _ := json.Marshal(map[string]int{"imported": len(books), "deleted": 0})
+
+	w.Write(body)
+}
+
+// handleImportReplace stores the imported books and deletes every other
+// book outside buckets in one store operation, running the hooks on both
+// under its locks as HandleTxn does.
+func (s *Server) handleImportReplace(w http.ResponseWriter, r *http.Request, ops []BatchOp) {
+	if !s.normalizeOps(w, ops) || !s.handleLimits(w, opPuts(ops)...) {
+		return
+	}
+
+	if !s.handleBackup(w) {
+		return
+	}
+
+	books := make([]Book, 0, len(ops))
+	for _, op := range ops {
+		books = append(books, op.Book)
+	}
+
+	stop := startTiming(r, "store")
+	results, err := s.store.ImportBooks(books, inBucket, s.prepareWrites(r))
+	stop()
+
+	if !handleWriteError(w, err) {
+		return
+	}
+
+	deleted := 0
+	for _, result := range results {
+		if result.Op == "delete" {
+			deleted++
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	body, _ := json.Marshal(map[string]int{"imported": len(books), "deleted": deleted})
+
+	w.Write(body)
+}
+
+func readImport(body io.Reader, format string) ([]Book, error) {
+	books := make([]Book, 0)
+
+	if format == "csv" {
+		reader := csv.NewReader(body)
+
+		records, err := reader.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+
+		for i, record := range records {
+			if i == 0 && len(record) > 0 && record[0] == "id" {
+				continue
+			}
+
+			if len(record) != 3 {
+				return nil, errors.New(fmt.Sprintf("line %d: expected id, author and name", i+1))
+			}
+
+			books = append(books, Book{Id: record[0], Author: record[1], Name: record[2]})
+		}
+		return books, nil
+	}
+
+	decoder := json.NewDecoder(body)
+
+	for line := 1; ; line++ {
+		var record json.RawMessage
+
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			return books, nil
+		}
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("record %d: %v", line, err))
+		}
+
+		// the ExportSnapshot leading an export
+		var fields map[string]json.RawMessage
+		if line == 1 && json.Unmarshal(record, &fields) == nil && len(fields) == 1 && fields["snapshot_revision"] != nil {
+			continue
+		}
+
+		var book Book
+		if err := json.Unmarshal(record, &book); err != nil {
+			return nil, errors.New(fmt.Sprintf("record %d: %v", line, err))
+		}
+
+		books = append(books, book)
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// parseSQLInsert reads back a line of ?format=sql, returning the table and
+// the two string literals, or ok false when the line is not such an
+// insert.
+func parseSQLInsert(line string) (table, key, value string, ok bool) {
+	rest, ok := strings.CutPrefix(line, "INSERT INTO ")
+	if !ok {
+		return "", "", "", false
+	}
+	table, rest, ok = strings.Cut(rest, " (key, value) VALUES (")
+	if !ok {
+		return "", "", "", false
+	}
+
+	literals := make([]string, 0, 2)
+	for len(literals) < 2 {
+		if !strings.HasPrefix(rest, "'") {
+			return "", "", "", false
+		}
+
+		var literal strings.Builder
+		i := 1
+		for ; i < len(rest); i++ {
+			if rest[i] != '\'' {
+				literal.WriteByte(rest[i])
+			} else if i+1 < len(rest) && rest[i+1] == '\'' {
+				literal.WriteByte('\'')
+				i++
+			} else {
+				break
+			}
+		}
+		if i == len(rest) {
+			return "", "", "", false
+		}
+		literals = append(literals, literal.String())
+
+		rest = rest[i+1:]
+		if len(literals) == 1 {
+			if rest, ok = strings.CutPrefix(rest, ", "); !ok {
+				return "", "", "", false
+			}
+		}
+	}
+
+	if rest != ");" {
+		return "", "", "", false
+	}
+	return table, literals[0], literals[1], true
+}
+
+func TestExportSQL(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		table  string
+	}{
+		{name: "the default table", query: "", status: http.StatusOK, table: "kv"},
+		{name: "a table", query: "&table=books_v2", status: http.StatusOK, table: "books_v2"},
+		{name: "a table in a schema", query: "&table=archive.books", status: http.StatusOK, table: "archive.books"},
+		{name: "a table needing quotes", query: "&table=kv%3BDROP%20TABLE%20kv", status: http.StatusBadRequest},
+	}
+
+	books := []Book{
+		{Id: "quote's", Author: `O'Brien`, Name: `it's ''doubled'' and "double"`},
+		{Id: "slash", Name: `back\slash \' and a` + "\nnewline and a\ttab"},
+		{Id: "plain", Name: "x"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ts := newTestServer(t)
+			for _, book := range books {
+				s.store.AddBook(book)
+			}
+
+			status, body := send(t, http.MethodGet, ts.URL+"/export?format=sql"+tt.query, "")
+			if status != tt.status {
+				t.Fatalf("status %d %s, want %d", status, body, tt.status)
+			}
+			if status != http.StatusOK {
+				return
+			}
+
+			lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+			if len(lines) != len(books) {
+				t.Fatalf("%d lines, want %d:\n%s", len(lines), len(books), body)
+			}
+
+			for _, line := range lines {
+				table, key, value, ok := parseSQLInsert(line)
+				if !ok {
+					t.Fatalf("cannot parse %q", line)
+				}
+				if table != tt.table {
+					t.Errorf("insert into %s, want %s", table, tt.table)
+				}
+
+				var book Book
+				if err := json.Unmarshal([]byte(value), &book); err != nil {
+					t.Fatalf("value of %s: %v", key, err)
+				}
+
+				stored := s.store.FindBookById(key)
+				if stored == nil || book.Id != key || book.Author != stored.Author || book.Name != stored.Name {
+					t.Errorf("exported %s as %+v, stored %+v", key, book, stored)
+				}
+			}
+		})
+	}
+}
+
+func TestExportTar(t *testing.T) {
+	tests := []struct {
+		id   string
+		file string
+	}{
+		{id: "plain", file: "plain"},
+		{id: "with.dot", file: "with.dot"},
+		{id: "a/b", file: "a%2Fb"},
+		{id: "a%2Fb", file: "a%252Fb"},
+		{id: "../../etc/passwd", file: "%2E.%2F..%2Fetc%2Fpasswd"},
+		{id: "/rooted", file: "%2Frooted"},
+		{id: `back\slash`, file: "back%5Cslash"},
+		{id: "..", file: "%2E."},
+	}
+
+	s, ts := newTestServer(t)
+	for i, tt := range tests {
+		if err := s.store.AddBook(Book{Id: tt.id, Name: fmt.Sprint("value ", i)}); err != nil {
+			t.Fatalf("%s: %v", tt.id, err)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/export?format=tar", nil)
+	req.SetBasicAuth("test", "test")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+
+	files := make(map[string]Book)
+	archive := tar.NewReader(resp.Body)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if clean := path.Clean(header.Name); clean != header.Name || strings.Contains(clean, "/") || clean == ".." {
+			t.Errorf("file %q is not a plain name", header.Name)
+		}
+
+		var book Book
+		if err := json.NewDecoder(archive).Decode(&book); err != nil {
+			t.Fatalf("%s: %v", header.Name, err)
+		}
+		files[header.Name] = book
+	}
+
+	if len(files) != len(tests) {
+		t.Errorf("%d files, want %d", len(files), len(tests))
+	}
+	for i, tt := range tests {
+		book, ok := files[tt.file]
+		if !ok || book.Id != tt.id || book.Name != fmt.Sprint("value ", i) {
+			t.Errorf("file %s holds %+v, want %s", tt.file, book, tt.id)
+		}
+	}
+}
+
+// cancelingWriter is a ResponseWriter that goes away, cancelling the
+// request, once it took its first bytes.
+type cancelingWriter struct {
+	header  http.Header
+	written int
+	cancel  func()
+}
+
+func (cw *cancelingWriter) Header() http.Header { return cw.header }
+func (cw *cancelingWriter) WriteHeader(int)     {}
+
+func (cw *cancelingWriter) Write(p []byte) (int, error) {
+	cw.written += len(p)
+	cw.cancel()
+	return len(p), nil
+}
+
+func TestExportStopsWhenTheClientGoesAway(t *testing.T) {
+	s, _ := newTestServer(t)
+	for i := range 5000 {
+		s.store.AddBook(Book{Id: fmt.Sprint("book-", i), Name: strings.Repeat("x", 100)})
+	}
+
+	for _, format := range []string{"jsonl", "csv", "sql", "tar"} {
+		t.Run(format, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(t.Context())
+			defer cancel()
+
+			req := httptest.NewRequestWithContext(ctx, http.MethodGet, "/export?format="+format, nil)
+			req.SetBasicAuth("test", "test")
+			cw := &cancelingWriter{header: make(http.Header), cancel: cancel}
+
+			s.ServeHTTP(cw, req)
+
+			if cw.written == 0 || cw.written > 64<<10 {
+				t.Errorf("wrote %d bytes of about %d before stopping", cw.written, 5000*100)
+			}
+			if n := s.openStreams.Load(); n != 0 {
+				t.Errorf("%d streams still open", n)
+			}
+		})
+	}
+}
+
+func TestStreamsCloseWhenTheClientGoesAway(t *testing.T) {
+	for _, path := range []string{"/watch?prefix=a", "/subscribe/news", "/replication/stream"} {
+		t.Run(path, func(t *testing.T) {
+			s, ts := newTestServer(t)
+
+			ctx, cancel := context.WithCancel(t.Context())
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+path, nil)
+			req.SetBasicAuth("test", "test")
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status %d", resp.StatusCode)
+			}
+			if n := s.openStreams.Load(); n != 1 {
+				t.Errorf("%d streams open while streaming, want 1", n)
+			}
+
+			cancel()
+			resp.Body.Close()
+
+			deadline := time.Now().Add(5 * time.Second)
+			for s.openStreams.Load() != 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("the stream is still open after the client went away")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestExportSnapshotRevision(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		lead   bool // whether a snapshot record leads the books
+	}{
+		{name: "jsonl", format: "jsonl", lead: true},
+		{name: "csv", format: "csv"},
+		{name: "sql", format: "sql"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ts := newTestServer(t)
+			s.store.AddBook(Book{Id: "a", Name: "1"})
+			s.store.AddBook(Book{Id: "b", Name: "2"})
+			s.store.SetBook(Book{Id: "a", Name: "3"})
+			revision := s.store.FindBookById("a").Version
+
+			req, _ := http.NewRequest(http.MethodGet, ts.URL+"/export?format="+tt.format, nil)
+			req.SetBasicAuth("test", "test")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if header := resp.Header.Get("X-Snapshot-Revision"); header != fmt.Sprint(revision) {
+				t.Errorf("X-Snapshot-Revision %q, want %d", header, revision)
+			}
+
+			first, _, _ := strings.Cut(string(data), "\n")
+			if want := fmt.Sprintf(`{"snapshot_revision":%d}`, revision); (first == want) != tt.lead {
+				t.Errorf("first line %s, want a lead of %s is %v", first, want, tt.lead)
+			}
+
+			// a change after the export has a higher version
+			s.store.SetBook(Book{Id: "b", Name: "4"})
+			if version := s.store.FindBookById("b").Version; version <= revision {
+				t.Errorf("a later write got version %d, not above %d", version, revision)
+			}
+
+			if tt.format != "jsonl" {
+				return
+			}
+
+			books, err := readImport(strings.NewReader(string(data)), "jsonl")
+			if err != nil || len(books) != 2 {
+				t.Errorf("reimported %d books, error %v, want the two books", len(books), err)
+			}
+		})
+	}
+}
+
+func TestExportSnapshotIsConsistent(t *testing.T) {
+	s, ts := newTestServer(t)
+	for i := range 100 {
+		s.store.AddBook(Book{Id: fmt.Sprint("book-", i), Name: "0"})
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+				s.store.SetBook(Book{Id: fmt.Sprint("book-", i%100), Name: fmt.Sprint(i)})
+			}
+		}
+	}()
+
+	for range 20 {
+		_, body := send(t, http.MethodGet, ts.URL+"/export", "")
+		lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+
+		var snapshot ExportSnapshot
+		if err := json.Unmarshal([]byte(lines[0]), &snapshot); err != nil {
+			t.Fatal(err)
+		}
+
+		highest := uint64(0)
+		for _, line := range lines[1:] {
+			var book Book
+			if err := json.Unmarshal([]byte(line), &book); err != nil {
+				t.Fatal(err)
+			}
+			highest = max(highest, book.Version)
+		}
+		if highest != snapshot.SnapshotRevision {
+			t.Fatalf("books up to version %d in an export of revision %d", highest, snapshot.SnapshotRevision)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// failoverProbeInterval is how often a standby asks the primary for its
+// health.
+const failoverProbeInterval = time.Second
+
+// termId is the book holding the failover term. Like locks it lives under
+// an id no bucket name can produce, so it persists and replicates with the
+// books but stays out of every listing.
+const termId = bucketIdPrefix + "#cluster/term"
+
+// clusterTerm is the failover term of the store. Every promotion raises
+// it, replicas learn it with the books, and a replica refuses the stream
+// of a primary in an earlier term than it has seen.
+func (s *Server) clusterTerm() uint64 {
+	return bookTerm(s.store.FindBookById(termId))
+}
+
+func (s *Server) setClusterTerm(term uint64) {
+	if _, ok := s.store.ApplyBatch([]BatchOp{{Op: "put", Book: Book{Id: termId, Name: strconv.FormatUint(term, 10)}}}); !ok {
+		log.Printf("failover: storing term %d failed", term)
+	}
+}
+
+func bookTerm(book *Book) uint64 {
+	if book == nil {
+		return 0
+	}
+	term, _ := strconv.ParseUint(book.Name, 10, 64)
+	return term
+}
+
+// snapshotTerm is the term of a replication snapshot.
+func snapshotTerm(books []Book) uint64 {
+	for _, book := range books {
+		if book.Id == termId {
+			return bookTerm(&book)
+		}
+	}
+	return 0
+}
+
+// clusterMembers are the members a server can ask about the primary: the
+// ones -peers finds, and the primary -replica-of names.
+func (s *Server) clusterMembers() []string {
+	members := make([]string, 0)
+	if s.cfg.PeersSpec != "" {
+		if peers, err := s.cfg.discoverPeers(); err == nil {
+			members = append(members, peers...)
+		}
+	}
+	if s.cfg.ReplicaOf != "" && s.cfg.ReplicaOf != discoveredPeers && !slices.Contains(members, s.cfg.ReplicaOf) {
+		members = append(members, s.cfg.ReplicaOf)
+	}
+	return members
+}
+
+// claimedPrimary probes the members and returns the one that is ready and
+// primary, if any, and the highest term any of them reported. The server
+// itself passes as it is still a replica or fenced when it asks.
+func (s *Server) claimedPrimary() (*ProxyMember, uint64) {
+	client := &http.Client{Timeout: failoverProbeInterval}
+
+	var claim *ProxyMember
+	var highest uint64
+
+	for _, base := range s.clusterMembers() {
+		member := probeMember(client, base)
+		highest = max(highest, member.Term)
+
+		if member.Ready && member.Role == "primary" && (claim == nil || member.Term > claim.Term) {
+			claim = &member
+		}
+	}
+	return claim, highest
+}
+
+// watchTerm fences a primary once another member is primary in a later
+// term, as when it comes back after a standby took over. It looks every
+// -peers-interval.
+func (s *Server) watchTerm() {
+	tick := time.NewTicker(s.cfg.PeersInterval)
+	defer tick.Stop()
+
+	for range tick.C {
+		if s.replicating.Load() || s.fenced.Load() {
+			continue
+		}
+
+		if claim, _ := s.claimedPrimary(); claim != nil && claim.Term > s.clusterTerm() {
+			s.fenced.Store(true)
+			log.Printf("failover: %s is primary at term %d, after this server's term %d; refusing writes", claim.URL, claim.Term, s.clusterTerm())
+		}
+	}
+}
+
+// primaryHealthy reports whether primary is up and still primary. For
+// -replica-of peers any ready primary among the members will do.
+func (s *Server) primaryHealthy(client *http.Client, primary string) bool {
+	if primary == discoveredPeers {
+		_, err := s.cfg.discoverPrimary()
+		return err == nil
+	}
+
+	member := probeMember(client, primary)
+	return member.Ready && member.Role == "primary"
+}
+
+// watchPrimary probes the primary on /readyz while the server is a
+// standby and promotes it once the primary has been down for
+// -failover-after. The clock starts only after the primary has been seen
+// healthy, so a standby started before its primary waits for it. The
+// promotion waits while another member claims primary, and the old
+// primary, should it come back, fences itself on finding a later term;
+// -failover-command can still move traffic off it meanwhile.
+func (s *Server) watchPrimary(primary string) {
+	client := &http.Client{Timeout: failoverProbeInterval}
+
+	tick := time.NewTicker(failoverProbeInterval)
+	defer tick.Stop()
+
+	var seen bool
+	var downSince time.Time
+
+	for {
+		select {
+		case <-s.promoted.Done():
+			return
+		case <-tick.C:
+		}
+
+		if s.primaryHealthy(client, primary) {
+			if !downSince.IsZero() {
+				log.Printf("failover: primary %s is back", primary)
+			}
+			seen, downSince = true, time.Time{}
+			continue
+		}
+
+		if !seen {
+			continue
+		}
+
+		now := time.Now()
+		if downSince.IsZero() {
+			log.Printf("failover: primary %s is down, taking over in %v", primary, s.cfg.FailoverAfter)
+			downSince = now
+		}
+
+		if now.Sub(downSince) < s.cfg.FailoverAfter {
+			continue
+		}
+
+		err := s.promoteReplica("primary " + primary + " down for " + now.Sub(downSince).Round(time.Second).String())
+		if err == nil {
+			s.runFailoverCommand(primary)
+		}
+		if err == nil || errors.Is(err, errNotReplica) {
+			return
+		}
+
+		log.Printf("failover: not taking over: %v", err)
+		downSince = time.Time{}
+	}
+}
+
+// runFailoverCommand runs -failover-command after a takeover, for up to a
+// minute.
+func (s *Server) runFailoverCommand(primary string) {
+	if s.cfg.FailoverCommand == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", s.cfg.FailoverCommand)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), "BOOKS_ADDR="+s.cfg.Addr, "BOOKS_PRIMARY="+primary)
+
+	if err := cmd.Run(); err != nil {
+		log.Printf("failover: -failover-command: %v", err)
+		return
+	}
+	log.Printf("failover: -failover-command done")
+}
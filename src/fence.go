@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// raiseFenceToken makes token the highest one seen unless a higher one
+// already is.
+func raiseFenceToken(highest *atomic.Uint64, token uint64) {
+	for {
+		seen := highest.Load()
+		if token <= seen || highest.CompareAndSwap(seen, token) {
+			return
+		}
+	}
+}
+
+// fenceWriter raises the highest fence token to its own once the write it
+// answers succeeds, so a rejected write leaves the fence where it was.
+type fenceWriter struct {
+	http.ResponseWriter
+	highest     *atomic.Uint64
+	token       uint64
+	wroteHeader bool
+}
+
+func (fw *fenceWriter) WriteHeader(status int) {
+	if !fw.wroteHeader {
+		fw.wroteHeader = true
+		if status >= 200 && status < 300 {
+			raiseFenceToken(fw.highest, fw.token)
+		}
+	}
+	fw.ResponseWriter.WriteHeader(status)
+}
+
+func (fw *fenceWriter) Write(b []byte) (int, error) {
+	if !fw.wroteHeader {
+		fw.WriteHeader(http.StatusOK)
+	}
+	return fw.ResponseWriter.Write(b)
+}
+
+func (fw *fenceWriter) Unwrap() http.ResponseWriter {
+	return fw.ResponseWriter
+}
+
+// handleFenceToken rejects writes whose X-Fence-Token is older than the
+// highest one seen, so a deposed leader cannot overwrite newer state.
+// Reads and writes without the header are not fenced. It reports whether
+// the request may go ahead and returns the writer to answer it on, which
+// raises the highest token when the write succeeds.
+func (s *Server) handleFenceToken(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, bool) {
+	header := r.Header.Get("X-Fence-Token")
+	if header == "" || !isWriteMethod(r.Method) {
+		return w, true
+	}
+
+	token, err := strconv.ParseUint(header, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("invalid X-Fence-Token %s", header))
+		return w, false
+	}
+
+	if highest := s.highestFenceToken.Load(); token < highest {
+		writeError(w, http.StatusConflict, CodeStaleFenceToken, fmt.Sprintf("Fence token %d is older than %d", token, highest))
+		return w, false
+	}
+
+	return &fenceWriter{ResponseWriter: w, highest: &s.highestFenceToken, token: token}, true
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"cmp"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFenceTokens(t *testing.T) {
+	type write struct {
+		token  string // X-Fence-Token, none when empty
+		method string // PUT when empty
+		body   string // a valid book when empty
+		status int
+	}
+
+	tests := []struct {
+		name   string
+		writes []write
+	}{
+		{name: "a first token", writes: []write{{token: "5", status: 200}}},
+		{name: "a higher token", writes: []write{{token: "5", status: 200}, {token: "6", status: 200}}},
+		{name: "the same token", writes: []write{{token: "5", status: 200}, {token: "5", status: 200}}},
+		{name: "a lower token after a higher one", writes: []write{{token: "5", status: 200}, {token: "9", status: 200}, {token: "7", status: 409}}},
+		{name: "a stale token does not lower the highest", writes: []write{{token: "9", status: 200}, {token: "3", status: 409}, {token: "8", status: 409}}},
+		{name: "writes without a token are not fenced", writes: []write{{token: "9", status: 200}, {token: "", status: 200}}},
+		{name: "a token that is not a number", writes: []write{{token: "five", status: 400}}},
+		{name: "a rejected write does not raise the token", writes: []write{{token: "5", status: 200}, {token: "9", body: "{", status: 400}, {token: "7", status: 200}}},
+		{name: "a read does not raise the token", writes: []write{{token: "5", status: 200}, {token: "9", method: "HEAD", status: 200}, {token: "7", status: 200}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ts := newTestServer(t)
+			s.store.AddBook(Book{Id: "c", Name: "0"})
+
+			for i, write := range tt.writes {
+				method, body := cmp.Or(write.method, http.MethodPut), cmp.Or(write.body, `{"name":"x"}`)
+
+				req, _ := http.NewRequest(method, ts.URL+"/book/c", strings.NewReader(body))
+				req.SetBasicAuth("test", "test")
+				if write.token != "" {
+					req.Header.Set("X-Fence-Token", write.token)
+				}
+
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+
+				if resp.StatusCode != write.status {
+					t.Errorf("write %d with token %q = %d, want %d", i, write.token, resp.StatusCode, write.status)
+				}
+			}
+		})
+	}
+}
+
+func TestRaiseFenceTokenConcurrently(t *testing.T) {
+	var highest atomic.Uint64
+
+	var wg sync.WaitGroup
+	for token := uint64(1); token <= 1000; token++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			raiseFenceToken(&highest, token)
+		}()
+	}
+	wg.Wait()
+
+	if got := highest.Load(); got != 1000 {
+		t.Errorf("highest token %d, want 1000", got)
+	}
+	if raiseFenceToken(&highest, 999); highest.Load() != 1000 {
+		t.Error("a lower token lowered the highest")
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FileStore is a MemoryStore that periodically writes its books to a JSON
+// file and loads them back on startup.
+type FileStore struct {
+	*MemoryStore
+
+	path    string
+	dirty   atomic.Bool
+	flushMu sync.Mutex
+}
+
+func NewFileStore(path string, memory *MemoryStore) (*FileStore, error) {
+	fs := &FileStore{MemoryStore: memory, path: path}
+
+	books, err := readStoredBooks(memory.Keyring(), path)
+	if os.IsNotExist(err) {
+		return fs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	memory.ReplaceBooks(books)
+
+	return fs, nil
+}
+
+// Flush writes the books to the data file if anything changed since the
+// last flush. The file is replaced atomically so a crash never leaves it
+// half written.
+func (fs *FileStore) Flush() error {
+	fs.flushMu.Lock()
+	defer fs.flushMu.Unlock()
+
+	if !fs.dirty.Swap(false) {
+		return nil
+	}
+
+	books, _ := fs.GetBooks(context.Background())
+	data, _ := json.Marshal(storedBooks(books))
+
+	err := writeFileAtomic(fs.path, fs.keys.sealFile(data))
+	if err != nil {
+		fs.dirty.Store(true)
+	}
+
+	return err
+}
+
+// VerifyFiles checks the checksums of the books in the data file.
+func (fs *FileStore) VerifyFiles() ([]CorruptEntry, error) {
+	fs.flushMu.Lock()
+	defer fs.flushMu.Unlock()
+
+	data, err := os.ReadFile(fs.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err == nil {
+		data, err = fs.keys.openFile(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, corrupt, err := loadStoredBooks(fs.path, data)
+	if err != nil {
+		return []CorruptEntry{{Source: fs.path, Error: err.Error()}}, nil
+	}
+	return corrupt, nil
+}
+
+// Reencrypt rewrites the data file with the current encryption key.
+func (fs *FileStore) Reencrypt() error {
+	fs.dirty.Store(true)
+	return fs.Flush()
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it into place.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
+
+// Check verifies the directory holding the data file is still there.
+func (fs *FileStore) Check() error {
+	_, err := os.Stat(filepath.Dir(fs.path))
+	return err
+}
+
+func (fs *FileStore) Close() error {
+	return fs.Flush()
+}
+
+func (fs *FileStore) FlushEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := fs.Flush(); err != nil {
+			log.Printf("flush %s: %v", fs.path, err)
+		}
+	}
+}
+
+func (fs *FileStore) AddBook(book Book) error {
+	err := fs.MemoryStore.AddBook(book)
+	if err == nil {
+		fs.dirty.Store(true)
+	}
+	return err
+}
+
+func (fs *FileStore) SetBook(book Book) error {
+	err := fs.MemoryStore.SetBook(book)
+	if err == nil {
+		fs.dirty.Store(true)
+	}
+	return err
+}
+
+func (fs *FileStore) SetBookIf(book Book, cond string) error {
+	err := fs.MemoryStore.SetBookIf(book, cond)
+	if err == nil {
+		fs.dirty.Store(true)
+	}
+	return err
+}
+
+func (fs *FileStore) SwapBook(old Book, book Book) error {
+	err := fs.MemoryStore.SwapBook(old, book)
+	if err == nil {
+		fs.dirty.Store(true)
+	}
+	return err
+}
+
+func (fs *FileStore) RestoreBook(id string, prepare func(book *Book) error) error {
+	err := fs.MemoryStore.RestoreBook(id, prepare)
+	if err == nil {
+		fs.dirty.Store(true)
+	}
+	return err
+}
+
+func (fs *FileStore) DelBook(id string) error {
+	err := fs.MemoryStore.DelBook(id)
+	if err == nil {
+		fs.dirty.Store(true)
+	}
+	return err
+}
+
+func (fs *FileStore) DelBookIf(id string, cond string) error {
+	err := fs.MemoryStore.DelBookIf(id, cond)
+	if err == nil {
+		fs.dirty.Store(true)
+	}
+	return err
+}
+
+func (fs *FileStore) ApplyBatch(ops []BatchOp) ([]BatchResult, bool) {
+	results, applied := fs.MemoryStore.ApplyBatch(ops)
+	if applied {
+		fs.dirty.Store(true)
+	}
+	return results, applied
+}
+
+func (fs *FileStore) Txn(compare []TxnCompare, success, failure []BatchOp, prepare func(writes []*BatchOp) error) (bool, []BatchResult, error) {
+	succeeded, results, err := fs.MemoryStore.Txn(compare, success, failure, prepare)
+	if err == nil {
+		fs.dirty.Store(true)
+	}
+	return succeeded, results, err
+}
+
+func (fs *FileStore) ImportBooks(books []Book, keep func(id string) bool, prepare func(writes []*BatchOp) error) ([]BatchResult, error) {
+	results, err := fs.MemoryStore.ImportBooks(books, keep, prepare)
+	if err == nil {
+		fs.dirty.Store(true)
+	}
+	return results, err
+}
+
+func (fs *FileStore) ApplyChange(event ChangeEvent) {
+	fs.MemoryStore.ApplyChange(event)
+	fs.dirty.Store(true)
+}
+
+func (fs *FileStore) DrainBooks(ids []string, prepare func(ids []string) error) ([]Book, error) {
+	drained, err := fs.MemoryStore.DrainBooks(ids, prepare)
+	if len(drained) > 0 {
+		fs.dirty.Store(true)
+	}
+	return drained, err
+}
+
+func (fs *FileStore) ReplaceBooks(books []Book) {
+	fs.MemoryStore.ReplaceBooks(books)
+	fs.dirty.Store(true)
+}
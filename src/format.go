@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var formatContentTypes = map[string]string{
+	"json":     "application/json",
+	"text":     "text/plain",
+	"csv":      "text/csv",
+	"msgpack":  "application/msgpack",
+	"protobuf": "application/protobuf",
+}
+
+// mediaTypeAliases are the older names clients still send.
+var mediaTypeAliases = map[string]string{
+	"application/x-msgpack":  "application/msgpack",
+	"application/x-protobuf": "application/protobuf",
+}
+
+// mediaType returns the media type of a Content-Type or Accept entry,
+// without parameters and aliases.
+func mediaType(value string) string {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.SplitN(value, ";", 2)[0]))
+	if alias, ok := mediaTypeAliases[mediaType]; ok {
+		return alias
+	}
+	return mediaType
+}
+
+func isBinaryFormat(format string) bool {
+	return format == "msgpack" || format == "protobuf"
+}
+
+// negotiateFormat picks the first format named in the Accept header, falling
+// back to -default-format.
+func (s *Server) negotiateFormat(r *http.Request) string {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType := mediaType(accept)
+
+		for format, contentType := range formatContentTypes {
+			if mediaType == contentType {
+				return format
+			}
+		}
+	}
+
+	return s.cfg.DefaultFormat
+}
+
+// renderBooks encodes books in the given format and returns the body with
+// its content type.
+func renderBooks(format string, books []Book) ([]byte, string) {
+	switch format {
+	case "text":
+		var buf bytes.Buffer
+		for _, book := range books {
+			fmt.Fprintf(&buf, "%s\t%s\t%s\n", book.Id, book.Author, book.Name)
+		}
+		return buf.Bytes(), formatContentTypes[format]
+
+	case "csv":
+		var buf bytes.Buffer
+		writer := csv.NewWriter(&buf)
+		writer.Write([]string{"id", "author", "name"})
+		for _, book := range books {
+			writer.Write([]string{book.Id, book.Author, book.Name})
+		}
+		writer.Flush()
+		return buf.Bytes(), formatContentTypes[format]
+
+	case "msgpack":
+		return msgpackBooks(books), formatContentTypes[format]
+
+	case "protobuf":
+		return protobufBooks(books), formatContentTypes[format]
+	}
+
+	body, _ := json.Marshal(books)
+	return body, formatContentTypes["json"]
+}
+
+func renderBook(format string, book Book) ([]byte, string) {
+	switch format {
+	case "json":
+		body, _ := json.Marshal(book)
+		return body, formatContentTypes[format]
+
+	case "msgpack":
+		return appendMsgpackBook(nil, book), formatContentTypes[format]
+
+	case "protobuf":
+		return appendProtoBook(nil, book), formatContentTypes[format]
+	}
+
+	return renderBooks(format, []Book{book})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDefaultFormat(t *testing.T) {
+	tests := []struct {
+		name          string
+		defaultFormat string
+		accept        string
+		contentType   string
+		contains      string
+	}{
+		{name: "json without Accept", defaultFormat: "json", accept: "", contentType: "application/json", contains: `"id":"a"`},
+		{name: "text without Accept", defaultFormat: "text", accept: "", contentType: "text/plain", contains: "a\tA\t1"},
+		{name: "csv without Accept", defaultFormat: "csv", accept: "", contentType: "text/csv", contains: "a,A,1"},
+		{name: "the default for */*", defaultFormat: "text", accept: "*/*", contentType: "text/plain", contains: "a\tA\t1"},
+		{name: "the default for an unknown type", defaultFormat: "csv", accept: "application/xml", contentType: "text/csv"},
+		{name: "Accept overrides the default", defaultFormat: "text", accept: "application/json", contentType: "application/json", contains: `"id":"a"`},
+		{name: "the first known type of Accept", defaultFormat: "json", accept: "application/xml, text/csv;q=0.9, text/plain", contentType: "text/csv"},
+		{name: "an alias", defaultFormat: "json", accept: "application/x-msgpack", contentType: "application/msgpack"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.DefaultFormat = tt.defaultFormat
+
+			s, ts := newTestServer(t, WithConfig(cfg))
+			s.store.AddBook(Book{Id: "a", Author: "A", Name: "1"})
+
+			req, _ := http.NewRequest(http.MethodGet, ts.URL+"/books/", nil)
+			req.SetBasicAuth("test", "test")
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+
+			if got := mediaType(resp.Header.Get("Content-Type")); got != tt.contentType {
+				t.Errorf("Content-Type %s, want %s", got, tt.contentType)
+			}
+			if !strings.Contains(string(body), tt.contains) {
+				t.Errorf("body %q, want it to contain %q", body, tt.contains)
+			}
+		})
+	}
+}
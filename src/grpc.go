@@ -0,0 +1,573 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// The messages of books.proto that are not books. Book, []Book for Books
+// and ChangeEvent stand for the others.
+type (
+	GRPCGetRequest struct {
+		Id string
+	}
+
+	GRPCDeleteRequest struct {
+		Id      string
+		Version uint64
+	}
+
+	GRPCListRequest struct {
+		Prefix string
+	}
+
+	GRPCWatchRequest struct {
+		Id     string
+		Prefix string
+	}
+
+	GRPCEmpty struct{}
+)
+
+// grpcCodec encodes the messages of books.proto with the protobuf encoding
+// of protobuf.go, so the service needs no generated code. It serves both
+// ends of a call.
+type grpcCodec struct{}
+
+func (grpcCodec) Name() string {
+	return "proto"
+}
+
+func (grpcCodec) Marshal(v any) ([]byte, error) {
+	switch m := v.(type) {
+	case *Book:
+		return appendProtoBook(nil, *m), nil
+	case *[]Book:
+		return protobufBooks(*m), nil
+	case *ChangeEvent:
+		return appendProtoEvent(nil, *m), nil
+	case *GRPCGetRequest:
+		return appendProtoString(nil, 1, m.Id), nil
+	case *GRPCDeleteRequest:
+		return appendProtoVarint(appendProtoString(nil, 1, m.Id), 2, m.Version), nil
+	case *GRPCListRequest:
+		return appendProtoString(nil, 1, m.Prefix), nil
+	case *GRPCWatchRequest:
+		return appendProtoString(appendProtoString(nil, 1, m.Id), 2, m.Prefix), nil
+	case *GRPCEmpty:
+		return []byte{}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("no protobuf encoding for %T", v))
+}
+
+func (grpcCodec) Unmarshal(data []byte, v any) error {
+	var err error
+
+	switch m := v.(type) {
+	case *Book:
+		*m, err = decodeProtoBook(data)
+	case *[]Book:
+		*m, err = decodeProtoBooks(data)
+	case *ChangeEvent:
+		*m, err = decodeProtoEvent(data)
+	case *GRPCGetRequest:
+		err = decodeProtoStrings(data, &m.Id)
+	case *GRPCDeleteRequest:
+		err = protoFields(data, func(field, wire int, v uint64, b []byte) error {
+			var err error
+			switch field {
+			case 1:
+				m.Id, err = protoString(field, b)
+			case 2:
+				m.Version = v
+			}
+			return err
+		})
+	case *GRPCListRequest:
+		err = decodeProtoStrings(data, &m.Prefix)
+	case *GRPCWatchRequest:
+		err = decodeProtoStrings(data, &m.Id, &m.Prefix)
+	case *GRPCEmpty:
+	default:
+		err = errors.New(fmt.Sprintf("no protobuf decoding for %T", v))
+	}
+	return err
+}
+
+func appendProtoEvent(b []byte, event ChangeEvent) []byte {
+	b = appendProtoString(b, 1, event.Op)
+	b = appendProtoString(b, 2, event.Id)
+	if event.Old != nil {
+		b = appendProtoBytes(b, 3, appendProtoBook(nil, *event.Old))
+	}
+	if event.New != nil {
+		b = appendProtoBytes(b, 4, appendProtoBook(nil, *event.New))
+	}
+	return b
+}
+
+func decodeProtoEvent(data []byte) (ChangeEvent, error) {
+	var event ChangeEvent
+
+	err := protoFields(data, func(field, wire int, v uint64, b []byte) error {
+		var err error
+		switch field {
+		case 1:
+			event.Op, err = protoString(field, b)
+		case 2:
+			event.Id, err = protoString(field, b)
+		case 3, 4:
+			var book Book
+			book, err = decodeProtoBook(b)
+			if field == 3 {
+				event.Old = &book
+			} else {
+				event.New = &book
+			}
+		}
+		return err
+	})
+
+	return event, err
+}
+
+func decodeProtoBooks(data []byte) ([]Book, error) {
+	books := make([]Book, 0)
+
+	err := protoFields(data, func(field, wire int, v uint64, b []byte) error {
+		if field != 1 {
+			return nil
+		}
+
+		book, err := decodeProtoBook(b)
+		books = append(books, book)
+		return err
+	})
+
+	return books, err
+}
+
+// decodeProtoStrings decodes a message of string fields numbered from 1,
+// in the order of fields.
+func decodeProtoStrings(data []byte, fields ...*string) error {
+	return protoFields(data, func(field, wire int, v uint64, b []byte) error {
+		if field < 1 || field > len(fields) {
+			return nil
+		}
+
+		var err error
+		*fields[field-1], err = protoString(field, b)
+		return err
+	})
+}
+
+// grpcUnary describes a unary method of the service, run by call.
+func grpcUnary[Req any](name string, call func(s *Server, ctx context.Context, req *Req) (any, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			req := new(Req)
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+
+			handler := func(ctx context.Context, req any) (any, error) {
+				return call(srv.(*Server), ctx, req.(*Req))
+			}
+			if interceptor == nil {
+				return handler(ctx, req)
+			}
+			return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/books.Books/" + name}, handler)
+		},
+	}
+}
+
+// grpcBooksService is the Books service of books.proto, as protoc would
+// generate it.
+var grpcBooksService = grpc.ServiceDesc{
+	ServiceName: "books.Books",
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{
+		grpcUnary("Get", (*Server).grpcGet),
+		grpcUnary("Put", (*Server).grpcPut),
+		grpcUnary("Delete", (*Server).grpcDelete),
+		grpcUnary("List", (*Server).grpcList),
+	},
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Watch",
+		ServerStreams: true,
+		Handler: func(srv any, stream grpc.ServerStream) error {
+			req := new(GRPCWatchRequest)
+			if err := stream.RecvMsg(req); err != nil {
+				return err
+			}
+			return srv.(*Server).grpcWatch(req, stream)
+		},
+	}},
+	Metadata: "books.proto",
+}
+
+// newGRPCServer returns a gRPC server with the Books service of s.
+// Messages are bounded by -max-body-bytes, as request bodies are, and
+// calls use the certificate of -tls-cert as HTTP does.
+func newGRPCServer(s *Server) (*grpc.Server, error) {
+	opts := []grpc.ServerOption{
+		grpc.ForceServerCodec(grpcCodec{}),
+		grpc.MaxRecvMsgSize(int(s.cfg.MaxBodyBytes)),
+		grpc.ChainUnaryInterceptor(grpcRecoverUnary, s.grpcAuditUnary),
+		grpc.StreamInterceptor(grpcRecoverStream),
+	}
+
+	if s.cfg.tlsEnabled() {
+		config, err := s.cfg.serverTLSConfig(&s.tls)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(config)))
+	}
+
+	gs := grpc.NewServer(opts...)
+	gs.RegisterService(&grpcBooksService, s)
+
+	return gs, nil
+}
+
+// serveGRPC serves the Books service of s on addr.
+func serveGRPC(s *Server, addr string) (*grpc.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	gs, err := newGRPCServer(s)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	go gs.Serve(ln)
+
+	log.Printf("Serving grpc on %s", ln.Addr())
+
+	return gs, nil
+}
+
+// grpcRecoverUnary and grpcRecoverStream log a panic of a call and fail
+// it, as Recover does for HTTP requests.
+func grpcRecoverUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("panic serving grpc %s: %v", info.FullMethod, p)
+			err = status.Error(codes.Internal, "internal server error")
+		}
+	}()
+
+	return handler(ctx, req)
+}
+
+func grpcRecoverStream(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("panic serving grpc %s: %v", info.FullMethod, p)
+			err = status.Error(codes.Internal, "internal server error")
+		}
+	}()
+
+	return handler(srv, stream)
+}
+
+// grpcCallRequest is the request of a call to method, with the credentials
+// of its metadata.
+func grpcCallRequest(ctx context.Context, method string) *http.Request {
+	r := (&http.Request{
+		Method: strings.ToUpper(method),
+		URL:    &url.URL{Path: "/"},
+		Proto:  "grpc",
+		Header: http.Header{"X-Book-Protocol": {"grpc"}},
+	}).WithContext(ctx)
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, name := range []string{"Authorization", "X-API-Key"} {
+		if values := md.Get(name); len(values) > 0 {
+			r.Header.Set(name, values[0])
+		}
+	}
+
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+	}
+
+	return r
+}
+
+// grpcAuditUnary records the Put and Delete calls to the audit log, with
+// their status code as the reply, refused ones included.
+func (s *Server) grpcAuditUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	var id string
+	switch req := req.(type) {
+	case *Book:
+		id = req.Id
+	case *GRPCDeleteRequest:
+		id = req.Id
+	default:
+		return handler(ctx, req)
+	}
+
+	audited := s.auditWrite(grpcCallRequest(ctx, path.Base(info.FullMethod)), []string{s.cfg.normalizeId(id)})
+	reply, err := handler(ctx, req)
+	audited(0, status.Code(err).String())
+
+	return reply, err
+}
+
+// grpcRequest rate limits and authenticates a call as RateLimit and Auth
+// do an HTTP request, from the authorization and x-api-key metadata, and
+// returns the request the hooks see for it. The full method name, e.g.
+// /books.Books/Put, is the route of -rate-limit-routes. Tenant keys are
+// refused, since the service has no buckets to confine them to.
+func (s *Server) grpcRequest(ctx context.Context, method string, write bool) (*http.Request, error) {
+	r := grpcCallRequest(ctx, method)
+
+	route, _ := grpc.Method(ctx)
+	if allowed, wait := s.rateLimiter.Allow(s.apiKeys.rateLimitClient(r), route, write); !allowed {
+		grpc.SetHeader(ctx, metadata.Pairs("retry-after", strconv.Itoa(int(math.Ceil(wait.Seconds())))))
+		return nil, status.Error(codes.ResourceExhausted, "rate limit exceeded")
+	}
+
+	access, ok := s.apiKeys.authenticate(r)
+
+	switch {
+	case !ok && (write || s.cfg.AuthReads || hasCredentials(r)):
+		return nil, status.Error(codes.Unauthenticated, "authorization failed")
+	case ok && write && access != accessWrite:
+		return nil, status.Error(codes.PermissionDenied, "credentials do not allow writes")
+	case s.apiKeys.requestTenant(r) != "":
+		return nil, status.Error(codes.PermissionDenied, "keys confined to a tenant can not use gRPC")
+	}
+
+	if reason := s.writesRefused(); write && reason != "" {
+		return nil, status.Error(codes.FailedPrecondition, reason)
+	}
+
+	return r, nil
+}
+
+// grpcBookId returns the book id for id, or the error refusing it.
+func (s *Server) grpcBookId(id string) (string, error) {
+	id = s.cfg.normalizeId(id)
+
+	if id == "" {
+		return "", status.Error(codes.InvalidArgument, "book id is missing")
+	}
+	if s.cfg.isReservedId(id) {
+		return "", status.Error(codes.InvalidArgument, fmt.Sprintf("Book id %s is reserved", id))
+	}
+
+	return id, nil
+}
+
+// grpcError turns the error of a hook, a broken limit or the store into
+// the status of a call, by the HTTP status it would be answered with.
+func grpcError(err error) error {
+	httpStatus, message := http.StatusBadRequest, err.Error()
+
+	var exceeded *limitExceeded
+	var hookError *HookError
+	switch {
+	case errors.As(err, &exceeded):
+		httpStatus, message = exceeded.status, exceeded.limitError.Message
+	case errors.As(err, &hookError):
+		httpStatus, message = hookError.Status, hookError.Message
+	case errors.Is(err, errNotRaftLeader):
+		httpStatus = http.StatusServiceUnavailable
+	}
+
+	code := codes.InvalidArgument
+	switch httpStatus {
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusConflict:
+		code = codes.AlreadyExists
+	case http.StatusPreconditionFailed:
+		code = codes.FailedPrecondition
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests, http.StatusInsufficientStorage:
+		code = codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	}
+	return status.Error(code, message)
+}
+
+func (s *Server) grpcGet(ctx context.Context, req *GRPCGetRequest) (any, error) {
+	r, err := s.grpcRequest(ctx, "get", false)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := s.grpcBookId(req.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	book := s.store.FindBookById(id)
+	if book == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("Book with id %s not found", id))
+	}
+
+	if err := s.runGetHooks(r, book); err != nil {
+		return nil, grpcError(err)
+	}
+
+	return book, nil
+}
+
+// grpcPut writes the book as PUT /book/<id> does, with the version of the
+// book in the place of If-Match and its expiry in the place of ?ttl=.
+func (s *Server) grpcPut(ctx context.Context, book *Book) (any, error) {
+	r, err := s.grpcRequest(ctx, "put", true)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := s.grpcBookId(book.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	var compare []TxnCompare
+	if book.Version != 0 {
+		compare = []TxnCompare{{Id: id, If: "version:" + strconv.FormatUint(book.Version, 10)}}
+	}
+	version := book.Version
+	book.Id, book.Version = id, 0
+
+	if book.Author == "" && book.Name == "" {
+		switch s.cfg.EmptyValuePolicy {
+		case "reject":
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("book %s has no author and name", id))
+		case "delete":
+			if _, err := s.grpcDelete(ctx, &GRPCDeleteRequest{Id: id}); err != nil && status.Code(err) != codes.NotFound {
+				return nil, err
+			}
+			return &Book{Id: id}, nil
+		}
+	}
+
+	if httpStatus, limitError := s.checkLimits(*book); limitError != nil {
+		return nil, grpcError(&limitExceeded{httpStatus, limitError})
+	}
+
+	written, _, err := s.store.Txn(compare, []BatchOp{{Op: "put", Book: *book}}, nil, s.prepareWrites(r))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	if !written {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("Book with id %s does not have version %d", id, version))
+	}
+
+	stored := s.store.FindBookById(id)
+	if stored == nil {
+		return &Book{Id: id}, nil
+	}
+	return stored, nil
+}
+
+// grpcDelete deletes the book as DELETE /book/<id> does, with the version
+// of the request in the place of If-Match.
+func (s *Server) grpcDelete(ctx context.Context, req *GRPCDeleteRequest) (any, error) {
+	r, err := s.grpcRequest(ctx, "delete", true)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := s.grpcBookId(req.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	cond := "present"
+	if req.Version != 0 {
+		cond = "version:" + strconv.FormatUint(req.Version, 10)
+	}
+
+	written, _, err := s.store.Txn([]TxnCompare{{Id: id, If: cond}}, []BatchOp{{Op: "delete", Book: Book{Id: id}}}, nil, s.prepareWrites(r))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	switch {
+	case written:
+		return &GRPCEmpty{}, nil
+	case s.store.FindBookById(id) == nil:
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("Book with id %s not found", id))
+	default:
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("Book with id %s does not have version %d", id, req.Version))
+	}
+}
+
+// grpcList lists the books outside buckets, as GET /books/ does.
+func (s *Server) grpcList(ctx context.Context, req *GRPCListRequest) (any, error) {
+	if _, err := s.grpcRequest(ctx, "list", false); err != nil {
+		return nil, err
+	}
+
+	all, err := s.store.GetBooks(ctx)
+	if err != nil {
+		return nil, status.FromContextError(err).Err()
+	}
+
+	books := make([]Book, 0)
+	for _, book := range withoutBuckets(all) {
+		if strings.HasPrefix(book.Id, req.Prefix) {
+			books = append(books, book)
+		}
+	}
+
+	return &books, nil
+}
+
+// grpcWatch streams the changes /watch does, until the call ends. A
+// watcher that is dropped for falling behind fails the call with ABORTED,
+// so the client knows to list the books again.
+func (s *Server) grpcWatch(req *GRPCWatchRequest, stream grpc.ServerStream) error {
+	if _, err := s.grpcRequest(stream.Context(), "watch", false); err != nil {
+		return err
+	}
+
+	wt := s.store.Watchers().Subscribe(s.cfg.normalizeId(req.Id), req.Prefix, watchBuffer)
+	defer s.store.Watchers().Unsubscribe(wt)
+
+	for {
+		select {
+		case event, ok := <-wt.Events():
+			if !ok {
+				return status.Error(codes.Aborted, "the watch fell too far behind or the server is shutting down")
+			}
+			if err := stream.SendMsg(&event); err != nil {
+				return err
+			}
+
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
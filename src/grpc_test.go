@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// dialGRPC serves the Books service of s for the test and connects to it,
+// over TLS when -tls-cert is set.
+func dialGRPC(t *testing.T, s *Server) *grpc.ClientConn {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gs, err := newGRPCServer(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go gs.Serve(ln)
+	t.Cleanup(gs.Stop)
+
+	creds := insecure.NewCredentials()
+	if s.cfg.tlsEnabled() {
+		creds = credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})
+	}
+
+	conn, err := grpc.NewClient(ln.Addr().String(),
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(grpcCodec{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+// grpcAs returns a context whose calls send the given authorization.
+func grpcAs(t *testing.T, authorization string) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	if authorization == "" {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, "authorization", authorization)
+}
+
+const grpcTestUser = "Basic dGVzdDp0ZXN0"
+
+func TestGRPC(t *testing.T) {
+	tests := []struct {
+		name   string
+		auth   string
+		method string
+		req    any
+		reply  any
+		code   codes.Code
+		want   any
+	}{
+		{name: "get", auth: grpcTestUser, method: "Get", req: &GRPCGetRequest{Id: "a"}, reply: &Book{}, want: "a1"},
+		{name: "get a missing book", auth: grpcTestUser, method: "Get", req: &GRPCGetRequest{Id: "x"}, reply: &Book{}, code: codes.NotFound},
+		{name: "get without an id", auth: grpcTestUser, method: "Get", req: &GRPCGetRequest{}, reply: &Book{}, code: codes.InvalidArgument},
+		{name: "get without credentials", method: "Get", req: &GRPCGetRequest{Id: "a"}, reply: &Book{}, code: codes.Unauthenticated},
+		{name: "get with a wrong key", auth: "Bearer nobody", method: "Get", req: &GRPCGetRequest{Id: "a"}, reply: &Book{}, code: codes.Unauthenticated},
+		{name: "get with a tenant key", auth: "Bearer tenant", method: "Get", req: &GRPCGetRequest{Id: "a"}, reply: &Book{}, code: codes.PermissionDenied},
+		{name: "put", auth: grpcTestUser, method: "Put", req: &Book{Id: "c", Name: "c1"}, reply: &Book{}, want: "c1"},
+		{name: "put over a version", auth: grpcTestUser, method: "Put", req: &Book{Id: "a", Name: "a2", Version: 1}, reply: &Book{}, want: "a2"},
+		{name: "put over a stale version", auth: grpcTestUser, method: "Put", req: &Book{Id: "a", Name: "a2", Version: 99}, reply: &Book{}, code: codes.FailedPrecondition},
+		{name: "put with a read key", auth: "Bearer reader", method: "Put", req: &Book{Id: "c", Name: "c1"}, reply: &Book{}, code: codes.PermissionDenied},
+		{name: "put with a write key", auth: "Bearer writer", method: "Put", req: &Book{Id: "c", Name: "c1"}, reply: &Book{}, want: "c1"},
+		{name: "put without credentials", method: "Put", req: &Book{Id: "c", Name: "c1"}, reply: &Book{}, code: codes.Unauthenticated},
+		{name: "put over the id policy", auth: grpcTestUser, method: "Put", req: &Book{Id: "c/history", Name: "c1"}, reply: &Book{}, code: codes.InvalidArgument},
+		{name: "delete", auth: grpcTestUser, method: "Delete", req: &GRPCDeleteRequest{Id: "a"}, reply: &GRPCEmpty{}},
+		{name: "delete a version", auth: grpcTestUser, method: "Delete", req: &GRPCDeleteRequest{Id: "a", Version: 1}, reply: &GRPCEmpty{}},
+		{name: "delete a stale version", auth: grpcTestUser, method: "Delete", req: &GRPCDeleteRequest{Id: "a", Version: 99}, reply: &GRPCEmpty{}, code: codes.FailedPrecondition},
+		{name: "delete a missing book", auth: grpcTestUser, method: "Delete", req: &GRPCDeleteRequest{Id: "x"}, reply: &GRPCEmpty{}, code: codes.NotFound},
+		{name: "list", auth: grpcTestUser, method: "List", req: &GRPCListRequest{}, reply: &[]Book{}, want: []string{"a", "b1"}},
+		{name: "list a prefix", auth: grpcTestUser, method: "List", req: &GRPCListRequest{Prefix: "b"}, reply: &[]Book{}, want: []string{"b1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t)
+			s.apiKeys.Set([]APIKey{
+				{Key: "writer", Access: accessWrite},
+				{Key: "reader", Access: accessRead},
+				{Key: "tenant", Access: accessWrite, Tenant: "t"},
+			})
+			s.store.ApplyBatch([]BatchOp{{Op: "put", Book: Book{Id: "a", Name: "a1"}}, {Op: "put", Book: Book{Id: "b1", Name: "b"}}})
+
+			err := dialGRPC(t, s).Invoke(grpcAs(t, tt.auth), "/books.Books/"+tt.method, tt.req, tt.reply)
+			if status.Code(err) != tt.code {
+				t.Fatalf("%s = %v, want %v", tt.method, err, tt.code)
+			}
+			if err != nil {
+				return
+			}
+
+			var got any
+			switch reply := tt.reply.(type) {
+			case *Book:
+				got = reply.Name
+			case *[]Book:
+				ids := make([]string, 0)
+				for _, book := range *reply {
+					ids = append(ids, book.Id)
+				}
+				got = ids
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s replied %v, want %v", tt.method, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGRPCRefusesWritesOnAReplica(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	s.replicating.Store(true)
+
+	err := dialGRPC(t, s).Invoke(grpcAs(t, grpcTestUser), "/books.Books/Put", &Book{Id: "a", Name: "1"}, &Book{})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Put on a replica = %v, want FailedPrecondition", err)
+	}
+}
+
+func TestGRPCRateLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  RateLimits
+		method  string
+		req     any
+		reply   any
+		allowed int // calls allowed before ResourceExhausted
+	}{
+		{name: "writes", limits: RateLimits{Write: 0.001, Burst: 2}, method: "Put", req: &Book{Id: "a", Name: "1"}, reply: &Book{}, allowed: 2},
+		{name: "reads", limits: RateLimits{Read: 0.001, Burst: 3}, method: "Get", req: &GRPCGetRequest{Id: "a"}, reply: &Book{}, allowed: 3},
+		{name: "a route override", limits: RateLimits{Routes: map[string]float64{"/books.Books/Put": 0.001}, Burst: 1}, method: "Put", req: &Book{Id: "a", Name: "1"}, reply: &Book{}, allowed: 1},
+		{name: "reads are not write limited", limits: RateLimits{Write: 0.001, Burst: 1}, method: "Get", req: &GRPCGetRequest{Id: "a"}, reply: &Book{}, allowed: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t)
+			s.rateLimiter.Configure(tt.limits)
+			s.store.AddBook(Book{Id: "a", Name: "0"})
+			conn := dialGRPC(t, s)
+
+			for i := range 5 {
+				var header metadata.MD
+				err := conn.Invoke(grpcAs(t, grpcTestUser), "/books.Books/"+tt.method, tt.req, tt.reply, grpc.Header(&header))
+
+				if i < tt.allowed {
+					if err != nil {
+						t.Fatalf("call %d = %v, want it allowed", i, err)
+					}
+					continue
+				}
+				if status.Code(err) != codes.ResourceExhausted {
+					t.Fatalf("call %d = %v, want ResourceExhausted", i, err)
+				}
+				if len(header.Get("retry-after")) == 0 {
+					t.Fatal("a rejection without retry-after")
+				}
+			}
+		})
+	}
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its key
+// to a temporary directory and points the -tls-cert and -tls-key of cfg
+// at them.
+func writeTestCert(t *testing.T, cfg *Config) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	cert, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+
+	cfg.TLSCert, cfg.TLSKey = cert, keyFile
+}
+
+func TestGRPCTLS(t *testing.T) {
+	cfg := DefaultConfig()
+	writeTestCert(t, &cfg)
+
+	s, _ := newTestServer(t, WithConfig(cfg))
+	s.store.AddBook(Book{Id: "a", Name: "1"})
+
+	var book Book
+	if err := dialGRPC(t, s).Invoke(grpcAs(t, grpcTestUser), "/books.Books/Get", &GRPCGetRequest{Id: "a"}, &book); err != nil || book.Name != "1" {
+		t.Fatalf("Get over TLS = %v, %v", book, err)
+	}
+
+	s.cfg.TLSKey = filepath.Join(t.TempDir(), "missing.pem")
+	if _, err := newGRPCServer(s); err == nil {
+		t.Error("served gRPC without its TLS key")
+	}
+}
+
+func TestGRPCWatch(t *testing.T) {
+	s, _ := newTestServer(t)
+	conn := dialGRPC(t, s)
+
+	ctx := grpcAs(t, grpcTestUser)
+	stream, err := conn.NewStream(ctx, &grpcBooksService.Streams[0], "/books.Books/Watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.SendMsg(&GRPCWatchRequest{Prefix: "w/"}); err != nil {
+		t.Fatal(err)
+	}
+	stream.CloseSend()
+
+	// The watch is subscribed once the server has read the request, which
+	// is not known here, so write until an event arrives.
+	events := make(chan ChangeEvent)
+	go func() {
+		var event ChangeEvent
+		if stream.RecvMsg(&event) == nil {
+			events <- event
+		}
+	}()
+
+	for i := 0; ; i++ {
+		conn.Invoke(ctx, "/books.Books/Put", &Book{Id: "other", Name: "x"}, &Book{})
+		conn.Invoke(ctx, "/books.Books/Put", &Book{Id: "w/1", Name: "x"}, &Book{})
+
+		select {
+		case event := <-events:
+			if event.Op != "put" || event.Id != "w/1" || event.New == nil || event.New.Name != "x" {
+				t.Errorf("Watch sent %+v, want the put of w/1", event)
+			}
+			return
+		case <-time.After(20 * time.Millisecond):
+		}
+		if i == 100 {
+			t.Fatal("Watch sent no event")
+		}
+	}
+}
+
+func TestGRPCCodec(t *testing.T) {
+	expires := time.Unix(0, 1234).UTC()
+	book := Book{Id: "a", Author: "x", Name: "y", Version: 3, ExpiresAt: &expires, List: []string{"", "1"}}
+
+	tests := []struct {
+		name string
+		in   any
+		out  any
+	}{
+		{name: "book", in: &book, out: &Book{}},
+		{name: "books", in: &[]Book{book, {Id: "b"}}, out: &[]Book{}},
+		{name: "event", in: &ChangeEvent{Op: "put", Id: "a", Old: &Book{Id: "a"}, New: &book}, out: &ChangeEvent{}},
+		{name: "get request", in: &GRPCGetRequest{Id: "a"}, out: &GRPCGetRequest{}},
+		{name: "delete request", in: &GRPCDeleteRequest{Id: "a", Version: 7}, out: &GRPCDeleteRequest{}},
+		{name: "list request", in: &GRPCListRequest{Prefix: "p"}, out: &GRPCListRequest{}},
+		{name: "watch request", in: &GRPCWatchRequest{Id: "a", Prefix: "p"}, out: &GRPCWatchRequest{}},
+		{name: "empty", in: &GRPCEmpty{}, out: &GRPCEmpty{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := grpcCodec{}.Marshal(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := (grpcCodec{}).Unmarshal(data, tt.out); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tt.in, tt.out) {
+				t.Errorf("decoded %+v, want %+v", tt.out, tt.in)
+			}
+		})
+	}
+
+	if _, err := (grpcCodec{}).Marshal("a string"); err == nil {
+		t.Error("Marshal took a type that is not a message")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var gzipWriters = sync.Pool{
+	New: func() any { return gzip.NewWriter(nil) },
+}
+
+// gzipWriter holds the response back until it is known to reach
+// -gzip-min-bytes, then either compresses it or passes it through.
+type gzipWriter struct {
+	http.ResponseWriter
+	method   string
+	minBytes int
+	status   int
+	buf      []byte
+	gz       *gzip.Writer
+	decided  bool
+}
+
+func (gw *gzipWriter) WriteHeader(status int) {
+	if gw.status == 0 {
+		gw.status = status
+	}
+}
+
+func (gw *gzipWriter) Write(b []byte) (int, error) {
+	if gw.decided {
+		if gw.gz != nil {
+			return gw.gz.Write(b)
+		}
+		return gw.ResponseWriter.Write(b)
+	}
+
+	gw.buf = append(gw.buf, b...)
+	if len(gw.buf) >= gw.minBytes {
+		gw.decide(true)
+	}
+
+	return len(b), nil
+}
+
+// decide sends the header and what was buffered, compressed if asked and
+// the response allows it.
+func (gw *gzipWriter) decide(compress bool) {
+	gw.decided = true
+
+	if gw.status == 0 {
+		gw.status = http.StatusOK
+	}
+
+	header := gw.Header()
+
+	compress = compress &&
+		gw.method != http.MethodHead &&
+		gw.status != http.StatusNoContent && gw.status != http.StatusNotModified &&
+		header.Get("Content-Encoding") == "" &&
+		!strings.HasPrefix(header.Get("Content-Type"), "text/event-stream")
+
+	if compress {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+
+		gw.gz = gzipWriters.Get().(*gzip.Writer)
+		gw.gz.Reset(gw.ResponseWriter)
+	}
+
+	gw.ResponseWriter.WriteHeader(gw.status)
+
+	if len(gw.buf) > 0 {
+		gw.Write(gw.buf)
+	}
+	gw.buf = nil
+}
+
+// Flush sends what is buffered as is, since a flushing handler is
+// streaming and waiting for the threshold would hold events back.
+func (gw *gzipWriter) Flush() {
+	if !gw.decided {
+		gw.decide(false)
+	}
+
+	if gw.gz != nil {
+		gw.gz.Flush()
+	}
+
+	http.NewResponseController(gw.ResponseWriter).Flush()
+}
+
+func (gw *gzipWriter) Unwrap() http.ResponseWriter {
+	return gw.ResponseWriter
+}
+
+func (gw *gzipWriter) finish() {
+	if !gw.decided {
+		gw.decide(false)
+	}
+
+	if gw.gz != nil {
+		gw.gz.Close()
+		gzipWriters.Put(gw.gz)
+	}
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, coding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(coding), ";")
+
+		if strings.TrimSpace(name) == "gzip" {
+			return strings.ReplaceAll(params, " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+func (s *Server) Gzip(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipWriter{ResponseWriter: w, method: r.Method, minBytes: s.cfg.GzipMinBytes}
+		defer gw.finish()
+
+		next.ServeHTTP(gw, r)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// HandleHealthz answers 200 for as long as the process is up.
+func HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	status, _ := json.Marshal(map[string]string{"status": "ok"})
+	w.Write(status)
+}
+
+// HandleReadyz answers 200 once the store is loaded and its backend is
+// reachable, and 503 otherwise. Both name the role of the server, primary,
+// replica or fenced, and its failover term, which is how -proxy and the
+// other members tell them apart.
+func (s *Server) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if !s.ready.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		error, _ := json.Marshal(map[string]any{"status": "not ready", "role": s.serverRole(), "term": s.clusterTerm()})
+
+		w.Write(error)
+		return
+	}
+
+	if err := s.store.Check(); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		error, _ := json.Marshal(map[string]any{"status": fmt.Sprintf("backend unavailable: %v", err), "role": s.serverRole(), "term": s.clusterTerm()})
+
+		w.Write(error)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	status, _ := json.Marshal(map[string]any{"status": "ready", "role": s.serverRole(), "term": s.clusterTerm()})
+
+	w.Write(status)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// KeepHistory makes every replace keep up to depth earlier versions of the
+// book. The history lives with the book and goes when it is deleted.
+func (s *MemoryStore) KeepHistory(depth int) {
+	unlock := s.lock(nil, true)
+	defer unlock()
+
+	s.historyDepth = depth
+}
+
+// remember adds the current version of e to its history before it is
+// replaced. Callers hold the shard's write lock.
+func (s *MemoryStore) remember(e *entry) {
+	if s.historyDepth == 0 {
+		return
+	}
+
+	e.history = append(e.history, e.book)
+	if len(e.history) > s.historyDepth {
+		e.history = slices.Clone(e.history[len(e.history)-s.historyDepth:])
+	}
+}
+
+// BookHistory returns the earlier versions of a book, newest first.
+func (s *MemoryStore) BookHistory(id string) []Book {
+	sh := s.shardFor(id)
+
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	history := make([]Book, 0)
+
+	if e, ok := sh.books[id]; ok && !e.book.expired(time.Now()) {
+		for i := len(e.history) - 1; i >= 0; i-- {
+			history = append(history, e.history[i])
+		}
+	}
+	return history
+}
+
+// HandleBookHistory serves the kept versions of a book: GET
+// /book/<id>/history lists them newest first, GET /book/<id>/versions/<v>
+// returns one and POST /book/<id>/rollback?version=<v> writes it back as
+// the newest version.
+func (s *Server) HandleBookHistory(w http.ResponseWriter, r *http.Request) {
+	op, version := r.PathValue("op"), r.PathValue("version")
+	if op == "rollback" {
+		version = r.URL.Query().Get("version")
+	}
+
+	bookid := s.cfg.normalizeId(r.PathValue("id"))
+
+	if s.cfg.isReservedId(bookid) {
+		HandleReservedId(w, bookid)
+		return
+	}
+
+	method := http.MethodGet
+	if op == "rollback" {
+		method = http.MethodPost
+	}
+
+	if r.Method != method {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	v, err := strconv.ParseUint(version, 10, 64)
+	if op != "history" && err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("invalid version %q", version))
+		return
+	}
+
+	if op == "history" {
+		w.WriteHeader(http.StatusOK)
+		history, _ := json.Marshal(s.store.BookHistory(bookid))
+
+		w.Write(history)
+		return
+	}
+
+	if op == "versions" {
+		old := s.findVersion(bookid, v)
+		if old == nil {
+			handleVersionNotFound(w, bookid, v)
+			return
+		}
+
+		w.Header().Set("ETag", old.ETag(s.cfg.ETagAlgo))
+		w.WriteHeader(http.StatusOK)
+		body, _ := json.Marshal(old)
+
+		w.Write(body)
+		return
+	}
+
+	stored, ok := s.modifyBook(w, r, bookid, func(book *Book) bool {
+		old := s.findVersion(bookid, v)
+		if book.Version == 0 || old == nil {
+			handleVersionNotFound(w, bookid, v)
+			return false
+		}
+
+		restored := *old
+		restored.ExpiresAt = book.ExpiresAt
+		*book = restored
+		return true
+	})
+	if !ok {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	body, _ := json.Marshal(stored)
+
+	w.Write(body)
+}
+
+// findVersion returns version v of the book, current or kept.
+func (s *Server) findVersion(bookid string, v uint64) *Book {
+	if book := s.store.FindBookById(bookid); book != nil && book.Version == v {
+		return book
+	}
+
+	for _, book := range s.store.BookHistory(bookid) {
+		if book.Version == v {
+			return &book
+		}
+	}
+	return nil
+}
+
+// PointInTime is a past state of the store: as of store version Version
+// when it is set, else as of Time. A book is seen as its newest version
+// written by then, so the point reaches back as far as -history-depth
+// keeps versions, and deleted books, which take their history with them,
+// are not seen at all.
+type PointInTime struct {
+	Version uint64
+	Time    time.Time
+}
+
+// parsePointInTime reads ?at=, a store version or an RFC 3339 time.
+func parsePointInTime(value string) (PointInTime, error) {
+	if v, err := strconv.ParseUint(value, 10, 64); err == nil {
+		return PointInTime{Version: v}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return PointInTime{}, errors.New(fmt.Sprintf("invalid at %q, expected a version or an RFC 3339 time", value))
+	}
+	return PointInTime{Time: t}, nil
+}
+
+func (at PointInTime) String() string {
+	if at.Version != 0 {
+		return "version " + strconv.FormatUint(at.Version, 10)
+	}
+	return at.Time.Format(time.RFC3339Nano)
+}
+
+// holds reports whether book had been written by the point.
+func (at PointInTime) holds(book Book) bool {
+	if at.Version != 0 {
+		return book.Version <= at.Version
+	}
+	return !book.UpdatedAt.After(at.Time)
+}
+
+// at returns the version of e's book as of the point, or nil when it was
+// not written yet, is older than the history kept or had expired by then,
+// or by now for a version. Callers hold the shard's read lock.
+func (e *entry) at(at PointInTime, now time.Time) *Book {
+	if !at.Time.IsZero() {
+		now = at.Time
+	}
+
+	for i := len(e.history); i >= 0; i-- {
+		book := e.book
+		if i < len(e.history) {
+			book = e.history[i]
+		}
+
+		if at.holds(book) {
+			if book.expired(now) {
+				return nil
+			}
+			return &book
+		}
+	}
+	return nil
+}
+
+// BookAt returns the book as it was at the point, see PointInTime.
+func (s *MemoryStore) BookAt(id string, at PointInTime) *Book {
+	sh := s.shardFor(id)
+
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	if e, ok := sh.books[id]; ok {
+		return e.at(at, time.Now())
+	}
+	return nil
+}
+
+// BooksAt returns every book as it was at the point, in insertion order,
+// giving up with ctx's error once ctx is done.
+func (s *MemoryStore) BooksAt(ctx context.Context, at PointInTime) ([]Book, error) {
+	type found struct {
+		book Book
+		seq  uint64
+	}
+
+	all := make([]found, 0)
+	now := time.Now()
+
+	for _, sh := range s.shards {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		sh.mu.RLock()
+		for _, e := range sh.books {
+			if book := e.at(at, now); book != nil {
+				all = append(all, found{*book, e.seq})
+			}
+		}
+		sh.mu.RUnlock()
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i].seq < all[j].seq })
+
+	books := make([]Book, 0, len(all))
+	for _, f := range all {
+		books = append(books, f.book)
+	}
+	return books, nil
+}
+
+// handlePointInTime reads ?at= when the request has it, answering 400 for
+// a bad one.
+func handlePointInTime(w http.ResponseWriter, r *http.Request) (*PointInTime, bool) {
+	if !r.URL.Query().Has("at") {
+		return nil, true
+	}
+
+	at, err := parsePointInTime(r.URL.Query().Get("at"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return nil, false
+	}
+	return &at, true
+}
+
+func handleVersionNotFound(w http.ResponseWriter, bookid string, v uint64) {
+	writeError(w, http.StatusNotFound, CodeVersionNotFound, fmt.Sprintf("Book with id %s has no version %d", bookid, v))
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Hooks is code run by the book handlers, for servers built with
+// WithHooks. OnGet sees a book before GET /book/<id> answers with it,
+// OnPut before any request writes a book, and OnDelete before any request
+// deletes one, whether over HTTP, /ws, memcached or RESP. A hook may
+// change the book it is given, say to fill in a field, and an error
+// refuses the request: a HookError answers with its status and code, any
+// other error with 400. Hooks run after the reserved id checks and before
+// the size limits, and the id of a book cannot be changed.
+//
+// Writes that depend on the stored books, such as /txn, scripts, /incr
+// and the line protocols, call the hooks under the store locks, once, for
+// the writes that are about to commit, so hooks must not use the store.
+// Over memcached and RESP the request only carries the command as its
+// method, the client as its RemoteAddr and the protocol in the
+// X-Book-Protocol header. Embed NopHooks to implement only some.
+type Hooks interface {
+	OnGet(r *http.Request, book *Book) error
+	OnPut(r *http.Request, book *Book) error
+	OnDelete(r *http.Request, id string) error
+}
+
+// NopHooks does nothing, for embedding in a Hooks implementation.
+type NopHooks struct{}
+
+func (NopHooks) OnGet(r *http.Request, book *Book) error { return nil }
+
+func (NopHooks) OnPut(r *http.Request, book *Book) error { return nil }
+
+func (NopHooks) OnDelete(r *http.Request, id string) error { return nil }
+
+// HookError refuses a request with its own status and code.
+type HookError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *HookError) Error() string {
+	return e.Message
+}
+
+// handleHookError answers the request with the error of a hook, if any,
+// and reports whether it may go ahead.
+func handleHookError(w http.ResponseWriter, err error) bool {
+	if err == nil {
+		return true
+	}
+
+	var hookError *HookError
+	if errors.As(err, &hookError) {
+		writeError(w, hookError.Status, hookError.Code, hookError.Message)
+	} else {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+	}
+	return false
+}
+
+// runGetHooks runs OnGet of every hook and returns the first error.
+func (s *Server) runGetHooks(r *http.Request, book *Book) error {
+	for _, hooks := range s.hooks {
+		if err := hooks.OnGet(r, book); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runPutHooks runs OnPut of every hook and returns the first error. The
+// book keeps its id.
+func (s *Server) runPutHooks(r *http.Request, book *Book) error {
+	id := book.Id
+	defer func() { book.Id = id }()
+
+	for _, hooks := range s.hooks {
+		if err := hooks.OnPut(r, book); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runDeleteHooks runs OnDelete of every hook and returns the first error.
+func (s *Server) runDeleteHooks(r *http.Request, id string) error {
+	for _, hooks := range s.hooks {
+		if err := hooks.OnDelete(r, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepareWrites returns the prepare of Store.Txn that runs the hooks on
+// the writes about to commit and checks the books they leave against the
+// size limits. It is nil without hooks, as the limits are checked before.
+func (s *Server) prepareWrites(r *http.Request) func(writes []*BatchOp) error {
+	if len(s.hooks) == 0 {
+		return nil
+	}
+
+	return func(writes []*BatchOp) error {
+		for _, op := range writes {
+			if op.Op == "delete" {
+				if err := s.runDeleteHooks(r, op.Book.Id); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if err := s.runPutHooks(r, &op.Book); err != nil {
+				return err
+			}
+			if status, limitError := s.checkBookLimits(op.Book); limitError != nil {
+				return &limitExceeded{status, limitError}
+			}
+		}
+		return nil
+	}
+}
+
+// prepareDrain is prepareWrites for Store.DrainBooks.
+func (s *Server) prepareDrain(r *http.Request) func(ids []string) error {
+	if len(s.hooks) == 0 {
+		return nil
+	}
+
+	return func(ids []string) error {
+		for _, id := range ids {
+			if err := s.runDeleteHooks(r, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// prepareBook is prepareWrites for the single book of Store.RestoreBook.
+func (s *Server) prepareBook(r *http.Request) func(book *Book) error {
+	if len(s.hooks) == 0 {
+		return nil
+	}
+
+	return func(book *Book) error {
+		if err := s.runPutHooks(r, book); err != nil {
+			return err
+		}
+		if status, limitError := s.checkBookLimits(*book); limitError != nil {
+			return &limitExceeded{status, limitError}
+		}
+		return nil
+	}
+}
+
+// handleWriteError answers the request with the error of a prepare, a
+// hook error, a broken limit or a failed log append, if any, and reports
+// whether it may go ahead.
+func handleWriteError(w http.ResponseWriter, err error) bool {
+	if handleStoreError(w, err) {
+		return false
+	}
+	return handleHookError(w, err)
+}
+
+// handleGetHooks runs OnGet of every hook, answering the request and
+// reporting false when one refuses it.
+func (s *Server) handleGetHooks(w http.ResponseWriter, r *http.Request, book *Book) bool {
+	return handleHookError(w, s.runGetHooks(r, book))
+}
+
+// handlePutHooks runs OnPut of every hook, as handleGetHooks does.
+func (s *Server) handlePutHooks(w http.ResponseWriter, r *http.Request, book *Book) bool {
+	return handleHookError(w, s.runPutHooks(r, book))
+}
+
+// handleDeleteHooks runs OnDelete of every hook, as handleGetHooks does.
+func (s *Server) handleDeleteHooks(w http.ResponseWriter, r *http.Request, id string) bool {
+	return handleHookError(w, s.runDeleteHooks(r, id))
+}
+
+// lineRequest stands in for the HTTP request in the hooks of a command
+// of the line protocols, see Hooks.
+func lineRequest(conn net.Conn, protocol, command string) *http.Request {
+	return &http.Request{
+		Method:     strings.ToUpper(command),
+		URL:        &url.URL{Path: "/"},
+		Proto:      protocol,
+		Header:     http.Header{"X-Book-Protocol": {protocol}},
+		RemoteAddr: conn.RemoteAddr().String(),
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// recordingHooks records the ids the write hooks see and refuses the
+// writes of refuse.
+type recordingHooks struct {
+	NopHooks
+
+	mu      sync.Mutex
+	puts    []string
+	deletes []string
+	refuse  string
+}
+
+func (h *recordingHooks) OnPut(r *http.Request, book *Book) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if book.Id == h.refuse {
+		return &HookError{Status: http.StatusForbidden, Code: "refused", Message: "refused " + book.Id}
+	}
+	h.puts = append(h.puts, book.Id)
+	book.Author = "hooked"
+	return nil
+}
+
+func (h *recordingHooks) OnDelete(r *http.Request, id string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if id == h.refuse {
+		return &HookError{Status: http.StatusForbidden, Code: "refused", Message: "refused " + id}
+	}
+	h.deletes = append(h.deletes, id)
+	return nil
+}
+
+func TestHooksSeeTheWritesThatCommit(t *testing.T) {
+	tests := []struct {
+		name        string
+		books       []string
+		method      string
+		path        string
+		body        string
+		status      int
+		wantPuts    []string
+		wantDeletes []string
+		stored      map[string]bool
+	}{
+		{
+			name:     "txn success branch",
+			method:   http.MethodPost,
+			path:     "/txn",
+			body:     `{"compare":[{"id":"a","if":"absent"}],"success":[{"op":"put","book":{"id":"a","name":"x"}}],"failure":[{"op":"put","book":{"id":"b","name":"x"}}]}`,
+			status:   http.StatusOK,
+			wantPuts: []string{"a"},
+			stored:   map[string]bool{"a": true, "b": false},
+		},
+		{
+			name:     "txn failure branch",
+			books:    []string{"a"},
+			method:   http.MethodPost,
+			path:     "/txn",
+			body:     `{"compare":[{"id":"a","if":"absent"}],"success":[{"op":"put","book":{"id":"c","name":"x"}}],"failure":[{"op":"put","book":{"id":"b","name":"x"}},{"op":"delete","book":{"id":"d"}}]}`,
+			status:   http.StatusOK,
+			wantPuts: []string{"b"},
+			stored:   map[string]bool{"b": true, "c": false},
+		},
+		{
+			name:     "txn refused by a hook",
+			method:   http.MethodPost,
+			path:     "/txn",
+			body:     `{"compare":[],"success":[{"op":"put","book":{"id":"a","name":"x"}},{"op":"put","book":{"id":"refused","name":"x"}}]}`,
+			status:   http.StatusForbidden,
+			wantPuts: []string{"a"},
+			stored:   map[string]bool{"a": false, "refused": false},
+		},
+		{
+			name:        "drain of present books only",
+			books:       []string{"a"},
+			method:      http.MethodPost,
+			path:        "/drain/",
+			body:        `["a","b"]`,
+			status:      http.StatusOK,
+			wantDeletes: []string{"a"},
+			stored:      map[string]bool{"a": false},
+		},
+		{
+			name:        "flush",
+			books:       []string{"a", "b"},
+			method:      http.MethodPost,
+			path:        "/admin/flush",
+			status:      http.StatusOK,
+			wantDeletes: []string{"a", "b"},
+			stored:      map[string]bool{"a": false, "b": false},
+		},
+		{
+			name:        "flush refused by a hook",
+			books:       []string{"a", "refused"},
+			method:      http.MethodPost,
+			path:        "/admin/flush",
+			status:      http.StatusForbidden,
+			wantDeletes: []string{"a"},
+			stored:      map[string]bool{"a": true, "refused": true},
+		},
+		{
+			name:     "incr",
+			method:   http.MethodPost,
+			path:     "/book/n/incr",
+			status:   http.StatusOK,
+			wantPuts: []string{"n"},
+			stored:   map[string]bool{"n": true},
+		},
+		{
+			name:     "content",
+			books:    []string{"a"},
+			method:   http.MethodPut,
+			path:     "/book/a/content",
+			body:     "text",
+			status:   http.StatusNoContent,
+			wantPuts: []string{"a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hooks := &recordingHooks{refuse: "refused"}
+			s, ts := newTestServer(t, WithHooks(hooks))
+
+			for _, id := range tt.books {
+				if err := s.store.AddBook(Book{Id: id, Name: "stored"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if status, _ := send(t, tt.method, ts.URL+tt.path, tt.body); status != tt.status {
+				t.Fatalf("status = %d, want %d", status, tt.status)
+			}
+
+			if !slices.Equal(hooks.puts, tt.wantPuts) {
+				t.Errorf("OnPut saw %v, want %v", hooks.puts, tt.wantPuts)
+			}
+			if !slices.Equal(hooks.deletes, tt.wantDeletes) {
+				t.Errorf("OnDelete saw %v, want %v", hooks.deletes, tt.wantDeletes)
+			}
+
+			for id, want := range tt.stored {
+				book := s.store.FindBookById(id)
+				if (book != nil) != want {
+					t.Errorf("book %s stored = %v, want %v", id, book != nil, want)
+				}
+				if book != nil && slices.Contains(tt.wantPuts, id) && book.Author != "hooked" {
+					t.Errorf("book %s has author %q, want the one the hook set", id, book.Author)
+				}
+			}
+		})
+	}
+}
+
+func TestHooksRunOncePerIncrement(t *testing.T) {
+	hooks := &recordingHooks{}
+	s, ts := newTestServer(t, WithHooks(hooks))
+
+	const writers = 20
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, _, err := do(http.MethodPost, ts.URL+"/book/n/incr", ""); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, _, err := do(http.MethodPut, ts.URL+"/book/n", `{"name":"0"}`); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(hooks.puts) != 2*writers {
+		t.Errorf("OnPut ran %d times for %d writes", len(hooks.puts), 2*writers)
+	}
+	if s.store.FindBookById("n") == nil {
+		t.Error("book n is missing")
+	}
+}
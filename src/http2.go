@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+)
+
+// serverProtocols are the protocols the listener speaks. HTTP/2 over TLS
+// needs -tls-cert; without it -http2 has no effect.
+func (c Config) serverProtocols() *http.Protocols {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(c.HTTP2 && c.tlsEnabled())
+	protocols.SetUnencryptedHTTP2(c.H2C)
+
+	return protocols
+}
+
+func (c Config) http2Config() *http.HTTP2Config {
+	return &http.HTTP2Config{
+		MaxConcurrentStreams: c.HTTP2MaxStreams,
+		SendPingTimeout:      c.HTTP2PingInterval,
+		PingTimeout:          c.HTTP2PingTimeout,
+	}
+}
+
+// alpnProtocols are offered in the TLS handshake, best first.
+func (c Config) alpnProtocols() []string {
+	if c.HTTP2 {
+		return []string{"h2", "http/1.1"}
+	}
+	return []string{"http/1.1"}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// idempotencyMaxKeyBytes is the longest Idempotency-Key taken.
+const idempotencyMaxKeyBytes = 255
+
+// unkeptHeaders are set anew for every answer, replays included.
+var unkeptHeaders = []string{"X-Request-Id", "Content-Encoding", "Content-Length", "Vary"}
+
+// idempotentAnswer is the answer to the first request sent with a key.
+// status is 0 while that request is still being served.
+type idempotentAnswer struct {
+	scope       string
+	fingerprint string
+	status      int
+	header      http.Header
+	body        []byte
+	storedAt    time.Time
+}
+
+// IdempotencyCache keeps the answers by caller and key, oldest first in
+// order, in memory only: a restart or another replica forgets them. It
+// keeps at most maxKeys answers, each for ttl.
+type IdempotencyCache struct {
+	mu      sync.Mutex
+	answers map[string]*idempotentAnswer
+	order   []*idempotentAnswer
+	ttl     time.Duration
+	maxKeys int
+}
+
+// begin returns the answer kept for scope, or claims scope for a request
+// with fingerprint and returns nil.
+func (c *IdempotencyCache) begin(scope, fingerprint string) *idempotentAnswer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for len(c.order) > 0 && (now.Sub(c.order[0].storedAt) > c.ttl || len(c.order) >= c.maxKeys) {
+		if c.answers[c.order[0].scope] == c.order[0] {
+			delete(c.answers, c.order[0].scope)
+		}
+		c.order = c.order[1:]
+	}
+
+	if answer, ok := c.answers[scope]; ok {
+		kept := *answer
+		return &kept
+	}
+
+	answer := &idempotentAnswer{scope: scope, fingerprint: fingerprint, storedAt: now}
+	c.answers[scope] = answer
+	c.order = append(c.order, answer)
+	return nil
+}
+
+// finish keeps the answer to the request that claimed scope, or forgets
+// the claim when the answer may differ on a retry.
+func (c *IdempotencyCache) finish(scope string, rec *idempotencyRecorder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	answer := c.answers[scope]
+	if answer == nil || answer.status != 0 {
+		return
+	}
+
+	if !rec.keep() {
+		delete(c.answers, scope)
+		c.order = slices.DeleteFunc(c.order, func(kept *idempotentAnswer) bool { return kept == answer })
+		return
+	}
+
+	answer.status, answer.header, answer.body, answer.storedAt = rec.status, rec.header, rec.body.Bytes(), time.Now()
+}
+
+// idempotencyRecorder copies the answer as it is written, with the headers
+// the handler set.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	before   http.Header
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	maxBytes int64 // kept of the body, past which it is not kept at all
+	overflow bool
+	served   bool // false when the handler panicked
+}
+
+func (ir *idempotencyRecorder) WriteHeader(status int) {
+	if ir.status == 0 {
+		ir.status = status
+		ir.header = make(http.Header)
+		for name, values := range ir.ResponseWriter.Header() {
+			if !slices.Contains(unkeptHeaders, name) && !slices.Equal(values, ir.before[name]) {
+				ir.header[name] = slices.Clone(values)
+			}
+		}
+	}
+	ir.ResponseWriter.WriteHeader(status)
+}
+
+func (ir *idempotencyRecorder) Write(b []byte) (int, error) {
+	if ir.status == 0 {
+		ir.WriteHeader(http.StatusOK)
+	}
+	if int64(ir.body.Len()+len(b)) > ir.maxBytes {
+		ir.overflow = true
+	} else {
+		ir.body.Write(b)
+	}
+	return ir.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (ir *idempotencyRecorder) Unwrap() http.ResponseWriter {
+	return ir.ResponseWriter
+}
+
+// keep reports whether a retry should get this answer. Server errors, rate
+// limits and canceled requests may go another way when sent again, so
+// those retries run anew.
+func (ir *idempotencyRecorder) keep() bool {
+	status := ir.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return ir.served && !ir.overflow && status < http.StatusInternalServerError && status != http.StatusTooManyRequests && status != statusClientClosedRequest
+}
+
+// Idempotency answers a retried write with the answer to the first one.
+// Writes sent with the same Idempotency-Key by the same caller within
+// -idempotency-ttl are run once; a retry gets the kept answer with an
+// Idempotent-Replayed header. The key may not be reused for another
+// method, path or body, and a retry sent while the first request is still
+// being served is refused rather than run twice.
+func (s *Server) Idempotency(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || s.cfg.IdempotencyTTL <= 0 || !isWriteMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > idempotencyMaxKeyBytes {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Idempotency-Key is longer than %d bytes", idempotencyMaxKeyBytes))
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.cfg.MaxBodyBytes))
+		if err != nil {
+			writeError(w, badBodyStatus(err), "", err.Error())
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		sum := sha256.New()
+		fmt.Fprintf(sum, "%s %s\n", r.Method, r.URL.RequestURI())
+		sum.Write(body)
+		fingerprint := hex.EncodeToString(sum.Sum(nil))
+
+		scope := s.auditWho(r) + "\n" + key
+
+		answer := s.idempotency.begin(scope, fingerprint)
+		switch {
+		case answer == nil:
+			rec := &idempotencyRecorder{ResponseWriter: w, before: w.Header().Clone(), maxBytes: s.cfg.MaxBodyBytes}
+			defer s.idempotency.finish(scope, rec)
+
+			next.ServeHTTP(rec, r)
+			rec.served = true
+
+		case answer.fingerprint != fingerprint:
+			writeError(w, http.StatusConflict, CodeIdempotencyConflict, "Idempotency-Key was already used for another request")
+
+		case answer.status == 0:
+			writeError(w, http.StatusConflict, CodeIdempotencyConflict, "a request with this Idempotency-Key is still being served")
+
+		default:
+			for name, values := range answer.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(answer.status)
+
+			w.Write(answer.body)
+		}
+	}
+}
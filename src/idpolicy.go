@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var idCharsets = map[string]func(r rune) bool{
+	"any":       func(r rune) bool { return true },
+	"printable": func(r rune) bool { return r != utf8.RuneError && unicode.IsPrint(r) },
+	"safe": func(r rune) bool {
+		return r < utf8.RuneSelf && (isAlnum(byte(r)) || strings.ContainsRune("._~-/", r))
+	},
+	"alnum": func(r rune) bool { return r < utf8.RuneSelf && isAlnum(byte(r)) },
+}
+
+func isAlnum(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+func (c Config) idPrefixList() []string {
+	prefixes := make([]string, 0)
+
+	for _, prefix := range strings.Split(c.IdPrefixes, ",") {
+		prefix = strings.TrimSpace(prefix)
+		if prefix != "" {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+
+	return prefixes
+}
+
+// checkIdPolicy reports why a book may not be written under id, after
+// -normalize-ids has run. A bucket book is checked by its id in the bucket;
+// the other internal ids are the server's own and pass. No id may end in
+// an operation segment, see splitBookPath.
+func (c Config) checkIdPolicy(id string) error {
+	if _, op, _ := splitBookPath(id); op != "" {
+		return errors.New(fmt.Sprintf("book id %q ends in the operation %s, so /book/%s would not address it", id, op, id))
+	}
+
+	if inBucket(id) {
+		bucket, ok := bucketOf(id)
+		if !ok {
+			return nil
+		}
+		id = strings.TrimPrefix(id, bucketIdPrefix+bucket+"/")
+	}
+
+	if strings.TrimSpace(id) == "" {
+		return errors.New(fmt.Sprintf("book id %q is empty or blank", id))
+	}
+
+	allowed := idCharsets[c.IdCharset]
+	for i, r := range id {
+		if !allowed(r) {
+			return errors.New(fmt.Sprintf("book id %q has %q at byte %d, outside -id-charset %s", id, r, i, c.IdCharset))
+		}
+	}
+
+	prefixes := c.idPrefixList()
+	if len(prefixes) == 0 {
+		return nil
+	}
+
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(id, prefix) {
+			return nil
+		}
+	}
+
+	return errors.New(fmt.Sprintf("book id %q starts with none of -id-prefixes %s", id, strings.Join(prefixes, ", ")))
+}
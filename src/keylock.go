@@ -0,0 +1,29 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// stripedLocks serializes read-modify-write updates of the same id, so
+// concurrent updates of a hot book queue up instead of retrying on a stale
+// version over and over. Ids hash onto a fixed set of mutexes; different
+// ids only wait for one another when they share one.
+type stripedLocks struct {
+	stripes []sync.Mutex
+}
+
+func newStripedLocks(n int) *stripedLocks {
+	return &stripedLocks{stripes: make([]sync.Mutex, n)}
+}
+
+// lock locks the stripe of id and returns the matching unlock.
+func (sl *stripedLocks) lock(id string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+
+	mu := &sl.stripes[h.Sum32()%uint32(len(sl.stripes))]
+	mu.Lock()
+
+	return mu.Unlock
+}
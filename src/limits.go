@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// LimitError is the body of a write rejected by one of the size limits.
+type LimitError struct {
+	APIError
+	Id    string `json:"id,omitempty"`
+	Limit int64  `json:"limit,omitempty"`
+	Size  int64  `json:"size,omitempty"`
+}
+
+// limitExceeded carries a broken limit out of a store callback, such as
+// the prepare of Txn.
+type limitExceeded struct {
+	status     int
+	limitError *LimitError
+}
+
+func (e *limitExceeded) Error() string {
+	return e.limitError.Message
+}
+
+// storeUsage keeps what a store holds in total and per bucket, and what the
+// writes being applied have reserved on top, so each write checks
+// -max-store-bytes and the bucket quotas against all others under its own
+// shard locks. Its lock is taken last, under those of the shards.
+type storeUsage struct {
+	mu       sync.Mutex
+	maxBytes int64
+	quotas   map[string]Quota
+
+	bytes, reserved int64
+	buckets         map[string]*bucketUsage
+}
+
+// bucketUsage counts a bucket as /bucket/<bucket>/stats does, with the
+// ids as clients see them.
+type bucketUsage struct {
+	books, bytes                 int64
+	reservedBooks, reservedBytes int64
+}
+
+// LimitBytes has every write refuse to take the store past maxBytes, when
+// not 0, or a bucket past its quota. It fails with a *limitExceeded.
+func (s *MemoryStore) LimitBytes(maxBytes int64, quotas map[string]Quota) {
+	unlock := s.lock(nil, true)
+	defer unlock()
+
+	usage := &storeUsage{maxBytes: maxBytes, quotas: quotas, buckets: make(map[string]*bucketUsage)}
+	now := time.Now()
+
+	for _, sh := range s.shards {
+		sh.usage = usage
+		for id, e := range sh.books {
+			if !e.book.expired(now) {
+				usage.grow(id, 1, len(id)+e.book.valueSize())
+			}
+		}
+	}
+}
+
+// grow adds to the running totals of sh and of the limits. Callers hold
+// the shard's write lock.
+func (sh *shard) grow(id string, books int, keyBytes, valueBytes int) {
+	sh.keyBytes += keyBytes
+	sh.valueBytes += valueBytes
+	sh.usage.grow(id, books, keyBytes+valueBytes)
+}
+
+func (u *storeUsage) grow(id string, books int, bytes int) {
+	if u == nil {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.bytes += int64(bytes)
+
+	if bucket, ok := bucketOf(id); ok {
+		bytes -= books * len(bucketStoreId(bucket, ""))
+
+		usage := u.bucket(bucket)
+		usage.books += int64(books)
+		usage.bytes += int64(bytes)
+	}
+}
+
+// reset forgets the stored totals, as the store is emptied.
+func (u *storeUsage) reset() {
+	if u == nil {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.bytes = 0
+	for _, usage := range u.buckets {
+		usage.books, usage.bytes = 0, 0
+	}
+}
+
+func (u *storeUsage) bucket(bucket string) *bucketUsage {
+	usage, ok := u.buckets[bucket]
+	if !ok {
+		usage = &bucketUsage{}
+		u.buckets[bucket] = usage
+	}
+	return usage
+}
+
+func (u *storeUsage) quota(bucket string) (Quota, bool) {
+	if quota, ok := u.quotas[bucket]; ok {
+		return quota, true
+	}
+	quota, ok := u.quotas["*"]
+	return quota, ok
+}
+
+// reserve checks that the puts, replacing the books stored under their
+// ids, fit the limits, and holds their growth until release is called.
+// Callers hold the locks of every put and release before unlocking. From
+// the write to the release the growth counts twice, which may refuse a
+// concurrent write close to a limit early but never lets one past it.
+func (s *MemoryStore) reserve(puts []Book, now time.Time) (release func(), err error) {
+	u := s.shards[0].usage
+	if u == nil || len(puts) == 0 {
+		return func() {}, nil
+	}
+
+	var growth int64
+	newBooks := make(map[string]int64)
+	bucketGrowth := make(map[string]int64)
+
+	for _, book := range puts {
+		grown := int64(book.valueSize())
+		stored := s.shardFor(book.Id).live(book.Id, now)
+		if stored != nil {
+			grown -= int64(stored.valueSize())
+		} else {
+			grown += int64(len(book.Id))
+		}
+		growth += grown
+
+		if bucket, ok := bucketOf(book.Id); ok {
+			if stored == nil {
+				newBooks[bucket]++
+				grown -= int64(len(bucketStoreId(bucket, "")))
+			}
+			bucketGrowth[bucket] += grown
+		}
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if size := u.bytes + u.reserved + growth; u.maxBytes > 0 && growth > 0 && size > u.maxBytes {
+		return nil, &limitExceeded{http.StatusRequestEntityTooLarge, &LimitError{
+			APIError: APIError{Message: fmt.Sprintf("store would grow past %d bytes", u.maxBytes)},
+			Limit:    u.maxBytes,
+			Size:     size,
+		}}
+	}
+
+	for bucket, grown := range bucketGrowth {
+		quota, ok := u.quota(bucket)
+		if !ok {
+			continue
+		}
+		usage := u.bucket(bucket)
+
+		if count := usage.books + usage.reservedBooks + newBooks[bucket]; quota.MaxBooks > 0 && newBooks[bucket] > 0 && count > quota.MaxBooks {
+			return nil, &limitExceeded{http.StatusInsufficientStorage, &LimitError{
+				APIError: APIError{Message: fmt.Sprintf("bucket %s would hold more than %d books", bucket, quota.MaxBooks)},
+				Limit:    quota.MaxBooks,
+				Size:     count,
+			}}
+		}
+
+		if size := usage.bytes + usage.reservedBytes + grown; quota.MaxBytes > 0 && grown > 0 && size > quota.MaxBytes {
+			return nil, &limitExceeded{http.StatusInsufficientStorage, &LimitError{
+				APIError: APIError{Message: fmt.Sprintf("bucket %s would grow past %d bytes", bucket, quota.MaxBytes)},
+				Limit:    quota.MaxBytes,
+				Size:     size,
+			}}
+		}
+	}
+
+	u.reserved += growth
+	for bucket, grown := range bucketGrowth {
+		usage := u.bucket(bucket)
+		usage.reservedBooks += newBooks[bucket]
+		usage.reservedBytes += grown
+	}
+
+	return func() {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+
+		u.reserved -= growth
+		for bucket, grown := range bucketGrowth {
+			usage := u.bucket(bucket)
+			usage.reservedBooks -= newBooks[bucket]
+			usage.reservedBytes -= grown
+		}
+	}, nil
+}
+
+// handleStoreError answers a store write that failed on a limit or on
+// its log rather than on what it found stored, and reports whether err
+// was such a failure.
+func handleStoreError(w http.ResponseWriter, err error) bool {
+	var exceeded *limitExceeded
+	if errors.As(err, &exceeded) {
+		writeLimitError(w, exceeded.status, exceeded.limitError)
+		return true
+	}
+
+	var persist *persistError
+	if errors.As(err, &persist) {
+		writeError(w, http.StatusInternalServerError, CodeInternal, persist.Error())
+		return true
+	}
+	return false
+}
+
+// checkBookLimits is the part of checkLimits that only looks at the book
+// itself, so it can run under the store locks.
+func (s *Server) checkBookLimits(book Book) (int, *LimitError) {
+	if err := s.cfg.checkIdPolicy(book.Id); err != nil {
+		return http.StatusBadRequest, &LimitError{
+			APIError: APIError{Code: CodeInvalidId, Message: err.Error()},
+			Id:       book.Id,
+		}
+	}
+
+	if len(book.Id) > s.cfg.MaxIdBytes {
+		return http.StatusBadRequest, &LimitError{
+			APIError: APIError{Message: fmt.Sprintf("book id is longer than %d bytes", s.cfg.MaxIdBytes)},
+			Id:       book.Id,
+			Limit:    int64(s.cfg.MaxIdBytes),
+			Size:     int64(len(book.Id)),
+		}
+	}
+
+	if book.valueSize() > s.cfg.MaxValueBytes {
+		return http.StatusRequestEntityTooLarge, &LimitError{
+			APIError: APIError{Message: fmt.Sprintf("book %s is larger than %d bytes", book.Id, s.cfg.MaxValueBytes)},
+			Id:       book.Id,
+			Limit:    int64(s.cfg.MaxValueBytes),
+			Size:     int64(book.valueSize()),
+		}
+	}
+
+	return 0, nil
+}
+
+// checkLimits returns the status and body for the first limit the books
+// would break if written, or 0 and nil when they fit. An id breaking the
+// -id-charset or -id-prefixes policy counts as one.
+func (s *Server) checkLimits(books ...Book) (int, *LimitError) {
+	var growth int64
+
+	for _, book := range books {
+		if status, limitError := s.checkBookLimits(book); limitError != nil {
+			return status, limitError
+		}
+
+		growth += int64(book.valueSize())
+		if stored := s.store.FindBookById(book.Id); stored != nil {
+			growth -= int64(stored.valueSize())
+		} else {
+			growth += int64(len(book.Id))
+		}
+	}
+
+	if limitError := s.checkQuotas(books); limitError != nil {
+		return http.StatusInsufficientStorage, limitError
+	}
+
+	if s.cfg.MaxStoreBytes > 0 && growth > 0 {
+		keyBytes, valueBytes := s.store.SizeBytes()
+		size := int64(keyBytes+valueBytes) + growth
+
+		if size > s.cfg.MaxStoreBytes {
+			return http.StatusRequestEntityTooLarge, &LimitError{
+				APIError: APIError{Message: fmt.Sprintf("store would grow past %d bytes", s.cfg.MaxStoreBytes)},
+				Limit:    s.cfg.MaxStoreBytes,
+				Size:     size,
+			}
+		}
+	}
+
+	return 0, nil
+}
+
+// handleLimits answers with a LimitError when the books do not fit and
+// reports whether the write may go ahead.
+func (s *Server) handleLimits(w http.ResponseWriter, books ...Book) bool {
+	status, limitError := s.checkLimits(books...)
+	if limitError == nil {
+		return true
+	}
+
+	writeLimitError(w, status, limitError)
+	return false
+}
+
+// writeLimitError answers with limitError and its status.
+func writeLimitError(w http.ResponseWriter, status int, limitError *LimitError) {
+	limitError.APIError = newAPIError(w, status, limitError.Code, limitError.Message)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	error, _ := json.Marshal(limitError)
+
+	w.Write(error)
+}
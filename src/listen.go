@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// systemdFirstFD is the first descriptor systemd passes to an activated
+// service.
+const systemdFirstFD = 3
+
+// listen takes over the socket of the server that started this one, or
+// the one systemd passed in LISTEN_FDS, or else opens addr, probing idle
+// TCP connections every keepAlive.
+func listen(addr string, keepAlive time.Duration) (net.Listener, error) {
+	if file := inheritedFile(listenFDEnv, "listener"); file != nil {
+		defer file.Close()
+
+		ln, err := net.FileListener(file)
+		if unix, ok := ln.(*net.UnixListener); ok {
+			unix.SetUnlinkOnClose(true)
+		}
+		return ln, err
+	}
+
+	if file, err := systemdListener(); file != nil || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		return net.FileListener(file)
+	}
+
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		// A socket file left behind by a crash would make Listen fail.
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+
+		return net.Listen("unix", path)
+	}
+
+	lc := net.ListenConfig{KeepAlive: keepAlive}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// systemdListener returns the socket of a socket-activated service, nil
+// when the process was not activated.
+func systemdListener() (*os.File, error) {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if pid != os.Getpid() {
+		return nil, nil
+	}
+
+	fds, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if fds != 1 {
+		return nil, errors.New("systemd passed " + strconv.Itoa(fds) + " sockets, expected one")
+	}
+
+	return os.NewFile(systemdFirstFD, "systemd"), nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Locks and their leases are books under ids no bucket name can produce,
+// so they stay out of every listing. The lock book keeps the owner as its
+// author and the lease id as its name, the lease book the lock name; both
+// expire together, which releases the lock.
+const (
+	lockIdPrefix  = bucketIdPrefix + "#locks/"
+	leaseIdPrefix = bucketIdPrefix + "#leases/"
+)
+
+// Lock is the body of the /locks/ and /leases/ answers. The lease id is
+// only given to the holder. FenceToken is the version of the lock book; it
+// grows with every acquire and keepalive, so sending the latest one as
+// X-Fence-Token keeps a holder whose lease ran out from writing.
+type Lock struct {
+	Name       string    `json:"name"`
+	Owner      string    `json:"owner,omitempty"`
+	LeaseId    string    `json:"lease_id,omitempty"`
+	FenceToken uint64    `json:"fence_token"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+func newLeaseId() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+// lockOf describes the lock kept in book, or nil for no book.
+func lockOf(book *Book) *Lock {
+	if book == nil {
+		return nil
+	}
+
+	lock := &Lock{
+		Name:       strings.TrimPrefix(book.Id, lockIdPrefix),
+		Owner:      book.Author,
+		LeaseId:    book.Name,
+		FenceToken: book.Version,
+	}
+	if book.ExpiresAt != nil {
+		lock.ExpiresAt = *book.ExpiresAt
+	}
+	return lock
+}
+
+func writeLock(w http.ResponseWriter, status int, lock *Lock) {
+	w.WriteHeader(status)
+	body, _ := json.Marshal(lock)
+
+	w.Write(body)
+}
+
+// HandleLock serves a named lock:
+//
+//	GET  /locks/<name>  who holds it, 404 when free
+//	POST /locks/<name>  acquire it for ?ttl= with ?owner=, 409 when held
+func (s *Server) HandleLock(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	name := strings.TrimPrefix(r.URL.Path, "/locks/")
+	if name == "" {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "missing lock name")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		lock := lockOf(s.store.FindBookById(lockIdPrefix + name))
+		if lock == nil {
+			writeError(w, http.StatusNotFound, CodeNotFound, fmt.Sprintf("Lock %s is not held", name))
+			return
+		}
+
+		lock.LeaseId = ""
+		writeLock(w, http.StatusOK, lock)
+
+	case http.MethodPost:
+		s.acquireLock(w, r, name)
+
+	default:
+		HandleMethodIsNotAllowed(w, r)
+	}
+}
+
+func (s *Server) acquireLock(w http.ResponseWriter, r *http.Request, name string) {
+	lease := newLeaseId()
+	lockBook := Book{Id: lockIdPrefix + name, Author: r.URL.Query().Get("owner"), Name: lease}
+
+	if !handleTTL(w, r, &lockBook) {
+		return
+	}
+	if lockBook.ExpiresAt == nil {
+		expiresAt := time.Now().Add(s.cfg.LockTTL)
+		lockBook.ExpiresAt = &expiresAt
+	}
+
+	leaseBook := Book{Id: leaseIdPrefix + lease, Name: name, ExpiresAt: lockBook.ExpiresAt}
+
+	acquired, results, _ := s.store.Txn(
+		[]TxnCompare{{Id: lockBook.Id, If: "absent"}},
+		[]BatchOp{{Op: "put", Book: lockBook}, {Op: "put", Book: leaseBook}},
+		nil, nil,
+	)
+	if !acquired {
+		message := fmt.Sprintf("Lock %s is held", name)
+		if held := lockOf(s.store.FindBookById(lockBook.Id)); held != nil {
+			message = fmt.Sprintf("Lock %s is held until %s", name, held.ExpiresAt.Format(time.RFC3339))
+			if held.Owner != "" {
+				message = fmt.Sprintf("Lock %s is held by %s until %s", name, held.Owner, held.ExpiresAt.Format(time.RFC3339))
+			}
+		}
+
+		writeError(w, http.StatusConflict, CodeLockHeld, message)
+		return
+	}
+
+	lockBook.Version = results[0].Version
+	writeLock(w, http.StatusCreated, lockOf(&lockBook))
+}
+
+// HandleLease serves the lease of an acquired lock:
+//
+//	PUT    /leases/<id>/keepalive  extend it by ?ttl=, by default the last one
+//	DELETE /leases/<id>            release the lock
+func (s *Server) HandleLease(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	path := strings.TrimPrefix(r.URL.Path, "/leases/")
+	lease, keepalive := strings.CutSuffix(path, "/keepalive")
+
+	switch {
+	case lease == "" || strings.Contains(lease, "/"):
+		writeError(w, http.StatusNotFound, CodeNotFound, fmt.Sprintf("No route for %s", r.URL.Path))
+	case keepalive && r.Method == http.MethodPut:
+		s.renewLease(w, r, lease)
+	case !keepalive && r.Method == http.MethodDelete:
+		s.releaseLease(w, lease)
+	default:
+		HandleMethodIsNotAllowed(w, r)
+	}
+}
+
+// leaseBooks reads the lease with the lock it holds, or nils once the
+// lease has expired or been released.
+func (s *Server) leaseBooks(lease string) (*Book, *Book) {
+	leaseBook := s.store.FindBookById(leaseIdPrefix + lease)
+	if leaseBook == nil {
+		return nil, nil
+	}
+
+	lockBook := s.store.FindBookById(lockIdPrefix + leaseBook.Name)
+	if lockBook == nil || lockBook.Name != lease {
+		return nil, nil
+	}
+
+	return leaseBook, lockBook
+}
+
+// leaseUnchanged are the compares that make a write of the lease and its
+// lock fail when either was written since they were read.
+func leaseUnchanged(leaseBook, lockBook *Book) []TxnCompare {
+	return []TxnCompare{
+		{Id: leaseBook.Id, If: "version:" + strconv.FormatUint(leaseBook.Version, 10)},
+		{Id: lockBook.Id, If: "version:" + strconv.FormatUint(lockBook.Version, 10)},
+	}
+}
+
+func (s *Server) renewLease(w http.ResponseWriter, r *http.Request, lease string) {
+	var requested Book
+	if !handleTTL(w, r, &requested) {
+		return
+	}
+
+	for {
+		leaseBook, lockBook := s.leaseBooks(lease)
+		if leaseBook == nil {
+			writeError(w, http.StatusNotFound, CodeNotFound, fmt.Sprintf("Lease %s has expired or was released", lease))
+			return
+		}
+
+		ttl := leaseBook.ExpiresAt.Sub(leaseBook.UpdatedAt)
+		if requested.ExpiresAt != nil {
+			ttl = time.Until(*requested.ExpiresAt)
+		}
+
+		expiresAt := time.Now().Add(ttl)
+		renewedLease, renewedLock := *leaseBook, *lockBook
+		renewedLease.ExpiresAt, renewedLock.ExpiresAt = &expiresAt, &expiresAt
+
+		renewed, results, _ := s.store.Txn(leaseUnchanged(leaseBook, lockBook),
+			[]BatchOp{{Op: "put", Book: renewedLock}, {Op: "put", Book: renewedLease}}, nil, nil)
+		if renewed {
+			renewedLock.Version = results[0].Version
+			writeLock(w, http.StatusOK, lockOf(&renewedLock))
+			return
+		}
+	}
+}
+
+func (s *Server) releaseLease(w http.ResponseWriter, lease string) {
+	for {
+		leaseBook, lockBook := s.leaseBooks(lease)
+		if leaseBook == nil {
+			writeError(w, http.StatusNotFound, CodeNotFound, fmt.Sprintf("Lease %s has expired or was released", lease))
+			return
+		}
+
+		released, _, _ := s.store.Txn(leaseUnchanged(leaseBook, lockBook),
+			[]BatchOp{{Op: "delete", Book: Book{Id: lockBook.Id}}, {Op: "delete", Book: Book{Id: leaseBook.Id}}}, nil, nil)
+		if released {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+}
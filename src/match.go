@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+)
+
+// BulkDelete is the answer of DELETE /list.
+type BulkDelete struct {
+	Matched int  `json:"matched"`
+	Deleted int  `json:"deleted"`
+	DryRun  bool `json:"dry_run,omitempty"`
+}
+
+// keyMatcher reads ?match=, a glob as KEYS takes it, or ?regex=, an RE2
+// expression matching anywhere in the id unless anchored. Without either
+// it matches nothing and reports false.
+func keyMatcher(r *http.Request) (func(id string) bool, bool, error) {
+	query := r.URL.Query()
+
+	if query.Has("match") && query.Has("regex") {
+		return nil, false, errors.New("use either match or regex")
+	}
+
+	if pattern := query.Get("match"); pattern != "" {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, false, errors.New(fmt.Sprintf("invalid match pattern %s", pattern))
+		}
+		return func(id string) bool { return redisMatch(pattern, id) }, true, nil
+	}
+
+	if expr := query.Get("regex"); expr != "" {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, false, errors.New(fmt.Sprintf("invalid regex: %v", err))
+		}
+		return re.MatchString, true, nil
+	}
+
+	return nil, false, nil
+}
+
+// matchingIds returns the sorted ids outside buckets that match.
+func (s *Server) matchingIds(r *http.Request, match func(id string) bool) ([]string, error) {
+	books, err := s.store.GetBooks(r.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0)
+	for _, book := range withoutBuckets(books) {
+		if match(book.Id) {
+			ids = append(ids, book.Id)
+		}
+	}
+	slices.Sort(ids)
+
+	return ids, nil
+}
+
+// HandleList serves the ids matching ?match= or ?regex=:
+//
+//	GET    /list      the ids, sorted, or with ?count-only=true their number
+//	DELETE /list      delete the books, or with ?dry_run=true only count them
+//
+// A delete needs a pattern, matches no reserved id and removes at most
+// -bulk-delete-max books, all of them or none.
+func (s *Server) HandleList(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	match, ok, err := keyMatcher(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+	if !ok && r.Method == http.MethodDelete {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "DELETE /list needs match or regex")
+		return
+	}
+	if !ok {
+		match = func(string) bool { return true }
+	}
+
+	if r.Method == http.MethodGet && r.URL.Query().Get("count-only") == "true" {
+		stop := startTiming(r, "store")
+		count, err := s.store.CountBooks(r.Context(), func(id string) bool { return !inBucket(id) && match(id) })
+		stop()
+		if !handleCanceled(w, err) {
+			return
+		}
+
+		writeCount(w, count)
+		return
+	}
+
+	ids, err := s.matchingIds(r, match)
+	if !handleCanceled(w, err) {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		w.WriteHeader(http.StatusOK)
+		body, _ := json.Marshal(ids)
+
+		w.Write(body)
+		return
+	}
+
+	ids = slices.DeleteFunc(ids, s.cfg.isReservedId)
+	result := BulkDelete{Matched: len(ids), DryRun: r.URL.Query().Get("dry_run") == "true"}
+
+	if !result.DryRun {
+		if len(ids) > s.cfg.BulkDeleteMax {
+			writeError(w, http.StatusRequestEntityTooLarge, CodeTooLarge, fmt.Sprintf("%d books match, more than -bulk-delete-max %d", len(ids), s.cfg.BulkDeleteMax))
+			return
+		}
+
+		w, ok := s.handleFenceToken(w, r)
+		if !ok || !s.handleBackup(w) {
+			return
+		}
+
+		drained, err := s.store.DrainBooks(ids, s.prepareDrain(r))
+		if !handleWriteError(w, err) {
+			return
+		}
+		result.Deleted = len(drained)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	body, _ := json.Marshal(result)
+
+	w.Write(body)
+}
+
+// writeCount answers a query with ?count-only=true.
+func writeCount(w http.ResponseWriter, count int) {
+	w.WriteHeader(http.StatusOK)
+	body, _ := json.Marshal(map[string]int{"count": count})
+
+	w.Write(body)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCountOnly(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{name: "every id", path: "/list?count-only=true", want: `{"count":4}`},
+		{name: "a glob", path: "/list?match=user:*&count-only=true", want: `{"count":2}`},
+		{name: "a regex", path: "/list?regex=^user:[0-9]$&count-only=true", want: `{"count":1}`},
+		{name: "no matches", path: "/list?match=cart:*&count-only=true", want: `{"count":0}`},
+		{name: "a name prefix", path: "/search?prefix=Al&count-only=true", want: `{"count":2}`},
+		{name: "an exact name", path: "/search?value=Bob&count-only=true", want: `{"count":1}`},
+		{name: "ids all the same", path: "/list?match=user:*&count-only=false", want: `["user:1","user:admin"]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ts := newTestServer(t)
+			expired := time.Now().Add(-time.Second)
+			for _, book := range []Book{
+				{Id: "user:1", Name: "Alice"},
+				{Id: "user:admin", Name: "Alfred"},
+				{Id: "order:1", Name: "Bob"},
+				{Id: "order:2", Name: "Carol"},
+				{Id: "user:gone", Name: "Alan", ExpiresAt: &expired},
+				{Id: bucketStoreId("b", "user:2"), Name: "Alma"},
+			} {
+				s.store.AddBook(book)
+			}
+
+			status, body := send(t, http.MethodGet, ts.URL+tt.path, "")
+			if status != http.StatusOK || body != tt.want {
+				t.Errorf("answered %d %s, want %s", status, body, tt.want)
+			}
+		})
+	}
+}
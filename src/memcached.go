@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// memcachedMaxLine bounds a command line; keys are at most 250 bytes.
+const memcachedMaxLine = 2048
+
+// memcachedRelativeExptime is the largest exptime taken as seconds from now
+// rather than a Unix time, as memcached does.
+const memcachedRelativeExptime = 30 * 24 * 60 * 60
+
+// serveMemcachedConn speaks the memcached text protocol, mapping each key
+// to a book id and the value to the book name, like the text operations of
+// the HTTP API. Flags are not kept and read back as 0; the cas unique of
+// gets is the book version.
+func (s *Server) serveMemcachedConn(conn net.Conn) {
+	in := bufio.NewReader(conn)
+	out := bufio.NewWriter(conn)
+
+	for {
+		line, err := readLine(in, memcachedMaxLine)
+		if err == errLineTooLong {
+			out.WriteString("CLIENT_ERROR line too long\r\n")
+			out.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			out.WriteString("ERROR\r\n")
+		} else if fields[0] == "quit" {
+			return
+		} else if reply, ok := s.memcachedCommand(lineRequest(conn, "memcached", fields[0]), in, out, fields); ok {
+			if reply != "" {
+				out.WriteString(reply + "\r\n")
+			}
+		} else {
+			out.WriteString(reply + "\r\n")
+			out.Flush()
+			return
+		}
+
+		// Pipelined commands are answered together.
+		if in.Buffered() == 0 {
+			if out.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+// memcachedWrites are the commands that change a book.
+var memcachedWrites = map[string]bool{
+	"set": true, "add": true, "replace": true, "append": true, "prepend": true, "cas": true,
+	"delete": true, "incr": true, "decr": true, "touch": true,
+}
+
+// memcachedCommand runs one command and returns its reply, "" for none. It
+// reports false when the connection can not go on, e.g. after a data block
+// that was cut short. r is the request the hooks see.
+func (s *Server) memcachedCommand(r *http.Request, in *bufio.Reader, out *bufio.Writer, fields []string) (line string, ok bool) {
+	command, args := fields[0], fields[1:]
+
+	noreply := len(args) > 0 && args[len(args)-1] == "noreply"
+	if noreply {
+		args = args[:len(args)-1]
+	}
+
+	// answered is the reply even when noreply leaves it unsent.
+	answered := ""
+	reply := func(line string) (string, bool) {
+		answered = line
+		if noreply {
+			return "", true
+		}
+		return line, true
+	}
+
+	if memcachedWrites[command] && len(args) > 0 {
+		audited := s.auditWrite(r, []string{s.cfg.normalizeId(args[0])})
+		defer func() { audited(0, cmp.Or(answered, line)) }()
+	}
+
+	switch command {
+	case "get", "gets":
+		if len(args) == 0 {
+			return "ERROR", true
+		}
+
+		for _, key := range args {
+			book := s.store.FindBookById(s.cfg.normalizeId(key))
+			if book == nil || s.cfg.isReservedId(book.Id) {
+				continue
+			}
+
+			if command == "gets" {
+				fmt.Fprintf(out, "VALUE %s 0 %d %d\r\n", key, len(book.Name), book.Version)
+			} else {
+				fmt.Fprintf(out, "VALUE %s 0 %d\r\n", key, len(book.Name))
+			}
+			out.WriteString(book.Name + "\r\n")
+		}
+		return "END", true
+
+	case "set", "add", "replace", "append", "prepend", "cas":
+		want := 4
+		if command == "cas" {
+			want = 5
+		}
+		if len(args) != want {
+			return "ERROR", true
+		}
+
+		_, flagsErr := strconv.ParseUint(args[1], 10, 32)
+		exptime, exptimeErr := strconv.ParseInt(args[2], 10, 64)
+		n, sizeErr := strconv.Atoi(args[3])
+		if flagsErr != nil || exptimeErr != nil || sizeErr != nil || n < 0 {
+			return "CLIENT_ERROR bad command line format", false
+		}
+
+		if int64(n) > s.cfg.MaxBodyBytes {
+			if _, err := io.CopyN(io.Discard, in, int64(n)+2); err != nil {
+				return "", false
+			}
+			return reply("SERVER_ERROR object too large for cache")
+		}
+
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(in, data); err != nil {
+			return "", false
+		}
+		if string(data[n:]) != "\r\n" {
+			return "CLIENT_ERROR bad data chunk", false
+		}
+		value := string(data[:n])
+
+		var casUnique uint64
+		if command == "cas" {
+			var err error
+			if casUnique, err = strconv.ParseUint(args[4], 10, 64); err != nil {
+				return "CLIENT_ERROR bad command line format", false
+			}
+		}
+
+		return reply(s.memcachedStore(r, command, args[0], value, exptime, casUnique))
+
+	case "delete":
+		if len(args) != 1 {
+			return "ERROR", true
+		}
+
+		id, refused := s.memcachedWritable(args[0])
+		if refused != "" {
+			return reply(refused)
+		}
+
+		drained, err := s.store.DrainBooks([]string{id}, s.prepareDrain(r))
+		if err != nil {
+			return reply("SERVER_ERROR " + err.Error())
+		}
+		if len(drained) == 0 {
+			return reply("NOT_FOUND")
+		}
+		return reply("DELETED")
+
+	case "incr", "decr":
+		if len(args) != 2 {
+			return "ERROR", true
+		}
+
+		delta, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return reply("CLIENT_ERROR invalid numeric delta argument")
+		}
+
+		return reply(s.memcachedIncr(r, args[0], delta, command == "decr"))
+
+	case "touch":
+		if len(args) != 2 {
+			return "ERROR", true
+		}
+
+		exptime, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return reply("CLIENT_ERROR invalid exptime argument")
+		}
+
+		return reply(s.memcachedModify(r, args[0], func(book *Book) string {
+			if book.Version == 0 {
+				return "NOT_FOUND"
+			}
+			book.ExpiresAt = memcachedExpiry(exptime)
+			return ""
+		}, "TOUCHED"))
+
+	case "version":
+		return "VERSION books", true
+
+	case "verbosity":
+		return reply("OK")
+	}
+
+	return "ERROR", true
+}
+
+// memcachedWritable returns the book id for key, or the reply refusing a
+// write to it.
+func (s *Server) memcachedWritable(key string) (string, string) {
+	if len(key) > 250 {
+		return "", "CLIENT_ERROR key too long"
+	}
+
+	id := s.cfg.normalizeId(key)
+
+	if s.cfg.isReservedId(id) {
+		return "", fmt.Sprintf("CLIENT_ERROR book id %s is reserved", id)
+	}
+
+	if refused := s.writesRefused(); refused != "" {
+		return "", "SERVER_ERROR " + refused
+	}
+
+	return id, ""
+}
+
+// memcachedModify writes the book as change leaves it, see changeBook,
+// and answers done once it is stored.
+func (s *Server) memcachedModify(r *http.Request, key string, change func(book *Book) string, done string) string {
+	id, refused := s.memcachedWritable(key)
+	if refused != "" {
+		return refused
+	}
+
+	reply, err := s.changeBook(r, id, change)
+	if err != nil {
+		return "SERVER_ERROR " + err.Error()
+	}
+	if reply != "" {
+		return reply
+	}
+	return done
+}
+
+// memcachedStore runs the storage commands. Only the name changes, so the
+// author and the rest of a stored book stay.
+func (s *Server) memcachedStore(r *http.Request, command, key, value string, exptime int64, casUnique uint64) string {
+	if !utf8.ValidString(value) {
+		return "CLIENT_ERROR value is not valid UTF-8"
+	}
+
+	return s.memcachedModify(r, key, func(book *Book) string {
+		exists := book.Version != 0
+
+		switch {
+		case command == "add" && exists:
+			return "NOT_STORED"
+		case (command == "replace" || command == "append" || command == "prepend") && !exists:
+			return "NOT_STORED"
+		case command == "cas" && !exists:
+			return "NOT_FOUND"
+		case command == "cas" && book.Version != casUnique:
+			return "EXISTS"
+		}
+
+		switch command {
+		case "append":
+			book.Name += value
+		case "prepend":
+			book.Name = value + book.Name
+		default:
+			book.Name = value
+			book.ExpiresAt = memcachedExpiry(exptime)
+		}
+		return ""
+	}, "STORED")
+}
+
+// memcachedIncr treats the name as an unsigned 64 bit number, as memcached
+// does: incr wraps around and decr stops at 0.
+func (s *Server) memcachedIncr(r *http.Request, key string, delta uint64, decr bool) string {
+	var result uint64
+
+	reply := s.memcachedModify(r, key, func(book *Book) string {
+		if book.Version == 0 {
+			return "NOT_FOUND"
+		}
+
+		current, err := strconv.ParseUint(book.Name, 10, 64)
+		if err != nil {
+			return "CLIENT_ERROR cannot increment or decrement non-numeric value"
+		}
+
+		switch {
+		case !decr:
+			result = current + delta
+		case delta > current:
+			result = 0
+		default:
+			result = current - delta
+		}
+
+		book.Name = strconv.FormatUint(result, 10)
+		return ""
+	}, "")
+
+	if reply != "" {
+		return reply
+	}
+	return strconv.FormatUint(result, 10)
+}
+
+// memcachedExpiry turns an exptime into an expiry: 0 never expires, up to
+// 30 days counts seconds from now, anything larger is a Unix time and a
+// negative one has already passed.
+func memcachedExpiry(exptime int64) *time.Time {
+	var expiresAt time.Time
+
+	switch {
+	case exptime == 0:
+		return nil
+	case exptime < 0:
+		expiresAt = time.Now()
+	case exptime <= memcachedRelativeExptime:
+		expiresAt = time.Now().Add(time.Duration(exptime) * time.Second)
+	default:
+		expiresAt = time.Unix(min(exptime, math.MaxInt32*int64(2)), 0)
+	}
+
+	return &expiresAt
+}
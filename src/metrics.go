@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// streaming counts a streaming response as open until the func it returns
+// is called, once the handler stopped writing it.
+func (s *Server) streaming() func() {
+	s.openStreams.Add(1)
+	return func() { s.openStreams.Add(-1) }
+}
+
+// storeCounters is a store counting the books it evicted and the corrupt
+// reads it found.
+type storeCounters interface {
+	Counters() (evicted, corruptReads uint64)
+	ResetCounters()
+}
+
+// latencyBuckets are the upper bounds, in seconds, of the latency histogram.
+var latencyBuckets = []float64{0.0005, 0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+type requestKey struct {
+	route  string
+	method string
+	status int
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// Metrics collects request counters and latency histograms for /metrics.
+type Metrics struct {
+	mu       sync.Mutex
+	requests map[requestKey]uint64
+	latency  map[string]*histogram
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests: make(map[requestKey]uint64),
+		latency:  make(map[string]*histogram),
+	}
+}
+
+func (m *Metrics) Observe(route, method string, status int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[requestKey{route: route, method: method, status: status}]++
+
+	h, ok := m.latency[route]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latency[route] = h
+	}
+
+	seconds := d.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// Reset forgets every request observed so far.
+func (m *Metrics) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests = make(map[requestKey]uint64)
+	m.latency = make(map[string]*histogram)
+}
+
+// Render renders the collected metrics in the Prometheus text format.
+func (m *Metrics) Render(buf *bytes.Buffer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].status < keys[j].status
+	})
+
+	buf.WriteString("# HELP bookstore_http_requests_total Requests served, by route, method and status.\n")
+	buf.WriteString("# TYPE bookstore_http_requests_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(buf, "bookstore_http_requests_total{route=%q,method=%q,status=\"%d\"} %d\n",
+			key.route, key.method, key.status, m.requests[key])
+	}
+
+	routes := make([]string, 0, len(m.latency))
+	for route := range m.latency {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	buf.WriteString("# HELP bookstore_http_request_duration_seconds Request latency, by route.\n")
+	buf.WriteString("# TYPE bookstore_http_request_duration_seconds histogram\n")
+	for _, route := range routes {
+		h := m.latency[route]
+
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(buf, "bookstore_http_request_duration_seconds_bucket{route=%q,le=%q} %d\n",
+				route, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(buf, "bookstore_http_request_duration_seconds_bucket{route=%q,le=\"+Inf\"} %d\n", route, h.count)
+		fmt.Fprintf(buf, "bookstore_http_request_duration_seconds_sum{route=%q} %g\n", route, h.sum)
+		fmt.Fprintf(buf, "bookstore_http_request_duration_seconds_count{route=%q} %d\n", route, h.count)
+	}
+}
+
+func writeGauge(buf *bytes.Buffer, name, help string, value float64) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, help, name, name, value)
+}
+
+func (s *Server) MetricsMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		body := &countingBody{ReadCloser: r.Body}
+		r.Body = body
+
+		next.ServeHTTP(rec, r)
+
+		elapsed := time.Since(start)
+
+		s.metrics.Observe(r.Pattern, r.Method, rec.status, elapsed)
+		s.opStats.Observe(r, elapsed)
+		s.warnings.Observe(r, rec.status, elapsed, body.n, rec.written)
+	}
+}
+
+// HandleMetricsReset zeroes the counters and histograms, each collector at
+// once under its own lock. It is only routed with -allow-metrics-reset.
+func (s *Server) HandleMetricsReset(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	s.metrics.Reset()
+	s.warnings.Reset()
+	s.opStats.Reset()
+	s.store.Watchers().ResetDropped()
+	if counters, ok := s.store.(storeCounters); ok {
+		counters.ResetCounters()
+	}
+
+	w.WriteHeader(http.StatusOK)
+	body, _ := json.Marshal(map[string]bool{"reset": true})
+
+	w.Write(body)
+}
+
+func (s *Server) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+
+	s.metrics.Render(&buf)
+	s.warnings.Render(&buf)
+
+	keyBytes, valueBytes := s.store.SizeBytes()
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	books, _ := s.store.GetBooks(context.Background())
+
+	var evicted uint64
+	if counters, ok := s.store.(storeCounters); ok {
+		evicted, _ = counters.Counters()
+	}
+
+	writeGauge(&buf, "bookstore_books", "Books currently stored.", float64(len(books)))
+	writeGauge(&buf, "bookstore_key_bytes", "Total length of all book ids.", float64(keyBytes))
+	writeGauge(&buf, "bookstore_value_bytes", "Total length of all book values.", float64(valueBytes))
+	fmt.Fprintf(&buf, "# HELP bookstore_evictions_total Books evicted by -max-memory.\n# TYPE bookstore_evictions_total counter\nbookstore_evictions_total %d\n", evicted)
+	fmt.Fprintf(&buf, "# HELP bookstore_watch_events_dropped_total Events a watcher could not take for a full buffer, each dropping the watcher.\n# TYPE bookstore_watch_events_dropped_total counter\nbookstore_watch_events_dropped_total %d\n", s.store.Watchers().Dropped())
+	writeGauge(&buf, "bookstore_open_streams", "Exports, watches, subscriptions and replication streams being written.", float64(s.openStreams.Load()))
+	writeGauge(&buf, "go_memstats_heap_alloc_bytes", "Bytes of allocated heap objects.", float64(mem.HeapAlloc))
+	writeGauge(&buf, "go_memstats_sys_bytes", "Bytes of memory obtained from the OS.", float64(mem.Sys))
+	writeGauge(&buf, "go_goroutines", "Goroutines that currently exist.", float64(runtime.NumGoroutine()))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+
+	w.Write(buf.Bytes())
+}
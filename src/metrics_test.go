@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetricsReset(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed bool
+		method  string
+		status  int
+		reset   bool // whether the counters are zero afterwards
+	}{
+		{name: "reset", allowed: true, method: http.MethodPost, status: http.StatusOK, reset: true},
+		{name: "another method", allowed: true, method: http.MethodGet, status: http.StatusMethodNotAllowed},
+		{name: "without -allow-metrics-reset", method: http.MethodPost, status: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.AllowMetricsReset = tt.allowed
+			s, ts := newTestServer(t, WithConfig(cfg))
+			s.store.AddBook(Book{Id: "a", Name: "1"})
+
+			send(t, http.MethodGet, ts.URL+"/book/a", "")
+			send(t, http.MethodGet, ts.URL+"/book/missing", "")
+			s.store.(*MemoryStore).evicted.Add(1)
+
+			if status, body := send(t, tt.method, ts.URL+"/metrics/reset", ""); status != tt.status {
+				t.Fatalf("status %d %s, want %d", status, body, tt.status)
+			}
+
+			_, rendered := send(t, http.MethodGet, ts.URL+"/metrics", "")
+			counted := strings.Contains(rendered, "bookstore_http_requests_total{") ||
+				strings.Contains(rendered, "bookstore_http_request_duration_seconds_bucket{") ||
+				!strings.Contains(rendered, "bookstore_evictions_total 0")
+			if counted == tt.reset {
+				t.Errorf("counters reset is %v, want %v:\n%s", !counted, tt.reset, rendered)
+			}
+
+			_, body := send(t, http.MethodGet, ts.URL+"/admin/stats", "")
+			var stats AdminStats
+			if err := json.Unmarshal([]byte(body), &stats); err != nil {
+				t.Fatal(err)
+			}
+			if (len(stats.SlowestKeys) == 0) != tt.reset {
+				t.Errorf("slowest keys %v after the reset", stats.SlowestKeys)
+			}
+		})
+	}
+}
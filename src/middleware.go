@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	mrand "math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type Middleware func(http.HandlerFunc) http.HandlerFunc
+
+// builtinMiddlewares are the layers every server can name in its orders,
+// over the state of s.
+func (s *Server) builtinMiddlewares() map[string]Middleware {
+	return map[string]Middleware{
+		"trace":       s.Trace,
+		"slow-start":  s.SlowStart,
+		"auth":        s.apiKeys.Auth,
+		"logger":      Logger,
+		"metrics":     s.MetricsMiddleware,
+		"rate-limit":  s.RateLimit,
+		"gzip":        s.Gzip,
+		"idempotency": s.Idempotency,
+	}
+}
+
+// Chain is an ordered list of middleware layers, outermost first, and the
+// layers every route has inside Recovery whatever the order.
+type Chain struct {
+	layers []Middleware
+	always []Middleware
+}
+
+// NewChain builds a chain from a comma-separated list of the names of
+// layers in registry.
+func NewChain(order string, registry map[string]Middleware) (Chain, error) {
+	chain := Chain{}
+	seen := make(map[string]bool)
+
+	for _, name := range strings.Split(order, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		layer, ok := registry[name]
+		if !ok {
+			return chain, errors.New(fmt.Sprintf("unknown middleware %s", name))
+		}
+
+		if seen[name] {
+			return chain, errors.New(fmt.Sprintf("middleware %s listed twice", name))
+		}
+		seen[name] = true
+
+		chain.layers = append(chain.layers, layer)
+	}
+
+	return chain, nil
+}
+
+// Then wraps h in every layer of the chain, with Recovery around them all.
+// The layers it always has, such as ReadOnly, sit just inside Recovery so
+// they cover every other layer.
+func (c Chain) Then(h http.HandlerFunc) http.HandlerFunc {
+	for i := len(c.layers) - 1; i >= 0; i-- {
+		h = c.layers[i](h)
+	}
+
+	for i := len(c.always) - 1; i >= 0; i-- {
+		h = c.always[i](h)
+	}
+
+	return Recovery(h)
+}
+
+// RouteChains is a chain for every route group, by pattern prefix, and
+// the chain of the routes in none.
+type RouteChains struct {
+	fallback Chain
+	groups   map[string]Chain
+}
+
+// parseRouteMiddleware reads -route-middleware into orders by prefix.
+func parseRouteMiddleware(value string) (map[string]string, error) {
+	orders := make(map[string]string)
+
+	for _, group := range strings.Split(value, ";") {
+		group = strings.TrimSpace(group)
+		if group == "" {
+			continue
+		}
+
+		prefix, order, ok := strings.Cut(group, "=")
+		prefix = strings.TrimSpace(prefix)
+		if !ok || !strings.HasPrefix(prefix, "/") {
+			return nil, errors.New(fmt.Sprintf("invalid route group %q, expected prefix=layers", group))
+		}
+
+		if _, ok := orders[prefix]; ok {
+			return nil, errors.New(fmt.Sprintf("route group %s listed twice", prefix))
+		}
+		orders[prefix] = order
+	}
+
+	return orders, nil
+}
+
+// NewRouteChains builds the chain of order and one chain for every group
+// in groups, by prefix, from the layers in registry. Every chain also has
+// the layers of always, outermost first.
+func NewRouteChains(order string, groups map[string]string, registry map[string]Middleware, always ...Middleware) (RouteChains, error) {
+	chains := RouteChains{groups: make(map[string]Chain)}
+
+	var err error
+	if chains.fallback, err = NewChain(order, registry); err != nil {
+		return chains, err
+	}
+	chains.fallback.always = always
+
+	for prefix, order := range groups {
+		chain, err := NewChain(order, registry)
+		if err != nil {
+			return chains, errors.New(fmt.Sprintf("route group %s: %v", prefix, err))
+		}
+		chain.always = always
+		chains.groups[prefix] = chain
+	}
+
+	return chains, nil
+}
+
+// group returns the longest group prefix of pattern, or "".
+func (rc RouteChains) group(pattern string) string {
+	longest := ""
+	for prefix := range rc.groups {
+		if strings.HasPrefix(pattern, prefix) && len(prefix) > len(longest) {
+			longest = prefix
+		}
+	}
+	return longest
+}
+
+// Then wraps h in the chain of every group and picks one per request by
+// the pattern the mux matched, so routes are registered the same way
+// whatever group they fall in.
+func (rc RouteChains) Then(h http.HandlerFunc) http.HandlerFunc {
+	fallback := rc.fallback.Then(h)
+
+	grouped := make(map[string]http.HandlerFunc, len(rc.groups))
+	for prefix, chain := range rc.groups {
+		grouped[prefix] = chain.Then(h)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if prefix := rc.group(r.Pattern); prefix != "" {
+			grouped[prefix](w, r)
+			return
+		}
+		fallback(w, r)
+	}
+}
+
+func Recovery(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		defer func() {
+			if err := recover(); err != nil {
+				log.Printf("panic serving %s %s (request %s): %v", r.Method, r.URL.Path, requestID(r.Context()), err)
+				writeError(w, http.StatusInternalServerError, CodeInternal, "internal server error")
+			}
+		}()
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// Logger writes one structured log record per request once it has been
+// served.
+func Logger(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r)
+
+		slog.Info("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"latency", time.Since(start),
+			"remote_addr", r.RemoteAddr,
+			"request_id", requestID(r.Context()),
+		)
+	}
+}
+
+func newRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+// Auth accepts HTTP Basic credentials or an API key sent as a bearer token
+// or X-API-Key. Writes need a key with write access; reads need any valid
+// credentials unless -auth-reads=false.
+func (k *APIKeys) Auth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		access, ok := k.authenticate(r)
+		write := isWriteMethod(r.Method)
+
+		if !ok && (write || k.authReads || hasCredentials(r)) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="books"`)
+			writeError(w, http.StatusUnauthorized, CodeUnauthorized, "authorization failed")
+			return
+		}
+
+		if ok && write && access != accessWrite {
+			writeError(w, http.StatusForbidden, CodeForbidden, "credentials do not allow writes")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// hasCredentials reports whether the client sent credentials at all; wrong
+// ones are refused even where anonymous access is allowed.
+func hasCredentials(r *http.Request) bool {
+	return r.Header.Get("Authorization") != "" || r.Header.Get("X-API-Key") != ""
+}
+
+func isWriteMethod(method string) bool {
+	return method != http.MethodGet && method != http.MethodHead && method != http.MethodOptions
+}
+
+func (s *Server) SlowStart(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if mrand.Float64() >= acceptedFraction(time.Since(s.startedAt), s.cfg.SlowStart) {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusServiceUnavailable, CodeUnavailable, "server is warming up")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// acceptedFraction grows linearly from 0 to 1 over window, the -slow-start
+// window.
+func acceptedFraction(elapsed, window time.Duration) float64 {
+	if window <= 0 || elapsed >= window {
+		return 1
+	}
+	return float64(elapsed) / float64(window)
+}
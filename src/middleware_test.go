@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMiddlewareOrder(t *testing.T) {
+	tests := []struct {
+		name   string
+		order  string
+		routes map[string]string
+		path   string
+		status int
+		want   []string // the layers that ran, outermost first
+		err    bool
+	}{
+		{name: "as listed", order: "one,two,three", path: "/books/", status: 200, want: []string{"one", "two", "three"}},
+		{name: "another order", order: "three, one", path: "/books/", status: 200, want: []string{"three", "one"}},
+		{name: "no layers", order: "", path: "/books/", status: 200, want: []string{}},
+		{name: "a route group", order: "one,two", routes: map[string]string{"/size-bytes": "two"}, path: "/size-bytes", status: 200, want: []string{"two"}},
+		{name: "outside a route group", order: "one,two", routes: map[string]string{"/size-bytes": "two"}, path: "/books/", status: 200, want: []string{"one", "two"}},
+		{name: "recovery is outermost", order: "one,panic,two", path: "/books/", status: 500, want: []string{"one"}},
+		{name: "an unknown layer", order: "one,nope", err: true},
+		{name: "a layer twice", order: "one,two,one", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			ran := make([]string, 0)
+
+			record := func(name string) Middleware {
+				return func(next http.HandlerFunc) http.HandlerFunc {
+					return func(w http.ResponseWriter, r *http.Request) {
+						mu.Lock()
+						ran = append(ran, name)
+						mu.Unlock()
+						next(w, r)
+					}
+				}
+			}
+			panics := func(next http.HandlerFunc) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) { panic("layer failed") }
+			}
+
+			opts := []ServerOption{
+				WithMiddleware("one", record("one")),
+				WithMiddleware("two", record("two")),
+				WithMiddleware("three", record("three")),
+				WithMiddleware("panic", panics),
+				WithMiddlewareOrder(tt.order),
+			}
+			for prefix, order := range tt.routes {
+				opts = append(opts, WithRouteMiddleware(prefix, order))
+			}
+
+			s, err := New(opts...)
+			if tt.err {
+				if err == nil {
+					t.Fatal("New accepted the order")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+			if !slices.Equal(ran, tt.want) {
+				t.Errorf("ran %v, want %v", ran, tt.want)
+			}
+		})
+	}
+}
+
+func TestAcceptedFraction(t *testing.T) {
+	tests := []struct {
+		name      string
+		slowStart time.Duration
+		elapsed   time.Duration
+		want      float64
+	}{
+		{name: "without slow start", elapsed: 0, want: 1},
+		{name: "at startup", slowStart: 10 * time.Second, elapsed: 0, want: 0},
+		{name: "a quarter in", slowStart: 10 * time.Second, elapsed: 2500 * time.Millisecond, want: 0.25},
+		{name: "half way", slowStart: 10 * time.Second, elapsed: 5 * time.Second, want: 0.5},
+		{name: "at the end", slowStart: 10 * time.Second, elapsed: 10 * time.Second, want: 1},
+		{name: "past the end", slowStart: 10 * time.Second, elapsed: time.Minute, want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := acceptedFraction(tt.elapsed, tt.slowStart); got != tt.want {
+				t.Errorf("acceptedFraction(%v) = %v, want %v", tt.elapsed, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSlowStartRejectsLessOverTime samples the share of requests SlowStart
+// refuses at points of the window, which must shrink as it goes.
+func TestSlowStartRejectsLessOverTime(t *testing.T) {
+	const requests = 1000
+
+	cfg := DefaultConfig()
+	cfg.SlowStart = time.Hour
+
+	s, _ := newTestServer(t, WithConfig(cfg))
+	handler := s.SlowStart(func(w http.ResponseWriter, r *http.Request) {})
+
+	last := 1.1
+	for _, elapsed := range []time.Duration{0, 15 * time.Minute, 30 * time.Minute, 45 * time.Minute, time.Hour} {
+		s.startedAt = time.Now().Add(-elapsed)
+
+		rejected := 0
+		for range requests {
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest(http.MethodGet, "/books/", nil))
+
+			if w.Code == http.StatusServiceUnavailable {
+				rejected++
+				if w.Header().Get("Retry-After") == "" {
+					t.Fatal("a rejection without Retry-After")
+				}
+			}
+		}
+
+		share, want := float64(rejected)/requests, 1-float64(elapsed)/float64(time.Hour)
+		if share > want+0.08 || share < want-0.08 || share > last {
+			t.Errorf("%v into the window rejected %.2f, want about %.2f and below %.2f", elapsed, share, want, last)
+		}
+		last = share
+	}
+}
+
+func TestRateLimitClient(t *testing.T) {
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   string
+	}{
+		{name: "no credentials", want: "ip 192.0.2.1"},
+		{name: "a valid user", header: map[string]string{"Authorization": "Basic dGVzdDp0ZXN0"}, want: "user test"},
+		{name: "a wrong password", header: map[string]string{"Authorization": "Basic dGVzdDpub3Bl"}, want: "ip 192.0.2.1"},
+		{name: "a valid key", header: map[string]string{"X-API-Key": "secret"}, want: "key secret"},
+		{name: "a valid bearer token", header: map[string]string{"Authorization": "Bearer secret"}, want: "key secret"},
+		{name: "a made-up key", header: map[string]string{"X-API-Key": "made-up"}, want: "ip 192.0.2.1"},
+		{name: "a tenant key", header: map[string]string{"X-API-Key": "tenant-secret"}, want: "tenant acme"},
+	}
+
+	keys := &APIKeys{}
+	keys.Set([]APIKey{{Key: "secret", Access: accessWrite}, {Key: "tenant-secret", Access: accessWrite, Tenant: "acme"}})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/books/", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			for name, value := range tt.header {
+				r.Header.Set(name, value)
+			}
+
+			if client := keys.rateLimitClient(r); client != tt.want {
+				t.Errorf("client %q, want %q", client, tt.want)
+			}
+		})
+	}
+}
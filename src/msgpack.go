@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+	"unicode/utf8"
+)
+
+// Books are encoded in MessagePack as maps with the keys of their JSON,
+// leaving out the same empty fields. Content is bin and the times use the
+// timestamp extension, so they take their natural types rather than
+// base64 and RFC 3339 strings.
+
+// msgpackMaxDepth bounds the nesting of decoded bodies.
+const msgpackMaxDepth = 32
+
+const msgpackTimestampType = -1
+
+func appendMsgpackMap(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xde), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, 0xdf), uint32(n))
+}
+
+func appendMsgpackArray(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xdc), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, 0xdd), uint32(n))
+}
+
+func appendMsgpackString(b []byte, s string) []byte {
+	switch {
+	case len(s) < 32:
+		b = append(b, 0xa0|byte(len(s)))
+	case len(s) <= math.MaxUint8:
+		b = append(b, 0xd9, byte(len(s)))
+	case len(s) <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(len(s)))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(len(s)))
+	}
+	return append(b, s...)
+}
+
+func appendMsgpackBin(b []byte, data []byte) []byte {
+	switch {
+	case len(data) <= math.MaxUint8:
+		b = append(b, 0xc4, byte(len(data)))
+	case len(data) <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xc5), uint16(len(data)))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xc6), uint32(len(data)))
+	}
+	return append(b, data...)
+}
+
+func appendMsgpackUint(b []byte, v uint64) []byte {
+	switch {
+	case v < 128:
+		return append(b, byte(v))
+	case v <= math.MaxUint8:
+		return append(b, 0xcc, byte(v))
+	case v <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xcd), uint16(v))
+	case v <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, 0xce), uint32(v))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xcf), v)
+}
+
+// appendMsgpackTime uses the 96-bit timestamp, which holds any time.
+func appendMsgpackTime(b []byte, t time.Time) []byte {
+	b = append(b, 0xc7, 12, 0xff)
+	b = binary.BigEndian.AppendUint32(b, uint32(t.Nanosecond()))
+	return binary.BigEndian.AppendUint64(b, uint64(t.Unix()))
+}
+
+func appendMsgpackStrings(b []byte, items []string) []byte {
+	b = appendMsgpackArray(b, len(items))
+	for _, item := range items {
+		b = appendMsgpackString(b, item)
+	}
+	return b
+}
+
+func appendMsgpackBook(b []byte, book Book) []byte {
+	var fields []byte
+	n := 0
+
+	key := func(name string) {
+		n++
+		fields = appendMsgpackString(fields, name)
+	}
+
+	key("id")
+	fields = appendMsgpackString(fields, book.Id)
+	key("author")
+	fields = appendMsgpackString(fields, book.Author)
+	key("name")
+	fields = appendMsgpackString(fields, book.Name)
+	if book.ExpiresAt != nil {
+		key("expires_at")
+		fields = appendMsgpackTime(fields, *book.ExpiresAt)
+	}
+	key("version")
+	fields = appendMsgpackUint(fields, book.Version)
+	if !book.CreatedAt.IsZero() {
+		key("created_at")
+		fields = appendMsgpackTime(fields, book.CreatedAt)
+	}
+	if !book.UpdatedAt.IsZero() {
+		key("updated_at")
+		fields = appendMsgpackTime(fields, book.UpdatedAt)
+	}
+	if len(book.Content) > 0 {
+		key("content")
+		fields = appendMsgpackBin(fields, book.Content)
+	}
+	if book.ContentType != "" {
+		key("content_type")
+		fields = appendMsgpackString(fields, book.ContentType)
+	}
+	if len(book.List) > 0 {
+		key("list")
+		fields = appendMsgpackStrings(fields, book.List)
+	}
+	if len(book.Set) > 0 {
+		key("set")
+		fields = appendMsgpackStrings(fields, book.Set)
+	}
+
+	return append(appendMsgpackMap(b, n), fields...)
+}
+
+func msgpackBooks(books []Book) []byte {
+	b := appendMsgpackArray(nil, len(books))
+	for _, book := range books {
+		b = appendMsgpackBook(b, book)
+	}
+	return b
+}
+
+// msgpackDecoder reads MessagePack into the values encoding/json makes of
+// JSON, with bin as []byte and timestamps as time.Time, which marshal back
+// to the JSON the struct tags expect.
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+// msgpackToJSON converts a MessagePack body into JSON, so it decodes into
+// the same types with the same rules as a JSON body.
+func msgpackToJSON(data []byte) ([]byte, error) {
+	d := &msgpackDecoder{data: data}
+
+	v, err := d.value(0)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid msgpack at byte %d: %v", d.pos, err))
+	}
+	if d.pos != len(data) {
+		return nil, errors.New(fmt.Sprintf("invalid msgpack: %d bytes after the value", len(data)-d.pos))
+	}
+
+	return json.Marshal(v)
+}
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || n > len(d.data)-d.pos {
+		return nil, errors.New("unexpected end of data")
+	}
+
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// size reads a big-endian length or number of n bytes.
+func (d *msgpackDecoder) size(n int) (uint64, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+
+	v := uint64(0)
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func (d *msgpackDecoder) value(depth int) (any, error) {
+	if depth > msgpackMaxDepth {
+		return nil, errors.New("nested too deep")
+	}
+
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	c := b[0]
+
+	switch {
+	case c <= 0x7f:
+		return uint64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return d.object(int(c&0x0f), depth)
+	case c&0xf0 == 0x90:
+		return d.array(int(c&0x0f), depth)
+	case c&0xe0 == 0xa0:
+		return d.str(int(c & 0x1f))
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.size(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return d.next(int(n))
+
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.size(1 << (c - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return d.ext(int(n))
+
+	case 0xca:
+		bits, err := d.size(4)
+		return float64(math.Float32frombits(uint32(bits))), err
+	case 0xcb:
+		bits, err := d.size(8)
+		return math.Float64frombits(bits), err
+
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return d.size(1 << (c - 0xcc))
+
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		n := 1 << (c - 0xd0)
+		v, err := d.size(n)
+		shift := 64 - 8*n
+		return int64(v<<shift) >> shift, err
+
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.ext(1 << (c - 0xd4))
+
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.size(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(n))
+
+	case 0xdc, 0xdd:
+		n, err := d.size(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.array(int(n), depth)
+
+	case 0xde, 0xdf:
+		n, err := d.size(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.object(int(n), depth)
+	}
+
+	return nil, errors.New(fmt.Sprintf("unknown type byte 0x%02x", c))
+}
+
+func (d *msgpackDecoder) str(n int) (any, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	if !utf8.Valid(b) {
+		return nil, errors.New("string is not valid UTF-8")
+	}
+	return string(b), nil
+}
+
+// array and object check n against what is left, as every element takes
+// at least a byte, before allocating for it.
+func (d *msgpackDecoder) array(n, depth int) (any, error) {
+	if n > len(d.data)-d.pos {
+		return nil, errors.New("unexpected end of data")
+	}
+
+	items := make([]any, 0, n)
+	for range n {
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, v)
+	}
+	return items, nil
+}
+
+func (d *msgpackDecoder) object(n, depth int) (any, error) {
+	if 2*n > len(d.data)-d.pos {
+		return nil, errors.New("unexpected end of data")
+	}
+
+	fields := make(map[string]any, n)
+	for range n {
+		k, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, errors.New("map keys must be strings")
+		}
+
+		fields[key], err = d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fields, nil
+}
+
+// ext reads an extension of n data bytes. Only timestamps are known.
+func (d *msgpackDecoder) ext(n int) (any, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	if int8(b[0]) != msgpackTimestampType {
+		return nil, errors.New(fmt.Sprintf("unknown extension type %d", int8(b[0])))
+	}
+
+	data, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n {
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(data)), 0).UTC(), nil
+	case 8:
+		v := binary.BigEndian.Uint64(data)
+		return time.Unix(int64(v&(1<<34-1)), int64(v>>34)).UTC(), nil
+	case 12:
+		return time.Unix(int64(binary.BigEndian.Uint64(data[4:])), int64(binary.BigEndian.Uint32(data))).UTC(), nil
+	}
+	return nil, errors.New(fmt.Sprintf("invalid timestamp of %d bytes", n))
+}
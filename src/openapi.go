@@ -0,0 +1,426 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed swagger.html
+var swaggerPage []byte
+
+// apiParam is a string parameter of an operation, in path, query or header.
+type apiParam struct {
+	name, in, description string
+}
+
+// apiOperation describes one method of a route for /openapi.json. Body and
+// response are zero values of the Go types sent, nil for none and a string
+// for a JSON string; errors are the statuses it answers with an APIError.
+type apiOperation struct {
+	method, path, summary string
+	params                []apiParam
+	body, response        any
+	errors                []int
+}
+
+var (
+	idParam        = apiParam{"id", "path", "book id"}
+	bucketParam    = apiParam{"bucket", "path", "bucket name"}
+	matchParam     = apiParam{"match", "query", "glob of ids, * and ? matching any characters"}
+	regexParam     = apiParam{"regex", "query", "RE2 expression found anywhere in the id"}
+	lockParam      = apiParam{"name", "path", "lock name"}
+	channelParam   = apiParam{"channel", "path", "pub/sub channel name"}
+	leaseParam     = apiParam{"lease", "path", "lease id of an acquired lock"}
+	scriptParam    = apiParam{"script", "path", "script name"}
+	fenceParam     = apiParam{"X-Fence-Token", "header", "rejects the write when older than the newest token seen"}
+	ttlParam       = apiParam{"ttl", "query", "lifetime of the book, e.g. 10m"}
+	countOnlyParam = apiParam{"count-only", "query", `true to answer only {"count":n}`}
+	ifParam        = apiParam{"if", "query", "condition: absent, present, version:<n>, etag:<tag>, eq:<name> or ne:<name>"}
+	ifMatchParam   = apiParam{"If-Match", "header", "ETag the stored book must still have"}
+	atParam        = apiParam{"at", "query", "reads the store as it was at this version or RFC 3339 time, as far back as -history-depth keeps versions of each book; deleted books are not seen"}
+
+	idempotencyParam = apiParam{"Idempotency-Key", "header", "retries sent with the same key get the first answer instead of writing again"}
+)
+
+// apiOperations lists the routes served by main. Keep it in step when
+// adding one.
+var apiOperations = []apiOperation{
+	{method: "get", path: "/books/", summary: "List books, all at once or by ?limit= pages of ids with ?prefix=",
+		params:   []apiParam{{"prefix", "query", "only ids starting with it; asks for pages"}, {"limit", "query", "page size"}, {"cursor", "query", "next_cursor of the previous page"}, {"sort", "query", "field to sort a full listing by"}, {"order", "query", "asc or desc"}, {"modified_since", "query", "RFC 3339 time; only books updated after it"}, atParam},
+		response: []Book{}, errors: []int{400}},
+	{method: "post", path: "/book/", summary: "Add a book", params: []apiParam{ttlParam, fenceParam},
+		body: Book{}, response: []Book{}, errors: []int{400, 403, 409, 413}},
+	{method: "get", path: "/book/{id}", summary: "Get a book; HEAD answers the headers only", params: []apiParam{idParam, atParam},
+		response: Book{}, errors: []int{400, 404, 410}},
+	{method: "put", path: "/book/{id}", summary: "Replace a book", params: []apiParam{idParam, ttlParam, ifParam, ifMatchParam, fenceParam},
+		body: Book{}, response: Book{}, errors: []int{400, 403, 404, 409, 412, 413}},
+	{method: "delete", path: "/book/{id}", summary: "Delete a book", params: []apiParam{idParam, ifParam, fenceParam},
+		response: []Book{}, errors: []int{404, 412}},
+	{method: "post", path: "/book/{id}/cas", summary: "Swap the book while it still equals old", params: []apiParam{idParam, fenceParam},
+		body: SwapRequest{}, response: Book{}, errors: []int{400, 404, 409}},
+	{method: "get", path: "/book/{id}/content", summary: "Get the binary attachment", params: []apiParam{idParam},
+		errors: []int{404}},
+	{method: "put", path: "/book/{id}/content", summary: "Store a binary attachment with its Content-Type", params: []apiParam{idParam, fenceParam},
+		errors: []int{404, 413}},
+	{method: "delete", path: "/book/{id}/content", summary: "Drop the binary attachment", params: []apiParam{idParam, fenceParam},
+		errors: []int{404}},
+	{method: "post", path: "/book/{id}/incr", summary: "Add ?delta= to the integer name", params: []apiParam{idParam, {"delta", "query", "amount, 1 by default"}},
+		response: Book{}, errors: []int{400, 409}},
+	{method: "post", path: "/book/{id}/decr", summary: "Subtract ?delta= from the integer name", params: []apiParam{idParam, {"delta", "query", "amount, 1 by default"}},
+		response: Book{}, errors: []int{400, 409}},
+	{method: "post", path: "/book/{id}/append", summary: "Append the JSON string body to the name", params: []apiParam{idParam},
+		body: "", response: LengthResult{}, errors: []int{400, 413}},
+	{method: "get", path: "/book/{id}/range", summary: "Part of the name, in characters", params: []apiParam{idParam, {"start", "query", "first character"}, {"end", "query", "past the last character"}},
+		response: "", errors: []int{400, 404}},
+	{method: "get", path: "/book/{id}/strlen", summary: "Length of the name in characters", params: []apiParam{idParam},
+		response: LengthResult{}, errors: []int{404}},
+	{method: "get", path: "/book/{id}/list", summary: "Items ?start= to ?end= of the list", params: []apiParam{idParam, {"start", "query", "first item"}, {"end", "query", "past the last item"}},
+		response: []string{}, errors: []int{400, 404, 409}},
+	{method: "post", path: "/book/{id}/list", summary: "Push the items in the body", params: []apiParam{idParam, {"side", "query", "left or right, the default"}},
+		body: []string{}, response: LengthResult{}, errors: []int{400, 409, 413}},
+	{method: "delete", path: "/book/{id}/list", summary: "Pop one item", params: []apiParam{idParam, {"side", "query", "left or right, the default"}},
+		response: "", errors: []int{404, 409}},
+	{method: "get", path: "/book/{id}/set", summary: "Members of the set", params: []apiParam{idParam},
+		response: []string{}, errors: []int{404, 409}},
+	{method: "post", path: "/book/{id}/set", summary: "Add the members in the body", params: []apiParam{idParam},
+		body: []string{}, response: LengthResult{}, errors: []int{400, 409, 413}},
+	{method: "delete", path: "/book/{id}/set", summary: "Remove the members in the body", params: []apiParam{idParam},
+		body: []string{}, response: LengthResult{}, errors: []int{400, 409}},
+	{method: "get", path: "/book/{id}/history", summary: "Kept earlier versions, newest first", params: []apiParam{idParam},
+		response: []Book{}},
+	{method: "get", path: "/book/{id}/versions/{version}", summary: "One version of the book", params: []apiParam{idParam, {"version", "path", "version number"}},
+		response: Book{}, errors: []int{400, 404}},
+	{method: "post", path: "/book/{id}/rollback", summary: "Write an earlier version back as the newest", params: []apiParam{idParam, {"version", "query", "version number"}},
+		response: Book{}, errors: []int{400, 404}},
+	{method: "post", path: "/book/{id}/restore", summary: "Bring back a soft-deleted book", params: []apiParam{idParam},
+		response: Book{}, errors: []int{404}},
+	{method: "get", path: "/list", summary: "Sorted ids matching ?match= or ?regex=, every id without either", params: []apiParam{matchParam, regexParam, countOnlyParam},
+		response: []string{}, errors: []int{400}},
+	{method: "delete", path: "/list", summary: "Delete the books matching ?match= or ?regex=, at most -bulk-delete-max", params: []apiParam{matchParam, regexParam, {"dry_run", "query", "true to only count the matches"}, fenceParam},
+		response: BulkDelete{}, errors: []int{400, 409, 413}},
+	{method: "post", path: "/drain/", summary: "Delete and return the books with the ids in the body", params: []apiParam{fenceParam},
+		body: []string{}, response: []Book{}, errors: []int{400, 403, 413}},
+	{method: "get", path: "/diff/{id}/{other}", summary: "Compare two books field by field", params: []apiParam{idParam, {"other", "path", "book id"}},
+		response: map[string]any{}, errors: []int{400, 404}},
+	{method: "post", path: "/batch", summary: "Apply put and delete ops all or nothing; 409 with the results when any fails", params: []apiParam{fenceParam},
+		body: []BatchOp{}, response: []BatchResult{}, errors: []int{400, 403, 413}},
+	{method: "post", path: "/txn", summary: "Run the success or failure ops depending on the compares",
+		body: TxnRequest{}, response: TxnResponse{}, errors: []int{400, 413}},
+	{method: "get", path: "/search", summary: "Books by name", params: []apiParam{{"value", "query", "exact name"}, {"prefix", "query", "name prefix"}, {"contains", "query", "name substring"}, countOnlyParam},
+		response: []Book{}, errors: []int{400}},
+	{method: "get", path: "/export", summary: "Stream every book as JSON lines led by the snapshot revision, CSV, SQL inserts or a tar of one file per book; X-Snapshot-Revision carries the revision too", params: []apiParam{{"format", "query", "jsonl, the default, csv, sql or tar"}, {"table", "query", "the table of format=sql, kv by default"}},
+		errors: []int{400}},
+	{method: "post", path: "/import", summary: "Load books in the format of /export", params: []apiParam{{"format", "query", "jsonl, the default, or csv"}, {"mode", "query", "merge, the default, or replace"}},
+		response: map[string]int{}, errors: []int{400, 409, 413}},
+	{method: "get", path: "/watch", summary: "Server-Sent Events of changes to ids with ?prefix=", params: []apiParam{{"prefix", "query", "id prefix"}}},
+	{method: "get", path: "/watch/{id}", summary: "Server-Sent Events of changes to one book", params: []apiParam{idParam}},
+	{method: "get", path: "/ws", summary: "WebSocket carrying get, put, delete and subscribe requests",
+		errors: []int{400}},
+	{method: "post", path: "/publish/{channel}", summary: "Send the body to the current subscribers of a channel, storing nothing", params: []apiParam{channelParam},
+		response: map[string]int{}, errors: []int{400, 413}},
+	{method: "get", path: "/subscribe/{channel}", summary: "Server-Sent Events, or a WebSocket on upgrade, of the messages published to a channel", params: []apiParam{channelParam}},
+	{method: "get", path: "/bucket/{bucket}/books/", summary: "Books of a bucket", params: []apiParam{bucketParam},
+		response: []Book{}, errors: []int{400}},
+	{method: "get", path: "/bucket/{bucket}/stats", summary: "Size of a bucket", params: []apiParam{bucketParam},
+		response: BucketStats{}, errors: []int{400}},
+	{method: "get", path: "/bucket/{bucket}/export", summary: "Stream the books of a bucket like /export does", params: []apiParam{bucketParam, {"format", "query", "jsonl, the default, csv, sql or tar"}, {"table", "query", "the table of format=sql, kv by default"}},
+		errors: []int{400}},
+	{method: "delete", path: "/bucket/{bucket}", summary: "Delete every book of a bucket", params: []apiParam{bucketParam},
+		response: map[string]int{}, errors: []int{400}},
+	{method: "get", path: "/bucket/{bucket}/book/{id}", summary: "Get a book of a bucket", params: []apiParam{bucketParam, idParam},
+		response: Book{}, errors: []int{400, 404}},
+	{method: "put", path: "/bucket/{bucket}/book/{id}", summary: "Put a book into a bucket, which without ?ttl= expires after the -bucket-ttls lifetime of the bucket", params: []apiParam{bucketParam, idParam, ttlParam},
+		body: Book{}, response: Book{}, errors: []int{400, 413, 507}},
+	{method: "delete", path: "/bucket/{bucket}/book/{id}", summary: "Delete a book of a bucket", params: []apiParam{bucketParam, idParam},
+		response: []Book{}, errors: []int{400, 404}},
+	{method: "get", path: "/locks/{name}", summary: "Owner, fence token and expiry of a held lock", params: []apiParam{lockParam},
+		response: Lock{}, errors: []int{400, 404}},
+	{method: "post", path: "/locks/{name}", summary: "Acquire a lock; the answer carries the lease id", params: []apiParam{lockParam, {"ttl", "query", "lease, by default -lock-ttl"}, {"owner", "query", "shown to others while held"}},
+		response: Lock{}, errors: []int{400, 409}},
+	{method: "put", path: "/leases/{lease}/keepalive", summary: "Renew a lease", params: []apiParam{leaseParam, {"ttl", "query", "new lease, by default the last one"}},
+		response: Lock{}, errors: []int{400, 404}},
+	{method: "delete", path: "/leases/{lease}", summary: "Release the lock of a lease", params: []apiParam{leaseParam},
+		errors: []int{404}},
+	{method: "get", path: "/scripts/", summary: "Every stored script",
+		response: []Script{}},
+	{method: "get", path: "/scripts/{script}", summary: "Source of a stored script", params: []apiParam{scriptParam},
+		response: Script{}, errors: []int{400, 404}},
+	{method: "put", path: "/scripts/{script}", summary: "Store the script in the body, checking that it parses", params: []apiParam{scriptParam},
+		body: "", response: Script{}, errors: []int{400, 413}},
+	{method: "delete", path: "/scripts/{script}", summary: "Delete a stored script", params: []apiParam{scriptParam},
+		errors: []int{400, 404}},
+	{method: "post", path: "/scripts/{script}/run", summary: "Run a stored script atomically with the args in the body", params: []apiParam{scriptParam, fenceParam},
+		body: ScriptRun{}, response: ScriptResult{}, errors: []int{400, 404, 409, 413}},
+	{method: "post", path: "/eval", summary: "Run the script in the body atomically without storing it", params: []apiParam{fenceParam},
+		body: ScriptRun{}, response: ScriptResult{}, errors: []int{400, 409, 413}},
+	{method: "post", path: "/snapshot", summary: "Write the books to a file in -snapshot-dir",
+		response: map[string]string{}, errors: []int{500}},
+	{method: "post", path: "/restore", summary: "Replace every book with a snapshot", params: []apiParam{{"name", "query", "snapshot file name"}},
+		response: []Book{}, errors: []int{400, 404, 500}},
+	{method: "get", path: "/size-bytes", summary: "Total id and value bytes",
+		response: map[string]int{}},
+	{method: "get", path: "/capabilities", summary: "Settings of this server",
+		response: map[string]any{}},
+	{method: "get", path: "/replication/stream", summary: "JSON lines of a snapshot and then every change, for replicas"},
+	{method: "post", path: "/admin/promote", summary: "Stop replicating and take writes",
+		response: map[string]string{}, errors: []int{409}},
+	{method: "post", path: "/admin/purge", summary: "Drop soft-deleted books for good", params: []apiParam{{"id", "query", "only this book"}},
+		response: map[string]int{}},
+	{method: "post", path: "/admin/set-ttl", summary: "Give every book whose id matches a glob pattern the same expiry",
+		body: SetTTLRequest{}, response: map[string]int{}, errors: []int{400, 403, 409, 413}},
+	{method: "get", path: "/admin/stats", summary: "Store, process and request rates",
+		response: AdminStats{}},
+	{method: "post", path: "/admin/flush", summary: "Delete every book",
+		response: map[string]int{}},
+	{method: "get", path: "/admin/read-only", summary: "Whether writes are switched off",
+		response: ReadOnlyState{}},
+	{method: "put", path: "/admin/read-only", summary: "Switch writes off or on",
+		body: ReadOnlyState{}, response: ReadOnlyState{}, errors: []int{400}},
+	{method: "post", path: "/admin/reencrypt", summary: "Rewrite the store files and snapshots, backups included, with the first encryption key",
+		response: map[string]any{}, errors: []int{500}},
+	{method: "post", path: "/admin/verify", summary: "Check the checksums of the books in memory and in the store files",
+		response: VerifyReport{}, errors: []int{500}},
+	{method: "get", path: "/admin/quotas", summary: "Usage of every bucket with its -bucket-quotas quota",
+		response: []QuotaUsage{}},
+	{method: "get", path: "/admin/raft", summary: "This member's view of the raft cluster",
+		response: RaftStatus{}, errors: []int{404}},
+	{method: "post", path: "/admin/raft/join", summary: "Add a member to the raft cluster, on its leader",
+		body: RaftMember{}, response: RaftMember{}, errors: []int{400, 404, 503}},
+	{method: "post", path: "/admin/raft/leave", summary: "Remove a member from the raft cluster, on its leader",
+		body: RaftMember{}, response: RaftMember{}, errors: []int{400, 404, 503}},
+	{method: "post", path: "/admin/raft/snapshot", summary: "Snapshot the books of this member and compact its raft log",
+		response: map[string]any{}, errors: []int{404, 500}},
+	{method: "post", path: "/admin/preload", summary: "Load the -preload file again, replacing the books it holds",
+		response: map[string]any{}, errors: []int{404, 500}},
+	{method: "get", path: "/metrics", summary: "Prometheus metrics"},
+	{method: "get", path: "/", summary: "Browser UI for the books"},
+	{method: "get", path: "/healthz", summary: "Liveness", response: map[string]string{}},
+	{method: "get", path: "/readyz", summary: "Readiness", response: map[string]string{}, errors: []int{503}},
+}
+
+// publicPaths are served without credentials.
+var publicPaths = map[string]bool{"/": true, "/metrics": true, "/healthz": true, "/readyz": true}
+
+// errorCodes lists the codes answered with each status, for the error
+// descriptions.
+func errorCodes(status int) string {
+	codes := map[int][]string{
+		400: {CodeBadRequest, CodeScriptError, CodeInvalidId},
+		401: {CodeUnauthorized},
+		403: {CodeForbidden, CodeReadOnly, CodeReservedId},
+		404: {CodeNotFound, CodeBookNotFound, CodeVersionNotFound},
+		405: {CodeMethodNotAllowed},
+		409: {CodeConflict, CodeBookExists, CodeWrongType, CodeStaleFenceToken, CodeNotReplica, CodeLockHeld, CodeIdempotencyConflict},
+		410: {CodeBookDeleted},
+		412: {CodePreconditionFailed},
+		413: {CodeTooLarge},
+		429: {CodeRateLimited},
+		507: {CodeQuotaExceeded},
+		500: {CodeInternal},
+		503: {CodeUnavailable},
+	}[status]
+
+	return http.StatusText(status) + ": " + strings.Join(codes, ", ")
+}
+
+// schemas collects the component schemas of the Go types reached while
+// describing the operations.
+type schemas map[string]any
+
+func (sc schemas) of(t reflect.Type) map[string]any {
+	switch {
+	case t == reflect.TypeOf(time.Time{}):
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return map[string]any{"type": "string", "format": "byte"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := sc.of(t.Elem())
+		schema["nullable"] = true
+		return schema
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int64, reflect.Uint64, reflect.Uint32:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": sc.of(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": sc.of(t.Elem())}
+	case reflect.Struct:
+		if _, ok := sc[t.Name()]; !ok {
+			sc[t.Name()] = nil // placeholder, in case the type refers to itself
+			sc[t.Name()] = sc.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+
+	return map[string]any{}
+}
+
+func (sc schemas) object(t reflect.Type) map[string]any {
+	properties := make(map[string]any)
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+
+		if field.Anonymous && name == "" {
+			embedded := sc.object(field.Type)
+			for key, value := range embedded["properties"].(map[string]any) {
+				properties[key] = value
+			}
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = sc.of(field.Type)
+	}
+
+	return map[string]any{"type": "object", "properties": properties}
+}
+
+func buildOpenAPI() map[string]any {
+	sc := make(schemas)
+	paths := make(map[string]map[string]any)
+
+	errorResponse := func(status int) map[string]any {
+		return map[string]any{
+			"description": errorCodes(status),
+			"content":     map[string]any{"application/json": map[string]any{"schema": sc.of(reflect.TypeOf(APIError{}))}},
+		}
+	}
+
+	for _, op := range apiOperations {
+		opParams := op.params
+		if op.method != "get" && !strings.HasPrefix(op.path, "/admin/") {
+			opParams = append(slices.Clone(opParams), idempotencyParam)
+		}
+
+		params := make([]any, 0, len(opParams))
+		for _, p := range opParams {
+			params = append(params, map[string]any{
+				"name":        p.name,
+				"in":          p.in,
+				"description": p.description,
+				"required":    p.in == "path",
+				"schema":      map[string]string{"type": "string"},
+			})
+		}
+
+		ok := map[string]any{"description": "OK"}
+		if op.response != nil {
+			ok["content"] = map[string]any{"application/json": map[string]any{"schema": sc.of(reflect.TypeOf(op.response))}}
+		}
+
+		statuses := []int{401, 405}
+		if publicPaths[op.path] {
+			statuses = []int{405}
+		}
+
+		responses := map[string]any{"200": ok}
+		for _, status := range append(statuses, op.errors...) {
+			responses[strconv.Itoa(status)] = errorResponse(status)
+		}
+
+		operation := map[string]any{
+			"summary":    op.summary,
+			"parameters": params,
+			"responses":  responses,
+		}
+		if publicPaths[op.path] {
+			operation["security"] = []any{}
+		}
+		if op.body != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content":  map[string]any{"application/json": map[string]any{"schema": sc.of(reflect.TypeOf(op.body))}},
+			}
+		}
+
+		if paths[op.path] == nil {
+			paths[op.path] = make(map[string]any)
+		}
+		paths[op.path][op.method] = operation
+	}
+
+	names := make([]string, 0, len(sc))
+	for name := range sc {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]string{
+			"title":       "Books API",
+			"version":     "1",
+			"description": "Error answers are APIError objects; their code tells the cases of one status apart.",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": sc,
+			"securitySchemes": map[string]any{
+				"basic":  map[string]string{"type": "http", "scheme": "basic"},
+				"bearer": map[string]string{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"security": []any{map[string][]string{"basic": {}}, map[string][]string{"bearer": {}}},
+	}
+}
+
+var openAPI = sync.OnceValue(func() []byte {
+	spec, _ := json.MarshalIndent(buildOpenAPI(), "", "  ")
+	return spec
+})
+
+// HandleOpenAPI serves the OpenAPI 3 description of the routes.
+func (s *Server) HandleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	w.Write(openAPI())
+}
+
+// HandleDocs serves Swagger UI for /openapi.json. The page is embedded but
+// loads the Swagger UI scripts from a CDN, so browsing it needs network
+// access.
+func (s *Server) HandleDocs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	w.Write(swaggerPage)
+}
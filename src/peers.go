@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// discoveredPeers is the value of -replica-of and -proxy that takes the
+// members from -peers.
+const discoveredPeers = "peers"
+
+// checkPeersSpec reports a -peers that cannot be looked up.
+func (c Config) checkPeersSpec(spec string) error {
+	kind, name, _ := strings.Cut(spec, ":")
+	if (kind != "srv" && kind != "file") || name == "" {
+		return errors.New(fmt.Sprintf("invalid -peers %q, expected srv:<name> or file:<path>", spec))
+	}
+	if c.PeersScheme != "http" && c.PeersScheme != "https" {
+		return errors.New(fmt.Sprintf("invalid -peers-scheme %q", c.PeersScheme))
+	}
+	return nil
+}
+
+// discoverPeers looks the members up as -peers says and returns their
+// base URLs, sorted.
+func (c Config) discoverPeers() ([]string, error) {
+	kind, name, _ := strings.Cut(c.PeersSpec, ":")
+
+	var peers []string
+	switch kind {
+	case "srv":
+		_, targets, err := net.LookupSRV("", "", name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, target := range targets {
+			host := net.JoinHostPort(strings.TrimSuffix(target.Target, "."), strconv.Itoa(int(target.Port)))
+			peers = append(peers, c.PeersScheme+"://"+host)
+		}
+
+	case "file":
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if !strings.Contains(line, "://") {
+				line = c.PeersScheme + "://" + line
+			}
+			peers = append(peers, strings.TrimSuffix(line, "/"))
+		}
+
+	default:
+		return nil, c.checkPeersSpec(c.PeersSpec)
+	}
+
+	slices.Sort(peers)
+	peers = slices.Compact(peers)
+
+	if len(peers) == 0 {
+		return nil, errors.New(fmt.Sprintf("-peers %s lists no member", c.PeersSpec))
+	}
+	return peers, nil
+}
+
+// discoverPrimary looks the members up and returns the one that is ready
+// and calls itself primary in the latest term, the first of them on a tie,
+// for -replica-of peers.
+func (c Config) discoverPrimary() (string, error) {
+	peers, err := c.discoverPeers()
+	if err != nil {
+		return "", err
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	var primary *ProxyMember
+	for _, peer := range peers {
+		member := probeMember(client, peer)
+		if member.Ready && member.Role == "primary" && (primary == nil || member.Term > primary.Term) {
+			primary = &member
+		}
+	}
+	if primary != nil {
+		return primary.URL, nil
+	}
+	return "", errors.New(fmt.Sprintf("no ready primary among %s", strings.Join(peers, ", ")))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// readPreload reads a -preload file. CSV and JSON lines are read as
+// /import reads them.
+func readPreload(path string) ([]Book, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if filepath.Ext(path) == ".csv" {
+		return readImport(bytes.NewReader(data), "csv")
+	}
+
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		books := make([]Book, 0)
+		err := json.Unmarshal(trimmed, &books)
+		return books, err
+	}
+
+	return readImport(bytes.NewReader(data), "jsonl")
+}
+
+// preload puts the books of path into the store in one batch, so a file
+// with a bad book loads nothing. With -backend redis the books go through
+// to the upstream and are left in the cache, warm. It returns how many
+// books were put.
+func (s *Server) preload(path string) (int, error) {
+	books, err := readPreload(path)
+	if err != nil {
+		return 0, err
+	}
+
+	ops := make([]BatchOp, 0, len(books))
+	for i, book := range books {
+		book.Id, book.Version = s.cfg.normalizeId(book.Id), 0
+
+		if s.cfg.isReservedId(book.Id) {
+			return 0, errors.New(fmt.Sprintf("book %d: id %s is reserved", i+1, book.Id))
+		}
+
+		books[i] = book
+		ops = append(ops, BatchOp{Op: "put", Book: book})
+	}
+
+	if _, limitError := s.checkLimits(books...); limitError != nil {
+		return 0, errors.New(fmt.Sprintf("book %s: %s", limitError.Id, limitError.Message))
+	}
+
+	results, applied := s.store.ApplyBatch(ops)
+	if !applied {
+		for _, result := range results {
+			if result.Error != "" {
+				return 0, errors.New(fmt.Sprintf("book %s: %s", result.Id, result.Error))
+			}
+		}
+		return 0, errors.New("batch not applied")
+	}
+
+	return len(ops), nil
+}
+
+// HandlePreload loads -preload again, say to reset a demo to its dataset.
+// Books added since stay; those in the file get its content back.
+func (s *Server) HandlePreload(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	if s.cfg.PreloadFile == "" {
+		writeError(w, http.StatusNotFound, CodeNotFound, "no -preload file is set")
+		return
+	}
+
+	loaded, err := s.preload(s.cfg.PreloadFile)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("Preload failed. %v", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	body, _ := json.Marshal(map[string]any{"file": s.cfg.PreloadFile, "loaded": loaded})
+
+	w.Write(body)
+}
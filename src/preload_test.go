@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writePreload writes content to a file of the given name in a temporary
+// directory and returns its path.
+func writePreload(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// booksByName returns the stored books as id=name, in id order.
+func booksByName(t *testing.T, s *Server) []string {
+	t.Helper()
+
+	books, err := s.store.GetBooks(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored := make([]string, 0, len(books))
+	for _, book := range books {
+		stored = append(stored, book.Id+"="+book.Name)
+	}
+	slices.Sort(stored)
+	return stored
+}
+
+func TestPreload(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    []string // the books stored afterwards, nil when the preload fails
+	}{
+		{name: "csv", file: "books.csv", content: "a,A,new\nc,C,3\n", want: []string{"a=new", "b=2", "c=3"}},
+		{name: "csv with a header", file: "books.csv", content: "id,author,name\nc,C,3\n", want: []string{"a=1", "b=2", "c=3"}},
+		{name: "a json array", file: "books.json", content: ` [{"id":"a","name":"new"},{"id":"c","name":"3"}]`, want: []string{"a=new", "b=2", "c=3"}},
+		{name: "json lines", file: "books.jsonl", content: "{\"id\":\"c\",\"name\":\"3\"}\n{\"id\":\"d\",\"name\":\"4\"}\n", want: []string{"a=1", "b=2", "c=3", "d=4"}},
+		{name: "json lines without the extension", file: "books", content: `{"id":"c","name":"3"}`, want: []string{"a=1", "b=2", "c=3"}},
+		{name: "an empty file", file: "books.json", content: "", want: []string{"a=1", "b=2"}},
+		{name: "an empty array", file: "books.json", content: "[]", want: []string{"a=1", "b=2"}},
+		{name: "the stored version is ignored", file: "books.json", content: `[{"id":"a","name":"new","version":99}]`, want: []string{"a=new", "b=2"}},
+		{name: "a reserved id", file: "books.json", content: `[{"id":"c","name":"3"},{"id":"staging:c","name":"3"}]`},
+		{name: "a book over -max-value-bytes", file: "books.json", content: `[{"id":"c","name":"3"},{"id":"d","name":"` + strings.Repeat("x", 65) + `"}]`},
+		{name: "a csv line without a name", file: "books.csv", content: "c,C,3\nd,D\n"},
+		{name: "invalid json", file: "books.json", content: `[{"id":"c"`},
+	}
+
+	cfg := DefaultConfig()
+	cfg.ReservedIds, cfg.MaxValueBytes = "staging:*", 64
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t, WithConfig(cfg))
+			s.store.AddBook(Book{Id: "a", Name: "1"})
+			s.store.AddBook(Book{Id: "b", Name: "2"})
+
+			loaded, err := s.preload(writePreload(t, tt.file, tt.content))
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("loaded %d books, want an error", loaded)
+				}
+				if stored := booksByName(t, s); !slices.Equal(stored, []string{"a=1", "b=2"}) {
+					t.Errorf("a failed preload left %v", stored)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if stored := booksByName(t, s); !slices.Equal(stored, tt.want) {
+				t.Errorf("stored %v, want %v", stored, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreloadMissingFile(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	if _, err := s.preload(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("preloaded a missing file")
+	}
+}
+
+func TestHandlePreload(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		content  string // of the file once loaded, replaced before the request
+		status   int
+		contains string
+		want     []string
+	}{
+		{name: "reload", method: "POST", content: `[{"id":"a","name":"1"}]`, status: 200, contains: `"loaded":1`, want: []string{"a=1", "z=added"}},
+		{name: "reload a changed file", method: "POST", content: `[{"id":"a","name":"1"},{"id":"b","name":"2"}]`, status: 200, contains: `"loaded":2`, want: []string{"a=1", "b=2", "z=added"}},
+		{name: "reload a broken file", method: "POST", content: `[{"id":`, status: 500, contains: CodeInternal, want: []string{"a=changed", "z=added"}},
+		{name: "another method", method: "GET", content: `[{"id":"a","name":"1"}]`, status: 405, want: []string{"a=changed", "z=added"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.PreloadFile = writePreload(t, "books.json", `[{"id":"a","name":"1"}]`)
+
+			s, ts := newTestServer(t, WithConfig(cfg))
+			if _, err := s.preload(cfg.PreloadFile); err != nil {
+				t.Fatal(err)
+			}
+			s.store.SetBook(Book{Id: "a", Name: "changed"})
+			s.store.AddBook(Book{Id: "z", Name: "added"})
+
+			if err := os.WriteFile(cfg.PreloadFile, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			status, body := send(t, tt.method, ts.URL+"/admin/preload", "")
+			if status != tt.status || !strings.Contains(body, tt.contains) {
+				t.Fatalf("status %d %s, want %d with %q", status, body, tt.status, tt.contains)
+			}
+
+			if stored := booksByName(t, s); !slices.Equal(stored, tt.want) {
+				t.Errorf("stored %v, want %v", stored, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Stored scripts are books under ids no bucket name can produce, with the
+// source as the name, so they persist and replicate like locks do.
+const (
+	scriptBucket   = "#scripts"
+	scriptIdPrefix = bucketIdPrefix + scriptBucket + "/"
+)
+
+// scriptMaxAttempts is how often a run starts over because books it read
+// changed before it could commit.
+const scriptMaxAttempts = 16
+
+// Script is a stored script, as GET /scripts/ lists it.
+type Script struct {
+	Name      string    `json:"name"`
+	Source    string    `json:"source"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ScriptRun is the body of POST /scripts/<name>/run and of POST /eval,
+// which takes the source along.
+type ScriptRun struct {
+	Script string   `json:"script,omitempty"`
+	Args   []string `json:"args"`
+}
+
+// ScriptResult is the answer of a run: the value of the script, how many
+// books it wrote and how many runs it took to commit.
+type ScriptResult struct {
+	Result   any `json:"result"`
+	Writes   int `json:"writes"`
+	Attempts int `json:"attempts"`
+}
+
+func scriptOf(book *Book) Script {
+	return Script{Name: strings.TrimPrefix(book.Id, scriptIdPrefix), Source: book.Name, UpdatedAt: book.UpdatedAt}
+}
+
+// scriptView is what one run sees of the store: the books it read, as they
+// were when first read, with its own writes on top. The writes only reach
+// the store when the run commits.
+type scriptView struct {
+	store  Store
+	read   map[string]*Book
+	writes map[string]*Book // nil for a delete
+	order  []string         // the written ids, in order of their first write
+}
+
+func newScriptView(store Store) *scriptView {
+	return &scriptView{store: store, read: make(map[string]*Book), writes: make(map[string]*Book)}
+}
+
+func (v *scriptView) get(id string) *Book {
+	if book, ok := v.writes[id]; ok {
+		return book
+	}
+	if book, ok := v.read[id]; ok {
+		return book
+	}
+
+	book := v.store.FindBookById(id)
+	v.read[id] = book
+	return book
+}
+
+func (v *scriptView) write(id string, book *Book) {
+	// Reading first makes the commit check what the write replaces.
+	v.get(id)
+
+	if _, ok := v.writes[id]; !ok {
+		v.order = append(v.order, id)
+	}
+	v.writes[id] = book
+}
+
+// txn is the commit of the run: every book read must still be the version
+// read, or still absent, and then the writes go in.
+func (v *scriptView) txn() ([]TxnCompare, []BatchOp) {
+	compare := make([]TxnCompare, 0, len(v.read))
+	for id, book := range v.read {
+		cond := "absent"
+		if book != nil {
+			cond = fmt.Sprintf("version:%d", book.Version)
+		}
+		compare = append(compare, TxnCompare{Id: id, If: cond})
+	}
+
+	ops := make([]BatchOp, 0, len(v.order))
+	for _, id := range v.order {
+		if book := v.writes[id]; book != nil {
+			ops = append(ops, BatchOp{Op: "put", Book: *book})
+		} else if v.read[id] != nil {
+			ops = append(ops, BatchOp{Op: "delete", Book: Book{Id: id}})
+		}
+	}
+
+	return compare, ops
+}
+
+// bookId is the id a script names a book by, normalized and checked as
+// the routes do.
+func (env *scriptEnv) bookId(value any) (string, error) {
+	id, ok := value.(string)
+	if !ok || id == "" {
+		return "", errors.New("needs a book id")
+	}
+
+	id = env.cfg.normalizeId(id)
+	if env.cfg.isReservedId(id) {
+		return "", errors.New(fmt.Sprintf("book id %s is reserved", id))
+	}
+	return id, nil
+}
+
+// scriptBook is a book as scripts see it, nil for none.
+func scriptBook(book *Book) any {
+	if book == nil {
+		return nil
+	}
+	return map[string]any{"id": book.Id, "author": book.Author, "name": book.Name, "version": int64(book.Version)}
+}
+
+func scriptGet(env *scriptEnv, args []any) (any, error) {
+	id, err := env.bookId(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return scriptBook(env.view.get(id)), nil
+}
+
+func scriptExists(env *scriptEnv, args []any) (any, error) {
+	id, err := env.bookId(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return env.view.get(id) != nil, nil
+}
+
+// scriptPut sets the author and name of a book, keeping whatever else it
+// holds, and returns it.
+func scriptPut(env *scriptEnv, args []any) (any, error) {
+	id, err := env.bookId(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	book := Book{Id: id}
+	if current := env.view.get(id); current != nil {
+		book = *current
+	}
+	book.Author, book.Name = scriptString(args[1]), scriptString(args[2])
+
+	env.view.write(id, &book)
+	return scriptBook(&book), nil
+}
+
+// scriptDel deletes a book and reports whether there was one.
+func scriptDel(env *scriptEnv, args []any) (any, error) {
+	id, err := env.bookId(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if env.view.get(id) == nil {
+		return false, nil
+	}
+
+	env.view.write(id, nil)
+	return true, nil
+}
+
+// runScript runs forms until a run commits. The writes of a run go in with
+// one Txn that only holds while every book the run read is unchanged, so
+// the script acts as if it ran alone, without holding any lock while it
+// runs. A run that fails answers with its error and writes nothing. The
+// hooks only see the writes of the run that commits.
+func (s *Server) runScript(w http.ResponseWriter, r *http.Request, forms []any, args []string) {
+	scriptArgs := make([]any, 0, len(args))
+	for _, arg := range args {
+		scriptArgs = append(scriptArgs, arg)
+	}
+
+	for attempt := 1; attempt <= scriptMaxAttempts; attempt++ {
+		env := &scriptEnv{vars: map[string]any{"args": scriptArgs}, view: newScriptView(s.store), cfg: s.cfg}
+
+		result, err := env.block(forms)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, CodeScriptError, err.Error())
+			return
+		}
+
+		compare, ops := env.view.txn()
+		if !s.normalizeOps(w, ops) || !s.handleLimits(w, opPuts(ops)...) {
+			return
+		}
+
+		succeeded, _, err := s.store.Txn(compare, ops, nil, s.prepareWrites(r))
+		if !handleWriteError(w, err) {
+			return
+		}
+
+		if succeeded {
+			w.WriteHeader(http.StatusOK)
+			body, _ := json.Marshal(ScriptResult{Result: result, Writes: len(ops), Attempts: attempt})
+
+			w.Write(body)
+			return
+		}
+	}
+
+	writeError(w, http.StatusConflict, CodeConflict, fmt.Sprintf("the books read by the script kept changing; gave up after %d runs", scriptMaxAttempts))
+}
+
+// HandleScripts serves the stored scripts:
+//
+//	GET          /scripts/             every script
+//	GET, DELETE  /scripts/<name>
+//	PUT          /scripts/<name>       store the source in the body
+//	POST         /scripts/<name>/run   run it with ScriptRun args
+func (s *Server) HandleScripts(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	name, run := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/scripts/"), "/run")
+
+	if name == "" && !run && r.Method == http.MethodGet {
+		scripts := make([]Script, 0)
+		for _, book := range s.bucketBooks(r.Context(), scriptBucket) {
+			book.Id = scriptIdPrefix + book.Id
+			scripts = append(scripts, scriptOf(&book))
+		}
+
+		w.WriteHeader(http.StatusOK)
+		body, _ := json.Marshal(scripts)
+
+		w.Write(body)
+		return
+	}
+
+	if !bucketNamePattern.MatchString(name) {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("invalid script name %s", name))
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.MaxBodyBytes)
+
+	switch {
+	case run && r.Method == http.MethodPost:
+		var body ScriptRun
+
+		if err := s.decodeBody(r, &body); err != nil {
+			writeError(w, badBodyStatus(err), "", err.Error())
+			return
+		}
+
+		book := s.store.FindBookById(scriptIdPrefix + name)
+		if book == nil {
+			writeError(w, http.StatusNotFound, CodeNotFound, fmt.Sprintf("Script %s not found", name))
+			return
+		}
+
+		forms, err := parseScript(book.Name)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, CodeScriptError, err.Error())
+			return
+		}
+
+		if w, ok := s.handleFenceToken(w, r); ok {
+			s.runScript(w, r, forms, body.Args)
+		}
+
+	case !run && r.Method == http.MethodGet:
+		book := s.store.FindBookById(scriptIdPrefix + name)
+		if book == nil {
+			writeError(w, http.StatusNotFound, CodeNotFound, fmt.Sprintf("Script %s not found", name))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		body, _ := json.Marshal(scriptOf(book))
+
+		w.Write(body)
+
+	case !run && r.Method == http.MethodPut:
+		source, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, badBodyStatus(err), "", err.Error())
+			return
+		}
+
+		if _, err := parseScript(string(source)); err != nil {
+			writeError(w, http.StatusBadRequest, CodeScriptError, err.Error())
+			return
+		}
+
+		s.store.ApplyBatch([]BatchOp{{Op: "put", Book: Book{Id: scriptIdPrefix + name, Name: string(source)}}})
+
+		w.WriteHeader(http.StatusOK)
+		body, _ := json.Marshal(scriptOf(s.store.FindBookById(scriptIdPrefix + name)))
+
+		w.Write(body)
+
+	case !run && r.Method == http.MethodDelete:
+		if err := s.store.DelBook(scriptIdPrefix + name); err != nil {
+			writeError(w, http.StatusNotFound, CodeNotFound, fmt.Sprintf("Script %s not found", name))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		HandleMethodIsNotAllowed(w, r)
+	}
+}
+
+// HandleEval runs the script sent in the body once, without storing it,
+// as EVAL does in Redis.
+func (s *Server) HandleEval(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	w, ok := s.handleFenceToken(w, r)
+	if !ok {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.MaxBodyBytes)
+
+	var body ScriptRun
+
+	if err := s.decodeBody(r, &body); err != nil {
+		writeError(w, badBodyStatus(err), "", err.Error())
+		return
+	}
+
+	forms, err := parseScript(body.Script)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeScriptError, err.Error())
+		return
+	}
+
+	s.runScript(w, r, forms, body.Args)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+// The protobuf encoding follows this schema. Times are Unix nanoseconds,
+// left out when unset:
+//
+//	message Book {
+//	  string id = 1;
+//	  string author = 2;
+//	  string name = 3;
+//	  int64 expires_at = 4;
+//	  uint64 version = 5;
+//	  int64 created_at = 6;
+//	  int64 updated_at = 7;
+//	  bytes content = 8;
+//	  string content_type = 9;
+//	  repeated string list = 10;
+//	  repeated string set = 11;
+//	}
+//
+//	message Books { repeated Book books = 1; }           // GET /books/
+//
+//	message BatchOp { string op = 1; Book book = 2; }
+//	message Batch { repeated BatchOp ops = 1; }          // POST /batch
+
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+func appendProtoTag(b []byte, field, wire int) []byte {
+	return binary.AppendUvarint(b, uint64(field<<3|wire))
+}
+
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	return binary.AppendUvarint(appendProtoTag(b, field, protoVarint), v)
+}
+
+func appendProtoBytes(b []byte, field int, data []byte) []byte {
+	b = appendProtoTag(b, field, protoBytes)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func appendProtoString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	return appendProtoBytes(b, field, []byte(s))
+}
+
+func appendProtoTime(b []byte, field int, t time.Time) []byte {
+	if t.IsZero() {
+		return b
+	}
+	return appendProtoVarint(b, field, uint64(t.UnixNano()))
+}
+
+func appendProtoBook(b []byte, book Book) []byte {
+	b = appendProtoString(b, 1, book.Id)
+	b = appendProtoString(b, 2, book.Author)
+	b = appendProtoString(b, 3, book.Name)
+	if book.ExpiresAt != nil {
+		b = appendProtoTime(b, 4, *book.ExpiresAt)
+	}
+	b = appendProtoVarint(b, 5, book.Version)
+	b = appendProtoTime(b, 6, book.CreatedAt)
+	b = appendProtoTime(b, 7, book.UpdatedAt)
+	if len(book.Content) > 0 {
+		b = appendProtoBytes(b, 8, book.Content)
+	}
+	b = appendProtoString(b, 9, book.ContentType)
+	// Repeated strings keep their empty items.
+	for _, item := range book.List {
+		b = appendProtoBytes(b, 10, []byte(item))
+	}
+	for _, item := range book.Set {
+		b = appendProtoBytes(b, 11, []byte(item))
+	}
+	return b
+}
+
+func protobufBooks(books []Book) []byte {
+	b := make([]byte, 0)
+	for _, book := range books {
+		b = appendProtoBytes(b, 1, appendProtoBook(nil, book))
+	}
+	return b
+}
+
+// protoFields calls fn with each field of a message: the varint for
+// varint fields and the bytes for length-delimited ones. Fixed-size
+// fields are skipped, as the schema has none.
+func protoFields(data []byte, fn func(field, wire int, v uint64, b []byte) error) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("invalid protobuf tag")
+		}
+		data = data[n:]
+
+		field, wire := int(tag>>3), int(tag&7)
+		var v uint64
+		var b []byte
+
+		switch wire {
+		case protoVarint:
+			v, n = binary.Uvarint(data)
+			if n <= 0 {
+				return errors.New(fmt.Sprintf("invalid protobuf varint in field %d", field))
+			}
+		case protoBytes:
+			size, m := binary.Uvarint(data)
+			if m <= 0 || size > uint64(len(data)-m) {
+				return errors.New(fmt.Sprintf("protobuf field %d is cut short", field))
+			}
+			b, n = data[m:m+int(size)], m+int(size)
+		case protoFixed64, protoFixed32:
+			n = 8
+			if wire == protoFixed32 {
+				n = 4
+			}
+			if n > len(data) {
+				return errors.New(fmt.Sprintf("protobuf field %d is cut short", field))
+			}
+		default:
+			return errors.New(fmt.Sprintf("unsupported protobuf wire type %d in field %d", wire, field))
+		}
+		data = data[n:]
+
+		if err := fn(field, wire, v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// protoString checks what a string field holds, as protobuf requires.
+func protoString(field int, b []byte) (string, error) {
+	if !utf8.Valid(b) {
+		return "", errors.New(fmt.Sprintf("protobuf field %d is not valid UTF-8", field))
+	}
+	return string(b), nil
+}
+
+func decodeProtoBook(data []byte) (Book, error) {
+	var book Book
+
+	err := protoFields(data, func(field, wire int, v uint64, b []byte) error {
+		var err error
+
+		if varint := field >= 4 && field <= 7; field <= 11 && varint != (wire == protoVarint) {
+			return errors.New(fmt.Sprintf("protobuf field %d has the wrong wire type %d", field, wire))
+		}
+
+		switch field {
+		case 1:
+			book.Id, err = protoString(field, b)
+		case 2:
+			book.Author, err = protoString(field, b)
+		case 3:
+			book.Name, err = protoString(field, b)
+		case 4:
+			expiresAt := time.Unix(0, int64(v)).UTC()
+			book.ExpiresAt = &expiresAt
+		case 5:
+			book.Version = v
+		case 6:
+			book.CreatedAt = time.Unix(0, int64(v)).UTC()
+		case 7:
+			book.UpdatedAt = time.Unix(0, int64(v)).UTC()
+		case 8:
+			book.Content = append([]byte(nil), b...)
+		case 9:
+			book.ContentType, err = protoString(field, b)
+		case 10, 11:
+			var item string
+			item, err = protoString(field, b)
+			if field == 10 {
+				book.List = append(book.List, item)
+			} else {
+				book.Set = append(book.Set, item)
+			}
+		}
+		return err
+	})
+
+	return book, err
+}
+
+func decodeProtoBatch(data []byte) ([]BatchOp, error) {
+	ops := make([]BatchOp, 0)
+
+	err := protoFields(data, func(field, wire int, v uint64, b []byte) error {
+		if field != 1 {
+			return nil
+		}
+
+		var op BatchOp
+		err := protoFields(b, func(field, wire int, v uint64, b []byte) error {
+			var err error
+			switch field {
+			case 1:
+				op.Op, err = protoString(field, b)
+			case 2:
+				op.Book, err = decodeProtoBook(b)
+			}
+			return err
+		})
+
+		ops = append(ops, op)
+		return err
+	})
+
+	return ops, err
+}
+
+// decodeProtobuf decodes a protobuf body into a book or a batch, the only
+// bodies the schema has.
+func decodeProtobuf(data []byte, v any) error {
+	var err error
+
+	switch target := v.(type) {
+	case *Book:
+		*target, err = decodeProtoBook(data)
+	case *[]BatchOp:
+		*target, err = decodeProtoBatch(data)
+	default:
+		err = errors.New("protobuf bodies are only taken for books and batches")
+	}
+	return err
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// proxyTarget is the URL of the member a request goes to, kept in its
+// context for the rewrite.
+type proxyTarget struct{}
+
+// ProxyMember is a member as the last probe found it, as GET
+// /proxy/members lists it.
+type ProxyMember struct {
+	URL       string    `json:"url"`
+	Role      string    `json:"role,omitempty"`
+	Term      uint64    `json:"term,omitempty"`
+	Ready     bool      `json:"ready"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at,omitzero"`
+}
+
+// Proxy routes the API to the members of a cluster. Members are probed on
+// /readyz, which names their role: writes and /admin/ go to the primary,
+// reads go round the ready replicas, or to the primary when there is none.
+// With -proxy peers the members are looked up again every -peers-interval.
+type Proxy struct {
+	cfg      Config
+	discover bool
+	client   *http.Client
+	reverse  *httputil.ReverseProxy
+	next     atomic.Uint64
+
+	// the keys /proxy/members accepts
+	apiKeys *APIKeys
+
+	mu      sync.RWMutex
+	urls    []*url.URL
+	members []ProxyMember
+}
+
+// parseProxyMembers parses the base URLs of members.
+func parseProxyMembers(members []string) ([]*url.URL, error) {
+	urls := make([]*url.URL, 0, len(members))
+
+	for _, member := range members {
+		member = strings.TrimSuffix(strings.TrimSpace(member), "/")
+		if member == "" {
+			continue
+		}
+
+		u, err := url.Parse(member)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, errors.New(fmt.Sprintf("invalid -proxy member %q", member))
+		}
+		urls = append(urls, u)
+	}
+
+	if len(urls) == 0 {
+		return nil, errors.New("-proxy lists no member")
+	}
+	return urls, nil
+}
+
+// NewProxy returns the proxy of the -proxy members of cfg.
+func NewProxy(cfg Config) (*Proxy, error) {
+	p := &Proxy{cfg: cfg, client: &http.Client{Timeout: max(cfg.ProxyProbeInterval, time.Second)}, apiKeys: &APIKeys{authReads: cfg.AuthReads}}
+
+	if cfg.ProxyMembers == discoveredPeers {
+		if err := cfg.checkPeersSpec(cfg.PeersSpec); err != nil {
+			return nil, errors.New(fmt.Sprintf("-proxy peers: %v", err))
+		}
+		p.discover = true
+		p.discoverMembers()
+	} else {
+		urls, err := parseProxyMembers(strings.Split(cfg.ProxyMembers, ","))
+		if err != nil {
+			return nil, err
+		}
+		p.setMembers(urls)
+	}
+
+	p.reverse = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(pr.In.Context().Value(proxyTarget{}).(*url.URL))
+			pr.SetXForwarded()
+			pr.Out.Header.Set("X-Request-ID", requestID(pr.In.Context()))
+		},
+		// The member echoes the request id, which is on the answer already.
+		ModifyResponse: func(resp *http.Response) error {
+			resp.Header.Del("X-Request-ID")
+			return nil
+		},
+		FlushInterval: -1, // streams like /watch go through as they are written
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			target := r.Context().Value(proxyTarget{}).(*url.URL)
+			p.markDown(target, err)
+
+			writeError(w, http.StatusBadGateway, CodeUnavailable, fmt.Sprintf("member %s failed: %v", target, err))
+		},
+	}
+
+	return p, nil
+}
+
+// setMembers replaces the members with urls, keeping what the last probe
+// found of those already known.
+func (p *Proxy) setMembers(urls []*url.URL) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	known := make(map[string]ProxyMember, len(p.members))
+	for _, member := range p.members {
+		known[member.URL] = member
+	}
+
+	members := make([]ProxyMember, len(urls))
+	for i, u := range urls {
+		member, ok := known[u.String()]
+		if !ok {
+			member = ProxyMember{URL: u.String()}
+		}
+		members[i] = member
+	}
+
+	p.urls, p.members = urls, members
+}
+
+// discoverMembers looks the members up with -peers. A failed lookup keeps
+// the members found before.
+func (p *Proxy) discoverMembers() {
+	peers, err := p.cfg.discoverPeers()
+	if err == nil {
+		var urls []*url.URL
+		if urls, err = parseProxyMembers(peers); err == nil {
+			p.mu.RLock()
+			changed := len(urls) != len(p.urls)
+			for i := 0; !changed && i < len(urls); i++ {
+				changed = urls[i].String() != p.urls[i].String()
+			}
+			p.mu.RUnlock()
+
+			if changed {
+				log.Printf("proxy: members are %s", strings.Join(peers, ", "))
+				p.setMembers(urls)
+			}
+			return
+		}
+	}
+
+	log.Printf("proxy: look up -peers %s: %v", p.cfg.PeersSpec, err)
+}
+
+// probeMember asks the member at base for its role on /readyz.
+func probeMember(client *http.Client, base string) ProxyMember {
+	member := ProxyMember{URL: base, CheckedAt: time.Now()}
+
+	resp, err := client.Get(strings.TrimSuffix(base, "/") + "/readyz")
+	if err != nil {
+		member.Error = err.Error()
+		return member
+	}
+	defer resp.Body.Close()
+
+	var status struct {
+		Status string `json:"status"`
+		Role   string `json:"role"`
+		Term   uint64 `json:"term"`
+	}
+	json.NewDecoder(resp.Body).Decode(&status)
+
+	member.Role, member.Term = status.Role, status.Term
+	member.Ready = resp.StatusCode == http.StatusOK
+	if !member.Ready {
+		member.Error = fmt.Sprintf("%s: %s", resp.Status, status.Status)
+	}
+	return member
+}
+
+// probeAll probes every member at once and logs when the primary changes.
+func (p *Proxy) probeAll() {
+	p.mu.RLock()
+	urls := p.urls
+	p.mu.RUnlock()
+
+	probed := make([]ProxyMember, len(urls))
+
+	var wg sync.WaitGroup
+	for i := range urls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			probed[i] = probeMember(p.client, urls[i].String())
+		}()
+	}
+	wg.Wait()
+
+	p.mu.Lock()
+	before := p.primary()
+	for _, member := range probed {
+		if i := p.member(member.URL); i >= 0 {
+			p.members[i] = member
+		}
+	}
+	after := p.primary()
+	p.mu.Unlock()
+
+	if before != after {
+		if after == "" {
+			log.Printf("proxy: no ready primary")
+		} else {
+			log.Printf("proxy: primary is %s", after)
+		}
+	}
+}
+
+func (p *Proxy) run(ctx context.Context) {
+	tick := time.NewTicker(p.cfg.ProxyProbeInterval)
+	defer tick.Stop()
+
+	var discover <-chan time.Time
+	if p.discover {
+		lookup := time.NewTicker(p.cfg.PeersInterval)
+		defer lookup.Stop()
+		discover = lookup.C
+	}
+
+	for {
+		select {
+		case <-tick.C:
+			p.probeAll()
+		case <-discover:
+			p.discoverMembers()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// member is the index of the member at base, or -1. The caller holds mu.
+func (p *Proxy) member(base string) int {
+	return slices.IndexFunc(p.members, func(member ProxyMember) bool { return member.URL == base })
+}
+
+// markDown takes a member out of rotation until the next probe, after a
+// request to it failed.
+func (p *Proxy) markDown(target *url.URL, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if i := p.member(target.String()); i >= 0 {
+		p.members[i].Ready, p.members[i].Error = false, err.Error()
+	}
+}
+
+// primary is the URL of the ready member calling itself primary in the
+// latest term, the first of them on a tie, or "". The caller holds mu.
+func (p *Proxy) primary() string {
+	if i := p.primaryIndex(); i >= 0 {
+		return p.members[i].URL
+	}
+	return ""
+}
+
+func (p *Proxy) primaryIndex() int {
+	found := -1
+	for i, member := range p.members {
+		if member.Ready && member.Role == "primary" && (found < 0 || member.Term > p.members[found].Term) {
+			found = i
+		}
+	}
+	return found
+}
+
+// pick chooses the member for a request, or nil when none can take it.
+func (p *Proxy) pick(r *http.Request) *url.URL {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var primary *url.URL
+	if i := p.primaryIndex(); i >= 0 {
+		primary = p.urls[i]
+	}
+	if isWriteMethod(r.Method) || strings.HasPrefix(r.URL.Path, "/admin/") {
+		return primary
+	}
+
+	replicas := make([]*url.URL, 0, len(p.members))
+	for i, member := range p.members {
+		if member.Ready && member.Role == "replica" {
+			replicas = append(replicas, p.urls[i])
+		}
+	}
+
+	if len(replicas) == 0 {
+		return primary
+	}
+	return replicas[p.next.Add(1)%uint64(len(replicas))]
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := p.pick(r)
+	if target == nil {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusServiceUnavailable, CodeUnavailable, "no ready member can take the request")
+		return
+	}
+
+	p.reverse.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyTarget{}, target)))
+}
+
+// HandleProxyReadyz answers 200 while the proxy knows a ready primary.
+func (p *Proxy) HandleProxyReadyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	p.mu.RLock()
+	primary := p.primary()
+	p.mu.RUnlock()
+
+	if primary == "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		error, _ := json.Marshal(map[string]string{"status": "no ready primary", "role": "proxy"})
+
+		w.Write(error)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	status, _ := json.Marshal(map[string]string{"status": "ready", "role": "proxy"})
+
+	w.Write(status)
+}
+
+// HandleProxyMembers lists the members as last probed.
+func (p *Proxy) HandleProxyMembers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	p.mu.RLock()
+	members, _ := json.Marshal(p.members)
+	p.mu.RUnlock()
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(members)
+}
+
+// runProxy serves the -proxy of cfg until SIGINT or SIGTERM and returns the exit
+// status.
+func runProxy(cfg Config) int {
+	p, err := NewProxy(cfg)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	if cfg.APIKeysFile != "" {
+		keys, err := loadAPIKeys(cfg.APIKeysFile)
+		if err != nil {
+			log.Printf("load -api-keys-file: %v", err)
+			return 1
+		}
+		p.apiKeys.Set(keys)
+	}
+
+	handler := http.NewServeMux()
+
+	handler.Handle("/", p)
+
+	handler.HandleFunc("/healthz", Recovery(HandleHealthz))
+
+	handler.HandleFunc("/readyz", Recovery(p.HandleProxyReadyz))
+
+	handler.HandleFunc("/proxy/members", Recovery(p.apiKeys.Auth(p.HandleProxyMembers)))
+
+	hs := &http.Server{
+		Handler:           RequestID(handler.ServeHTTP),
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    1 << 20,
+	}
+	hs.Protocols, hs.HTTP2 = cfg.serverProtocols(), cfg.http2Config()
+
+	if cfg.tlsEnabled() {
+		var current atomic.Pointer[tls.Config]
+		hs.TLSConfig, err = cfg.serverTLSConfig(&current)
+		if err != nil {
+			log.Printf("invalid TLS settings: %v", err)
+			return 1
+		}
+	}
+
+	ln, err := listen(cfg.Addr, cfg.TCPKeepAlive)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	p.probeAll()
+	go p.run(ctx)
+
+	log.Printf("proxying to %s", cfg.ProxyMembers)
+
+	if err := (&Server{cfg: cfg, http: hs}).Serve(ctx, ln); err != nil {
+		log.Printf("shutdown: %v", err)
+		return 1
+	}
+	return 0
+}
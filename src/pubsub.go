@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Message is one publish to a channel, as subscribers receive it. Data is
+// the body of the publish.
+type Message struct {
+	Channel     string    `json:"channel"`
+	Data        string    `json:"data"`
+	PublishedAt time.Time `json:"published_at"`
+}
+
+// Channels fans published messages out to the subscribers of a channel.
+// Nothing is stored: a message reaches whoever is subscribed right then,
+// and subscribers that fall watchBuffer messages behind are dropped like
+// watchers are.
+type Channels struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan Message]bool
+}
+
+func NewChannels() *Channels {
+	return &Channels{subscribers: make(map[string]map[chan Message]bool)}
+}
+
+func (ch *Channels) Subscribe(channel string) chan Message {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	messages := make(chan Message, watchBuffer)
+
+	if ch.subscribers[channel] == nil {
+		ch.subscribers[channel] = make(map[chan Message]bool)
+	}
+	ch.subscribers[channel][messages] = true
+
+	return messages
+}
+
+func (ch *Channels) Unsubscribe(channel string, messages chan Message) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	ch.drop(channel, messages)
+}
+
+// drop closes messages if still subscribed. Callers hold ch.mu.
+func (ch *Channels) drop(channel string, messages chan Message) {
+	if !ch.subscribers[channel][messages] {
+		return
+	}
+
+	delete(ch.subscribers[channel], messages)
+	if len(ch.subscribers[channel]) == 0 {
+		delete(ch.subscribers, channel)
+	}
+	close(messages)
+}
+
+// Publish hands message to the subscribers of its channel without
+// blocking and returns how many got it.
+func (ch *Channels) Publish(message Message) int {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	received := 0
+
+	for messages := range ch.subscribers[message.Channel] {
+		select {
+		case messages <- message:
+			received++
+		default:
+			ch.drop(message.Channel, messages)
+		}
+	}
+
+	return received
+}
+
+// CloseAll ends every subscription, so shutdown does not wait on them.
+func (ch *Channels) CloseAll() {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	for channel, subscribers := range ch.subscribers {
+		for messages := range subscribers {
+			ch.drop(channel, messages)
+		}
+	}
+}
+
+// HandlePublish sends the request body to the subscribers of
+// POST /publish/<channel> and answers with how many received it.
+func (s *Server) HandlePublish(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	channel := strings.TrimPrefix(r.URL.Path, "/publish/")
+	if channel == "" {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "missing channel name")
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.cfg.MaxBodyBytes))
+	if err != nil {
+		writeError(w, badBodyStatus(err), "", fmt.Sprintf("Bad request. %v", err))
+		return
+	}
+
+	if !utf8.Valid(data) {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "message is not valid UTF-8")
+		return
+	}
+
+	received := s.channels.Publish(Message{Channel: channel, Data: string(data), PublishedAt: time.Now()})
+
+	w.WriteHeader(http.StatusOK)
+	body, _ := json.Marshal(map[string]int{"receivers": received})
+
+	w.Write(body)
+}
+
+// HandleSubscribe streams the messages published to GET /subscribe/<channel>
+// from now on, over a WebSocket when the request asks for an upgrade and as
+// Server-Sent Events otherwise.
+func (s *Server) HandleSubscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	channel := strings.TrimPrefix(r.URL.Path, "/subscribe/")
+	if channel == "" {
+		w.Header().Set("Content-Type", "application/json")
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "missing channel name")
+		return
+	}
+
+	defer s.streaming()()
+
+	if isWebSocketUpgrade(r) {
+		s.subscribeWebSocket(w, r, channel)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	messages := s.channels.Subscribe(channel)
+	defer s.channels.Unsubscribe(channel, messages)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				return
+			}
+
+			data, _ := json.Marshal(message)
+			fmt.Fprintf(w, "event: message\ndata: %s\n\n", data)
+
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+
+		case <-r.Context().Done():
+			return
+		}
+
+		if rc.Flush() != nil {
+			return
+		}
+	}
+}
+
+// subscribeWebSocket sends each message as a text frame until either side
+// closes. Messages from the client are read only to see it close; a
+// subscriber dropped for falling behind gets a close frame.
+func (s *Server) subscribeWebSocket(w http.ResponseWriter, r *http.Request, channel string) {
+	c := s.acceptWebSocket(w, r)
+	if c == nil {
+		return
+	}
+	defer c.conn.Close()
+
+	messages := s.channels.Subscribe(channel)
+
+	go func() {
+		for message := range messages {
+			if c.writeJSON(message) != nil {
+				c.conn.Close()
+			}
+		}
+		c.writeFrame(opClose, nil)
+		c.conn.Close()
+	}()
+
+	for {
+		if _, err := c.readMessage(); err != nil {
+			s.channels.Unsubscribe(channel, messages)
+			return
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Quota caps how many books a bucket holds and their id plus value bytes,
+// as /bucket/<bucket>/stats counts them. Zero is no cap.
+type Quota struct {
+	MaxBooks int64 `json:"max_books"`
+	MaxBytes int64 `json:"max_bytes"`
+}
+
+func parseBucketQuotas(value string) (map[string]Quota, error) {
+	quotas := make(map[string]Quota)
+
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		bucket, limits, ok := strings.Cut(part, "=")
+		books, bytes, ok2 := strings.Cut(limits, "/")
+		if !ok || !ok2 || (bucket != "*" && !bucketNamePattern.MatchString(bucket)) {
+			return nil, errors.New(fmt.Sprintf("expected <bucket>=<max books>/<max bytes>, got %q", part))
+		}
+
+		var quota Quota
+		var err error
+		if quota.MaxBooks, err = strconv.ParseInt(books, 10, 64); err != nil || quota.MaxBooks < 0 {
+			return nil, errors.New(fmt.Sprintf("invalid max books in %q", part))
+		}
+		if quota.MaxBytes, err = strconv.ParseInt(bytes, 10, 64); err != nil || quota.MaxBytes < 0 {
+			return nil, errors.New(fmt.Sprintf("invalid max bytes in %q", part))
+		}
+
+		quotas[bucket] = quota
+	}
+
+	return quotas, nil
+}
+
+// bucketQuota returns the quota of bucket and whether it has one.
+func (s *Server) bucketQuota(bucket string) (Quota, bool) {
+	if quota, ok := s.bucketQuotas[bucket]; ok {
+		return quota, true
+	}
+	quota, ok := s.bucketQuotas["*"]
+	return quota, ok
+}
+
+// bucketOf returns the bucket a store id is kept in. Internal ids, like
+// those of locks, are in no bucket.
+func bucketOf(id string) (string, bool) {
+	bucket, _, ok := strings.Cut(strings.TrimPrefix(id, bucketIdPrefix), "/")
+	if !inBucket(id) || !ok || !bucketNamePattern.MatchString(bucket) {
+		return "", false
+	}
+	return bucket, true
+}
+
+func (s *Server) bucketStats(ctx context.Context, bucket string) BucketStats {
+	stats := BucketStats{Bucket: bucket}
+
+	for _, book := range s.bucketBooks(ctx, bucket) {
+		stats.Books++
+		stats.KeyBytes += len(book.Id)
+		stats.ValueBytes += book.valueSize()
+	}
+
+	return stats
+}
+
+// checkQuotas returns the first bucket quota the books would break if
+// written. Like -max-store-bytes it is checked before the hooks run, to
+// refuse early; the store checks both again as it writes, so concurrent
+// writes can not overshoot them.
+func (s *Server) checkQuotas(books []Book) *LimitError {
+	if len(s.bucketQuotas) == 0 {
+		return nil
+	}
+
+	newBooks := make(map[string]int64)
+	growth := make(map[string]int64)
+	buckets := make([]string, 0)
+
+	for _, book := range books {
+		bucket, ok := bucketOf(book.Id)
+		if !ok {
+			continue
+		}
+		if _, ok := s.bucketQuota(bucket); !ok {
+			continue
+		}
+
+		if _, seen := growth[bucket]; !seen {
+			buckets = append(buckets, bucket)
+		}
+
+		growth[bucket] += int64(book.valueSize())
+		if stored := s.store.FindBookById(book.Id); stored != nil {
+			growth[bucket] -= int64(stored.valueSize())
+		} else {
+			newBooks[bucket]++
+			growth[bucket] += int64(len(book.Id) - len(bucketStoreId(bucket, "")))
+		}
+	}
+
+	for _, bucket := range buckets {
+		quota, _ := s.bucketQuota(bucket)
+		stats := s.bucketStats(context.Background(), bucket)
+
+		if count := int64(stats.Books) + newBooks[bucket]; quota.MaxBooks > 0 && newBooks[bucket] > 0 && count > quota.MaxBooks {
+			return &LimitError{
+				APIError: APIError{Message: fmt.Sprintf("bucket %s would hold more than %d books", bucket, quota.MaxBooks)},
+				Limit:    quota.MaxBooks,
+				Size:     count,
+			}
+		}
+
+		if size := int64(stats.KeyBytes+stats.ValueBytes) + growth[bucket]; quota.MaxBytes > 0 && growth[bucket] > 0 && size > quota.MaxBytes {
+			return &LimitError{
+				APIError: APIError{Message: fmt.Sprintf("bucket %s would grow past %d bytes", bucket, quota.MaxBytes)},
+				Limit:    quota.MaxBytes,
+				Size:     size,
+			}
+		}
+	}
+
+	return nil
+}
+
+// QuotaUsage is one bucket of GET /admin/quotas.
+type QuotaUsage struct {
+	BucketStats
+	Quota *Quota `json:"quota,omitempty"`
+}
+
+// HandleQuotas lists the usage of every bucket holding books or having a
+// quota of its own, with the quota that applies.
+func (s *Server) HandleQuotas(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	buckets := make(map[string]bool)
+	for bucket := range s.bucketQuotas {
+		if bucket != "*" {
+			buckets[bucket] = true
+		}
+	}
+
+	// One book per bucket is enough, so skip past the rest of each.
+	for after := ""; ; {
+		page, more, err := s.store.BooksAfter(r.Context(), bucketIdPrefix, after, 1)
+		if !handleCanceled(w, err) {
+			return
+		}
+		if len(page) == 0 {
+			break
+		}
+
+		after = page[0].Id
+		if bucket, ok := bucketOf(after); ok {
+			buckets[bucket] = true
+			after = bucketStoreId(bucket, "\xff")
+		}
+
+		if !more {
+			break
+		}
+	}
+
+	names := make([]string, 0, len(buckets))
+	for bucket := range buckets {
+		names = append(names, bucket)
+	}
+	sort.Strings(names)
+
+	usage := make([]QuotaUsage, 0, len(names))
+	for _, bucket := range names {
+		entry := QuotaUsage{BucketStats: s.bucketStats(r.Context(), bucket)}
+		if quota, ok := s.bucketQuota(bucket); ok {
+			entry.Quota = &quota
+		}
+		usage = append(usage, entry)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	body, _ := json.Marshal(usage)
+
+	w.Write(body)
+}
@@ -0,0 +1,698 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// raftApplyTimeout bounds how long a write waits to be committed.
+const raftApplyTimeout = 10 * time.Second
+
+var errNotRaftLeader = errors.New("this server is not the raft leader, which takes the writes")
+
+// errRaftDryRun ends the run of a Store method that only had its prepare
+// called, see RaftStore.
+var errRaftDryRun = errors.New("dry run")
+
+// raftCommand is one write in the Raft log. Op names the Store method
+// and the other fields are its arguments.
+type raftCommand struct {
+	Op      string       `json:"op"`
+	Id      string       `json:"id,omitempty"`
+	Ids     []string     `json:"ids,omitempty"`
+	Cond    string       `json:"cond,omitempty"`
+	Book    Book         `json:"book"`
+	Old     Book         `json:"old"`
+	Books   []Book       `json:"books,omitempty"`
+	Ops     []BatchOp    `json:"ops,omitempty"`
+	Failure []BatchOp    `json:"failure,omitempty"`
+	Compare []TxnCompare `json:"compare,omitempty"`
+	Event   *ChangeEvent `json:"event,omitempty"`
+
+	// Expect is set on a txn the hooks have seen, to whether they were
+	// shown its success branch; the other branch is left out.
+	Expect *bool `json:"expect,omitempty"`
+}
+
+// raftResult is what applying a command returned, for the member that
+// proposed it.
+type raftResult struct {
+	err     error
+	ok      bool // whether ApplyBatch applied and Txn succeeded
+	results []BatchResult
+	books   []Book
+}
+
+// raftFSM applies the commands of the Raft log to the books of a member.
+// Every member applies the same commands in the same order, so they hold
+// the same books under the same versions.
+type raftFSM struct {
+	memory *MemoryStore
+}
+
+func (f *raftFSM) Apply(entry *raft.Log) any {
+	data, err := f.memory.keys.openLine(entry.Data)
+	if err != nil {
+		return raftResult{err: err}
+	}
+
+	var c raftCommand
+	if err := json.Unmarshal(data, &c); err != nil {
+		return raftResult{err: err}
+	}
+
+	return f.apply(c)
+}
+
+func (f *raftFSM) apply(c raftCommand) raftResult {
+	m := f.memory
+
+	switch c.Op {
+	case "add":
+		return raftResult{err: m.AddBook(c.Book)}
+	case "set":
+		return raftResult{err: m.SetBook(c.Book)}
+	case "set-if":
+		return raftResult{err: m.SetBookIf(c.Book, c.Cond)}
+	case "swap":
+		return raftResult{err: m.SwapBook(c.Old, c.Book)}
+	case "delete":
+		return raftResult{err: m.DelBook(c.Id)}
+	case "delete-if":
+		return raftResult{err: m.DelBookIf(c.Id, c.Cond)}
+
+	case "drain":
+		books, err := m.DrainBooks(c.Ids, nil)
+		return raftResult{err: err, books: books}
+
+	case "batch":
+		results, applied := m.ApplyBatch(c.Ops)
+		return raftResult{ok: applied, results: results}
+
+	case "txn":
+		succeeded, results, err := m.Txn(c.Compare, c.Ops, c.Failure, nil)
+		if err == nil && c.Expect != nil && succeeded != *c.Expect {
+			err = errors.New("the books changed while the transaction was prepared; retry it")
+		}
+		return raftResult{err: err, ok: succeeded, results: results}
+
+	case "replace":
+		m.ReplaceBooks(c.Books)
+		return raftResult{}
+
+	case "change":
+		m.ApplyChange(*c.Event)
+		return raftResult{}
+	}
+
+	return raftResult{err: errors.New(fmt.Sprintf("unknown raft command %s", c.Op))}
+}
+
+// Snapshot takes the books for Raft to compact its log with. They are
+// persisted as the put records of a compacted WAL.
+func (f *raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	books, err := f.memory.GetBooks(context.Background())
+	return raftSnapshot{books: books, keys: &f.memory.keys}, err
+}
+
+func (f *raftFSM) Restore(snapshot io.ReadCloser) error {
+	defer snapshot.Close()
+
+	books := make([]Book, 0)
+
+	scanner := bufio.NewScanner(snapshot)
+	scanner.Buffer(make([]byte, 64*1024), 1<<30)
+
+	for line := 1; scanner.Scan(); line++ {
+		record, err := parseWALRecord(&f.memory.keys, scanner.Bytes())
+		if err != nil {
+			return errors.New(fmt.Sprintf("raft snapshot line %d: %v", line, err))
+		}
+		books = append(books, record.Book)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	f.memory.ReplaceBooks(books)
+
+	return nil
+}
+
+// raftSnapshot holds the books of a snapshot and the keys they are sealed
+// with.
+type raftSnapshot struct {
+	books []Book
+	keys  *Keyring
+}
+
+func (snapshot raftSnapshot) Persist(sink raft.SnapshotSink) error {
+	w := bufio.NewWriter(sink)
+
+	for _, book := range snapshot.books {
+		line, _ := json.Marshal(WALRecord{Op: "put", Book: book, CRC: book.checksum()})
+		w.Write(snapshot.keys.sealLine(line))
+		w.WriteByte('\n')
+	}
+
+	if err := w.Flush(); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (raftSnapshot) Release() {}
+
+// RaftStore is a MemoryStore whose writes go through the Raft log of a
+// cluster: the leader appends each one as a command, and every member
+// applies it once it is committed, see raftFSM. Reads are served by the
+// books of the member, so a follower may answer them a moment behind the
+// leader. Writes to a follower fail with errNotRaftLeader; RaftForward
+// sends those of HTTP requests to the leader.
+//
+// The prepare of a write, which runs the hooks, only runs on the leader:
+// the write is run on its books first with a prepare that ends it, and
+// the writes prepare leaves are what goes into the log. The leader writes
+// one book change at a time, so the log holds nothing the run did not see.
+//
+// Each member stamps UpdatedAt and expires books by its own clock, and
+// keeps its own -history-depth. Soft delete is refused with -backend raft,
+// so RestoreBook and PurgeDeleted are those of the MemoryStore and find
+// nothing to do.
+type RaftStore struct {
+	*MemoryStore
+
+	raft    *raft.Raft
+	id      string
+	closers []io.Closer
+
+	mu sync.Mutex // orders the writes of the leader
+}
+
+// newRaftStore starts the Raft member of config on the log, stable,
+// snapshot store and transport given, applying the cluster's writes to
+// memory. With bootstrap and no state yet, it starts a cluster of one.
+func newRaftStore(memory *MemoryStore, config *raft.Config, logs raft.LogStore, stable raft.StableStore, snapshots raft.SnapshotStore, transport raft.Transport, bootstrap bool) (*RaftStore, error) {
+	if bootstrap {
+		existing, err := raft.HasExistingState(logs, stable, snapshots)
+		if err != nil {
+			return nil, err
+		}
+
+		if !existing {
+			cluster := raft.Configuration{Servers: []raft.Server{{ID: config.LocalID, Address: transport.LocalAddr()}}}
+			if err := raft.BootstrapCluster(config, logs, stable, snapshots, transport, cluster); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	r, err := raft.NewRaft(config, &raftFSM{memory: memory}, logs, stable, snapshots, transport)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RaftStore{MemoryStore: memory, raft: r, id: string(config.LocalID)}, nil
+}
+
+// openRaftStore starts the Raft member of -raft-id, keeping its log in
+// -raft-dir and talking to the others on -raft-addr.
+func openRaftStore(memory *MemoryStore, cfg Config) (*RaftStore, error) {
+	if err := os.MkdirAll(cfg.RaftDir, 0o755); err != nil {
+		return nil, err
+	}
+
+	logs, err := openRaftBoltStore(filepath.Join(cfg.RaftDir, "raft.db"))
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots, err := raft.NewFileSnapshotStore(cfg.RaftDir, 2, os.Stderr)
+	if err != nil {
+		logs.Close()
+		return nil, err
+	}
+
+	advertise, err := net.ResolveTCPAddr("tcp", cfg.RaftAddr)
+	if err != nil {
+		logs.Close()
+		return nil, err
+	}
+
+	transport, err := raft.NewTCPTransport(cfg.RaftAddr, advertise, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		logs.Close()
+		return nil, err
+	}
+
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(cfg.RaftID)
+
+	rs, err := newRaftStore(memory, config, logs, logs, snapshots, transport, cfg.RaftBootstrap)
+	if err != nil {
+		transport.Close()
+		logs.Close()
+		return nil, err
+	}
+
+	rs.closers = []io.Closer{transport, logs}
+
+	return rs, nil
+}
+
+// checkRaft checks the settings -backend raft needs and refuses the
+// features that would let the books of the members drift apart.
+func (c Config) checkRaft() error {
+	if id, err := url.Parse(c.RaftID); err != nil || (id.Scheme != "http" && id.Scheme != "https") || id.Host == "" {
+		return errors.New(fmt.Sprintf("-backend raft needs -raft-id, the http or https URL of this server, not %q", c.RaftID))
+	}
+
+	if c.RaftAddr == "" {
+		return errors.New("-backend raft needs -raft-addr")
+	}
+
+	// The cluster elects its own primary, and snapshots hold no
+	// soft-deleted books.
+	switch {
+	case c.ReplicaOf != "":
+		return errors.New("-backend raft can not be combined with -replica-of")
+	case c.PeersSpec != "":
+		return errors.New("-backend raft can not be combined with -peers")
+	case c.SoftDelete:
+		return errors.New("-backend raft can not be combined with -soft-delete")
+	}
+	return nil
+}
+
+// propose appends c to the Raft log and returns what applying it did on
+// this member. Callers hold rs.mu.
+func (rs *RaftStore) propose(c raftCommand) raftResult {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return raftResult{err: err}
+	}
+
+	future := rs.raft.Apply(rs.keys.sealLine(data), raftApplyTimeout)
+
+	if err := raftError(future.Error()); err != nil {
+		return raftResult{err: err}
+	}
+
+	return future.Response().(raftResult)
+}
+
+// caughtUp waits until this member has applied every write committed
+// before, which a new leader may not have yet, so a dry run sees them.
+// Callers hold rs.mu.
+func (rs *RaftStore) caughtUp() error {
+	return raftError(rs.raft.Barrier(raftApplyTimeout).Error())
+}
+
+// raftError is err of a raft future as the Store methods return it.
+func raftError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, raft.ErrNotLeader), errors.Is(err, raft.ErrLeadershipLost), errors.Is(err, raft.ErrLeadershipTransferInProgress):
+		return errNotRaftLeader
+	}
+	return errors.New(fmt.Sprintf("raft: %v", err))
+}
+
+// leader returns the URL of the HTTP API of the leader, or nil while there
+// is none.
+func (rs *RaftStore) leader() *url.URL {
+	_, id := rs.raft.LeaderWithID()
+	if id == "" {
+		return nil
+	}
+
+	leader, err := url.Parse(string(id))
+	if err != nil {
+		return nil
+	}
+	return leader
+}
+
+func (rs *RaftStore) AddBook(book Book) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	return rs.propose(raftCommand{Op: "add", Book: book}).err
+}
+
+func (rs *RaftStore) SetBook(book Book) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	return rs.propose(raftCommand{Op: "set", Book: book}).err
+}
+
+func (rs *RaftStore) SetBookIf(book Book, cond string) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	return rs.propose(raftCommand{Op: "set-if", Book: book, Cond: cond}).err
+}
+
+func (rs *RaftStore) SwapBook(old Book, book Book) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	return rs.propose(raftCommand{Op: "swap", Old: old, Book: book}).err
+}
+
+func (rs *RaftStore) DelBook(id string) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	return rs.propose(raftCommand{Op: "delete", Id: id}).err
+}
+
+func (rs *RaftStore) DelBookIf(id string, cond string) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	return rs.propose(raftCommand{Op: "delete-if", Id: id, Cond: cond}).err
+}
+
+// DrainBooks has the hooks refuse the drain before it goes into the log.
+func (rs *RaftStore) DrainBooks(ids []string, prepare func(ids []string) error) ([]Book, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if prepare != nil {
+		if err := rs.caughtUp(); err != nil {
+			return nil, err
+		}
+
+		_, err := rs.MemoryStore.DrainBooks(ids, func(present []string) error {
+			if err := prepare(present); err != nil {
+				return err
+			}
+			return errRaftDryRun
+		})
+		if err != errRaftDryRun {
+			return nil, err
+		}
+	}
+
+	result := rs.propose(raftCommand{Op: "drain", Ids: ids})
+	return result.books, result.err
+}
+
+// ApplyBatch fails every op when the batch can not go into the log.
+func (rs *RaftStore) ApplyBatch(ops []BatchOp) ([]BatchResult, bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	result := rs.propose(raftCommand{Op: "batch", Ops: ops})
+	if result.err != nil {
+		results := make([]BatchResult, len(ops))
+		for i, op := range ops {
+			results[i] = BatchResult{Op: op.Op, Id: op.Book.Id, Error: result.err.Error()}
+		}
+		return results, false
+	}
+	return result.results, result.ok
+}
+
+// Txn logs only the branch prepare was shown, as prepare left it.
+func (rs *RaftStore) Txn(compare []TxnCompare, success, failure []BatchOp, prepare func(writes []*BatchOp) error) (bool, []BatchResult, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	c := raftCommand{Op: "txn", Compare: compare, Ops: success, Failure: failure}
+
+	if prepare != nil {
+		if err := rs.caughtUp(); err != nil {
+			return false, nil, err
+		}
+
+		success, failure = slices.Clone(success), slices.Clone(failure)
+
+		succeeded, _, err := rs.MemoryStore.Txn(compare, success, failure, func(writes []*BatchOp) error {
+			if err := prepare(writes); err != nil {
+				return err
+			}
+			return errRaftDryRun
+		})
+		if err != errRaftDryRun {
+			return succeeded, nil, err
+		}
+
+		c.Expect = &succeeded
+		if succeeded {
+			c.Ops, c.Failure = success, nil
+		} else {
+			c.Ops, c.Failure = nil, failure
+		}
+	}
+
+	result := rs.propose(c)
+	return result.ok, result.results, result.err
+}
+
+// ImportBooks works out the writes of the import on the local copy, runs
+// prepare on them and logs them as a txn. As every write goes through
+// rs.mu, the copy does not change before the txn is applied.
+func (rs *RaftStore) ImportBooks(books []Book, keep func(id string) bool, prepare func(writes []*BatchOp) error) ([]BatchResult, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if err := rs.caughtUp(); err != nil {
+		return nil, err
+	}
+
+	var ops []BatchOp
+	_, err := rs.MemoryStore.ImportBooks(books, keep, func(writes []*BatchOp) error {
+		if prepare != nil {
+			if err := prepare(writes); err != nil {
+				return err
+			}
+		}
+		for _, op := range writes {
+			ops = append(ops, *op)
+		}
+		return errRaftDryRun
+	})
+	if err != errRaftDryRun {
+		return nil, err
+	}
+
+	result := rs.propose(raftCommand{Op: "txn", Ops: ops})
+	return result.results, result.err
+}
+
+func (rs *RaftStore) ReplaceBooks(books []Book) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if err := rs.propose(raftCommand{Op: "replace", Books: books}).err; err != nil {
+		log.Printf("raft: replace books: %v", err)
+	}
+}
+
+func (rs *RaftStore) ApplyChange(event ChangeEvent) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if err := rs.propose(raftCommand{Op: "change", Event: &event}).err; err != nil {
+		log.Printf("raft: apply change to %s: %v", event.Id, err)
+	}
+}
+
+// Check reports whether the cluster has a leader to take writes.
+func (rs *RaftStore) Check() error {
+	if rs.leader() == nil {
+		return errors.New("the raft cluster has no leader")
+	}
+	return nil
+}
+
+func (rs *RaftStore) Close() error {
+	err := rs.raft.Shutdown().Error()
+
+	for _, closer := range rs.closers {
+		closer.Close()
+	}
+	return err
+}
+
+// raftLocalPaths are the writes that act on the member they are sent to,
+// which RaftForward leaves to it.
+var raftLocalPaths = map[string]bool{
+	"/admin/raft/snapshot": true,
+	"/admin/read-only":     true,
+	"/admin/reencrypt":     true,
+	"/admin/verify":        true,
+	"/admin/quotas":        true,
+}
+
+// RaftForward hands the writes a follower gets to the leader of the Raft
+// cluster and answers with the leader's answer; credentials and limits are
+// then checked by the leader. It is next unless the store is a RaftStore.
+// A member never forwards a request forwarded to it, so members that
+// disagree on the leader answer 503 instead of passing it around.
+func (s *Server) RaftForward(next http.HandlerFunc) http.HandlerFunc {
+	rs, ok := s.store.(*RaftStore)
+	if !ok {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isWriteMethod(r.Method) || raftLocalPaths[r.URL.Path] || rs.raft.State() == raft.Leader {
+			next(w, r)
+			return
+		}
+
+		leader := rs.leader()
+		if leader == nil || r.Header.Get("X-Raft-Forwarded") != "" {
+			writeError(w, http.StatusServiceUnavailable, CodeNoLeader, "the raft cluster has no leader to take the write")
+			return
+		}
+
+		proxy := &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				pr.SetURL(leader)
+				pr.SetXForwarded()
+				pr.Out.Header.Set("X-Raft-Forwarded", rs.id)
+			},
+			// The leader echoes the request id, which is on the answer already.
+			ModifyResponse: func(resp *http.Response) error {
+				resp.Header.Del("X-Request-ID")
+				return nil
+			},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				writeError(w, http.StatusBadGateway, CodeUnavailable, fmt.Sprintf("raft leader %s failed: %v", leader, err))
+			},
+		}
+		proxy.ServeHTTP(w, r)
+	}
+}
+
+// RaftMember is one member of the cluster, by the URL of its HTTP API
+// and the address of its Raft transport.
+type RaftMember struct {
+	Id      string `json:"id"`
+	Address string `json:"address,omitempty"`
+}
+
+// RaftStatus is this member's view of the cluster, at GET /admin/raft.
+type RaftStatus struct {
+	Id           string       `json:"id"`
+	State        string       `json:"state"` // Leader, Follower, Candidate or Shutdown
+	Leader       string       `json:"leader"`
+	Members      []RaftMember `json:"members"`
+	AppliedIndex uint64       `json:"applied_index"`
+}
+
+// HandleRaft serves GET /admin/raft, and POST /admin/raft/join and
+// /admin/raft/leave, which add and remove a member with the RaftMember in
+// the body, and /admin/raft/snapshot, which has this member snapshot its
+// books so its log can be compacted.
+func (s *Server) HandleRaft(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	rs, ok := s.store.(*RaftStore)
+	if !ok {
+		writeError(w, http.StatusNotFound, CodeNotFound, "this server is not in a raft cluster, see -backend raft")
+		return
+	}
+
+	op := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/raft"), "/")
+
+	if (op == "") != (r.Method == http.MethodGet) || (op != "" && r.Method != http.MethodPost) {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	var err error
+	var answer any
+
+	switch op {
+	case "":
+		answer, err = rs.status()
+
+	case "join", "leave":
+		var member RaftMember
+		if err := s.decodeBody(r, &member); err != nil {
+			writeError(w, badBodyStatus(err), "", err.Error())
+			return
+		}
+
+		if id, err := url.Parse(member.Id); err != nil || id.Host == "" || (op == "join" && member.Address == "") {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, "expected the URL of the member as id, and its Raft address to join")
+			return
+		}
+
+		if op == "join" {
+			err = rs.raft.AddVoter(raft.ServerID(member.Id), raft.ServerAddress(member.Address), 0, raftApplyTimeout).Error()
+		} else {
+			err = rs.raft.RemoveServer(raft.ServerID(member.Id), 0, raftApplyTimeout).Error()
+		}
+		answer = member
+
+	case "snapshot":
+		future := rs.raft.Snapshot()
+
+		if err = future.Error(); err == nil {
+			var meta *raft.SnapshotMeta
+			var snapshot io.ReadCloser
+
+			if meta, snapshot, err = future.Open(); err == nil {
+				snapshot.Close()
+				answer = map[string]any{"id": meta.ID, "index": meta.Index}
+			}
+		}
+
+	default:
+		writeError(w, http.StatusNotFound, CodeNotFound, fmt.Sprintf("unknown raft operation %s", op))
+		return
+	}
+
+	switch {
+	case errors.Is(err, raft.ErrNotLeader):
+		writeError(w, http.StatusServiceUnavailable, CodeNoLeader, err.Error())
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("raft: %v", err))
+	default:
+		body, _ := json.Marshal(answer)
+		w.Write(body)
+	}
+}
+
+func (rs *RaftStore) status() (RaftStatus, error) {
+	future := rs.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return RaftStatus{}, err
+	}
+
+	_, leader := rs.raft.LeaderWithID()
+	status := RaftStatus{Id: rs.id, State: rs.raft.State().String(), Leader: string(leader), Members: make([]RaftMember, 0), AppliedIndex: rs.raft.AppliedIndex()}
+
+	for _, server := range future.Configuration().Servers {
+		status.Members = append(status.Members, RaftMember{Id: string(server.ID), Address: string(server.Address)})
+	}
+
+	return status, nil
+}
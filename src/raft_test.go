@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// raftNode is one member of a test cluster.
+type raftNode struct {
+	s         *Server
+	ts        *httptest.Server
+	store     *RaftStore
+	transport *raft.InmemTransport
+}
+
+// newRaftCluster starts members in memory, with the first one bootstrapped
+// as the leader and the others joined through its /admin/raft/join.
+func newRaftCluster(t *testing.T, members int, opts ...ServerOption) []*raftNode {
+	t.Helper()
+
+	nodes := make([]*raftNode, members)
+
+	for i := range nodes {
+		ts := httptest.NewUnstartedServer(nil)
+		_, transport := raft.NewInmemTransport("")
+
+		config := raft.DefaultConfig()
+		config.LocalID = raft.ServerID("http://" + ts.Listener.Addr().String())
+		config.HeartbeatTimeout = 50 * time.Millisecond
+		config.ElectionTimeout = 50 * time.Millisecond
+		config.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.CommitTimeout = 5 * time.Millisecond
+		config.LogOutput = io.Discard
+
+		logs := raft.NewInmemStore()
+		rs, err := newRaftStore(NewMemoryStore(4, 0), config, logs, logs, raft.NewInmemSnapshotStore(), transport, i == 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { rs.Close() })
+
+		s, err := New(append([]ServerOption{WithStore(rs)}, opts...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts.Config.Handler = s
+		ts.Start()
+		t.Cleanup(ts.Close)
+
+		nodes[i] = &raftNode{s: s, ts: ts, store: rs, transport: transport}
+	}
+
+	for _, a := range nodes {
+		for _, b := range nodes {
+			if a != b {
+				a.transport.Connect(b.transport.LocalAddr(), b.transport)
+			}
+		}
+	}
+
+	waitFor(t, "a leader", func() bool { return nodes[0].store.raft.State() == raft.Leader })
+
+	for _, node := range nodes[1:] {
+		body := fmt.Sprintf(`{"id":%q,"address":%q}`, node.store.id, node.transport.LocalAddr())
+		if status, answer := send(t, http.MethodPost, nodes[0].ts.URL+"/admin/raft/join", body); status != http.StatusOK {
+			t.Fatalf("join %s: %d %s", node.store.id, status, answer)
+		}
+	}
+
+	return nodes
+}
+
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); !done(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// converged waits until every member holds the same books as the first,
+// by id, version and name, and returns them.
+func converged(t *testing.T, nodes []*raftNode) []Book {
+	t.Helper()
+
+	summary := func(node *raftNode) string {
+		books, _ := node.store.GetBooks(t.Context())
+		lines := make([]string, 0, len(books))
+		for _, book := range books {
+			lines = append(lines, fmt.Sprintf("%s@%d=%s", book.Id, book.Version, book.Name))
+		}
+		slices.Sort(lines)
+		return strings.Join(lines, " ")
+	}
+
+	waitFor(t, "the members to converge", func() bool {
+		want := summary(nodes[0])
+		for _, node := range nodes[1:] {
+			if summary(node) != want {
+				return false
+			}
+		}
+		return true
+	})
+
+	books, _ := nodes[0].store.GetBooks(t.Context())
+	return books
+}
+
+func TestRaftClusterStatus(t *testing.T) {
+	nodes := newRaftCluster(t, 3)
+
+	status, answer := send(t, http.MethodGet, nodes[2].ts.URL+"/admin/raft", "")
+	if status != http.StatusOK {
+		t.Fatalf("status %d: %s", status, answer)
+	}
+
+	var got RaftStatus
+	if err := json.Unmarshal([]byte(answer), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Id != nodes[2].store.id || got.State != "Follower" || got.Leader != nodes[0].store.id || len(got.Members) != 3 {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestRaftWrites(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(node *raftNode) error
+		want  []string // names of the books, by id
+	}{
+		{
+			name:  "add",
+			write: func(node *raftNode) error { return node.store.AddBook(Book{Id: "c", Name: "3"}) },
+			want:  []string{"a=1", "b=2", "c=3"},
+		},
+		{
+			name:  "set",
+			write: func(node *raftNode) error { return node.store.SetBook(Book{Id: "a", Name: "9"}) },
+			want:  []string{"a=9", "b=2"},
+		},
+		{
+			name:  "set if",
+			write: func(node *raftNode) error { return node.store.SetBookIf(Book{Id: "a", Name: "9"}, "eq:1") },
+			want:  []string{"a=9", "b=2"},
+		},
+		{
+			name:  "swap",
+			write: func(node *raftNode) error { return node.store.SwapBook(Book{Name: "2"}, Book{Id: "b", Name: "9"}) },
+			want:  []string{"a=1", "b=9"},
+		},
+		{
+			name:  "delete",
+			write: func(node *raftNode) error { return node.store.DelBook("a") },
+			want:  []string{"b=2"},
+		},
+		{
+			name:  "delete if",
+			write: func(node *raftNode) error { return node.store.DelBookIf("b", "exists") },
+			want:  []string{"a=1"},
+		},
+		{
+			name: "drain",
+			write: func(node *raftNode) error {
+				drained, err := node.store.DrainBooks([]string{"a", "missing"}, nil)
+				if err == nil && len(drained) != 1 {
+					err = errors.New(fmt.Sprintf("drained %v", drained))
+				}
+				return err
+			},
+			want: []string{"b=2"},
+		},
+		{
+			name: "batch",
+			write: func(node *raftNode) error {
+				if _, applied := node.store.ApplyBatch([]BatchOp{{Op: "put", Book: Book{Id: "c", Name: "3"}}, {Op: "delete", Book: Book{Id: "a"}}}); !applied {
+					return errors.New("not applied")
+				}
+				return nil
+			},
+			want: []string{"b=2", "c=3"},
+		},
+		{
+			name: "txn",
+			write: func(node *raftNode) error {
+				succeeded, _, err := node.store.Txn([]TxnCompare{{Id: "a", If: "absent"}}, nil, []BatchOp{{Op: "put", Book: Book{Id: "c", Name: "3"}}}, nil)
+				if err == nil && succeeded {
+					err = errors.New("the compare held")
+				}
+				return err
+			},
+			want: []string{"a=1", "b=2", "c=3"},
+		},
+		{
+			name: "replace",
+			write: func(node *raftNode) error {
+				node.store.ReplaceBooks([]Book{{Id: "z", Name: "26"}})
+				return nil
+			},
+			want: []string{"z=26"},
+		},
+		{
+			name: "change",
+			write: func(node *raftNode) error {
+				node.store.ApplyChange(ChangeEvent{Op: "delete", Id: "a", Old: node.store.FindBookById("a")})
+				return nil
+			},
+			want: []string{"b=2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes := newRaftCluster(t, 3)
+
+			for _, book := range []Book{{Id: "a", Name: "1"}, {Id: "b", Name: "2"}} {
+				if err := nodes[0].store.AddBook(book); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := tt.write(nodes[0]); err != nil {
+				t.Fatal(err)
+			}
+
+			got := make([]string, 0)
+			for _, book := range converged(t, nodes) {
+				got = append(got, book.Id+"="+book.Name)
+			}
+			slices.Sort(got)
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRaftFollowerForwardsWrites(t *testing.T) {
+	nodes := newRaftCluster(t, 3)
+
+	status, answer := send(t, http.MethodPost, nodes[1].ts.URL+"/book/", `{"id":"a","name":"1"}`)
+	if status != http.StatusOK {
+		t.Fatalf("status %d: %s", status, answer)
+	}
+
+	if books := converged(t, nodes); len(books) != 1 || books[0].Id != "a" {
+		t.Errorf("got %v", books)
+	}
+
+	// Writes to the store of a follower, as the other protocols make
+	// them, are not forwarded.
+	if err := nodes[2].store.AddBook(Book{Id: "b"}); err != errNotRaftLeader {
+		t.Errorf("got %v, want errNotRaftLeader", err)
+	}
+}
+
+func TestRaftHooksRunOnTheLeader(t *testing.T) {
+	hooks := &recordingHooks{refuse: "refused"}
+	nodes := newRaftCluster(t, 3, WithHooks(hooks))
+
+	body := `{"compare":[{"id":"a","if":"absent"}],"success":[{"op":"put","book":{"id":"a","name":"x"}}]}`
+	if status, answer := send(t, http.MethodPost, nodes[2].ts.URL+"/txn", body); status != http.StatusOK {
+		t.Fatalf("status %d: %s", status, answer)
+	}
+
+	converged(t, nodes)
+	for _, node := range nodes {
+		if book := node.store.FindBookById("a"); book == nil || book.Author != "hooked" {
+			t.Errorf("%s holds %v", node.store.id, book)
+		}
+	}
+	if !slices.Equal(hooks.puts, []string{"a"}) {
+		t.Errorf("hooks saw %v", hooks.puts)
+	}
+
+	body = `{"success":[{"op":"put","book":{"id":"refused","name":"x"}}]}`
+	if status, _ := send(t, http.MethodPost, nodes[1].ts.URL+"/txn", body); status != http.StatusForbidden {
+		t.Errorf("got %d for a refused write", status)
+	}
+	if nodes[0].store.FindBookById("refused") != nil {
+		t.Error("the refused write went into the log")
+	}
+}
+
+func TestRaftLeave(t *testing.T) {
+	nodes := newRaftCluster(t, 3)
+
+	body := fmt.Sprintf(`{"id":%q}`, nodes[2].store.id)
+	if status, answer := send(t, http.MethodPost, nodes[1].ts.URL+"/admin/raft/leave", body); status != http.StatusOK {
+		t.Fatalf("status %d: %s", status, answer)
+	}
+
+	waitFor(t, "the member to leave", func() bool {
+		status, _ := nodes[0].store.status()
+		return len(status.Members) == 2
+	})
+}
+
+func TestRaftSnapshot(t *testing.T) {
+	nodes := newRaftCluster(t, 3)
+
+	if err := nodes[0].store.AddBook(Book{Id: "a", Name: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	converged(t, nodes)
+
+	status, answer := send(t, http.MethodPost, nodes[1].ts.URL+"/admin/raft/snapshot", "")
+	if status != http.StatusOK || !strings.Contains(answer, `"index"`) {
+		t.Fatalf("status %d: %s", status, answer)
+	}
+}
+
+func TestRaftWithoutALeader(t *testing.T) {
+	nodes := newRaftCluster(t, 3)
+
+	nodes[0].store.raft.Shutdown().Error()
+	for _, node := range nodes[1:] {
+		node.transport.DisconnectAll()
+	}
+	waitFor(t, "the leader to be lost", func() bool { return nodes[1].store.leader() == nil })
+
+	status, answer := send(t, http.MethodPost, nodes[1].ts.URL+"/book/", `{"id":"a","name":"1"}`)
+	if status != http.StatusServiceUnavailable || !strings.Contains(answer, CodeNoLeader) {
+		t.Errorf("status %d: %s", status, answer)
+	}
+}
+
+// memorySink is a raft.SnapshotSink into a buffer.
+type memorySink struct {
+	bytes.Buffer
+}
+
+func (*memorySink) ID() string    { return "test" }
+func (*memorySink) Cancel() error { return nil }
+func (*memorySink) Close() error  { return nil }
+
+func TestRaftFSMSnapshotRoundtrip(t *testing.T) {
+	from := &raftFSM{memory: NewMemoryStore(4, 0)}
+	from.memory.AddBook(Book{Id: "a", Author: "A", Name: "1"})
+	from.memory.AddBook(Book{Id: "b", Name: "2"})
+
+	snapshot, err := from.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sink memorySink
+	if err := snapshot.Persist(&sink); err != nil {
+		t.Fatal(err)
+	}
+
+	to := &raftFSM{memory: NewMemoryStore(4, 0)}
+	if err := to.Restore(io.NopCloser(&sink)); err != nil {
+		t.Fatal(err)
+	}
+
+	want, _ := from.memory.GetBooks(t.Context())
+	got, _ := to.memory.GetBooks(t.Context())
+	if len(got) != len(want) || got[0].Author != "A" || got[1].Version != want[1].Version {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestRaftBoltStore(t *testing.T) {
+	bs, err := openRaftBoltStore(filepath.Join(t.TempDir(), "raft.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	logs := make([]*raft.Log, 0)
+	for index := uint64(1); index <= 5; index++ {
+		logs = append(logs, &raft.Log{Index: index, Term: 1, Data: []byte{byte(index)}})
+	}
+	if err := bs.StoreLogs(logs); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.DeleteRange(1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.SetUint64([]byte("term"), 7); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		check func() (any, error)
+		want  any
+	}{
+		{name: "first index", check: func() (any, error) { return bs.FirstIndex() }, want: uint64(3)},
+		{name: "last index", check: func() (any, error) { return bs.LastIndex() }, want: uint64(5)},
+		{name: "a log", check: func() (any, error) {
+			var log raft.Log
+			err := bs.GetLog(4, &log)
+			return log.Data[0], err
+		}, want: byte(4)},
+		{name: "a deleted log", check: func() (any, error) {
+			var log raft.Log
+			return nil, bs.GetLog(2, &log)
+		}, want: raft.ErrLogNotFound},
+		{name: "a uint64", check: func() (any, error) { return bs.GetUint64([]byte("term")) }, want: uint64(7)},
+		{name: "a missing key", check: func() (any, error) { return bs.Get([]byte("missing")) }, want: errRaftKeyNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.check()
+			if err != nil {
+				got = err
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+
+	"github.com/hashicorp/raft"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	raftLogsBucket   = []byte("logs")
+	raftStableBucket = []byte("stable")
+)
+
+// errRaftKeyNotFound is what raft expects of a StableStore for a key it
+// never set.
+var errRaftKeyNotFound = errors.New("not found")
+
+// raftBoltStore keeps the Raft log and the stable store of a member in one
+// bbolt file, logs by big-endian index so they sort and range in order.
+type raftBoltStore struct {
+	db *bolt.DB
+}
+
+func openRaftBoltStore(path string) (*raftBoltStore, error) {
+	db, err := bolt.Open(path, 0o600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(raftLogsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(raftStableBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &raftBoltStore{db: db}, nil
+}
+
+func (bs *raftBoltStore) Close() error {
+	return bs.db.Close()
+}
+
+func raftIndexKey(index uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, index)
+}
+
+func (bs *raftBoltStore) FirstIndex() (uint64, error) {
+	var index uint64
+
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		if key, _ := tx.Bucket(raftLogsBucket).Cursor().First(); key != nil {
+			index = binary.BigEndian.Uint64(key)
+		}
+		return nil
+	})
+	return index, err
+}
+
+func (bs *raftBoltStore) LastIndex() (uint64, error) {
+	var index uint64
+
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		if key, _ := tx.Bucket(raftLogsBucket).Cursor().Last(); key != nil {
+			index = binary.BigEndian.Uint64(key)
+		}
+		return nil
+	})
+	return index, err
+}
+
+func (bs *raftBoltStore) GetLog(index uint64, log *raft.Log) error {
+	return bs.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(raftLogsBucket).Get(raftIndexKey(index))
+		if data == nil {
+			return raft.ErrLogNotFound
+		}
+		return json.Unmarshal(data, log)
+	})
+}
+
+func (bs *raftBoltStore) StoreLog(log *raft.Log) error {
+	return bs.StoreLogs([]*raft.Log{log})
+}
+
+func (bs *raftBoltStore) StoreLogs(logs []*raft.Log) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(raftLogsBucket)
+
+		for _, log := range logs {
+			data, err := json.Marshal(log)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(raftIndexKey(log.Index), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (bs *raftBoltStore) DeleteRange(min, max uint64) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(raftLogsBucket)
+
+		// Deleting under a cursor can skip the key after, so the keys are
+		// collected first.
+		keys := make([][]byte, 0)
+		cursor := bucket.Cursor()
+		for key, _ := cursor.Seek(raftIndexKey(min)); key != nil && binary.BigEndian.Uint64(key) <= max; key, _ = cursor.Next() {
+			keys = append(keys, key)
+		}
+
+		for _, key := range keys {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (bs *raftBoltStore) Set(key []byte, value []byte) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(raftStableBucket).Put(key, value)
+	})
+}
+
+func (bs *raftBoltStore) Get(key []byte) ([]byte, error) {
+	var value []byte
+
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		stored := tx.Bucket(raftStableBucket).Get(key)
+		if stored == nil {
+			return errRaftKeyNotFound
+		}
+		value = append([]byte(nil), stored...)
+		return nil
+	})
+	return value, err
+}
+
+func (bs *raftBoltStore) SetUint64(key []byte, value uint64) error {
+	return bs.Set(key, binary.BigEndian.AppendUint64(nil, value))
+}
+
+func (bs *raftBoltStore) GetUint64(key []byte) (uint64, error) {
+	value, err := bs.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(value), nil
+}
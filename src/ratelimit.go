@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimitSettings are the flags a reload of -config may change.
+var rateLimitSettings = []string{"rate-limit", "write-rate-limit", "rate-limit-routes", "rate-burst"}
+
+// RateLimits are the per client rates, in requests per second. A rate of 0
+// means unlimited.
+type RateLimits struct {
+	Read   float64
+	Write  float64
+	Routes map[string]float64
+	Burst  int
+}
+
+// rateLimits validates and collects the rate limit settings.
+func (c Config) rateLimits() (RateLimits, error) {
+	limits := RateLimits{Read: c.RateLimit, Write: c.WriteRateLimit, Routes: make(map[string]float64), Burst: c.RateBurst}
+
+	if limits.Read < 0 || limits.Write < 0 {
+		return limits, errors.New("rates must not be negative")
+	}
+
+	if limits.Burst < 1 {
+		return limits, errors.New(fmt.Sprintf("invalid -rate-burst %d", limits.Burst))
+	}
+
+	for _, route := range strings.Split(c.RateLimitRoutes, ",") {
+		route = strings.TrimSpace(route)
+		if route == "" {
+			continue
+		}
+
+		pattern, rate, ok := strings.Cut(route, "=")
+		n, err := strconv.ParseFloat(rate, 64)
+		if !ok || err != nil || n < 0 {
+			return limits, errors.New(fmt.Sprintf("invalid -rate-limit-routes entry %s", route))
+		}
+
+		limits.Routes[pattern] = n
+	}
+
+	return limits, nil
+}
+
+type bucketKey struct {
+	client string
+	class  string
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter keeps a token bucket per client and rate class.
+type RateLimiter struct {
+	mu      sync.Mutex
+	limits  RateLimits
+	buckets map[bucketKey]*bucket
+	pruned  time.Time
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		buckets: make(map[bucketKey]*bucket),
+	}
+}
+
+// Configure swaps in new limits; buckets start over so a lowered burst
+// applies at once.
+func (rl *RateLimiter) Configure(limits RateLimits) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.limits = limits
+	rl.buckets = make(map[bucketKey]*bucket)
+}
+
+// Allow takes a token for the client and reports whether it had one, and
+// if not, how long until it will.
+func (rl *RateLimiter) Allow(client, route string, write bool) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	class, rate := "read", rl.limits.Read
+
+	if n, ok := rl.limits.Routes[route]; ok {
+		class, rate = "route "+route, n
+	} else if write && rl.limits.Write > 0 {
+		class, rate = "write", rl.limits.Write
+	}
+
+	if rate == 0 {
+		return true, 0
+	}
+
+	now := time.Now()
+	burst := float64(rl.limits.Burst)
+
+	rl.prune(now)
+
+	key := bucketKey{client: client, class: class}
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		rl.buckets[key] = b
+	}
+
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+// prune drops, at most once a minute, buckets idle long enough to have
+// refilled; they would start out full anyway. Callers hold rl.mu.
+func (rl *RateLimiter) prune(now time.Time) {
+	if now.Sub(rl.pruned) < time.Minute {
+		return
+	}
+	rl.pruned = now
+
+	for key, b := range rl.buckets {
+		if now.Sub(b.last) > time.Minute {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// rateLimitClient identifies the client by its credentials, so clients
+// behind one NAT do not share a limit, and otherwise by its IP address.
+// The keys of a tenant share the tenant's limit. Only credentials that
+// authenticate count, as RateLimit may run before Auth and a client could
+// otherwise get a fresh limit with every made-up user or key.
+func (k *APIKeys) rateLimitClient(r *http.Request) string {
+	if _, ok := k.authenticate(r); ok {
+		if tenant := k.requestTenant(r); tenant != "" {
+			return "tenant " + tenant
+		}
+
+		if user, _, ok := r.BasicAuth(); ok {
+			return "user " + user
+		}
+
+		key, _ := k.requestAPIKey(r)
+		return "key " + key.Key
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip " + host
+}
+
+func (s *Server) RateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		ok, wait := s.rateLimiter.Allow(s.apiKeys.rateLimitClient(r), r.Pattern, isWriteMethod(r.Method))
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, CodeRateLimited, "rate limit exceeded")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// ReadOnlyState is the answer of /admin/read-only.
+type ReadOnlyState struct {
+	ReadOnly    bool `json:"read_only"`
+	Replicating bool `json:"replicating"`
+}
+
+// writesRefused returns why the server takes no writes right now, or ""
+// when it does.
+func (s *Server) writesRefused() string {
+	switch {
+	case s.replicating.Load():
+		return "this server is a read-only replica"
+	case s.fenced.Load():
+		return "this server was primary in an earlier term and is fenced"
+	case s.readOnly.Load():
+		return "this server is in read-only mode"
+	}
+	return ""
+}
+
+// ReadOnly rejects writes while the server is a replica or in read-only
+// mode.
+func (s *Server) ReadOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if reason := s.writesRefused(); reason != "" && isWriteMethod(r.Method) {
+			writeError(w, http.StatusForbidden, CodeReadOnly, reason)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// HandleReadOnly reports whether writes are switched off, and PUT with
+// {"read_only": true} or false switches them. Promoting a replica is up to
+// /admin/promote.
+func (s *Server) HandleReadOnly(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var state ReadOnlyState
+
+		body, _ := io.ReadAll(http.MaxBytesReader(w, r.Body, s.cfg.MaxBodyBytes))
+		err := json.Unmarshal(body, &state)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+			return
+		}
+
+		s.readOnly.Store(state.ReadOnly)
+	default:
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	state, _ := json.Marshal(ReadOnlyState{ReadOnly: s.readOnly.Load(), Replicating: s.replicating.Load()})
+
+	w.Write(state)
+}
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// redisMaxInline bounds an inline command, as typed into telnet.
+const redisMaxInline = 64 << 10
+
+// redisMaxArgs bounds the number of arguments of one command.
+const redisMaxArgs = 1 << 20
+
+// redisProtocolError is a malformed request; it is answered and the
+// connection closed, since the rest of the stream can not be trusted.
+type redisProtocolError struct {
+	message string
+}
+
+func (e redisProtocolError) Error() string {
+	return "Protocol error: " + e.message
+}
+
+// redisWrites are the commands that need write access.
+var redisWrites = map[string]bool{"SET": true, "DEL": true, "EXPIRE": true}
+
+// serveRedisConn speaks RESP2 with GET, MGET, SET, DEL, EXISTS, EXPIRE,
+// TTL, KEYS and SCAN, mapping each key to a book id and the value to the book name like
+// the text operations of the HTTP API. There is a single database, 0.
+func (s *Server) serveRedisConn(conn net.Conn) {
+	in := bufio.NewReaderSize(conn, redisMaxInline)
+	out := bufio.NewWriter(conn)
+
+	// access is what the last successful AUTH granted, "" before one, and
+	// credentials its arguments.
+	access := ""
+	var credentials []string
+
+	for {
+		args, err := readRedisCommand(in, s.cfg.MaxBodyBytes)
+
+		var protocolError redisProtocolError
+		if errors.As(err, &protocolError) {
+			out.WriteString("-ERR " + protocolError.Error() + "\r\n")
+			out.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		if len(args) > 0 {
+			r := redisRequest(conn, args[0], credentials)
+			audited := func(int, string) {}
+			if redisWrites[r.Method] {
+				audited = s.auditWrite(r, s.redisWriteKeys(args))
+			}
+
+			reply := s.redisRefused(access, args[0])
+			switch {
+			case strings.EqualFold(args[0], "auth"):
+				if reply = s.redisAuth(&access, args[1:]); reply == "+OK" {
+					credentials = args[1:]
+				}
+			case reply == "":
+				reply = s.redisCommand(r, out, args)
+			}
+			audited(0, reply)
+
+			if reply != "" {
+				out.WriteString(reply + "\r\n")
+			}
+
+			if strings.EqualFold(args[0], "quit") {
+				out.Flush()
+				return
+			}
+		}
+
+		// Pipelined commands are answered together.
+		if in.Buffered() == 0 {
+			if out.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+// redisRequest is the request the hooks see for command, with the
+// credentials of the last AUTH as an HTTP request would send them.
+func redisRequest(conn net.Conn, command string, credentials []string) *http.Request {
+	r := lineRequest(conn, "redis", command)
+
+	switch len(credentials) {
+	case 1:
+		r.Header.Set("X-API-Key", credentials[0])
+	case 2:
+		r.SetBasicAuth(credentials[0], credentials[1])
+	}
+
+	return r
+}
+
+// redisWriteKeys returns the book ids a write command names.
+func (s *Server) redisWriteKeys(args []string) []string {
+	keys := args[1:]
+	if !strings.EqualFold(args[0], "del") {
+		keys = keys[:min(len(keys), 1)]
+	}
+
+	ids := make([]string, 0, len(keys))
+	for _, key := range keys {
+		ids = append(ids, s.cfg.normalizeId(key))
+	}
+	return ids
+}
+
+// redisAuth runs AUTH with an API key, or with a user and password as
+// HTTP Basic credentials are checked, and records the access it grants. A
+// failed AUTH leaves the access as it was. Tenant keys are refused, since
+// RESP has no buckets to confine them to.
+func (s *Server) redisAuth(access *string, args []string) string {
+	var key APIKey
+	var ok bool
+
+	switch len(args) {
+	case 1:
+		key, ok = s.apiKeys.lookupAPIKey(args[0])
+	case 2:
+		key, ok = APIKey{Access: accessWrite}, validate(args[0], args[1])
+	default:
+		return redisArity("auth")
+	}
+
+	if !ok {
+		return "-WRONGPASS invalid username-password pair or user is disabled."
+	}
+	if key.Tenant != "" {
+		return "-NOPERM keys confined to a tenant can not use RESP"
+	}
+
+	*access = key.Access
+	return "+OK"
+}
+
+// redisRefused returns the reply refusing command to a connection with
+// access, as Auth does for HTTP: writes need write access, and the rest
+// needs an AUTH unless -auth-reads=false. AUTH and QUIT are always run.
+func (s *Server) redisRefused(access, command string) string {
+	name := strings.ToUpper(command)
+	if name == "AUTH" || name == "QUIT" {
+		return ""
+	}
+
+	if access == "" && (redisWrites[name] || s.cfg.AuthReads) {
+		return "-NOAUTH Authentication required."
+	}
+
+	if redisWrites[name] && access != accessWrite {
+		return fmt.Sprintf("-NOPERM this user has no permissions to run the '%s' command", strings.ToLower(name))
+	}
+
+	return ""
+}
+
+// readRedisCommand reads a command sent as an array of bulk strings, as
+// clients do, or as an inline line of words. No bulk string may be longer
+// than maxBulk.
+func readRedisCommand(in *bufio.Reader, maxBulk int64) ([]string, error) {
+	line, err := readLine(in, redisMaxInline)
+	if err == errLineTooLong {
+		return nil, redisProtocolError{"too big request"}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > redisMaxArgs {
+		return nil, redisProtocolError{"invalid multibulk length"}
+	}
+
+	args := make([]string, 0, max(n, 0))
+
+	for range n {
+		line, err := readLine(in, redisMaxInline)
+		if err == errLineTooLong {
+			return nil, redisProtocolError{"too big bulk length"}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if !strings.HasPrefix(line, "$") {
+			return nil, redisProtocolError{fmt.Sprintf("expected '$', got '%.1s'", line)}
+		}
+
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || int64(size) > maxBulk {
+			return nil, redisProtocolError{"invalid bulk length"}
+		}
+
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(in, data); err != nil {
+			return nil, err
+		}
+		if string(data[size:]) != "\r\n" {
+			return nil, redisProtocolError{"bulk string is not terminated by CRLF"}
+		}
+
+		args = append(args, string(data[:size]))
+	}
+
+	return args, nil
+}
+
+func redisBulk(out *bufio.Writer, value string) {
+	fmt.Fprintf(out, "$%d\r\n%s\r\n", len(value), value)
+}
+
+func redisArity(name string) string {
+	return fmt.Sprintf("-ERR wrong number of arguments for '%s' command", strings.ToLower(name))
+}
+
+// redisCommand runs one command and returns its reply when it fits on one
+// line, or "" after writing a longer one itself. r is the request the
+// hooks see.
+func (s *Server) redisCommand(r *http.Request, out *bufio.Writer, args []string) string {
+	name, args := strings.ToUpper(args[0]), args[1:]
+
+	switch name {
+	case "PING":
+		if len(args) > 1 {
+			return redisArity(name)
+		}
+		if len(args) == 1 {
+			redisBulk(out, args[0])
+			return ""
+		}
+		return "+PONG"
+
+	case "ECHO":
+		if len(args) != 1 {
+			return redisArity(name)
+		}
+		redisBulk(out, args[0])
+		return ""
+
+	case "QUIT", "CLIENT":
+		return "+OK"
+
+	case "SELECT":
+		if len(args) != 1 {
+			return redisArity(name)
+		}
+		if args[0] != "0" {
+			return "-ERR DB index is out of range"
+		}
+		return "+OK"
+
+	case "COMMAND":
+		return "*0"
+
+	case "GET":
+		if len(args) != 1 {
+			return redisArity(name)
+		}
+
+		book := s.redisFind(args[0])
+		if book == nil {
+			return "$-1"
+		}
+		redisBulk(out, book.Name)
+		return ""
+
+	case "SET":
+		if len(args) < 2 {
+			return redisArity(name)
+		}
+		return s.redisSet(r, args[0], args[1], args[2:])
+
+	case "DEL":
+		if len(args) == 0 {
+			return redisArity(name)
+		}
+
+		ids := make([]string, 0, len(args))
+		for _, key := range args {
+			id, refused := s.redisWritable(key)
+			if refused != "" {
+				return refused
+			}
+			ids = append(ids, id)
+		}
+
+		deleted, err := s.store.DrainBooks(ids, s.prepareDrain(r))
+		if err != nil {
+			return "-ERR " + err.Error()
+		}
+		return ":" + strconv.Itoa(len(deleted))
+
+	case "MGET":
+		if len(args) == 0 {
+			return redisArity(name)
+		}
+
+		fmt.Fprintf(out, "*%d\r\n", len(args))
+		for _, key := range args {
+			if book := s.redisFind(key); book != nil {
+				redisBulk(out, book.Name)
+			} else {
+				out.WriteString("$-1\r\n")
+			}
+		}
+		return ""
+
+	case "EXISTS":
+		if len(args) == 0 {
+			return redisArity(name)
+		}
+
+		found := 0
+		for _, key := range args {
+			if s.redisFind(key) != nil {
+				found++
+			}
+		}
+		return ":" + strconv.Itoa(found)
+
+	case "EXPIRE":
+		if len(args) < 2 || len(args) > 3 {
+			return redisArity(name)
+		}
+		return s.redisExpire(r, args[0], args[1], args[2:])
+
+	case "TTL":
+		if len(args) != 1 {
+			return redisArity(name)
+		}
+
+		book := s.redisFind(args[0])
+		switch {
+		case book == nil:
+			return ":-2"
+		case book.ExpiresAt == nil:
+			return ":-1"
+		}
+		return ":" + strconv.FormatInt(int64((time.Until(*book.ExpiresAt)+time.Second/2)/time.Second), 10)
+
+	case "KEYS":
+		if len(args) != 1 {
+			return redisArity(name)
+		}
+
+		s.redisKeys(out, args[0])
+		return ""
+
+	case "SCAN":
+		if len(args) == 0 || len(args)%2 == 0 {
+			return redisArity(name)
+		}
+		if _, err := strconv.ParseUint(args[0], 10, 64); err != nil {
+			return "-ERR invalid cursor"
+		}
+
+		pattern := "*"
+		for i := 1; i < len(args); i += 2 {
+			switch strings.ToUpper(args[i]) {
+			case "MATCH":
+				pattern = args[i+1]
+			case "COUNT":
+			default:
+				return "-ERR syntax error"
+			}
+		}
+
+		// The whole keyspace comes back at once, which COUNT, a hint,
+		// allows.
+		out.WriteString("*2\r\n")
+		redisBulk(out, "0")
+		s.redisKeys(out, pattern)
+		return ""
+	}
+
+	return fmt.Sprintf("-ERR unknown command '%s'", strings.ToLower(name))
+}
+
+// redisKeys writes the array of the ids matching pattern.
+func (s *Server) redisKeys(out *bufio.Writer, pattern string) {
+	books, _ := s.store.GetBooks(context.Background())
+
+	keys := make([]string, 0)
+	for _, book := range books {
+		if !s.cfg.isReservedId(book.Id) && redisMatch(pattern, book.Id) {
+			keys = append(keys, book.Id)
+		}
+	}
+
+	fmt.Fprintf(out, "*%d\r\n", len(keys))
+	for _, key := range keys {
+		redisBulk(out, key)
+	}
+}
+
+// redisFind returns the book stored under key, or nil when there is none
+// or the id is reserved.
+func (s *Server) redisFind(key string) *Book {
+	id := s.cfg.normalizeId(key)
+	if s.cfg.isReservedId(id) {
+		return nil
+	}
+	return s.store.FindBookById(id)
+}
+
+// redisWritable returns the book id for key, or the reply refusing a write
+// to it.
+func (s *Server) redisWritable(key string) (string, string) {
+	id := s.cfg.normalizeId(key)
+
+	if s.cfg.isReservedId(id) {
+		return "", fmt.Sprintf("-ERR book id %s is reserved", id)
+	}
+
+	if refused := s.writesRefused(); refused != "" {
+		return "", "-READONLY " + refused
+	}
+
+	return id, ""
+}
+
+// redisModify writes the book as change leaves it, see changeBook, and
+// answers done once it is stored.
+func (s *Server) redisModify(r *http.Request, key string, change func(book *Book) string, done string) string {
+	id, refused := s.redisWritable(key)
+	if refused != "" {
+		return refused
+	}
+
+	reply, err := s.changeBook(r, id, change)
+	if err != nil {
+		return "-ERR " + err.Error()
+	}
+	if reply != "" {
+		return reply
+	}
+	return done
+}
+
+// redisSet runs SET with its NX, XX, EX, PX, EXAT, PXAT and KEEPTTL
+// options. Like a new value in Redis, the name drops the expiry unless
+// KEEPTTL is given; the author and the rest of a stored book stay.
+func (s *Server) redisSet(r *http.Request, key, value string, options []string) string {
+	var nx, xx, keepTTL bool
+	var expiresAt *time.Time
+
+	for i := 0; i < len(options); i++ {
+		switch option := strings.ToUpper(options[i]); option {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "KEEPTTL":
+			keepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if i+1 == len(options) || expiresAt != nil {
+				return "-ERR syntax error"
+			}
+			i++
+
+			n, err := strconv.ParseInt(options[i], 10, 64)
+			if err != nil || n <= 0 {
+				return "-ERR invalid expire time in 'set' command"
+			}
+
+			var at time.Time
+			switch option {
+			case "EX":
+				at = time.Now().Add(time.Duration(n) * time.Second)
+			case "PX":
+				at = time.Now().Add(time.Duration(n) * time.Millisecond)
+			case "EXAT":
+				at = time.Unix(n, 0)
+			case "PXAT":
+				at = time.UnixMilli(n)
+			}
+			expiresAt = &at
+		default:
+			return "-ERR syntax error"
+		}
+	}
+
+	if (nx && xx) || (keepTTL && expiresAt != nil) {
+		return "-ERR syntax error"
+	}
+
+	if !utf8.ValidString(value) {
+		return "-ERR value is not valid UTF-8"
+	}
+
+	return s.redisModify(r, key, func(book *Book) string {
+		exists := book.Version != 0
+		if (nx && exists) || (xx && !exists) {
+			return "$-1"
+		}
+
+		book.Name = value
+		if !keepTTL {
+			book.ExpiresAt = expiresAt
+		}
+		return ""
+	}, "+OK")
+}
+
+// redisExpire runs EXPIRE with its NX, XX, GT and LT options, where no
+// expiry counts as an infinite one. A time that is not in the future
+// expires the book at once.
+func (s *Server) redisExpire(r *http.Request, key, seconds string, options []string) string {
+	n, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		return "-ERR value is not an integer or out of range"
+	}
+
+	option := ""
+	if len(options) == 1 {
+		option = strings.ToUpper(options[0])
+		if option != "NX" && option != "XX" && option != "GT" && option != "LT" {
+			return "-ERR Unsupported option " + options[0]
+		}
+	}
+
+	at := time.Now().Add(time.Duration(n) * time.Second)
+
+	return s.redisModify(r, key, func(book *Book) string {
+		if book.Version == 0 {
+			return ":0"
+		}
+
+		current := book.ExpiresAt
+		switch {
+		case option == "NX" && current != nil,
+			option == "XX" && current == nil,
+			option == "GT" && (current == nil || !at.After(*current)),
+			option == "LT" && current != nil && !at.Before(*current):
+			return ":0"
+		}
+
+		book.ExpiresAt = &at
+		return ""
+	}, ":1")
+}
+
+// redisMatch reports whether id matches the glob pattern of KEYS. Unlike
+// path.Match, * and ? also match a slash, as ids are not paths to Redis.
+func redisMatch(pattern, id string) bool {
+	ok, _ := path.Match(strings.ReplaceAll(pattern, "/", "\x00"), strings.ReplaceAll(id, "/", "\x00"))
+	return ok
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisTimeout bounds connecting to the upstream and each command.
+const redisTimeout = 5 * time.Second
+
+// redisReplyError is an error reply of the upstream, as opposed to a
+// broken connection.
+type redisReplyError string
+
+func (e redisReplyError) Error() string {
+	return string(e)
+}
+
+// redisUpstream keeps books as JSON under prefix+id on a Redis server, with
+// the book's expiry as the key's. It uses a single connection, opened again
+// after an error.
+type redisUpstream struct {
+	addr     string
+	password string
+	db       int
+	prefix   string
+
+	mu   sync.Mutex
+	conn net.Conn
+	in   *bufio.Reader
+}
+
+func newRedisUpstream(rawURL, prefix string) (*redisUpstream, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, errors.New(fmt.Sprintf("unsupported scheme %q, want redis", u.Scheme))
+	}
+
+	ru := &redisUpstream{addr: u.Host, prefix: prefix}
+
+	if u.Port() == "" {
+		ru.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+
+	if password, ok := u.User.Password(); ok {
+		ru.password = password
+	}
+
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		ru.db, err = strconv.Atoi(db)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid database %q", db))
+		}
+	}
+
+	return ru, ru.Ping()
+}
+
+func (ru *redisUpstream) dial() error {
+	conn, err := net.DialTimeout("tcp", ru.addr, redisTimeout)
+	if err != nil {
+		return err
+	}
+
+	ru.conn, ru.in = conn, bufio.NewReader(conn)
+
+	if ru.password != "" {
+		if _, err := ru.send("AUTH", ru.password); err != nil {
+			ru.reset()
+			return err
+		}
+	}
+
+	if ru.db != 0 {
+		if _, err := ru.send("SELECT", strconv.Itoa(ru.db)); err != nil {
+			ru.reset()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// do runs one command and returns its reply: a string, an int64, nil or a
+// []any of those.
+func (ru *redisUpstream) do(args ...string) (any, error) {
+	ru.mu.Lock()
+	defer ru.mu.Unlock()
+
+	if ru.conn == nil {
+		if err := ru.dial(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := ru.send(args...)
+
+	var replyError redisReplyError
+	if err != nil && !errors.As(err, &replyError) {
+		ru.reset()
+	}
+
+	return reply, err
+}
+
+// send writes a command and reads its reply. Callers hold ru.mu.
+func (ru *redisUpstream) send(args ...string) (any, error) {
+	ru.conn.SetDeadline(time.Now().Add(redisTimeout))
+
+	var command strings.Builder
+	fmt.Fprintf(&command, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	if _, err := io.WriteString(ru.conn, command.String()); err != nil {
+		return nil, err
+	}
+
+	return readRedisReply(ru.in)
+}
+
+func readRedisReply(in *bufio.Reader) (any, error) {
+	line, err := in.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+
+	case '-':
+		return nil, redisReplyError(line[1:])
+
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(in, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readRedisReply(in); err != nil {
+				var replyError redisReplyError
+				if !errors.As(err, &replyError) {
+					return nil, err
+				}
+			}
+		}
+		return items, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("unexpected reply %q", line))
+}
+
+func (ru *redisUpstream) decode(reply any) (*Book, error) {
+	data, ok := reply.(string)
+	if !ok {
+		return nil, nil
+	}
+
+	var book Book
+	if err := json.Unmarshal([]byte(data), &book); err != nil {
+		return nil, err
+	}
+	return &book, nil
+}
+
+func (ru *redisUpstream) Get(id string) (*Book, error) {
+	reply, err := ru.do("GET", ru.prefix+id)
+	if err != nil {
+		return nil, err
+	}
+	return ru.decode(reply)
+}
+
+// List scans the keys under the prefix and reads them in chunks.
+func (ru *redisUpstream) List(ctx context.Context) ([]Book, error) {
+	pattern := strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`).Replace(ru.prefix) + "*"
+
+	keys := make([]string, 0)
+	cursor := "0"
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		reply, err := ru.do("SCAN", cursor, "MATCH", pattern, "COUNT", "1000")
+		if err != nil {
+			return nil, err
+		}
+
+		page, ok := reply.([]any)
+		if !ok || len(page) != 2 {
+			return nil, errors.New("unexpected SCAN reply")
+		}
+
+		cursor, _ = page[0].(string)
+		found, _ := page[1].([]any)
+		for _, key := range found {
+			if key, ok := key.(string); ok {
+				keys = append(keys, key)
+			}
+		}
+
+		if cursor == "0" || cursor == "" {
+			break
+		}
+	}
+
+	books := make([]Book, 0, len(keys))
+	seen := make(map[string]bool, len(keys))
+
+	for start := 0; start < len(keys); start += 500 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		chunk := keys[start:min(start+500, len(keys))]
+
+		reply, err := ru.do(append([]string{"MGET"}, chunk...)...)
+		if err != nil {
+			return nil, err
+		}
+
+		values, _ := reply.([]any)
+		for _, value := range values {
+			book, err := ru.decode(value)
+			if err != nil {
+				return nil, err
+			}
+
+			// SCAN may return a key more than once.
+			if book != nil && !seen[book.Id] {
+				seen[book.Id] = true
+				books = append(books, *book)
+			}
+		}
+	}
+
+	return books, nil
+}
+
+func (ru *redisUpstream) Put(book Book) error {
+	data, _ := json.Marshal(book)
+	args := []string{"SET", ru.prefix + book.Id, string(data)}
+
+	if book.ExpiresAt != nil {
+		if !book.ExpiresAt.After(time.Now()) {
+			return ru.Delete(book.Id)
+		}
+		args = append(args, "PXAT", strconv.FormatInt(book.ExpiresAt.UnixMilli(), 10))
+	}
+
+	_, err := ru.do(args...)
+	return err
+}
+
+func (ru *redisUpstream) Delete(id string) error {
+	_, err := ru.do("DEL", ru.prefix+id)
+	return err
+}
+
+func (ru *redisUpstream) Ping() error {
+	_, err := ru.do("PING")
+	return err
+}
+
+func (ru *redisUpstream) Close() error {
+	ru.mu.Lock()
+	defer ru.mu.Unlock()
+
+	return ru.reset()
+}
+
+// reset closes the connection, if any, so the next command opens a new
+// one. Callers hold ru.mu.
+func (ru *redisUpstream) reset() error {
+	if ru.conn == nil {
+		return nil
+	}
+
+	err := ru.conn.Close()
+	ru.conn = nil
+	return err
+}
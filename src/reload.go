@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// reloadOnHangup reloads the settings that can change without a restart
+// on every SIGHUP: TLS files, API keys, encryption keys and, from -config,
+// rate limits.
+// Settings that fail to load keep their old values.
+func (s *Server) reloadOnHangup() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	for range hangup {
+		s.reload()
+	}
+}
+
+func (s *Server) reload() {
+	if s.cfg.tlsEnabled() {
+		config, err := s.cfg.tlsConfig()
+		if err != nil {
+			log.Printf("reload TLS files: %v", err)
+		} else {
+			s.tls.Store(config)
+			log.Printf("reloaded TLS files")
+		}
+	}
+
+	if s.cfg.ConfigFile != "" {
+		cfg := s.cfg
+		err := cfg.apply(rateLimitSettings...)
+
+		limits, limitsErr := cfg.rateLimits()
+		if err == nil {
+			err = limitsErr
+		}
+
+		if err != nil {
+			log.Printf("reload rate limits: %v", err)
+		} else {
+			s.rateLimiter.Configure(limits)
+			log.Printf("reloaded rate limits")
+		}
+	}
+
+	if s.cfg.EncryptionKeyFile != "" {
+		if err := s.store.Keyring().Load(s.cfg); err != nil {
+			log.Printf("reload -encryption-key-file: %v", err)
+		} else {
+			log.Printf("reloaded encryption keys")
+		}
+	}
+
+	if s.cfg.APIKeysFile != "" {
+		keys, err := loadAPIKeys(s.cfg.APIKeysFile)
+		if err != nil {
+			log.Printf("reload -api-keys-file: %v", err)
+		} else {
+			s.apiKeys.Set(keys)
+			log.Printf("reloaded %d API keys", len(keys))
+		}
+	}
+}
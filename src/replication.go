@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// serverRole is primary, replica or fenced, as /readyz reports it.
+func (s *Server) serverRole() string {
+	switch {
+	case s.replicating.Load():
+		return "replica"
+	case s.fenced.Load():
+		return "fenced"
+	}
+	return "primary"
+}
+
+// ReplicationMessage is one line of the replication stream: a snapshot of
+// every book first, then each change as it happens. Op is snapshot or
+// ping besides the change ops. The snapshot holds the term book, see
+// clusterTerm.
+type ReplicationMessage struct {
+	ChangeEvent
+	Books []Book `json:"books,omitempty"`
+}
+
+// replicationBuffer is how many changes a replica may fall behind before
+// its stream is dropped. It holds a whole batch or transaction of
+// -max-body-bytes, whose ops take well over 16 bytes each; a larger burst,
+// such as a restore, drops the stream and the replica reconnects for a
+// fresh snapshot.
+func (c Config) replicationBuffer() int {
+	return max(watchBuffer, int(c.MaxBodyBytes/16))
+}
+
+// HandleReplicationStream streams the store to a replica as JSON lines.
+// The watcher is subscribed before the snapshot is taken, so no change
+// falls between the two; replicas skip the events the snapshot already
+// holds by their versions.
+func (s *Server) HandleReplicationStream(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	if access, ok := s.apiKeys.authenticate(r); !ok || access != accessWrite {
+		writeError(w, http.StatusForbidden, CodeForbidden, "replication needs write credentials")
+		return
+	}
+
+	defer s.streaming()()
+
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	wt := s.store.Watchers().SubscribeAll(s.cfg.replicationBuffer())
+	defer s.store.Watchers().Unsubscribe(wt)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	books, err := s.store.GetBooks(r.Context())
+	if err != nil {
+		return
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.Encode(ReplicationMessage{ChangeEvent: ChangeEvent{Op: "snapshot"}, Books: books})
+
+	if rc.Flush() != nil {
+		return
+	}
+
+	ping := time.NewTicker(15 * time.Second)
+	defer ping.Stop()
+
+	for {
+		select {
+		case event, ok := <-wt.Events():
+			if !ok {
+				return
+			}
+			encoder.Encode(ReplicationMessage{ChangeEvent: event})
+
+		case <-ping.C:
+			encoder.Encode(ReplicationMessage{ChangeEvent: ChangeEvent{Op: "ping"}})
+
+		case <-r.Context().Done():
+			return
+		}
+
+		if rc.Flush() != nil {
+			return
+		}
+	}
+}
+
+// errPrimaryMoved ends the stream from a primary that -peers no longer
+// finds primary.
+var errPrimaryMoved = errors.New("the primary moved")
+
+// replicate follows the primary until the server is promoted. Every
+// connection starts from a fresh snapshot, so a replica that fell behind
+// or lost its stream catches up by reconnecting. With -replica-of peers
+// the primary is looked up again before every connection and every
+// -peers-interval while connected, so a replica follows a failover.
+func (s *Server) replicate(primary string) {
+	backoff := time.Second
+
+	for {
+		var err error
+		if primary == discoveredPeers {
+			var found string
+			if found, err = s.cfg.discoverPrimary(); err == nil {
+				err = s.followDiscovered(found, func() { backoff = time.Second })
+			}
+		} else {
+			err = s.followPrimary(s.promoted, primary, func() { backoff = time.Second })
+		}
+
+		select {
+		case <-s.promoted.Done():
+			return
+		default:
+		}
+
+		if errors.Is(err, errPrimaryMoved) {
+			continue
+		}
+
+		log.Printf("replication from %s: %v; retrying in %v", primary, err, backoff)
+
+		select {
+		case <-s.promoted.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff = min(2*backoff, time.Minute)
+	}
+}
+
+// followDiscovered follows primary, a member found by -peers, until the
+// members name another primary.
+func (s *Server) followDiscovered(primary string, connected func()) error {
+	ctx, cancel := context.WithCancelCause(s.promoted)
+	defer cancel(nil)
+
+	go func() {
+		lookup := time.NewTicker(s.cfg.PeersInterval)
+		defer lookup.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-lookup.C:
+			}
+
+			if found, err := s.cfg.discoverPrimary(); err == nil && found != primary {
+				log.Printf("replication: primary moved from %s to %s", primary, found)
+				cancel(errPrimaryMoved)
+				return
+			}
+		}
+	}()
+
+	err := s.followPrimary(ctx, primary, connected)
+	if cause := context.Cause(ctx); errors.Is(cause, errPrimaryMoved) {
+		return cause
+	}
+	return err
+}
+
+func (s *Server) followPrimary(ctx context.Context, primary string, connected func()) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(primary, "/")+"/replication/stream", nil)
+	if err != nil {
+		return err
+	}
+
+	if user, password, ok := strings.Cut(s.cfg.ReplicaCredentials, ":"); ok {
+		req.SetBasicAuth(user, password)
+	} else if s.cfg.ReplicaCredentials != "" {
+		req.Header.Set("Authorization", "Bearer "+s.cfg.ReplicaCredentials)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("primary answered %s", resp.Status))
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1<<30)
+
+	for scanner.Scan() {
+		var message ReplicationMessage
+
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			return err
+		}
+
+		switch message.Op {
+		case "snapshot":
+			if primaryTerm, known := snapshotTerm(message.Books), s.clusterTerm(); primaryTerm < known {
+				return errors.New(fmt.Sprintf("primary is at term %d, behind the term %d this replica has seen", primaryTerm, known))
+			}
+			s.store.ReplaceBooks(message.Books)
+			log.Printf("replicating from %s: %d books", primary, len(message.Books))
+			connected()
+		case "ping":
+		default:
+			s.store.ApplyChange(message.ChangeEvent)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("stream ended")
+}
+
+// errNotReplica refuses the promotion of a server that is no replica.
+var errNotReplica = errors.New("Server is not a replica")
+
+// promoteReplica stops following the primary and starts taking writes in
+// the next term. It refuses while another member claims to be primary,
+// see claimedPrimary.
+func (s *Server) promoteReplica(reason string) error {
+	if !s.replicating.Load() {
+		return errNotReplica
+	}
+
+	claim, highest := s.claimedPrimary()
+	if claim != nil {
+		return errors.New(fmt.Sprintf("%s claims primary at term %d", claim.URL, claim.Term))
+	}
+
+	if !s.replicating.CompareAndSwap(true, false) {
+		return errNotReplica
+	}
+
+	s.promote()
+	next := max(highest, s.clusterTerm()) + 1
+	s.setClusterTerm(next)
+
+	log.Printf("promoted to primary at term %d: %s", next, reason)
+	return nil
+}
+
+// HandlePromote stops following the primary and starts taking writes.
+func (s *Server) HandlePromote(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	if err := s.promoteReplica("POST /admin/promote"); errors.Is(err, errNotReplica) {
+		writeError(w, http.StatusConflict, CodeNotReplica, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusConflict, CodePrimaryClaimed, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	role, _ := json.Marshal(map[string]string{"role": "primary"})
+
+	w.Write(role)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeMember answers /readyz with its role and term and streams a
+// snapshot of one book on /replication/stream, then holds the stream open.
+func fakeMember(t *testing.T, role *atomic.Value, term uint64) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/readyz":
+			json.NewEncoder(w).Encode(map[string]any{"status": "ready", "role": role.Load(), "term": term})
+		case "/replication/stream":
+			books := []Book{{Id: "a", Name: "1", Version: 1}, {Id: termId, Name: strconv.FormatUint(term, 10), Version: 2}}
+			json.NewEncoder(w).Encode(ReplicationMessage{ChangeEvent: ChangeEvent{Op: "snapshot"}, Books: books})
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// peersConfig returns the default settings with -peers pointed at a seeds
+// file of members for the test.
+func peersConfig(t *testing.T, members ...string) Config {
+	seeds := filepath.Join(t.TempDir(), "peers")
+	if err := os.WriteFile(seeds, []byte(strings.Join(members, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.PeersSpec = "file:" + seeds
+	return cfg
+}
+
+func TestReplicaFollowsAMovedPrimary(t *testing.T) {
+	var roleA, roleB atomic.Value
+	roleA.Store("primary")
+	roleB.Store("replica")
+	a, b := fakeMember(t, &roleA, 0), fakeMember(t, &roleB, 0)
+
+	cfg := peersConfig(t, a.URL, b.URL)
+	cfg.PeersInterval = 20 * time.Millisecond
+
+	s, _ := newTestServer(t, WithConfig(cfg))
+
+	connected := make(chan struct{}, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.followDiscovered(a.URL, func() { connected <- struct{}{} })
+	}()
+
+	select {
+	case <-connected:
+	case err := <-done:
+		t.Fatalf("the replica stopped following: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the replica never got the snapshot")
+	}
+
+	if book := s.store.FindBookById("a"); book == nil {
+		t.Fatal("the snapshot was not applied")
+	}
+
+	roleA.Store("replica")
+	roleB.Store("primary")
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, errPrimaryMoved) {
+			t.Fatalf("the replica stopped with %v, want errPrimaryMoved", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the replica kept following the old primary")
+	}
+}
+
+func TestPromotion(t *testing.T) {
+	tests := []struct {
+		name     string
+		role     string
+		term     uint64
+		status   int
+		contains string
+		wantTerm uint64
+	}{
+		{name: "while another member is primary", role: "primary", term: 3, status: http.StatusConflict, contains: CodePrimaryClaimed, wantTerm: 0},
+		{name: "after the primary stepped down", role: "replica", term: 3, status: http.StatusOK, contains: `"primary"`, wantTerm: 4},
+		{name: "while a fenced member is up", role: "fenced", term: 1, status: http.StatusOK, contains: `"primary"`, wantTerm: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var role atomic.Value
+			role.Store(tt.role)
+			cfg := peersConfig(t, fakeMember(t, &role, tt.term).URL)
+
+			s, ts := newTestServer(t, WithConfig(cfg))
+			s.replicating.Store(true)
+
+			status, body := send(t, http.MethodPost, ts.URL+"/admin/promote", "")
+			if status != tt.status || !strings.Contains(body, tt.contains) {
+				t.Fatalf("promote = %d %s, want %d with %s", status, body, tt.status, tt.contains)
+			}
+			if got := s.clusterTerm(); got != tt.wantTerm {
+				t.Errorf("term %d after promote, want %d", got, tt.wantTerm)
+			}
+			if s.replicating.Load() != (tt.status != http.StatusOK) {
+				t.Errorf("replicating = %v after promote %d", s.replicating.Load(), status)
+			}
+		})
+	}
+}
+
+func TestReplicaRefusesAnEarlierTerm(t *testing.T) {
+	var role atomic.Value
+	role.Store("primary")
+	stale := fakeMember(t, &role, 2)
+
+	s, _ := newTestServer(t)
+	s.setClusterTerm(5)
+
+	err := s.followPrimary(context.Background(), stale.URL, func() { t.Error("followed a primary of an earlier term") })
+	if err == nil || !strings.Contains(err.Error(), "behind the term 5") {
+		t.Fatalf("followPrimary = %v, want a refusal of term 2", err)
+	}
+	if s.store.FindBookById("a") != nil {
+		t.Error("the snapshot of the earlier term was applied")
+	}
+}
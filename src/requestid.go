@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+type requestIDKey struct{}
+
+// maxRequestIDBytes bounds the X-Request-ID taken from clients, which end
+// up in every log line of the request.
+const maxRequestIDBytes = 128
+
+// RequestID tags every request with the client's X-Request-ID, or a new one
+// when it sent none or an unusable one, and echoes it on the answer so
+// client and server logs can be matched up. It wraps the whole mux, so the
+// id is on every answer, errors included.
+func RequestID(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set("X-Request-ID", id)
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	}
+}
+
+// validRequestID accepts non-empty ids of printable ASCII without spaces.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDBytes {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// requestID returns the id RequestID gave the request ctx belongs to, or ""
+// outside of a request.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// A restarted server finds its listening socket and the handoff pipe at
+// these inherited descriptors.
+const (
+	listenFDEnv  = "BOOKS_LISTEN_FD"
+	handoffFDEnv = "BOOKS_HANDOFF_FD"
+)
+
+// inheritedFile returns the descriptor named by env, if any, and clears
+// env so a later restart starts clean.
+func inheritedFile(env, name string) *os.File {
+	value := os.Getenv(env)
+	os.Unsetenv(env)
+
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return nil
+	}
+	return os.NewFile(uintptr(fd), name)
+}
+
+// waitForHandoff holds a restarted server back until the old one has
+// closed its store, so the data it loads holds every committed write.
+// Connections meanwhile queue on the shared socket.
+func waitForHandoff() {
+	handoff := inheritedFile(handoffFDEnv, "handoff")
+	if handoff == nil {
+		return
+	}
+
+	log.Printf("waiting for the previous server to finish")
+	io.Copy(io.Discard, handoff)
+	handoff.Close()
+}
+
+// restart starts the current binary again with the same arguments, handing
+// it the listening socket. The new server waits until the returned pipe is
+// closed, which the caller does once its store is closed.
+func restart(ln net.Listener) (*os.File, error) {
+	// The socket file must outlive this server's listener.
+	if unix, ok := ln.(*net.UnixListener); ok {
+		unix.SetUnlinkOnClose(false)
+	}
+
+	fileListener, ok := ln.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, errors.New("listener cannot be handed over")
+	}
+
+	lnFile, err := fileListener.File()
+	if err != nil {
+		return nil, err
+	}
+	defer lnFile.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{lnFile, reader}
+	cmd.Env = append(os.Environ(), listenFDEnv+"=3", handoffFDEnv+"=4")
+
+	if err := cmd.Start(); err != nil {
+		writer.Close()
+		return nil, err
+	}
+
+	log.Printf("started pid %d to take over", cmd.Process.Pid)
+
+	return writer, nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+var s3Client = &http.Client{Timeout: 5 * time.Minute}
+
+func (c Config) s3Enabled() bool {
+	return c.S3URL != ""
+}
+
+// s3Escape escapes s as SigV4 wants it: everything but the unreserved
+// characters, and slashes too unless the string is a path.
+func s3Escape(s string, path bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if isAlnum(c) || c == '-' || c == '_' || c == '.' || c == '~' || path && c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Credentials returns -s3-access-key and -s3-secret-key, or the AWS
+// environment variables for the ones left empty. They are read when
+// signing, so the secrets never show up as flag defaults in -help.
+func (c Config) s3Credentials() (accessKey, secretKey string) {
+	accessKey, secretKey = c.S3AccessKey, c.S3SecretKey
+	if accessKey == "" {
+		accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if secretKey == "" {
+		secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	return accessKey, secretKey
+}
+
+// signS3 signs req with AWS Signature Version 4 for the body whose SHA-256
+// is payloadHash.
+func (c Config) signS3(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	accessKey, secretKey := c.s3Credentials()
+	if accessKey == "" {
+		return
+	}
+
+	query := req.URL.Query()
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	params := make([]string, 0, len(names))
+	for _, name := range names {
+		for _, value := range query[name] {
+			params = append(params, s3Escape(name, false)+"="+s3Escape(value, false))
+		}
+	}
+
+	canonical := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, true),
+		strings.Join(params, "&"),
+		"host:" + req.URL.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n",
+		"host;x-amz-content-sha256;x-amz-date",
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.S3Region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, c.S3Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=%s",
+		accessKey, scope, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+// s3Do sends a signed request and returns the body of a 2xx answer.
+func (c Config) s3Do(method, rawURL string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(body)
+	c.signS3(req, hex.EncodeToString(sum[:]), time.Now())
+
+	resp, err := s3Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		return nil, errors.New(fmt.Sprintf("%s %s: %s %s", method, req.URL.Redacted(), resp.Status, bytes.TrimSpace(data)))
+	}
+	return data, nil
+}
+
+// uploadSnapshot copies the snapshot file at path, sealed as it is on
+// disk, under -s3-url and returns the URL of the object.
+func (c Config) uploadSnapshot(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	objectURL := strings.TrimSuffix(c.S3URL, "/") + "/" + s3Escape(filepath.Base(path), true)
+
+	if _, err := c.s3Do(http.MethodPut, objectURL, data); err != nil {
+		return "", err
+	}
+	return objectURL, nil
+}
+
+// latestSnapshotURL finds the newest snapshot under -s3-url with a
+// ListObjectsV2 of its prefix. Snapshot names hold their UTC time, so the
+// newest sorts last.
+func (c Config) latestSnapshotURL() (string, error) {
+	if !c.s3Enabled() {
+		return "", errors.New("-restore-from latest needs -s3-url")
+	}
+
+	location, err := url.Parse(strings.TrimSuffix(c.S3URL, "/"))
+	if err != nil {
+		return "", err
+	}
+
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(location.Path, "/"), "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	prefix += "books-"
+
+	keys := make([]string, 0)
+	token := ""
+
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		listURL := *location
+		listURL.Path, listURL.RawPath, listURL.RawQuery = "/"+bucket, "", query.Encode()
+
+		data, err := c.s3Do(http.MethodGet, listURL.String(), nil)
+		if err != nil {
+			return "", err
+		}
+
+		var listing struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if err := xml.Unmarshal(data, &listing); err != nil {
+			return "", err
+		}
+
+		for _, object := range listing.Contents {
+			if strings.HasSuffix(object.Key, ".json") {
+				keys = append(keys, object.Key)
+			}
+		}
+
+		if !listing.IsTruncated || listing.NextContinuationToken == "" {
+			break
+		}
+		token = listing.NextContinuationToken
+	}
+
+	if len(keys) == 0 {
+		return "", errors.New(fmt.Sprintf("no snapshot under %s", c.S3URL))
+	}
+
+	location.Path, location.RawPath, location.RawQuery = "/"+bucket+"/"+slices.Max(keys), "", ""
+	return location.String(), nil
+}
+
+// restoreSnapshot reads the snapshot object at rawURL, or the newest one
+// for latest, and replaces every book with its contents.
+func (s *Server) restoreSnapshot(rawURL string) (string, int, error) {
+	if rawURL == "latest" {
+		latest, err := s.cfg.latestSnapshotURL()
+		if err != nil {
+			return "", 0, err
+		}
+		rawURL = latest
+	}
+
+	data, err := s.cfg.s3Do(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return rawURL, 0, err
+	}
+
+	books, err := decodeStoredBooks(s.store.Keyring(), rawURL, data)
+	if err != nil {
+		return rawURL, 0, err
+	}
+
+	s.store.ReplaceBooks(books)
+	return rawURL, len(books), nil
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Scripts are written as s-expressions. A script is a sequence of forms
+// run in order; the value of the last is its result:
+//
+//	; move one copy of a book from shelf to loan
+//	(let book (get (nth args 0)))
+//	(if (nil? book) (error "no such book"))
+//	(let left (- (int (field book "name")) 1))
+//	(if (< left 0) (error "none left"))
+//	(put (field book "id") (field book "author") (str left))
+//	left
+//
+// Values are nil, true, false, integers, strings, lists and books, which
+// are maps of id, author, name and version. nil and false are false, all
+// else is true. Variables are set with let and seen by the whole script;
+// args holds the arguments of the run as strings. No string or list a
+// script builds may be larger than -max-value-bytes.
+//
+// Forms: (let name value), (do ...), (if cond then [else]), (while cond
+// ...), (each name list ...), (and ...), (or ...).
+//
+// Functions: + - * / % = != < > <= >= not str int len list nth append nil?
+// field error, and on the store get, exists, put and del.
+
+type scriptSymbol string
+
+// scriptMaxDepth bounds the nesting of forms, and so the recursion of the
+// parser and of eval.
+const scriptMaxDepth = 64
+
+var scriptForms = map[string]bool{
+	"let": true, "do": true, "if": true, "while": true, "each": true, "and": true, "or": true,
+}
+
+// scriptBuiltin is a function of scripts, taking args arguments or any
+// number when args is -1.
+type scriptBuiltin struct {
+	args int
+	fn   func(env *scriptEnv, args []any) (any, error)
+}
+
+var scriptBuiltins = map[string]scriptBuiltin{
+	"+":      {-1, scriptAdd},
+	"-":      {-1, scriptSub},
+	"*":      {2, scriptArith("*")},
+	"/":      {2, scriptArith("/")},
+	"%":      {2, scriptArith("%")},
+	"=":      {2, func(_ *scriptEnv, a []any) (any, error) { return reflect.DeepEqual(a[0], a[1]), nil }},
+	"!=":     {2, func(_ *scriptEnv, a []any) (any, error) { return !reflect.DeepEqual(a[0], a[1]), nil }},
+	"<":      {2, scriptCompare("<")},
+	">":      {2, scriptCompare(">")},
+	"<=":     {2, scriptCompare("<=")},
+	">=":     {2, scriptCompare(">=")},
+	"not":    {1, func(_ *scriptEnv, a []any) (any, error) { return !scriptTruthy(a[0]), nil }},
+	"str":    {-1, scriptStr},
+	"int":    {1, scriptInt},
+	"len":    {1, scriptLen},
+	"list":   {-1, scriptList},
+	"nth":    {2, scriptNth},
+	"append": {-1, scriptAppend},
+	"nil?":   {1, func(_ *scriptEnv, a []any) (any, error) { return a[0] == nil, nil }},
+	"field":  {2, scriptField},
+	"error":  {1, func(_ *scriptEnv, a []any) (any, error) { return nil, errors.New(scriptString(a[0])) }},
+	"get":    {1, scriptGet},
+	"exists": {1, scriptExists},
+	"put":    {3, scriptPut},
+	"del":    {1, scriptDel},
+}
+
+type scriptParser struct {
+	src  string
+	pos  int
+	line int
+}
+
+// parseScript parses source and checks that every form names a known form
+// or function with the right number of arguments.
+func parseScript(source string) ([]any, error) {
+	p := &scriptParser{src: source, line: 1}
+	forms := make([]any, 0)
+
+	for {
+		p.skip()
+		if p.pos == len(p.src) {
+			return forms, nil
+		}
+
+		form, err := p.form(0)
+		if err == nil {
+			err = checkScriptForm(form)
+		}
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("line %d: %v", p.line, err))
+		}
+		forms = append(forms, form)
+	}
+}
+
+// skip moves past white space and ; comments.
+func (p *scriptParser) skip() {
+	for p.pos < len(p.src) {
+		switch p.src[p.pos] {
+		case ';':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		case '\n':
+			p.line++
+			p.pos++
+		case ' ', '\t', '\r':
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (p *scriptParser) form(depth int) (any, error) {
+	if depth > scriptMaxDepth {
+		return nil, errors.New("forms nested too deep")
+	}
+
+	switch p.src[p.pos] {
+	case '(':
+		p.pos++
+		list := make([]any, 0)
+
+		for {
+			p.skip()
+			if p.pos == len(p.src) {
+				return nil, errors.New("missing )")
+			}
+			if p.src[p.pos] == ')' {
+				p.pos++
+				return list, nil
+			}
+
+			item, err := p.form(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+
+	case ')':
+		return nil, errors.New("unexpected )")
+
+	case '"':
+		quoted, err := strconv.QuotedPrefix(p.src[p.pos:])
+		if err != nil {
+			return nil, errors.New("unterminated or invalid string")
+		}
+		p.pos += len(quoted)
+
+		s, _ := strconv.Unquote(quoted)
+		return s, nil
+	}
+
+	start := p.pos
+	for p.pos < len(p.src) && !strings.ContainsRune(" \t\r\n();\"", rune(p.src[p.pos])) {
+		p.pos++
+	}
+
+	atom := p.src[start:p.pos]
+	if n, err := strconv.ParseInt(atom, 10, 64); err == nil {
+		return n, nil
+	}
+	return scriptSymbol(atom), nil
+}
+
+func checkScriptForm(form any) error {
+	list, ok := form.([]any)
+	if !ok {
+		return nil
+	}
+
+	if len(list) == 0 {
+		return errors.New("empty form ()")
+	}
+
+	head, ok := list[0].(scriptSymbol)
+	if !ok {
+		return errors.New(fmt.Sprintf("%v can not be called", list[0]))
+	}
+	name, args := string(head), list[1:]
+
+	if builtin, ok := scriptBuiltins[name]; ok {
+		if builtin.args >= 0 && len(args) != builtin.args {
+			return errors.New(fmt.Sprintf("%s takes %d arguments, not %d", name, builtin.args, len(args)))
+		}
+	} else if !scriptForms[name] {
+		return errors.New(fmt.Sprintf("unknown function %s", name))
+	}
+
+	switch {
+	case name == "let" && len(args) != 2, name == "if" && (len(args) < 2 || len(args) > 3),
+		name == "while" && len(args) < 1, name == "each" && len(args) < 2:
+		return errors.New(fmt.Sprintf("wrong number of arguments to %s", name))
+	}
+
+	if name == "let" || name == "each" {
+		if _, ok := args[0].(scriptSymbol); !ok {
+			return errors.New(fmt.Sprintf("%s needs a variable name first", name))
+		}
+		args = args[1:]
+	}
+
+	for _, arg := range args {
+		if err := checkScriptForm(arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scriptEnv is one run of a script.
+type scriptEnv struct {
+	vars  map[string]any
+	steps int
+	view  *scriptView
+	sizes map[*any]int // of the lists seen, by their first item
+
+	// the settings the script runs under, -script-max-steps and
+	// -max-value-bytes among them
+	cfg Config
+}
+
+// size returns about how many bytes value takes as str shows it. The
+// sizes of lists are kept, so appending to a long list does not walk it
+// again; lists are never changed in place, so a kept size stays right.
+func (env *scriptEnv) size(value any) int {
+	switch v := value.(type) {
+	case nil:
+		return 0
+	case string:
+		return len(v)
+	case int64:
+		return len(strconv.FormatInt(v, 10))
+	case bool:
+		return len(strconv.FormatBool(v))
+	case []any:
+		if len(v) == 0 {
+			return 2
+		}
+		if size, ok := env.sizes[&v[0]]; ok {
+			return size
+		}
+
+		size := 1
+		for _, item := range v {
+			size += env.size(item) + 3
+		}
+		if env.sizes == nil {
+			env.sizes = make(map[*any]int)
+		}
+		env.sizes[&v[0]] = size
+		return size
+	}
+	return len(scriptString(value))
+}
+
+// checkSize fails a script whose value of size bytes would be larger than
+// -max-value-bytes, before it is built, so a loop of str or append cannot
+// grow one without bound.
+func (env *scriptEnv) checkSize(size int) error {
+	if size > env.cfg.MaxValueBytes {
+		return errors.New(fmt.Sprintf("value of %d bytes is larger than -max-value-bytes %d", size, env.cfg.MaxValueBytes))
+	}
+	return nil
+}
+
+func (env *scriptEnv) block(forms []any) (any, error) {
+	var result any
+
+	for _, form := range forms {
+		var err error
+		if result, err = env.eval(form); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (env *scriptEnv) eval(form any) (any, error) {
+	env.steps++
+	if env.steps > env.cfg.ScriptMaxSteps {
+		return nil, errors.New(fmt.Sprintf("more than -script-max-steps %d steps", env.cfg.ScriptMaxSteps))
+	}
+
+	switch f := form.(type) {
+	case scriptSymbol:
+		switch f {
+		case "nil":
+			return nil, nil
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+
+		value, ok := env.vars[string(f)]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("undefined variable %s", f))
+		}
+		return value, nil
+
+	case []any:
+		return env.call(string(f[0].(scriptSymbol)), f[1:])
+	}
+
+	return form, nil
+}
+
+func (env *scriptEnv) call(name string, args []any) (any, error) {
+	switch name {
+	case "let":
+		value, err := env.eval(args[1])
+		if err == nil {
+			env.vars[string(args[0].(scriptSymbol))] = value
+		}
+		return value, err
+
+	case "do":
+		return env.block(args)
+
+	case "if":
+		cond, err := env.eval(args[0])
+		switch {
+		case err != nil:
+			return nil, err
+		case scriptTruthy(cond):
+			return env.eval(args[1])
+		case len(args) == 3:
+			return env.eval(args[2])
+		}
+		return nil, nil
+
+	case "while":
+		for {
+			cond, err := env.eval(args[0])
+			if err != nil || !scriptTruthy(cond) {
+				return nil, err
+			}
+			if _, err := env.block(args[1:]); err != nil {
+				return nil, err
+			}
+		}
+
+	case "each":
+		value, err := env.eval(args[1])
+		if err != nil {
+			return nil, err
+		}
+		list, ok := value.([]any)
+		if !ok {
+			return nil, errors.New("each needs a list")
+		}
+
+		for _, item := range list {
+			env.vars[string(args[0].(scriptSymbol))] = item
+			if _, err := env.block(args[2:]); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+
+	case "and", "or":
+		var value any = name == "and"
+		for _, arg := range args {
+			var err error
+			if value, err = env.eval(arg); err != nil || scriptTruthy(value) != (name == "and") {
+				return value, err
+			}
+		}
+		return value, nil
+	}
+
+	values := make([]any, 0, len(args))
+	for _, arg := range args {
+		value, err := env.eval(arg)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	value, err := scriptBuiltins[name].fn(env, values)
+	if err != nil && name != "error" {
+		err = errors.New(fmt.Sprintf("%s: %v", name, err))
+	}
+	return value, err
+}
+
+func scriptTruthy(value any) bool {
+	return value != nil && value != false
+}
+
+// scriptString is how str and error show a value.
+func scriptString(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+func scriptInts(args []any) ([]int64, error) {
+	ints := make([]int64, 0, len(args))
+	for _, arg := range args {
+		n, ok := arg.(int64)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("%s is not an integer", scriptString(arg)))
+		}
+		ints = append(ints, n)
+	}
+	return ints, nil
+}
+
+func scriptAdd(_ *scriptEnv, args []any) (any, error) {
+	ints, err := scriptInts(args)
+	sum := int64(0)
+	for _, n := range ints {
+		sum += n
+	}
+	return sum, err
+}
+
+func scriptSub(_ *scriptEnv, args []any) (any, error) {
+	ints, err := scriptInts(args)
+	if err != nil || len(ints) == 0 {
+		return nil, errors.New("needs integers")
+	}
+	if len(ints) == 1 {
+		return -ints[0], nil
+	}
+
+	result := ints[0]
+	for _, n := range ints[1:] {
+		result -= n
+	}
+	return result, nil
+}
+
+func scriptArith(op string) func(*scriptEnv, []any) (any, error) {
+	return func(_ *scriptEnv, args []any) (any, error) {
+		ints, err := scriptInts(args)
+		if err != nil {
+			return nil, err
+		}
+
+		a, b := ints[0], ints[1]
+		switch {
+		case op == "*":
+			return a * b, nil
+		case b == 0:
+			return nil, errors.New("division by zero")
+		case op == "/":
+			return a / b, nil
+		}
+		return a % b, nil
+	}
+}
+
+// scriptCompare orders two integers or two strings.
+func scriptCompare(op string) func(*scriptEnv, []any) (any, error) {
+	return func(_ *scriptEnv, args []any) (any, error) {
+		cmp := 0
+
+		switch a := args[0].(type) {
+		case int64:
+			b, ok := args[1].(int64)
+			if !ok {
+				return nil, errors.New("compares an integer with something else")
+			}
+			if a < b {
+				cmp = -1
+			} else if a > b {
+				cmp = 1
+			}
+		case string:
+			b, ok := args[1].(string)
+			if !ok {
+				return nil, errors.New("compares a string with something else")
+			}
+			cmp = strings.Compare(a, b)
+		default:
+			return nil, errors.New("compares integers or strings")
+		}
+
+		switch op {
+		case "<":
+			return cmp < 0, nil
+		case ">":
+			return cmp > 0, nil
+		case "<=":
+			return cmp <= 0, nil
+		}
+		return cmp >= 0, nil
+	}
+}
+
+func scriptStr(env *scriptEnv, args []any) (any, error) {
+	size := 0
+	for _, arg := range args {
+		size += env.size(arg)
+	}
+	if err := env.checkSize(size); err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+	for _, arg := range args {
+		b.WriteString(scriptString(arg))
+	}
+	if err := env.checkSize(b.Len()); err != nil {
+		return nil, err
+	}
+	return b.String(), nil
+}
+
+func scriptInt(_ *scriptEnv, args []any) (any, error) {
+	switch v := args[0].(type) {
+	case int64:
+		return v, nil
+	case string:
+		n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%q is not an integer", v))
+		}
+		return n, nil
+	}
+	return nil, errors.New(fmt.Sprintf("%s is not an integer", scriptString(args[0])))
+}
+
+// scriptLen counts the characters of a string or the items of a list.
+func scriptLen(_ *scriptEnv, args []any) (any, error) {
+	switch v := args[0].(type) {
+	case string:
+		return int64(utf8.RuneCountInString(v)), nil
+	case []any:
+		return int64(len(v)), nil
+	}
+	return nil, errors.New("needs a string or a list")
+}
+
+func scriptList(env *scriptEnv, args []any) (any, error) {
+	if err := env.checkSize(env.size(args)); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+func scriptNth(_ *scriptEnv, args []any) (any, error) {
+	list, ok := args[0].([]any)
+	i, isInt := args[1].(int64)
+	if !ok || !isInt {
+		return nil, errors.New("needs a list and an index")
+	}
+	if i < 0 || i >= int64(len(list)) {
+		return nil, nil
+	}
+	return list[i], nil
+}
+
+// scriptAppend returns a new list, leaving the one it was given as it was.
+func scriptAppend(env *scriptEnv, args []any) (any, error) {
+	if len(args) == 0 {
+		return nil, errors.New("needs a list")
+	}
+	list, ok := args[0].([]any)
+	if !ok {
+		return nil, errors.New("needs a list")
+	}
+
+	size := env.size(list)
+	for _, item := range args[1:] {
+		size += env.size(item) + 3
+	}
+	if err := env.checkSize(size); err != nil {
+		return nil, err
+	}
+	return append(append([]any{}, list...), args[1:]...), nil
+}
+
+func scriptField(_ *scriptEnv, args []any) (any, error) {
+	book, ok := args[0].(map[string]any)
+	name, isString := args[1].(string)
+	if !ok || !isString {
+		return nil, errors.New("needs a book and a field name")
+	}
+	return book[name], nil
+}
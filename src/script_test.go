@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestScriptValuesAreCapped(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		wantErr string
+	}{
+		{
+			name:   "small str",
+			script: `(str "a" 1 true)`,
+		},
+		{
+			name:    "str doubling without bound",
+			script:  `(let s "x") (while true (let s (str s s)))`,
+			wantErr: "str: value of",
+		},
+		{
+			name:    "append without bound",
+			script:  `(let l (list)) (while true (let l (append l "xxxxxxxxxxxxxxxx")))`,
+			wantErr: "append: value of",
+		},
+		{
+			name:    "lists nesting themselves",
+			script:  `(let l (list "x")) (while true (let l (list l l)))`,
+			wantErr: "list: value of",
+		},
+		{
+			name:    "str of a large list",
+			script:  `(let l (list)) (each i (list 1 2 3 4 5 6 7 8) (let l (append l (str "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx" i)))) (str l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l l)`,
+			wantErr: "str: value of",
+		},
+		{
+			name:   "append under the cap",
+			script: `(let l (list)) (each i (list 1 2 3) (let l (append l i))) (len l)`,
+		},
+	}
+
+	cfg := DefaultConfig()
+	cfg.MaxValueBytes = 4 << 10
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forms, err := parseScript(tt.script)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			env := &scriptEnv{cfg: cfg, vars: map[string]any{}}
+			_, err = env.block(forms)
+
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("error %v, want none", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
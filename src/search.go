@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// EnableValueIndex starts indexing books by name, including the ones
+// already stored.
+func (s *MemoryStore) EnableValueIndex() {
+	unlock := s.lock(nil, true)
+	defer unlock()
+
+	for _, sh := range s.shards {
+		sh.names = make(map[string]map[string]bool)
+
+		for _, e := range sh.books {
+			sh.indexName(e.book)
+		}
+	}
+}
+
+func nameMatches(match, name, value string) bool {
+	switch match {
+	case "prefix":
+		return strings.HasPrefix(name, value)
+	case "contains":
+		return strings.Contains(name, value)
+	}
+	return name == value
+}
+
+// SearchBooks returns the books whose name equals value, or with match
+// "prefix" or "contains" starts with or contains it, in id order. With the
+// value index an exact match only looks at the books holding the name and
+// the others only at each distinct name once. Like GetBooks it gives up
+// once ctx is done.
+func (s *MemoryStore) SearchBooks(ctx context.Context, match, value string) ([]Book, error) {
+	unlock := s.lock(nil, false)
+	defer unlock()
+
+	now := time.Now()
+	books := make([]Book, 0)
+
+	for _, sh := range s.shards {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		ids := make([]string, 0)
+
+		switch {
+		case sh.names == nil:
+			for id, e := range sh.books {
+				if nameMatches(match, e.book.Name, value) {
+					ids = append(ids, id)
+				}
+			}
+		case match == "exact":
+			for id := range sh.names[value] {
+				ids = append(ids, id)
+			}
+		default:
+			for name, named := range sh.names {
+				if nameMatches(match, name, value) {
+					for id := range named {
+						ids = append(ids, id)
+					}
+				}
+			}
+		}
+
+		for _, id := range ids {
+			if book := sh.find(id, now); book != nil {
+				books = append(books, *book)
+			}
+		}
+	}
+
+	sort.Slice(books, func(i, j int) bool { return books[i].Id < books[j].Id })
+
+	return books, nil
+}
+
+// HandleSearch lists the books by name: ?value= matches it exactly,
+// ?prefix= by prefix and ?contains= by substring. With ?count-only=true it
+// answers only how many match.
+func (s *Server) HandleSearch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	query := r.URL.Query()
+	match := ""
+
+	for _, param := range []string{"value", "prefix", "contains"} {
+		if !query.Has(param) {
+			continue
+		}
+
+		if match != "" {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, "give only one of value, prefix and contains")
+			return
+		}
+		match = param
+	}
+
+	if match == "" {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "expected value, prefix or contains")
+		return
+	}
+
+	value := query.Get(match)
+	if match == "value" {
+		match = "exact"
+	}
+
+	stop := startTiming(r, "store")
+	found, err := s.store.SearchBooks(r.Context(), match, value)
+	stop()
+	if !handleCanceled(w, err) {
+		return
+	}
+	books := withoutBuckets(found)
+
+	if query.Get("count-only") == "true" {
+		writeCount(w, len(books))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	body, _ := json.Marshal(books)
+
+	w.Write(body)
+}
@@ -1,111 +1,423 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"log"
+	"log/slog"
 	"net/http"
 	"time"
 
-	"encoding/base64"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"unicode/utf8"
 )
 
 func main() {
+	cfg, args, err := ParseFlags(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+
+	if len(args) > 0 {
+		os.Exit(cfg.runCommand(args))
+	}
+
+	if err := cfg.validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	switch cfg.LogFormat {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+	}
+
+	if cfg.ProxyMembers != "" {
+		os.Exit(runProxy(cfg))
+	}
+
+	waitForHandoff()
+
+	store, err := OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s, err := New(WithConfig(cfg), WithStore(store))
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	stop := make(chan os.Signal, 1)
 
-	signal.Notify(stop, os.Interrupt)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
-	handler := http.NewServeMux()
+	upgrade := make(chan os.Signal, 1)
 
-	handler.HandleFunc("/book/", BasicAuth(Logger(HandleBook)))
+	signal.Notify(upgrade, syscall.SIGUSR2)
 
-	handler.HandleFunc("/books/", BasicAuth(Logger(HandleBooks)))
+	go s.reloadOnHangup()
 
-	s := &http.Server{
-		Addr:           ":8080",
-		Handler:        handler,          // if nil use default http.DefaultServeMux
-		ReadTimeout:    10 * time.Second, // max duration reading entire request
-		WriteTimeout:   10 * time.Second, // max timing write response
-		IdleTimeout:    15 * time.Second, // max time wait for the next request
-		MaxHeaderBytes: 1 << 20,          // 2^20 or 128kbytes
+	ln, err := listen(cfg.Addr, cfg.TCPKeepAlive)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	log.Printf("Listening on http://%s\n", s.Addr)
-	log.Fatal(s.ListenAndServe())
+	if err := s.Start(); err != nil {
+		log.Fatal(err)
+	}
 
-}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(ctx, ln)
+	}()
+
+	// SIGUSR2 restarts the binary, e.g. after an upgrade, without closing
+	// the socket: the new server takes it over and loads the store once
+	// this one has drained its requests and closed the store.
+	var handoff *os.File
+
+wait:
+	for {
+		select {
+		case err := <-served:
+			log.Fatal(err)
+		case <-stop:
+			break wait
+		case <-upgrade:
+			handoff, err = restart(ln)
+			if err == nil {
+				break wait
+			}
+			log.Printf("restart: %v", err)
+		}
+	}
 
-func Logger(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+	cancel()
 
-		log.Printf("server [net/http] method [%s]  connection from [%v]", r.Method, r.RemoteAddr)
+	if err := <-served; err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+
+	s.Stop()
 
-		next.ServeHTTP(w, r)
+	if err := store.Close(); err != nil {
+		log.Printf("close store: %v", err)
 	}
-}
 
-func BasicAuth(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+	if handoff != nil {
+		handoff.Close()
+	}
+}
 
-		auth := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+func (c Config) reservedPatterns() []string {
+	patterns := make([]string, 0)
 
-		if len(auth) != 2 || auth[0] != "Basic" {
-			http.Error(w, "authorization failed", http.StatusUnauthorized)
-			return
+	for _, pattern := range strings.Split(c.ReservedIds, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern != "" {
+			patterns = append(patterns, pattern)
 		}
+	}
 
-		payload, _ := base64.StdEncoding.DecodeString(auth[1])
-		pair := strings.SplitN(string(payload), ":", 2)
+	return patterns
+}
 
-		if len(pair) != 2 || !validate(pair[0], pair[1]) {
-			http.Error(w, "authorization failed", http.StatusUnauthorized)
-			return
+func (c Config) isReservedId(id string) bool {
+	if inBucket(id) {
+		return true
+	}
+
+	for _, pattern := range c.reservedPatterns() {
+		if ok, _ := path.Match(pattern, id); ok {
+			return true
 		}
+	}
+	return false
+}
+
+var idNormalizers = map[string]func(string) string{
+	"trim":      strings.TrimSpace,
+	"lowercase": strings.ToLower,
+	"collapse-slashes": func(id string) string {
+		for strings.Contains(id, "//") {
+			id = strings.ReplaceAll(id, "//", "/")
+		}
+		return id
+	},
+}
+
+func (c Config) normalizeSteps() []string {
+	steps := make([]string, 0)
 
-		next.ServeHTTP(w, r)
+	for _, step := range strings.Split(c.NormalizeIds, ",") {
+		step = strings.TrimSpace(step)
+		if step != "" {
+			steps = append(steps, step)
+		}
 	}
+
+	return steps
 }
 
-func validate(username, password string) bool {
-	if username == "test" && password == "test" { //Basic dGVzdDp0ZXN0
-		return true
+// normalizeId applies the -normalize-ids steps in order. Every handler runs
+// ids through it, on writes and on lookups alike, so a book stored under a
+// normalized id is always found again.
+func (c Config) normalizeId(id string) string {
+	for _, step := range c.normalizeSteps() {
+		id = idNormalizers[step](id)
 	}
-	return false
+	return id
+}
+
+func HandleReservedId(w http.ResponseWriter, id string) {
+	writeError(w, http.StatusForbidden, CodeReservedId, fmt.Sprintf("Book id %s is reserved", id))
 }
 
-func HandleBooks(w http.ResponseWriter, r *http.Request) {
+func (s *Server) HandleBooks(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	if r.Method == http.MethodGet {
-		HandleGetBooks(w, r)
+	query := r.URL.Query()
+
+	if r.Method == http.MethodGet && query.Has("at") && (query.Has("cursor") || query.Has("limit") || query.Has("prefix")) {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "at cannot be combined with cursor, limit or prefix")
+
+	} else if r.Method == http.MethodGet && (query.Has("cursor") || query.Has("limit") || query.Has("prefix")) {
+		s.HandleGetBooksPage(w, r)
+
+	} else if r.Method == http.MethodGet {
+		s.HandleGetBooks(w, r)
+
+	} else {
+		HandleMethodIsNotAllowed(w, r)
+
 	}
 }
 
-func HandleGetBooks(w http.ResponseWriter, r *http.Request) {
+type BooksPage struct {
+	Books      []Book `json:"books"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+const defaultPageLimit = 100
+
+// HandleGetBooksPage serves books ordered by id, one page at a time. The
+// opaque cursor encodes the last id of the previous page.
+func (s *Server) HandleGetBooksPage(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit := defaultPageLimit
+
+	if query.Get("limit") != "" {
+		n, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("invalid limit %s", query.Get("limit")))
+			return
+		}
+		limit = n
+	}
+
+	after, err := base64.RawURLEncoding.DecodeString(query.Get("cursor"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("invalid cursor %s", query.Get("cursor")))
+		return
+	}
+
+	page := BooksPage{}
+
+	stop := startTiming(r, "store")
+	books, more, err := s.store.BooksAfter(r.Context(), query.Get("prefix"), string(after), limit)
+	stop()
+	if !handleCanceled(w, err) {
+		return
+	}
+	if more {
+		page.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(books[len(books)-1].Id))
+	}
+
+	flat, ok := handleModifiedSince(w, r, withoutBuckets(books))
+	if !ok {
+		return
+	}
+
+	page.Books = flat
+
+	stop = startTiming(r, "serialize")
+	pageJson, _ := json.Marshal(page)
+	stop()
+
+	w.WriteHeader(http.StatusOK)
+
+	w.Write(pageJson)
+}
+
+func (s *Server) HandleGetBooks(w http.ResponseWriter, r *http.Request) {
+	at, ok := handlePointInTime(w, r)
+	if !ok {
+		return
+	}
+
+	var all []Book
+	var err error
+
+	stop := startTiming(r, "store")
+	if at != nil {
+		all, err = s.store.BooksAt(r.Context(), *at)
+	} else {
+		all, err = s.store.GetBooks(r.Context())
+	}
+	stop()
+	if !handleCanceled(w, err) {
+		return
+	}
+	list := withoutBuckets(all)
+
+	list, ok = handleModifiedSince(w, r, list)
+	if !ok {
+		return
+	}
+
+	err = sortBooks(list, r.URL.Query().Get("sort"), r.URL.Query().Get("order"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+
+	stop = startTiming(r, "serialize")
+	books, contentType := renderBooks(s.negotiateFormat(r), list)
+	stop()
+
+	w.Header().Set("Content-Type", contentType)
 	w.WriteHeader(http.StatusOK)
-	books, _ := json.Marshal(bookStore.GetBooks())
 
 	w.Write(books)
 }
 
-func HandleBook(w http.ResponseWriter, r *http.Request) {
+var bookSortFields = map[string]func(a, b Book) bool{
+	"id":     func(a, b Book) bool { return a.Id < b.Id },
+	"author": func(a, b Book) bool { return a.Author < b.Author },
+	"name":   func(a, b Book) bool { return a.Name < b.Name },
+}
+
+// sortBooks orders books in place by the given field; an empty field keeps
+// insertion order.
+func sortBooks(books []Book, field, order string) error {
+	if field == "" && order == "" {
+		return nil
+	}
+
+	if field == "" {
+		field = "id"
+	}
+
+	less, ok := bookSortFields[field]
+	if !ok {
+		return errors.New(fmt.Sprintf("unknown sort field %s", field))
+	}
+
+	if order != "" && order != "asc" && order != "desc" {
+		return errors.New(fmt.Sprintf("unknown sort order %s", order))
+	}
+
+	sort.SliceStable(books, func(i, j int) bool {
+		if order == "desc" {
+			return less(books[j], books[i])
+		}
+		return less(books[i], books[j])
+	})
+
+	return nil
+}
+
+// bookOperations are the operations addressed as /book/<id>/<operation>,
+// next to /book/<id>/versions/<version>.
+var bookOperations = []string{"cas", "content", "incr", "decr", "append", "range", "strlen", "history", "rollback", "restore", "list", "set"}
+
+// splitBookPath splits the path after /book/ into the book id and the
+// operation in the segment after it, with the version of
+// /versions/<version>. A path that ends in no operation is all id, so
+// an id may hold slashes but no operation can be read as part of one;
+// checkIdPolicy refuses the ids that would end in one.
+func splitBookPath(path string) (id, op, version string) {
+	if i := strings.LastIndex(path, "/versions/"); i > 0 && !strings.Contains(path[i+len("/versions/"):], "/") {
+		return path[:i], "versions", path[i+len("/versions/"):]
+	}
+
+	if i := strings.LastIndex(path, "/"); i > 0 && slices.Contains(bookOperations, path[i+1:]) {
+		return path[:i], path[i+1:], ""
+	}
+
+	return path, "", ""
+}
+
+// HandleBook serves /book/ and /book/<id>, and the operations on a book
+// after its id, see splitBookPath. The handlers read the parts as the
+// path values id, op and version.
+func (s *Server) HandleBook(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	if r.Method == http.MethodGet {
-		HandleGetBook(w, r)
+	w, ok := s.handleFenceToken(w, r)
+	if !ok {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.MaxBodyBytes)
+
+	id, op, version := splitBookPath(strings.TrimPrefix(r.URL.Path, "/book/"))
+	r.SetPathValue("id", id)
+	r.SetPathValue("op", op)
+	r.SetPathValue("version", version)
+
+	if op == "cas" {
+		s.HandleSwapBook(w, r)
+
+	} else if op == "content" {
+		s.HandleBookContent(w, r)
+
+	} else if op == "incr" || op == "decr" {
+		s.HandleIncrBook(w, r)
+
+	} else if op == "append" || op == "range" || op == "strlen" {
+		s.HandleBookText(w, r)
+
+	} else if op == "history" || op == "rollback" || op == "versions" {
+		s.HandleBookHistory(w, r)
+
+	} else if op == "restore" {
+		s.HandleRestoreBook(w, r)
+
+	} else if op == "list" {
+		s.HandleBookList(w, r)
+
+	} else if op == "set" {
+		s.HandleBookSet(w, r)
+
+	} else if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		s.HandleGetBook(w, r)
 
 	} else if r.Method == http.MethodPost {
-		HandleAddBook(w, r)
+		s.HandleAddBook(w, r)
 
 	} else if r.Method == http.MethodPut {
-		HandleUpdateBook(w, r)
+		s.HandleUpdateBook(w, r)
 
 	} else if r.Method == http.MethodDelete {
-		HandleDeleteBook(w, r)
+		s.HandleDeleteBook(w, r)
 
 	} else {
 		HandleMethodIsNotAllowed(w, r)
@@ -114,169 +426,672 @@ func HandleBook(w http.ResponseWriter, r *http.Request) {
 }
 
 func HandleMethodIsNotAllowed(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusBadRequest)
-	msg, _ := json.Marshal(fmt.Sprintf("Method %s not allowed", r.Method))
-	w.Write(msg)
+	writeError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, fmt.Sprintf("Method %s not allowed", r.Method))
 }
 
-func HandleGetBook(w http.ResponseWriter, r *http.Request) {
-	bookid := strings.Replace(r.URL.Path, "/book/", "", 1)
+func (s *Server) HandleGetBook(w http.ResponseWriter, r *http.Request) {
+	bookid := s.cfg.normalizeId(r.PathValue("id"))
 
-	book := bookStore.FindBookById(bookid)
+	at, ok := handlePointInTime(w, r)
+	if !ok {
+		return
+	}
 
-	if book == nil {
-		w.WriteHeader(http.StatusNotFound)
-		error, _ := json.Marshal(fmt.Sprintf("Book with id %s not found", bookid))
+	if at != nil {
+		stop := startTiming(r, "store")
+		book := s.store.BookAt(bookid, *at)
+		stop()
 
-		w.Write(error)
+		if book == nil && s.store.FindBookById(bookid) != nil {
+			writeError(w, http.StatusNotFound, CodeVersionNotFound, fmt.Sprintf("Book with id %s has no version as of %s among the %d earlier versions -history-depth keeps", bookid, at, s.cfg.HistoryDepth))
+			return
+		}
+		if book == nil {
+			writeError(w, http.StatusNotFound, CodeVersionNotFound, fmt.Sprintf("Book with id %s has no version as of %s", bookid, at))
+			return
+		}
 
+		s.serveBook(w, r, book)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	stop := startTiming(r, "store")
+	book := s.store.FindBookById(bookid)
+	stop()
 
-	bookidJson, _ := json.Marshal(book)
+	if book == nil && s.store.RecentlyDeleted(bookid) {
+		writeError(w, http.StatusGone, CodeBookDeleted, fmt.Sprintf("Book with id %s was deleted", bookid))
 
-	w.Write(bookidJson)
+		return
+	}
+
+	if book == nil {
+		writeError(w, http.StatusNotFound, CodeBookNotFound, fmt.Sprintf("Book with id %s not found", bookid))
+
+		return
+	}
+
+	s.serveBook(w, r, book)
 }
 
-func HandleAddBook(w http.ResponseWriter, r *http.Request) {
-	decoder := json.NewDecoder(r.Body)
+// serveBook answers a read of book, in the format the request asks for.
+func (s *Server) serveBook(w http.ResponseWriter, r *http.Request, book *Book) {
+	if !s.handleGetHooks(w, r, book) {
+		return
+	}
+
+	w.Header().Set("ETag", book.ETag(s.cfg.ETagAlgo))
+	setTimestampHeaders(w, *book)
+
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && s.notModified(r, *book) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	stop := startTiming(r, "serialize")
+	format := s.negotiateFormat(r)
+	body, contentType := renderBook(format, *book)
+	stop()
+
+	if charset := r.URL.Query().Get("charset"); charset != "" && !isBinaryFormat(format) {
+		encoded, name, err := transcode(string(body), charset)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+			return
+		}
 
+		contentType += "; charset=" + name
+		body = encoded
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+
+	w.Write(body)
+}
+
+func (s *Server) HandleAddBook(w http.ResponseWriter, r *http.Request) {
 	var book Book
 
-	err := decoder.Decode(&book)
+	err := s.decodeBook(r, &book)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		error, _ := json.Marshal(fmt.Sprintf("Bad request. %v", err))
+		writeError(w, badBodyStatus(err), "", err.Error())
+		return
+	}
+
+	book.Id = s.cfg.normalizeId(book.Id)
 
-		w.Write(error)
+	if !handleTTL(w, r, &book) {
 		return
 	}
 
-	err = bookStore.AddBook(book)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		error, _ := json.Marshal(fmt.Sprintf("Bad request. %v", err))
+	if s.cfg.isReservedId(book.Id) {
+		HandleReservedId(w, book.Id)
+		return
+	}
 
-		w.Write(error)
+	if s.handleEmptyBook(w, r, book, "") {
 		return
 	}
 
-	HandleGetBooks(w, r)
+	if !s.handlePutHooks(w, r, &book) || !s.handleLimits(w, book) {
+		return
+	}
+
+	stop := startTiming(r, "store")
+	err = s.store.AddBook(book)
+	stop()
+	if handleStoreError(w, err) {
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusConflict, CodeBookExists, err.Error())
+		return
+	}
+
+	s.HandleGetBooks(w, r)
 }
 
-func HandleUpdateBook(w http.ResponseWriter, r *http.Request) {
-	bookid := strings.Replace(r.URL.Path, "/book/", "", 1)
+// handleTTL sets the book expiry from ?ttl= (a duration such as 60s);
+// without it the book never expires. It reports false after answering
+// the request when the ttl is invalid.
+func handleTTL(w http.ResponseWriter, r *http.Request, book *Book) bool {
+	book.ExpiresAt = nil
 
-	decoder := json.NewDecoder(r.Body)
+	if !r.URL.Query().Has("ttl") {
+		return true
+	}
 
-	var book Book
+	ttl, err := time.ParseDuration(r.URL.Query().Get("ttl"))
+	if err != nil || ttl <= 0 {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("invalid ttl %s", r.URL.Query().Get("ttl")))
+		return false
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	book.ExpiresAt = &expiresAt
+
+	return true
+}
+
+// badBodyStatus maps a request body error to 413 when the body exceeded
+// -max-body-bytes and to 400 otherwise.
+func badBodyStatus(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+func (s *Server) decodeBook(r *http.Request, book *Book) error {
+	return s.decodeBody(r, book)
+}
 
-	err := decoder.Decode(&book)
+// decodeBody decodes a JSON body, or one of the Content-Type
+// application/msgpack or application/protobuf.
+func (s *Server) decodeBody(r *http.Request, v any) error {
+	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		error, _ := json.Marshal(fmt.Sprintf("Bad request. %v", err))
+		return err
+	}
+
+	switch mediaType(r.Header.Get("Content-Type")) {
+	case formatContentTypes["protobuf"]:
+		return decodeProtobuf(body, v)
 
-		w.Write(error)
+	case formatContentTypes["msgpack"]:
+		body, err = msgpackToJSON(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.cfg.RequireUTF8 && !utf8.Valid(body) {
+		return errors.New("body is not valid UTF-8")
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+// handleEmptyBook applies -empty-value-policy to a book without author and
+// name and reports whether the request has already been answered. With the
+// delete policy the book is only deleted if cond, when set, holds.
+func (s *Server) handleEmptyBook(w http.ResponseWriter, r *http.Request, book Book, cond string) bool {
+	if book.Author != "" || book.Name != "" || s.cfg.EmptyValuePolicy == "allow" {
+		return false
+	}
+
+	if s.cfg.EmptyValuePolicy == "reject" {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("book %s has no author and name", book.Id))
+		return true
+	}
+
+	if cond != "" && !validCondition(cond) {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("unknown condition %s", cond))
+		return true
+	}
+
+	if !s.handleDeleteHooks(w, r, book.Id) {
+		return true
+	}
+
+	if cond != "" {
+		if err := s.store.DelBookIf(book.Id, cond); err != nil {
+			writeConditionError(w, book.Id, cond, err)
+			return true
+		}
+
+		s.HandleGetBooks(w, r)
+		return true
+	}
+
+	err := s.store.DelBook(book.Id)
+
+	if handleStoreError(w, err) {
+		return true
+	}
+	if err != nil {
+		writeError(w, http.StatusNotFound, CodeBookNotFound, err.Error())
+
+		return true
+	}
+
+	s.HandleGetBooks(w, r)
+	return true
+}
+
+func (s *Server) HandleUpdateBook(w http.ResponseWriter, r *http.Request) {
+	bookid := s.cfg.normalizeId(r.PathValue("id"))
+
+	if s.cfg.isReservedId(bookid) {
+		HandleReservedId(w, bookid)
+		return
+	}
+
+	var book Book
+
+	err := s.decodeBook(r, &book)
+	if err != nil {
+		writeError(w, badBodyStatus(err), "", err.Error())
 		return
 	}
 
 	book.Id = bookid
 
-	err = bookStore.SetBook(book)
+	if !handleTTL(w, r, &book) {
+		return
+	}
 
-	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		error, _ := json.Marshal(fmt.Sprintf("%v", err))
+	ifMatch, ok := handleIfMatch(w, r)
+	if !ok {
+		return
+	}
+
+	cond := r.URL.Query().Get("if")
+	if cond != "" && ifMatch != "" {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "if and If-Match cannot be combined")
+		return
+	}
 
-		w.Write(error)
+	if ifMatch != "" {
+		cond = ifMatch
+	}
 
+	if s.handleEmptyBook(w, r, book, cond) {
 		return
 	}
 
-	HandleGetBook(w, r)
-}
+	if !s.handlePutHooks(w, r, &book) || !s.handleLimits(w, book) {
+		return
+	}
 
-func HandleDeleteBook(w http.ResponseWriter, r *http.Request) {
-	bookid := strings.Replace(r.URL.Path, "/book/", "", 1)
-	err := bookStore.DelBook(bookid)
+	if cond != "" {
+		s.HandleConditionalUpdateBook(w, r, book, cond)
+		return
+	}
 
-	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		error, _ := json.Marshal(fmt.Sprintf("%v", err))
+	stop := startTiming(r, "store")
+	err = s.store.SetBook(book)
+	stop()
 
-		w.Write(error)
+	if handleStoreError(w, err) {
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusNotFound, CodeBookNotFound, err.Error())
 
 		return
 	}
 
-	HandleGetBooks(w, r)
+	s.HandleGetBook(w, r)
 }
 
-// BOOK
+func (s *Server) HandleConditionalUpdateBook(w http.ResponseWriter, r *http.Request, book Book, cond string) {
+	if !validCondition(cond) {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("unknown condition %s", cond))
+		return
+	}
+
+	stop := startTiming(r, "store")
+	err := s.store.SetBookIf(book, cond)
+	stop()
 
-type Book struct {
-	Id     string `json:"id"`
-	Author string `json:"author"`
-	Name   string `json:"name"`
+	if err != nil {
+		writeConditionError(w, book.Id, cond, err)
+		return
+	}
+
+	s.HandleGetBook(w, r)
 }
 
-type BookStore struct {
-	books []Book
+// writeConditionError answers a write whose condition did not hold.
+// Create-only and update-only writes fail like POST and a plain PUT.
+func writeConditionError(w http.ResponseWriter, id string, cond string, err error) {
+	if handleStoreError(w, err) {
+		return
+	}
+
+	switch cond {
+	case "absent":
+		writeError(w, http.StatusConflict, CodeBookExists, fmt.Sprintf("Book with id %s already exists", id))
+	case "present", "exists":
+		writeError(w, http.StatusNotFound, CodeBookNotFound, fmt.Sprintf("There is no book with id %s", id))
+	default:
+		writeError(w, http.StatusPreconditionFailed, CodePreconditionFailed, err.Error())
+	}
 }
 
-var bookStore = BookStore{
-	books: make([]Book, 0),
+// SwapRequest is the body of POST /book/<id>/cas.
+type SwapRequest struct {
+	Old Book `json:"old"`
+	New Book `json:"new"`
 }
 
-func (s BookStore) GetBooks() []Book {
-	return s.books
+// HandleSwapBook writes the new book only while the stored one still has
+// the old author and name, so two clients cannot both win a race.
+func (s *Server) HandleSwapBook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	bookid := s.cfg.normalizeId(r.PathValue("id"))
+
+	if s.cfg.isReservedId(bookid) {
+		HandleReservedId(w, bookid)
+		return
+	}
+
+	var swap SwapRequest
+
+	err := s.decodeBody(r, &swap)
+	if err != nil {
+		writeError(w, badBodyStatus(err), "", err.Error())
+		return
+	}
+
+	book := swap.New
+	book.Id = bookid
+
+	if !handleTTL(w, r, &book) {
+		return
+	}
+
+	if s.handleEmptyBook(w, r, book, "") {
+		return
+	}
+
+	if !s.handlePutHooks(w, r, &book) || !s.handleLimits(w, book) {
+		return
+	}
+
+	stop := startTiming(r, "store")
+	err = s.store.SwapBook(swap.Old, book)
+	stop()
+
+	if handleStoreError(w, err) {
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusConflict, CodeConflict, err.Error())
+
+		return
+	}
+
+	stored := s.store.FindBookById(bookid)
+	if stored != nil {
+		w.Header().Set("ETag", stored.ETag(s.cfg.ETagAlgo))
+	}
+
+	w.WriteHeader(http.StatusOK)
+	body, _ := json.Marshal(stored)
+
+	w.Write(body)
 }
 
-func (s BookStore) FindBookById(id string) *Book {
-	for _, book := range s.books {
-		if book.Id == id {
-			return &book
+func (s *Server) HandleDeleteBook(w http.ResponseWriter, r *http.Request) {
+	bookid := s.cfg.normalizeId(r.PathValue("id"))
+
+	if s.cfg.isReservedId(bookid) {
+		HandleReservedId(w, bookid)
+		return
+	}
+
+	cond, ok := handleIfMatch(w, r)
+	if !ok || !s.handleDeleteHooks(w, r, bookid) {
+		return
+	}
+
+	if cond != "" {
+		stop := startTiming(r, "store")
+		err := s.store.DelBookIf(bookid, cond)
+		stop()
+
+		if handleStoreError(w, err) {
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusPreconditionFailed, CodePreconditionFailed, err.Error())
+
+			return
 		}
+
+		s.HandleGetBooks(w, r)
+		return
 	}
 
-	return nil
-}
+	stop := startTiming(r, "store")
+	err := s.store.DelBook(bookid)
+	stop()
 
-func (s *BookStore) AddBook(book Book) error {
-	bk := s.FindBookById(book.Id)
-	if bk != nil {
-		return errors.New(fmt.Sprintf("Book with id %s already exists", book.Id))
+	if handleStoreError(w, err) {
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusNotFound, CodeBookNotFound, err.Error())
 
+		return
 	}
-	s.books = append(s.books, book)
 
-	return nil
+	s.HandleGetBooks(w, r)
 }
 
-func (s *BookStore) SetBook(book Book) error {
-	for i, bk := range s.books {
-		if bk.Id == book.Id {
+func (s *Server) HandleDrainBooks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	w, ok := s.handleFenceToken(w, r)
+	if !ok {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.MaxBodyBytes)
+
+	decoder := json.NewDecoder(r.Body)
+
+	var ids []string
+
+	err := decoder.Decode(&ids)
+	if err != nil {
+		writeError(w, badBodyStatus(err), "", err.Error())
+		return
+	}
 
-			s.books[i] = book
+	for i := range ids {
+		ids[i] = s.cfg.normalizeId(ids[i])
+	}
 
-			return nil
+	for _, id := range ids {
+		if s.cfg.isReservedId(id) {
+			HandleReservedId(w, id)
+			return
 		}
 	}
 
-	return errors.New(fmt.Sprintf("There is no book with id %s", book.Id))
+	if !s.handleBackup(w) {
+		return
+	}
+
+	drained, err := s.store.DrainBooks(ids, s.prepareDrain(r))
+	if !handleWriteError(w, err) {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	books, _ := json.Marshal(drained)
+
+	w.Write(books)
 }
 
-func (s *BookStore) DelBook(id string) error {
-	for i, bk := range s.books {
-		if bk.Id == id {
+type FieldChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
 
-			s.books = append(s.books[:i], s.books[i+1:]...)
+// HandleDiffBooks compares two books field by field: /diff/<id1>/<id2>.
+func (s *Server) HandleDiffBooks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
 
-			return nil
+	if r.Method != http.MethodGet {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	ids := strings.SplitN(strings.Replace(r.URL.Path, "/diff/", "", 1), "/", 2)
+
+	if len(ids) != 2 {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "expected /diff/<id1>/<id2>")
+		return
+	}
+
+	ids[0], ids[1] = s.cfg.normalizeId(ids[0]), s.cfg.normalizeId(ids[1])
+
+	books := s.store.FindBooksByIds(ids)
+
+	for i, book := range books {
+		if book == nil {
+			writeError(w, http.StatusNotFound, CodeBookNotFound, fmt.Sprintf("Book with id %s not found", ids[i]))
+			return
 		}
 	}
 
-	return errors.New(fmt.Sprintf("There is no book with id %s", id))
+	changes := make(map[string]FieldChange)
+
+	if books[0].Author != books[1].Author {
+		changes["author"] = FieldChange{From: books[0].Author, To: books[1].Author}
+	}
+
+	if books[0].Name != books[1].Name {
+		changes["name"] = FieldChange{From: books[0].Name, To: books[1].Name}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	diff, _ := json.Marshal(map[string]interface{}{
+		"from":    ids[0],
+		"to":      ids[1],
+		"changes": changes,
+	})
+
+	w.Write(diff)
+}
+
+func (s *Server) HandleSizeBytes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	keyBytes, valueBytes := s.store.SizeBytes()
+
+	w.WriteHeader(http.StatusOK)
+	size, _ := json.Marshal(map[string]int{
+		"key_bytes":   keyBytes,
+		"value_bytes": valueBytes,
+		"total_bytes": keyBytes + valueBytes,
+	})
+
+	w.Write(size)
+}
+
+func (s *Server) HandleCapabilities(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	caps, _ := json.Marshal(s.capabilities())
+
+	w.Write(caps)
+}
+
+// capabilities reports the optional features enabled by the settings of s.
+func (s *Server) capabilities() map[string]interface{} {
+	return map[string]interface{}{
+		"reserved_ids":              s.cfg.reservedPatterns(),
+		"slow_start":                s.cfg.SlowStart.String(),
+		"slow_request_threshold":    s.cfg.SlowRequestThreshold.String(),
+		"large_value_threshold":     s.cfg.LargeValueThreshold,
+		"idempotency_ttl":           s.cfg.IdempotencyTTL.String(),
+		"require_utf8":              s.cfg.RequireUTF8,
+		"empty_value_policy":        s.cfg.EmptyValuePolicy,
+		"trace_requests":            s.cfg.TraceRequests,
+		"allow_metrics_reset":       s.cfg.AllowMetricsReset,
+		"etag_algo":                 s.cfg.ETagAlgo,
+		"normalize_ids":             s.cfg.normalizeSteps(),
+		"id_charset":                s.cfg.IdCharset,
+		"id_prefixes":               s.cfg.idPrefixList(),
+		"tombstone_ttl":             s.cfg.TombstoneTTL.String(),
+		"shards":                    s.cfg.Shards,
+		"key_lock_stripes":          s.cfg.KeyLockStripes,
+		"lock_ttl":                  s.cfg.LockTTL.String(),
+		"webhook_retries":           s.cfg.WebhookRetries,
+		"audit":                     s.cfg.AuditLog != "",
+		"audit_retention":           s.cfg.AuditRetention.String(),
+		"encryption":                s.store.Keyring().Enabled(),
+		"verify_reads":              s.cfg.VerifyReads,
+		"bucket_quotas":             s.bucketQuotas,
+		"bucket_ttls":               s.cfg.BucketTTLs,
+		"middleware_order":          s.cfg.MiddlewareOrder,
+		"route_middleware":          s.cfg.RouteMiddleware,
+		"backup_before_destructive": s.cfg.BackupBeforeDestructive,
+		"server_timing":             s.cfg.ServerTiming,
+		"default_format":            s.cfg.DefaultFormat,
+		"max_body_bytes":            s.cfg.MaxBodyBytes,
+		"max_id_bytes":              s.cfg.MaxIdBytes,
+		"max_value_bytes":           s.cfg.MaxValueBytes,
+		"max_store_bytes":           s.cfg.MaxStoreBytes,
+		"max_memory":                s.cfg.MaxMemory,
+		"eviction_policy":           s.cfg.EvictionPolicy,
+		"value_index":               s.cfg.ValueIndex,
+		"history_depth":             s.cfg.HistoryDepth,
+		"soft_delete":               s.cfg.SoftDelete,
+		"archive_expired":           s.cfg.ArchiveExpired,
+		"debug_addr":                s.cfg.DebugAddr != "",
+		"memcached_addr":            s.cfg.MemcachedAddr,
+		"redis_addr":                s.cfg.RedisAddr,
+		"grpc_addr":                 s.cfg.GRPCAddr,
+		"raft":                      s.cfg.RaftID,
+		"backend":                   s.cfg.Backend,
+		"cache_ttl":                 s.cfg.CacheTTL.String(),
+		"write_behind":              s.cfg.WriteBehind,
+		"ttl_sweep_interval":        s.cfg.TTLSweepInterval.String(),
+		"tls":                       s.cfg.tlsEnabled(),
+		"client_certificates":       s.cfg.ClientCA != "",
+		"api_keys":                  len(s.apiKeys.Current()) > 0,
+		"tenants":                   s.apiKeys.tenantsEnabled(),
+		"cors_origins":              s.cfg.CORSOrigins,
+		"rate_limit":                s.cfg.RateLimit,
+		"write_rate_limit":          s.cfg.WriteRateLimit,
+		"auth_reads":                s.cfg.AuthReads,
+		"replica_of":                s.cfg.ReplicaOf,
+		"peers":                     s.cfg.PeersSpec,
+		"failover_after":            s.cfg.FailoverAfter.String(),
+		"replicating":               s.replicating.Load(),
+		"read_only":                 s.readOnly.Load(),
+		"tracing":                   s.cfg.tracingEnabled(),
+		"read_timeout":              s.cfg.ReadTimeout.String(),
+		"read_header_timeout":       s.cfg.ReadHeaderTimeout.String(),
+		"write_timeout":             s.cfg.WriteTimeout.String(),
+		"idle_timeout":              s.cfg.IdleTimeout.String(),
+		"keep_alives":               s.cfg.KeepAlives,
+		"tcp_keepalive":             s.cfg.TCPKeepAlive.String(),
+		"http2":                     s.cfg.HTTP2 && s.cfg.tlsEnabled(),
+		"h2c":                       s.cfg.H2C,
+		"http2_max_streams":         s.cfg.HTTP2MaxStreams,
+		"bulk_delete_max":           s.cfg.BulkDeleteMax,
+		"script_max_steps":          s.cfg.ScriptMaxSteps,
+		"preload":                   s.cfg.PreloadFile != "",
+		"snapshot_interval":         s.cfg.SnapshotInterval.String(),
+		"s3_snapshots":              s.cfg.s3Enabled(),
+	}
 }
@@ -0,0 +1,1533 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestServer serves the routes of a new server, on a new MemoryStore
+// unless the options give a store, until the test ends.
+func newTestServer(t *testing.T, opts ...ServerOption) (*Server, *httptest.Server) {
+	t.Helper()
+
+	s, err := New(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+// send makes a request with the credentials of the test user and returns
+// the status and body of the answer.
+func send(t *testing.T, method, url, body string) (int, string) {
+	t.Helper()
+
+	status, answer, err := do(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status, answer
+}
+
+// do is send for goroutines other than the test's.
+func do(method, url, body string) (int, string, error) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	req.SetBasicAuth("test", "test")
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	answer, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(answer), err
+}
+
+// sendHead is send for the streaming routes: it returns the status once
+// the headers are in and drops the connection.
+func sendHead(t *testing.T, method, url string) int {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("test", "test")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// acquireLock takes the lock name and returns its lease.
+func acquireLock(t *testing.T, ts *httptest.Server, name string) string {
+	t.Helper()
+
+	status, body := send(t, http.MethodPost, ts.URL+"/locks/"+name, "")
+	if status != http.StatusCreated {
+		t.Fatalf("acquiring lock %s: %d %s", name, status, body)
+	}
+
+	var lock Lock
+	if err := json.Unmarshal([]byte(body), &lock); err != nil {
+		t.Fatal(err)
+	}
+	return lock.LeaseId
+}
+
+// routeTest is one request to a server holding the books a, b and t. The
+// path may name a value setup returns as $.
+type routeTest struct {
+	name     string
+	setup    func(t *testing.T, s *Server, ts *httptest.Server) string
+	method   string
+	path     string
+	body     string
+	noAuth   bool
+	stream   bool
+	status   int
+	contains string
+}
+
+var routeTests = []routeTest{
+	{name: "list books", method: "GET", path: "/books/", status: 200, contains: `"id":"a"`},
+	{name: "list a page", method: "GET", path: "/books/?limit=1", status: 200, contains: `"next_cursor"`},
+	{name: "list with a bad limit", method: "GET", path: "/books/?limit=x", status: 400},
+	{name: "list without credentials", method: "GET", path: "/books/", noAuth: true, status: 401},
+	{name: "list as of version 0", method: "GET", path: "/books/?at=0", status: 200, contains: `[]`},
+
+	{name: "add", method: "POST", path: "/book/", body: `{"id":"c","author":"C","name":"3"}`, status: 200, contains: `"id":"c"`},
+	{name: "add an existing id", method: "POST", path: "/book/", body: `{"id":"a","name":"x"}`, status: 409},
+	{name: "add bad json", method: "POST", path: "/book/", body: `{`, status: 400},
+	{name: "add a reserved id", method: "POST", path: "/book/", body: `{"id":"\u0000x","name":"x"}`, status: 403},
+	{name: "add an id named like an operation", method: "POST", path: "/book/", body: `{"id":"cas","name":"x"}`, status: 200, contains: `"id":"cas"`},
+	{name: "add an id ending in an operation", method: "POST", path: "/book/", body: `{"id":"x/list","name":"x"}`, status: 400},
+	{name: "add an id ending in a version", method: "POST", path: "/book/", body: `{"id":"x/versions/1","name":"x"}`, status: 400},
+	{name: "add without credentials", method: "POST", path: "/book/", body: `{"id":"c","name":"x"}`, noAuth: true, status: 401},
+
+	{name: "get", method: "GET", path: "/book/a", status: 200, contains: `"author":"A"`},
+	{name: "head", method: "HEAD", path: "/book/a", status: 200},
+	{name: "get a book named like an operation", method: "GET", path: "/book/cas", setup: addCas, status: 200, contains: `"id":"cas"`},
+	{name: "swap a book named like an operation", method: "POST", path: "/book/cas/cas", body: `{"old":{"name":"x"},"new":{"name":"y"}}`, setup: addCas, status: 200, contains: `"name":"y"`},
+	{name: "get a missing book", method: "GET", path: "/book/missing", status: 404},
+	{name: "get at a version", method: "GET", path: "/book/a?at=$", setup: firstVersion, status: 200, contains: `"name":"1"`},
+	{name: "get at a version before the book", method: "GET", path: "/book/b?at=1", status: 404, contains: "-history-depth"},
+	{name: "get at a bad point", method: "GET", path: "/book/a?at=never", status: 400},
+
+	{name: "replace", method: "PUT", path: "/book/a", body: `{"author":"A","name":"9"}`, status: 200, contains: `"name":"9"`},
+	{name: "replace a missing book", method: "PUT", path: "/book/missing", body: `{"name":"9"}`, status: 404},
+	{name: "replace if absent", method: "PUT", path: "/book/a?if=absent", body: `{"name":"9"}`, status: 409},
+	{name: "replace with a stale etag", method: "PUT", path: "/book/a?if=version:12345", body: `{"name":"9"}`, status: 412},
+	{name: "replace with a bad condition", method: "PUT", path: "/book/a?if=maybe", body: `{"name":"9"}`, status: 400},
+	{name: "patch is not allowed", method: "PATCH", path: "/book/a", body: `{}`, status: 405},
+
+	{name: "delete", method: "DELETE", path: "/book/a", status: 200},
+	{name: "delete a missing book", method: "DELETE", path: "/book/missing", status: 404},
+
+	{name: "swap", method: "POST", path: "/book/a/cas", body: `{"old":{"author":"A","name":"1"},"new":{"author":"A","name":"2"}}`, status: 200, contains: `"name":"2"`},
+	{name: "swap a changed book", method: "POST", path: "/book/a/cas", body: `{"old":{"author":"A","name":"0"},"new":{"author":"A","name":"2"}}`, status: 409},
+
+	{name: "get content", method: "GET", path: "/book/a/content", setup: putContent, status: 200, contains: "attached"},
+	{name: "get missing content", method: "GET", path: "/book/a/content", status: 404},
+	{name: "put content", method: "PUT", path: "/book/a/content", body: "attached", status: 204},
+	{name: "put content of a missing book", method: "PUT", path: "/book/missing/content", body: "attached", status: 404},
+	{name: "delete content", method: "DELETE", path: "/book/a/content", setup: putContent, status: 204},
+
+	{name: "incr", method: "POST", path: "/book/n/incr?delta=5", status: 200, contains: `"name":"5"`},
+	{name: "incr a bad delta", method: "POST", path: "/book/n/incr?delta=x", status: 400},
+	{name: "incr text", method: "POST", path: "/book/t/incr", status: 409},
+	{name: "decr", method: "POST", path: "/book/a/decr", status: 200, contains: `"name":"0"`},
+
+	{name: "append", method: "POST", path: "/book/t/append", body: `"!"`, status: 200, contains: `"length":6`},
+	{name: "append a non-string", method: "POST", path: "/book/t/append", body: `1`, status: 400},
+	{name: "range", method: "GET", path: "/book/t/range?start=1&end=3", status: 200, contains: `"ell"`},
+	{name: "range of a missing book", method: "GET", path: "/book/missing/range", status: 404},
+	{name: "strlen", method: "GET", path: "/book/t/strlen", status: 200, contains: `"length":5`},
+	{name: "strlen of a missing book", method: "GET", path: "/book/missing/strlen", status: 404},
+
+	{name: "push", method: "POST", path: "/book/l/list", body: `["x","y"]`, status: 200, contains: `"length":2`},
+	{name: "push onto a set", method: "POST", path: "/book/m/list", body: `["x"]`, setup: addMembers, status: 409},
+	{name: "read a list", method: "GET", path: "/book/l/list", setup: pushList, status: 200, contains: `["x","y"]`},
+	{name: "read a missing list", method: "GET", path: "/book/l/list", status: 404},
+	{name: "pop", method: "DELETE", path: "/book/l/list", setup: pushList, status: 200, contains: `"y"`},
+
+	{name: "add members", method: "POST", path: "/book/m/set", body: `["x","y","x"]`, status: 200, contains: `"length":2`},
+	{name: "read a set", method: "GET", path: "/book/m/set", setup: addMembers, status: 200, contains: `"x"`},
+	{name: "read a missing set", method: "GET", path: "/book/m/set", status: 404},
+	{name: "remove members", method: "DELETE", path: "/book/m/set", body: `["x"]`, setup: addMembers, status: 200, contains: `"length":1`},
+
+	{name: "history", method: "GET", path: "/book/a/history", setup: replaceA, status: 200, contains: `"name":"1"`},
+	{name: "version", method: "GET", path: "/book/a/versions/$", setup: firstVersion, status: 200, contains: `"name":"1"`},
+	{name: "bad version", method: "GET", path: "/book/a/versions/x", status: 400},
+	{name: "rollback", method: "POST", path: "/book/a/rollback?version=$", setup: firstVersion, status: 200, contains: `"name":"1"`},
+	{name: "rollback without a version", method: "POST", path: "/book/a/rollback", status: 400},
+	{name: "restore a book that was not soft-deleted", method: "POST", path: "/book/a/restore", status: 404},
+
+	{name: "match ids", method: "GET", path: "/list?match=a*", status: 200, contains: `["a"]`},
+	{name: "match a bad regex", method: "GET", path: "/list?regex=(", status: 400},
+	{name: "delete matching ids", method: "DELETE", path: "/list?match=*", status: 200, contains: `"deleted":3`},
+	{name: "dry run", method: "DELETE", path: "/list?match=*&dry_run=true", status: 200, contains: `"deleted":0`},
+
+	{name: "drain", method: "POST", path: "/drain/", body: `["a","missing"]`, status: 200, contains: `"id":"a"`},
+	{name: "drain bad json", method: "POST", path: "/drain/", body: `{}`, status: 400},
+
+	{name: "diff", method: "GET", path: "/diff/a/b", status: 200, contains: `"from":"1"`},
+	{name: "diff a missing book", method: "GET", path: "/diff/a/missing", status: 404},
+	{name: "diff one id", method: "GET", path: "/diff/a", status: 400},
+
+	{name: "batch", method: "POST", path: "/batch", body: `[{"op":"put","book":{"id":"c","name":"3"}},{"op":"delete","book":{"id":"a"}}]`, status: 200},
+	{name: "batch with a failing op", method: "POST", path: "/batch", body: `[{"op":"put","book":{"id":"c","name":"3"}},{"op":"delete","book":{"id":"missing"}}]`, status: 409},
+	{name: "batch bad json", method: "POST", path: "/batch", body: `{}`, status: 400},
+
+	{name: "txn", method: "POST", path: "/txn", body: `{"compare":[{"id":"a","if":"exists"}],"success":[{"op":"get","book":{"id":"a"}}]}`, status: 200, contains: `"succeeded":true`},
+	{name: "txn with an unknown op", method: "POST", path: "/txn", body: `{"success":[{"op":"zap","book":{"id":"a"}}]}`, status: 400},
+
+	{name: "search", method: "GET", path: "/search?value=hello", status: 200, contains: `"id":"t"`},
+	{name: "search without a query", method: "GET", path: "/search", status: 400},
+
+	{name: "export", method: "GET", path: "/export", status: 200, contains: `"id":"b"`},
+	{name: "export csv", method: "GET", path: "/export?format=csv", status: 200, contains: "b,B,2"},
+	{name: "export tar", method: "GET", path: "/export?format=tar", status: 200, contains: "ustar"},
+	{name: "export sql", method: "GET", path: "/export?format=sql", status: 200, contains: "INSERT INTO kv (key, value) VALUES ('b', "},
+	{name: "import sql", method: "POST", path: "/import?format=sql", body: "", status: 400},
+	{name: "export an unknown format", method: "GET", path: "/export?format=xml", status: 400},
+	{name: "import", method: "POST", path: "/import", body: `{"id":"c","name":"3"}` + "\n", status: 200},
+	{name: "import bad lines", method: "POST", path: "/import", body: "{\n", status: 400},
+
+	{name: "watch", method: "GET", path: "/watch?prefix=a", stream: true, status: 200},
+	{name: "watch a book", method: "GET", path: "/watch/a", stream: true, status: 200},
+	{name: "ws without an upgrade", method: "GET", path: "/ws", status: 400},
+
+	{name: "publish", method: "POST", path: "/publish/news", body: `"hi"`, status: 200, contains: `"receivers":0`},
+	{name: "subscribe", method: "GET", path: "/subscribe/news", stream: true, status: 200},
+
+	{name: "bucket books", method: "GET", path: "/bucket/shelf/books/", setup: putShelf, status: 200, contains: `"id":"x"`},
+	{name: "bad bucket name", method: "GET", path: "/bucket/a%20b/books/", status: 400},
+	{name: "bucket stats", method: "GET", path: "/bucket/shelf/stats", setup: putShelf, status: 200, contains: `"books":1`},
+	{name: "bucket export", method: "GET", path: "/bucket/shelf/export", setup: putShelf, status: 200, contains: `"id":"x"`},
+	{name: "delete a bucket", method: "DELETE", path: "/bucket/shelf", setup: putShelf, status: 200, contains: `"deleted":1`},
+	{name: "get a bucket book", method: "GET", path: "/bucket/shelf/book/x", setup: putShelf, status: 200, contains: `"id":"x"`},
+	{name: "get a missing bucket book", method: "GET", path: "/bucket/shelf/book/x", status: 404},
+	{name: "put a bucket book", method: "PUT", path: "/bucket/shelf/book/x", body: `{"name":"y"}`, status: 200, contains: `"name":"y"`},
+	{name: "delete a bucket book", method: "DELETE", path: "/bucket/shelf/book/x", setup: putShelf, status: 200},
+	{name: "delete a missing bucket book", method: "DELETE", path: "/bucket/shelf/book/x", status: 404},
+
+	{name: "acquire a lock", method: "POST", path: "/locks/l?owner=me", status: 201, contains: `"lease_id"`},
+	{name: "acquire a held lock", method: "POST", path: "/locks/l", setup: holdLock, status: 409},
+	{name: "read a lock", method: "GET", path: "/locks/l", setup: holdLock, status: 200, contains: `"name":"l"`},
+	{name: "read a free lock", method: "GET", path: "/locks/l", status: 404},
+	{name: "keep a lease alive", method: "PUT", path: "/leases/$/keepalive", setup: holdLock, status: 200},
+	{name: "keep a missing lease alive", method: "PUT", path: "/leases/missing/keepalive", status: 404},
+	{name: "release a lease", method: "DELETE", path: "/leases/$", setup: holdLock, status: 204},
+	{name: "release a missing lease", method: "DELETE", path: "/leases/missing", status: 404},
+
+	{name: "list scripts", method: "GET", path: "/scripts/", setup: storeScript, status: 200, contains: `"name":"inc"`},
+	{name: "read a script", method: "GET", path: "/scripts/inc", setup: storeScript, status: 200, contains: `"source"`},
+	{name: "read a missing script", method: "GET", path: "/scripts/inc", status: 404},
+	{name: "store a script", method: "PUT", path: "/scripts/inc", body: incScript, status: 200},
+	{name: "store a script that does not parse", method: "PUT", path: "/scripts/inc", body: "(put", status: 400},
+	{name: "delete a script", method: "DELETE", path: "/scripts/inc", setup: storeScript, status: 204},
+	{name: "delete a missing script", method: "DELETE", path: "/scripts/inc", status: 404},
+	{name: "run a script", method: "POST", path: "/scripts/inc/run", body: `{"args":["a"]}`, setup: storeScript, status: 200, contains: `"writes":1`},
+	{name: "run a missing script", method: "POST", path: "/scripts/inc/run", body: `{"args":["a"]}`, status: 404},
+	{name: "eval", method: "POST", path: "/eval", body: `{"script":"(+ 1 2)"}`, status: 200, contains: `"result":3`},
+	{name: "eval an error", method: "POST", path: "/eval", body: `{"script":"(error \"no\")"}`, status: 400},
+
+	{name: "snapshot", method: "POST", path: "/snapshot", status: 200, contains: `"name":"books-`},
+	{name: "restore without a name", method: "POST", path: "/restore", status: 400},
+	{name: "restore a missing snapshot", method: "POST", path: "/restore?name=missing.json", status: 404},
+	{name: "size", method: "GET", path: "/size-bytes", status: 200, contains: `"key_bytes"`},
+	{name: "capabilities", method: "GET", path: "/capabilities", status: 200, contains: `"backend"`},
+	{name: "replication stream", method: "GET", path: "/replication/stream", stream: true, status: 200},
+
+	{name: "promote a primary", method: "POST", path: "/admin/promote", status: 409},
+	{name: "purge", method: "POST", path: "/admin/purge", status: 200, contains: `"purged":0`},
+	{name: "set a ttl", method: "POST", path: "/admin/set-ttl", body: `{"pattern":"[ab]","ttl":"1h"}`, status: 200, contains: `"updated":2`},
+	{name: "stats", method: "GET", path: "/admin/stats", status: 200},
+	{name: "stats without credentials", method: "GET", path: "/admin/stats", noAuth: true, status: 401},
+	{name: "flush", method: "POST", path: "/admin/flush", status: 200, contains: `"flushed":3`},
+	{name: "read-only state", method: "GET", path: "/admin/read-only", status: 200, contains: `"read_only":false`},
+	{name: "switch writes on", method: "PUT", path: "/admin/read-only", body: `{"read_only":false}`, status: 200},
+	{name: "read-only bad json", method: "PUT", path: "/admin/read-only", body: `{`, status: 400},
+	{name: "reencrypt without keys", method: "POST", path: "/admin/reencrypt", status: 200, contains: `"encrypted":false`},
+	{name: "verify", method: "POST", path: "/admin/verify", status: 200},
+	{name: "quotas", method: "GET", path: "/admin/quotas", status: 200},
+	{name: "preload without a file", method: "POST", path: "/admin/preload", status: 404},
+	{name: "raft without a cluster", method: "GET", path: "/admin/raft", status: 404},
+	{name: "raft join without a cluster", method: "POST", path: "/admin/raft/join", body: `{"id":"http://b","address":"b:7000"}`, status: 404},
+	{name: "raft leave without a cluster", method: "POST", path: "/admin/raft/leave", body: `{"id":"http://b"}`, status: 404},
+	{name: "raft snapshot without a cluster", method: "POST", path: "/admin/raft/snapshot", status: 404},
+
+	{name: "metrics", method: "GET", path: "/metrics", noAuth: true, status: 200},
+	{name: "ui", method: "GET", path: "/", noAuth: true, status: 200},
+	{name: "healthz", method: "GET", path: "/healthz", noAuth: true, status: 200},
+	{name: "readyz before serving", method: "GET", path: "/readyz", noAuth: true, status: 503},
+	{name: "openapi", method: "GET", path: "/openapi.json", status: 200, contains: `"openapi"`},
+	{name: "docs", method: "GET", path: "/docs", status: 200},
+}
+
+const incScript = `(put (nth args 0) "" (str (+ 1 (int (field (get (nth args 0)) "name")))))`
+
+func putContent(t *testing.T, s *Server, ts *httptest.Server) string {
+	if status, body := send(t, http.MethodPut, ts.URL+"/book/a/content", "attached"); status != http.StatusNoContent {
+		t.Fatalf("putting content: %d %s", status, body)
+	}
+	return ""
+}
+
+func addCas(t *testing.T, s *Server, ts *httptest.Server) string {
+	if err := s.store.AddBook(Book{Id: "cas", Name: "x"}); err != nil {
+		t.Fatal(err)
+	}
+	return ""
+}
+
+func pushList(t *testing.T, s *Server, ts *httptest.Server) string {
+	if status, body := send(t, http.MethodPost, ts.URL+"/book/l/list", `["x","y"]`); status != http.StatusOK {
+		t.Fatalf("pushing: %d %s", status, body)
+	}
+	return ""
+}
+
+func addMembers(t *testing.T, s *Server, ts *httptest.Server) string {
+	if status, body := send(t, http.MethodPost, ts.URL+"/book/m/set", `["x","y"]`); status != http.StatusOK {
+		t.Fatalf("adding members: %d %s", status, body)
+	}
+	return ""
+}
+
+func replaceA(t *testing.T, s *Server, ts *httptest.Server) string {
+	if err := s.store.SetBook(Book{Id: "a", Author: "A", Name: "changed"}); err != nil {
+		t.Fatal(err)
+	}
+	return ""
+}
+
+func firstVersion(t *testing.T, s *Server, ts *httptest.Server) string {
+	version := s.store.FindBookById("a").Version
+	replaceA(t, s, ts)
+	return fmt.Sprint(version)
+}
+
+func putShelf(t *testing.T, s *Server, ts *httptest.Server) string {
+	if status, body := send(t, http.MethodPut, ts.URL+"/bucket/shelf/book/x", `{"name":"y"}`); status != http.StatusOK {
+		t.Fatalf("putting a bucket book: %d %s", status, body)
+	}
+	return ""
+}
+
+func holdLock(t *testing.T, s *Server, ts *httptest.Server) string {
+	return acquireLock(t, ts, "l")
+}
+
+func storeScript(t *testing.T, s *Server, ts *httptest.Server) string {
+	if status, body := send(t, http.MethodPut, ts.URL+"/scripts/inc", incScript); status != http.StatusOK {
+		t.Fatalf("storing a script: %d %s", status, body)
+	}
+	return ""
+}
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "books-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the default -snapshot-dir is relative, so snapshots land under dir
+	if err := os.Chdir(dir); err != nil {
+		log.Fatal(err)
+	}
+	code := m.Run()
+
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestRoutes(t *testing.T) {
+	for _, tt := range routeTests {
+		t.Run(tt.name, func(t *testing.T) { tt.run(t) })
+	}
+}
+
+// run makes the request of tt to a new server holding the books a, b and
+// t.
+func (tt routeTest) run(t *testing.T) {
+	store := NewMemoryStore(4, 0)
+	store.KeepHistory(4)
+	s, ts := newTestServer(t, WithStore(store))
+
+	for _, book := range []Book{{Id: "a", Author: "A", Name: "1"}, {Id: "b", Author: "B", Name: "2"}, {Id: "t", Name: "hello"}} {
+		if err := s.store.AddBook(book); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := tt.path
+	if tt.setup != nil {
+		path = strings.ReplaceAll(path, "$", tt.setup(t, s, ts))
+	}
+
+	if tt.stream {
+		if status := sendHead(t, tt.method, ts.URL+path); status != tt.status {
+			t.Fatalf("%s %s = %d, want %d", tt.method, path, status, tt.status)
+		}
+		return
+	}
+
+	var status int
+	var body string
+	if tt.noAuth {
+		req, err := http.NewRequest(tt.method, ts.URL+path, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		answer, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		status, body = resp.StatusCode, string(answer)
+	} else {
+		status, body = send(t, tt.method, ts.URL+path, tt.body)
+	}
+
+	if status != tt.status {
+		t.Fatalf("%s %s = %d %s, want %d", tt.method, path, status, body, tt.status)
+	}
+	if !strings.Contains(body, tt.contains) {
+		t.Errorf("%s %s answered %s, want it to contain %s", tt.method, path, body, tt.contains)
+	}
+}
+
+var pathParam = regexp.MustCompile(`\{[a-z]+\}`)
+
+// TestRoutesCoverAPI checks that routeTests calls every operation
+// /openapi.json lists.
+func TestRoutesCoverAPI(t *testing.T) {
+	for _, op := range apiOperations {
+		route := regexp.MustCompile("^" + pathParam.ReplaceAllString(op.path, `[^/?]+`) + `(\?.*)?$`)
+
+		covered := false
+		for _, tt := range routeTests {
+			if strings.EqualFold(tt.method, op.method) && route.MatchString(tt.path) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			t.Errorf("no route test calls %s %s", strings.ToUpper(op.method), op.path)
+		}
+	}
+}
+
+func TestConcurrentIncrements(t *testing.T) {
+	s, ts := newTestServer(t)
+
+	const writers, increments = 8, 25
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				if status, body, err := do(http.MethodPost, ts.URL+"/book/n/incr", ""); err != nil || status != http.StatusOK {
+					t.Errorf("incr: %d %s %v", status, body, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if book := s.store.FindBookById("n"); book == nil || book.Name != fmt.Sprint(writers*increments) {
+		t.Errorf("n = %+v, want %d", book, writers*increments)
+	}
+}
+
+func TestConcurrentLocks(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	const contenders = 16
+
+	var mu sync.Mutex
+	acquired := 0
+
+	var wg sync.WaitGroup
+	for i := 0; i < contenders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status, body, err := do(http.MethodPost, ts.URL+"/locks/l", "")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			switch status {
+			case http.StatusCreated:
+				mu.Lock()
+				acquired++
+				mu.Unlock()
+			case http.StatusConflict:
+			default:
+				t.Errorf("lock: %d %s", status, body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if acquired != 1 {
+		t.Errorf("%d contenders acquired the lock, want 1", acquired)
+	}
+}
+
+func TestConcurrentBatchesAreAtomic(t *testing.T) {
+	s, ts := newTestServer(t)
+
+	const writers = 8
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name := fmt.Sprint(i)
+			body := fmt.Sprintf(`[{"op":"put","book":{"id":"x","name":%q}},{"op":"put","book":{"id":"y","name":%q}}]`, name, name)
+
+			for j := 0; j < 20; j++ {
+				if status, answer, err := do(http.MethodPost, ts.URL+"/batch", body); err != nil || status != http.StatusOK {
+					t.Errorf("batch: %d %s %v", status, answer, err)
+					return
+				}
+			}
+		}()
+	}
+
+	stop, read := make(chan struct{}), make(chan struct{})
+	var torn []string
+	go func() {
+		defer close(read)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			status, answer, err := do(http.MethodPost, ts.URL+"/txn", `{"success":[{"op":"get","book":{"id":"x"}},{"op":"get","book":{"id":"y"}}]}`)
+			if err != nil || status != http.StatusOK {
+				continue
+			}
+
+			var txn TxnResponse
+			if json.Unmarshal([]byte(answer), &txn) != nil || txn.Results[0].Book == nil || txn.Results[1].Book == nil {
+				continue
+			}
+			if txn.Results[0].Book.Name != txn.Results[1].Book.Name {
+				torn = append(torn, answer)
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(stop)
+	<-read
+
+	if len(torn) > 0 {
+		t.Errorf("a txn read x and y from different batches: %s", torn[0])
+	}
+	if x, y := s.store.FindBookById("x"), s.store.FindBookById("y"); x == nil || y == nil || x.Name != y.Name {
+		t.Errorf("x = %+v and y = %+v after the batches", x, y)
+	}
+}
+
+// dialWebSocket opens /ws on ts with the credentials of the test user.
+func dialWebSocket(t *testing.T, ts *httptest.Server) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: books\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\nAuthorization: Basic dGVzdDp0ZXN0\r\n\r\n")
+
+	in := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(in, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade = %d, want 101", resp.StatusCode)
+	}
+	return conn, in
+}
+
+// wsRoundTrip sends req as a masked text frame and reads the answer, which
+// fits in a short frame.
+func wsRoundTrip(t *testing.T, conn net.Conn, in *bufio.Reader, req WSRequest) WSResponse {
+	t.Helper()
+
+	payload, _ := json.Marshal(req)
+	mask := []byte{1, 2, 3, 4}
+
+	frame := []byte{0x80 | opText, 0x80 | 126, byte(len(payload) >> 8), byte(len(payload))}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(in, header); err != nil {
+		t.Fatal(err)
+	}
+	n := int(header[1] & 0x7f)
+	if n == 126 {
+		size := make([]byte, 2)
+		if _, err := io.ReadFull(in, size); err != nil {
+			t.Fatal(err)
+		}
+		n = int(size[0])<<8 | int(size[1])
+	}
+
+	answer := make([]byte, n)
+	if _, err := io.ReadFull(in, answer); err != nil {
+		t.Fatal(err)
+	}
+
+	var resp WSResponse
+	if err := json.Unmarshal(answer, &resp); err != nil {
+		t.Fatalf("%v: %s", err, answer)
+	}
+	return resp
+}
+
+func TestWebSocket(t *testing.T) {
+	s, ts := newTestServer(t)
+	conn, in := dialWebSocket(t, ts)
+
+	tests := []struct {
+		req    WSRequest
+		name   string
+		errors bool
+	}{
+		{req: WSRequest{Op: "get", Id: "a"}, errors: true},
+		{req: WSRequest{Op: "put", Id: "a", Book: Book{Author: "A", Name: "1"}}, name: "1"},
+		{req: WSRequest{Op: "get", Id: "a"}, name: "1"},
+		{req: WSRequest{Op: "put", Id: "\x00a", Book: Book{Name: "1"}}, errors: true},
+		{req: WSRequest{Op: "delete", Id: "a"}},
+		{req: WSRequest{Op: "delete", Id: "a"}, errors: true},
+		{req: WSRequest{Op: "zap", Id: "a"}, errors: true},
+	}
+
+	for i, tt := range tests {
+		tt.req.Ref = fmt.Sprint(i)
+		resp := wsRoundTrip(t, conn, in, tt.req)
+
+		if resp.Ref != tt.req.Ref {
+			t.Errorf("%s %s: ref = %q, want %q", tt.req.Op, tt.req.Id, resp.Ref, tt.req.Ref)
+		}
+		if (resp.Error != "") != tt.errors {
+			t.Errorf("%s %s: error = %q", tt.req.Op, tt.req.Id, resp.Error)
+		}
+		if tt.name != "" && (resp.Book == nil || resp.Book.Name != tt.name) {
+			t.Errorf("%s %s: book = %+v, want name %s", tt.req.Op, tt.req.Id, resp.Book, tt.name)
+		}
+	}
+
+	if s.store.FindBookById("a") != nil {
+		t.Error("book a is still there after the delete")
+	}
+}
+
+func TestStalledWatcherDoesNotHoldUpWrites(t *testing.T) {
+	s, ts := newTestServer(t)
+	watchers := s.store.Watchers()
+
+	stalled := watchers.Subscribe("", "stalled/", 1)
+	defer watchers.Unsubscribe(stalled)
+	reader := watchers.Subscribe("", "stalled/", 20)
+	defer watchers.Unsubscribe(reader)
+
+	dropped := watchers.Dropped()
+
+	for i := range 20 {
+		if status, body := send(t, "POST", ts.URL+"/book/", fmt.Sprintf(`{"id":"stalled/%d","name":"x"}`, i)); status != 200 {
+			t.Fatalf("write %d = %d %s", i, status, body)
+		}
+	}
+
+	if n := len(reader.Events()); n != 20 {
+		t.Errorf("the reading watcher got %d events, want 20", n)
+	}
+	if n := watchers.Dropped() - dropped; n != 1 {
+		t.Errorf("dropped %d events, want 1", n)
+	}
+
+	_, body := send(t, "GET", ts.URL+"/metrics", "")
+	if want := fmt.Sprint("bookstore_watch_events_dropped_total ", watchers.Dropped()); !strings.Contains(body, want) {
+		t.Errorf("metrics without %q", want)
+	}
+}
+
+func TestSplitBookPath(t *testing.T) {
+	tests := []struct {
+		path    string
+		id      string
+		op      string
+		version string
+	}{
+		{path: "a", id: "a"},
+		{path: "cas", id: "cas"},
+		{path: "a/cas", id: "a", op: "cas"},
+		{path: "cas/cas", id: "cas", op: "cas"},
+		{path: "shelf/a", id: "shelf/a"},
+		{path: "shelf/a/incr", id: "shelf/a", op: "incr"},
+		{path: "a/versions/3", id: "a", op: "versions", version: "3"},
+		{path: "versions/3", id: "versions/3"},
+		{path: "a/versions/3/x", id: "a/versions/3/x"},
+		{path: "a/unknown", id: "a/unknown"},
+		{path: "", id: ""},
+	}
+
+	for _, tt := range tests {
+		id, op, version := splitBookPath(tt.path)
+		if id != tt.id || op != tt.op || version != tt.version {
+			t.Errorf("splitBookPath(%q) = %q, %q, %q, want %q, %q, %q", tt.path, id, op, version, tt.id, tt.op, tt.version)
+		}
+	}
+}
+
+func TestReservedIds(t *testing.T) {
+	tests := []struct {
+		name         string
+		method, path string
+		body         string
+		status       int
+		names        map[string]string // of the books afterwards, "" for none
+	}{
+		{name: "add a reserved id", method: "POST", path: "/book/", body: `{"id":"staging:b","name":"x"}`, status: 403, names: map[string]string{"staging:b": ""}},
+		{name: "add an id the pattern does not match", method: "POST", path: "/book/", body: `{"id":"stagingb","name":"x"}`, status: 200, names: map[string]string{"stagingb": "x"}},
+		{name: "add an id of the second pattern", method: "POST", path: "/book/", body: `{"id":"sys.b","name":"x"}`, status: 403, names: map[string]string{"sys.b": ""}},
+		{name: "replace a reserved id", method: "PUT", path: "/book/staging:a", body: `{"name":"x"}`, status: 403, names: map[string]string{"staging:a": "internal"}},
+		{name: "delete a reserved id", method: "DELETE", path: "/book/staging:a", status: 403, names: map[string]string{"staging:a": "internal"}},
+		{name: "batch with a reserved id", method: "POST", path: "/batch", body: `[{"op":"put","book":{"id":"c","name":"3"}},{"op":"put","book":{"id":"staging:c","name":"3"}}]`, status: 403, names: map[string]string{"c": "", "staging:c": ""}},
+		{name: "drain a reserved id", method: "POST", path: "/drain/", body: `["a","staging:a"]`, status: 403, names: map[string]string{"a": "1", "staging:a": "internal"}},
+		{name: "read a book stored internally", method: "GET", path: "/book/staging:a", status: 200, names: map[string]string{"staging:a": "internal"}},
+	}
+
+	cfg := DefaultConfig()
+	cfg.ReservedIds = "staging:*, sys.*"
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ts := newTestServer(t, WithConfig(cfg))
+			s.store.AddBook(Book{Id: "a", Name: "1"})
+			// the way internal features store them, past the check
+			s.store.AddBook(Book{Id: "staging:a", Name: "internal"})
+
+			status, body := send(t, tt.method, ts.URL+tt.path, tt.body)
+			if status != tt.status {
+				t.Fatalf("%s %s = %d %s, want %d", tt.method, tt.path, status, body, tt.status)
+			}
+			if status == http.StatusForbidden && !strings.Contains(body, CodeReservedId) {
+				t.Errorf("refused with %s, want %s", body, CodeReservedId)
+			}
+
+			for id, want := range tt.names {
+				name := ""
+				if book := s.store.FindBookById(id); book != nil {
+					name = book.Name
+				}
+				if name != want {
+					t.Errorf("%s is named %q, want %q", id, name, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDrain(t *testing.T) {
+	tests := []struct {
+		name        string
+		ids         []string
+		wantDrained []string
+		wantLeft    []string
+	}{
+		{name: "one book", ids: []string{"a"}, wantDrained: []string{"a"}, wantLeft: []string{"b", "t"}},
+		{name: "several books", ids: []string{"b", "a"}, wantDrained: []string{"b", "a"}, wantLeft: []string{"t"}},
+		{name: "missing books are skipped", ids: []string{"missing", "t"}, wantDrained: []string{"t"}, wantLeft: []string{"a", "b"}},
+		{name: "an id twice", ids: []string{"a", "a"}, wantDrained: []string{"a"}, wantLeft: []string{"b", "t"}},
+		{name: "nothing", ids: []string{}, wantDrained: []string{}, wantLeft: []string{"a", "b", "t"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ts := newTestServer(t)
+			for _, book := range []Book{{Id: "a", Name: "1"}, {Id: "b", Name: "2"}, {Id: "t", Name: "hello"}} {
+				s.store.AddBook(book)
+			}
+
+			ids, _ := json.Marshal(tt.ids)
+			status, body := send(t, http.MethodPost, ts.URL+"/drain/", string(ids))
+			if status != http.StatusOK {
+				t.Fatalf("status %d: %s", status, body)
+			}
+
+			var drained []Book
+			if err := json.Unmarshal([]byte(body), &drained); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0)
+			for _, book := range drained {
+				got = append(got, book.Id)
+				if book.Name == "" {
+					t.Errorf("drained %s without its value", book.Id)
+				}
+			}
+			if !slices.Equal(got, tt.wantDrained) {
+				t.Errorf("drained %v, want %v", got, tt.wantDrained)
+			}
+
+			left := make([]string, 0)
+			books, _ := s.store.GetBooks(t.Context())
+			for _, book := range books {
+				left = append(left, book.Id)
+			}
+			slices.Sort(left)
+			if !slices.Equal(left, tt.wantLeft) {
+				t.Errorf("left %v, want %v", left, tt.wantLeft)
+			}
+		})
+	}
+}
+
+// TestConcurrentDrainsDeliverOnce has clients drain overlapping ids at
+// once; every book must reach exactly one of them.
+func TestConcurrentDrainsDeliverOnce(t *testing.T) {
+	s, ts := newTestServer(t)
+
+	const books, clients = 200, 8
+
+	ids := make([]string, books)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("job-%03d", i)
+		s.store.AddBook(Book{Id: ids[i], Name: "work"})
+	}
+
+	var mu sync.Mutex
+	delivered := make(map[string]int)
+
+	var wg sync.WaitGroup
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// windows of 20 ids overlapping by 10
+			for start := 0; start < books; start += 10 {
+				body, _ := json.Marshal(ids[start:min(start+20, books)])
+				status, answer, err := do(http.MethodPost, ts.URL+"/drain/", string(body))
+				if err != nil || status != http.StatusOK {
+					t.Errorf("drain: %d %s %v", status, answer, err)
+					return
+				}
+
+				var drained []Book
+				json.Unmarshal([]byte(answer), &drained)
+
+				mu.Lock()
+				for _, book := range drained {
+					delivered[book.Id]++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, id := range ids {
+		if delivered[id] != 1 {
+			t.Errorf("%s delivered %d times", id, delivered[id])
+		}
+	}
+}
+
+func TestRequireUTF8(t *testing.T) {
+	const invalid = "\xff\xfe"
+
+	tests := []struct {
+		name        string
+		requireUTF8 bool
+		method      string
+		path        string
+		body        string
+		status      int
+		id          string // of the book written
+		was         string // its name before, "" for none
+		written     bool
+	}{
+		{name: "add valid UTF-8", requireUTF8: true, method: "POST", path: "/book/", body: `{"id":"c","name":"héllo, 世界"}`, status: 200, id: "c", written: true},
+		{name: "add invalid UTF-8", requireUTF8: true, method: "POST", path: "/book/", body: `{"id":"c","name":"` + invalid + `"}`, status: 400, id: "c"},
+		{name: "add invalid UTF-8 without the flag", method: "POST", path: "/book/", body: `{"id":"c","name":"` + invalid + `"}`, status: 200, id: "c", written: true},
+		{name: "replace with valid UTF-8", requireUTF8: true, method: "PUT", path: "/book/a", body: `{"name":"ünï"}`, status: 200, id: "a", was: "1", written: true},
+		{name: "replace with invalid UTF-8", requireUTF8: true, method: "PUT", path: "/book/a", body: `{"name":"` + invalid + `"}`, status: 400, id: "a", was: "1"},
+		{name: "replace with invalid UTF-8 without the flag", method: "PUT", path: "/book/a", body: `{"name":"` + invalid + `"}`, status: 200, id: "a", was: "1", written: true},
+		{name: "append valid UTF-8", requireUTF8: true, method: "POST", path: "/book/t/append", body: `"é"`, status: 200, id: "t", was: "hello", written: true},
+		{name: "append invalid UTF-8", requireUTF8: true, method: "POST", path: "/book/t/append", body: `"` + invalid + `"`, status: 400, id: "t", was: "hello"},
+		{name: "append invalid UTF-8 without the flag", method: "POST", path: "/book/t/append", body: `"` + invalid + `"`, status: 200, id: "t", was: "hello", written: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.RequireUTF8 = tt.requireUTF8
+
+			s, ts := newTestServer(t, WithConfig(cfg))
+			s.store.AddBook(Book{Id: "a", Name: "1"})
+			s.store.AddBook(Book{Id: "t", Name: "hello"})
+
+			status, body := send(t, tt.method, ts.URL+tt.path, tt.body)
+			if status != tt.status {
+				t.Fatalf("status %d %s, want %d", status, body, tt.status)
+			}
+			if status == http.StatusBadRequest && !strings.Contains(body, "UTF-8") {
+				t.Errorf("refused with %s, want it to name UTF-8", body)
+			}
+
+			name := ""
+			if book := s.store.FindBookById(tt.id); book != nil {
+				name = book.Name
+			}
+			if (name != tt.was) != tt.written {
+				t.Errorf("%s is named %q after the write, was %q, want written %v", tt.id, name, tt.was, tt.written)
+			}
+		})
+	}
+}
+
+func TestSortBooks(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		want   []string
+	}{
+		{name: "insertion order", query: "", status: 200, want: []string{"c", "a", "b"}},
+		{name: "by id", query: "sort=id", status: 200, want: []string{"a", "b", "c"}},
+		{name: "by id descending", query: "sort=id&order=desc", status: 200, want: []string{"c", "b", "a"}},
+		{name: "by author", query: "sort=author&order=asc", status: 200, want: []string{"c", "b", "a"}},
+		{name: "by author descending", query: "sort=author&order=desc", status: 200, want: []string{"a", "b", "c"}},
+		{name: "by name", query: "sort=name", status: 200, want: []string{"b", "c", "a"}},
+		{name: "by name descending", query: "sort=name&order=desc", status: 200, want: []string{"a", "c", "b"}},
+		{name: "an order alone sorts by id", query: "order=desc", status: 200, want: []string{"c", "b", "a"}},
+		{name: "an unknown field", query: "sort=price", status: 400},
+		{name: "an unknown order", query: "sort=id&order=up", status: 400},
+	}
+
+	s, ts := newTestServer(t)
+	for _, book := range []Book{{Id: "c", Author: "Ann", Name: "2"}, {Id: "a", Author: "Cy", Name: "3"}, {Id: "b", Author: "Bo", Name: "1"}} {
+		s.store.AddBook(book)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := send(t, http.MethodGet, ts.URL+"/books/?"+tt.query, "")
+			if status != tt.status {
+				t.Fatalf("status %d, want %d: %s", status, tt.status, body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			var books []Book
+			if err := json.Unmarshal([]byte(body), &books); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0)
+			for _, book := range books {
+				got = append(got, book.Id)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConditionalUpdate(t *testing.T) {
+	tests := []struct {
+		name    string
+		id      string
+		cond    string // %d is the version of a
+		status  int
+		code    string
+		written bool // whether the book is named 9 afterwards
+	}{
+		{name: "exists, met", id: "a", cond: "exists", status: 200, written: true},
+		// Update-only and create-only writes fail as a plain PUT and POST do.
+		{name: "exists, unmet", id: "missing", cond: "exists", status: 404, code: CodeBookNotFound},
+		{name: "present, met", id: "a", cond: "present", status: 200, written: true},
+		{name: "absent, met", id: "c", cond: "absent", status: 200, written: true},
+		{name: "absent, unmet", id: "a", cond: "absent", status: 409, code: CodeBookExists},
+		{name: "eq, met", id: "a", cond: "eq:1", status: 200, written: true},
+		{name: "eq, unmet", id: "a", cond: "eq:2", status: 412, code: CodePreconditionFailed},
+		{name: "ne, met", id: "a", cond: "ne:2", status: 200, written: true},
+		{name: "ne, unmet", id: "a", cond: "ne:1", status: 412, code: CodePreconditionFailed},
+		{name: "version, met", id: "a", cond: "version:%d", status: 200, written: true},
+		{name: "version, unmet", id: "a", cond: "version:12345", status: 412, code: CodePreconditionFailed},
+		{name: "an unknown condition", id: "a", cond: "maybe", status: 400},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ts := newTestServer(t)
+			s.store.AddBook(Book{Id: "a", Name: "1"})
+
+			cond := tt.cond
+			if strings.Contains(cond, "%d") {
+				cond = fmt.Sprintf(cond, s.store.FindBookById("a").Version)
+			}
+
+			status, body := send(t, http.MethodPut, ts.URL+"/book/"+tt.id+"?if="+cond, `{"name":"9"}`)
+			if status != tt.status || !strings.Contains(body, tt.code) {
+				t.Fatalf("PUT ?if=%s = %d %s, want %d %s", cond, status, body, tt.status, tt.code)
+			}
+
+			book := s.store.FindBookById(tt.id)
+			if written := book != nil && book.Name == "9"; written != tt.written {
+				t.Errorf("%s written is %v, want %v", tt.id, written, tt.written)
+			}
+		})
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	tests := []struct {
+		name  string
+		set   func(s *Server) func() // sets a feature of s and returns what undoes it
+		key   string
+		want  any
+		never string // a secret that must not be reported
+	}{
+		{name: "defaults", set: func(s *Server) func() { return func() {} }, key: "require_utf8", want: false},
+		{
+			name: "require utf8",
+			set: func(s *Server) func() {
+				s.cfg.RequireUTF8 = true
+				return func() { s.cfg.RequireUTF8 = false }
+			},
+			key:  "require_utf8",
+			want: true,
+		},
+		{
+			name: "empty value policy",
+			set: func(s *Server) func() {
+				old := s.cfg.EmptyValuePolicy
+				s.cfg.EmptyValuePolicy = "reject"
+				return func() { s.cfg.EmptyValuePolicy = old }
+			},
+			key:  "empty_value_policy",
+			want: "reject",
+		},
+		{
+			name: "reserved ids",
+			set: func(s *Server) func() {
+				old := s.cfg.ReservedIds
+				s.cfg.ReservedIds = "staging:*"
+				return func() { s.cfg.ReservedIds = old }
+			},
+			key:  "reserved_ids",
+			want: []any{"staging:*"},
+		},
+		{
+			name: "api keys",
+			set: func(s *Server) func() {
+				old := s.apiKeys.Current()
+				s.apiKeys.Set([]APIKey{{Key: "s3cr3t-key", Access: accessWrite}})
+				return func() { s.apiKeys.Set(old) }
+			},
+			key:   "api_keys",
+			want:  true,
+			never: "s3cr3t-key",
+		},
+		{
+			name: "upstream credentials",
+			set: func(s *Server) func() {
+				old := s.cfg.UpstreamURL
+				s.cfg.UpstreamURL = "redis://:s3cr3t-password@cache:6379/0"
+				return func() { s.cfg.UpstreamURL = old }
+			},
+			key:   "backend",
+			want:  "memory",
+			never: "s3cr3t-password",
+		},
+	}
+
+	s, ts := newTestServer(t)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer tt.set(s)()
+
+			status, body := send(t, http.MethodGet, ts.URL+"/capabilities", "")
+			if status != http.StatusOK {
+				t.Fatalf("status %d: %s", status, body)
+			}
+
+			var caps map[string]any
+			if err := json.Unmarshal([]byte(body), &caps); err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(caps[tt.key]) != fmt.Sprint(tt.want) {
+				t.Errorf("%s = %v, want %v", tt.key, caps[tt.key], tt.want)
+			}
+			if tt.never != "" && strings.Contains(body, tt.never) {
+				t.Errorf("capabilities report the secret %s", tt.never)
+			}
+		})
+	}
+}
+
+func TestEmptyValuePolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		method string
+		path   string
+		body   string
+		status int
+		id     string
+		stored bool
+	}{
+		{name: "allow an empty add", policy: "allow", method: "POST", path: "/book/", body: `{"id":"c"}`, status: 200, id: "c", stored: true},
+		{name: "allow an empty replace", policy: "allow", method: "PUT", path: "/book/a", body: `{}`, status: 200, id: "a", stored: true},
+		{name: "reject an empty add", policy: "reject", method: "POST", path: "/book/", body: `{"id":"c"}`, status: 400, id: "c", stored: false},
+		{name: "reject an empty replace", policy: "reject", method: "PUT", path: "/book/a", body: `{}`, status: 400, id: "a", stored: true},
+		{name: "reject lets a value through", policy: "reject", method: "PUT", path: "/book/a", body: `{"name":"9"}`, status: 200, id: "a", stored: true},
+		{name: "delete on an empty replace", policy: "delete", method: "PUT", path: "/book/a", body: `{}`, status: 200, id: "a", stored: false},
+		{name: "delete on an empty swap", policy: "delete", method: "POST", path: "/book/a/cas", body: `{"old":{"author":"A","name":"1"},"new":{}}`, status: 200, id: "a", stored: false},
+		{name: "delete of a missing book", policy: "delete", method: "PUT", path: "/book/missing", body: `{}`, status: 404, id: "missing", stored: false},
+		{name: "no delete when a create-only condition fails", policy: "delete", method: "PUT", path: "/book/a?if=absent", body: `{}`, status: 409, id: "a", stored: true},
+		{name: "no delete when a name condition fails", policy: "delete", method: "PUT", path: "/book/a?if=eq:9", body: `{}`, status: 412, id: "a", stored: true},
+		{name: "delete when the condition holds", policy: "delete", method: "PUT", path: "/book/a?if=eq:1", body: `{}`, status: 200, id: "a", stored: false},
+		{name: "an unknown condition", policy: "delete", method: "PUT", path: "/book/a?if=maybe", body: `{}`, status: 400, id: "a", stored: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.EmptyValuePolicy = tt.policy
+
+			s, ts := newTestServer(t, WithConfig(cfg))
+			s.store.AddBook(Book{Id: "a", Author: "A", Name: "1"})
+
+			if status, body := send(t, tt.method, ts.URL+tt.path, tt.body); status != tt.status {
+				t.Fatalf("status %d, want %d: %s", status, tt.status, body)
+			}
+			if stored := s.store.FindBookById(tt.id) != nil; stored != tt.stored {
+				t.Errorf("%s stored %v, want %v", tt.id, stored, tt.stored)
+			}
+		})
+	}
+}
+
+func TestNormalizeId(t *testing.T) {
+	tests := []struct {
+		steps string
+		id    string
+		want  string
+	}{
+		{steps: "", id: " Shelf//A ", want: " Shelf//A "},
+		{steps: "trim", id: " Shelf//A \t", want: "Shelf//A"},
+		{steps: "lowercase", id: "Shelf/A", want: "shelf/a"},
+		{steps: "collapse-slashes", id: "shelf///a//b", want: "shelf/a/b"},
+		{steps: "trim, collapse-slashes, lowercase", id: "  Shelf//A ", want: "shelf/a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.steps+" "+tt.id, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.NormalizeIds = tt.steps
+
+			if got := cfg.normalizeId(tt.id); got != tt.want {
+				t.Errorf("normalizeId(%q) = %q, want %q", tt.id, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestNormalizedIdsRoundTrip writes books under ids that normalize alike
+// and reads them back under other spellings of the same id.
+func TestNormalizedIdsRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		write  string // the id in the body of POST /book/
+		read   string // the id in the path of GET /book/<id>
+		stored string
+	}{
+		{name: "case", write: "Shelf", read: "SHELF", stored: "shelf"},
+		{name: "whitespace", write: " shelf\t", read: "%20shelf", stored: "shelf"},
+		{name: "slashes", write: "shelf//a", read: "shelf%2F%2Fa", stored: "shelf/a"},
+		{name: "all of them", write: " Shelf//A ", read: "SHELF/a%20", stored: "shelf/a"},
+	}
+
+	cfg := DefaultConfig()
+	cfg.NormalizeIds = "trim,collapse-slashes,lowercase"
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ts := newTestServer(t, WithConfig(cfg))
+
+			body, _ := json.Marshal(Book{Id: tt.write, Name: "x"})
+			if status, answer := send(t, http.MethodPost, ts.URL+"/book/", string(body)); status != http.StatusOK {
+				t.Fatalf("add: %d %s", status, answer)
+			}
+			if s.store.FindBookById(tt.stored) == nil {
+				t.Fatalf("%q is not stored as %q", tt.write, tt.stored)
+			}
+
+			if status, answer := send(t, http.MethodGet, ts.URL+"/book/"+tt.read, ""); status != http.StatusOK || !strings.Contains(answer, `"name":"x"`) {
+				t.Errorf("get %s: %d %s", tt.read, status, answer)
+			}
+			if status, answer := send(t, http.MethodPut, ts.URL+"/book/"+tt.read, `{"name":"y"}`); status != http.StatusOK {
+				t.Errorf("replace %s: %d %s", tt.read, status, answer)
+			}
+			if status, answer := send(t, http.MethodDelete, ts.URL+"/book/"+tt.read, ""); status != http.StatusOK {
+				t.Errorf("delete %s: %d %s", tt.read, status, answer)
+			}
+		})
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	const ttl = 100 * time.Millisecond
+
+	tests := []struct {
+		name        string
+		neverStored bool
+		before      func(t *testing.T, ts *httptest.Server)
+		wait        time.Duration
+		status      int
+	}{
+		{name: "a book never stored", neverStored: true, status: 404},
+		{name: "a book stored", status: 200},
+		{
+			name:   "a book just deleted",
+			before: func(t *testing.T, ts *httptest.Server) { send(t, http.MethodDelete, ts.URL+"/book/a", "") },
+			status: 410,
+		},
+		{
+			name:   "a book just drained",
+			before: func(t *testing.T, ts *httptest.Server) { send(t, http.MethodPost, ts.URL+"/drain/", `["a"]`) },
+			status: 410,
+		},
+		{
+			name:   "a book deleted before the window",
+			before: func(t *testing.T, ts *httptest.Server) { send(t, http.MethodDelete, ts.URL+"/book/a", "") },
+			wait:   ttl + 50*time.Millisecond,
+			status: 404,
+		},
+		{
+			name: "a book deleted and added again",
+			before: func(t *testing.T, ts *httptest.Server) {
+				send(t, http.MethodDelete, ts.URL+"/book/a", "")
+				send(t, http.MethodPost, ts.URL+"/book/", `{"id":"a","name":"again"}`)
+			},
+			status: 200,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ts := newTestServer(t, WithStore(NewMemoryStore(4, ttl)))
+			if !tt.neverStored {
+				s.store.AddBook(Book{Id: "a", Name: "1"})
+			}
+			if tt.before != nil {
+				tt.before(t, ts)
+			}
+			time.Sleep(tt.wait)
+
+			status, body := send(t, http.MethodGet, ts.URL+"/book/a", "")
+			if status != tt.status {
+				t.Errorf("status %d, want %d: %s", status, tt.status, body)
+			}
+			if status == http.StatusGone && !strings.Contains(body, CodeBookDeleted) {
+				t.Errorf("410 without %s: %s", CodeBookDeleted, body)
+			}
+		})
+	}
+}
+
+// TestCursorPagination walks a large listing page by page; every id must
+// come back once, in order.
+func TestCursorPagination(t *testing.T) {
+	const books, others = 1000, 50
+
+	all := make([]string, 0, books+others)
+	for i := 0; i < books; i++ {
+		all = append(all, fmt.Sprintf("book-%04d", i))
+	}
+	for i := 0; i < others; i++ {
+		all = append(all, fmt.Sprintf("other-%02d", i))
+	}
+
+	tests := []struct {
+		name   string
+		prefix string
+		limit  int
+		// between runs after the first page
+		between func(s *Server)
+		want    []string
+	}{
+		{name: "pages of one", limit: 1, want: all},
+		{name: "pages of seven", limit: 7, want: all},
+		{name: "the default page", want: all},
+		{name: "one page of all", limit: books + others, want: all},
+		{name: "a page past the end", limit: 5000, want: all},
+		{name: "a prefix", prefix: "other-", limit: 9, want: all[books:]},
+		{name: "a prefix matching nothing", prefix: "none-", limit: 9, want: []string{}},
+		{
+			name:  "writes between pages",
+			limit: 100,
+			between: func(s *Server) {
+				s.store.DelBook("book-0999")
+				s.store.AddBook(Book{Id: "aaa", Name: "behind the cursor"})
+			},
+			want: slices.DeleteFunc(slices.Clone(all), func(id string) bool { return id == "book-0999" }),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ts := newTestServer(t)
+			for _, id := range slices.Backward(all) {
+				s.store.AddBook(Book{Id: id, Name: "x"})
+			}
+
+			got := make([]string, 0)
+			cursor := ""
+			for pages := 0; ; pages++ {
+				if pages > len(all) {
+					t.Fatal("the cursor never ran out")
+				}
+
+				url := fmt.Sprintf("%s/books/?prefix=%s&cursor=%s", ts.URL, tt.prefix, cursor)
+				if tt.limit > 0 {
+					url += fmt.Sprintf("&limit=%d", tt.limit)
+				}
+				status, body := send(t, http.MethodGet, url, "")
+				if status != http.StatusOK {
+					t.Fatalf("status %d: %s", status, body)
+				}
+
+				var page BooksPage
+				if err := json.Unmarshal([]byte(body), &page); err != nil {
+					t.Fatal(err)
+				}
+				if limit := cmp.Or(tt.limit, defaultPageLimit); len(page.Books) > limit {
+					t.Fatalf("a page of %d books, past the limit %d", len(page.Books), limit)
+				}
+				for _, book := range page.Books {
+					got = append(got, book.Id)
+				}
+
+				if page.NextCursor == "" {
+					break
+				}
+				cursor = page.NextCursor
+
+				if pages == 0 && tt.between != nil {
+					tt.between(s)
+				}
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %d ids, want %d; first difference at %d", len(got), len(tt.want), firstDifference(got, tt.want))
+			}
+		})
+	}
+}
+
+func firstDifference(a, b []string) int {
+	for i := range min(len(a), len(b)) {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return min(len(a), len(b))
+}
+
+func TestCursorPaginationErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		status int
+	}{
+		{name: "a cursor that is not base64", query: "cursor=***", status: 400},
+		{name: "a zero limit", query: "limit=0", status: 400},
+		{name: "a limit that is not a number", query: "limit=ten", status: 400},
+		{name: "a cursor past every id", query: "cursor=enp6", status: 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ts := newTestServer(t)
+			s.store.AddBook(Book{Id: "a", Name: "1"})
+			s.store.AddBook(Book{Id: "b", Name: "2"})
+
+			status, body := send(t, http.MethodGet, ts.URL+"/books/?"+tt.query, "")
+			if status != tt.status {
+				t.Fatalf("status %d %s, want %d", status, body, tt.status)
+			}
+			if status != http.StatusOK {
+				if !strings.Contains(body, CodeBadRequest) {
+					t.Errorf("refused with %s, want %s", body, CodeBadRequest)
+				}
+				return
+			}
+
+			var page BooksPage
+			if err := json.Unmarshal([]byte(body), &page); err != nil {
+				t.Fatal(err)
+			}
+			if len(page.Books) != 0 || page.NextCursor != "" {
+				t.Errorf("page %+v, want none left", page)
+			}
+		})
+	}
+}
+
+func TestDiffBooks(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		status   int
+		want     map[string]FieldChange
+		contains string
+	}{
+		{name: "every field changed", path: "/diff/a/b", status: 200, want: map[string]FieldChange{"author": {From: "A", To: "B"}, "name": {From: "1", To: "2"}}},
+		{name: "the name changed", path: "/diff/a/d", status: 200, want: map[string]FieldChange{"name": {From: "1", To: "3"}}},
+		{name: "the other way around", path: "/diff/d/a", status: 200, want: map[string]FieldChange{"name": {From: "3", To: "1"}}},
+		{name: "equal books", path: "/diff/a/c", status: 200, want: map[string]FieldChange{}},
+		{name: "a missing first book", path: "/diff/missing/a", status: 404, contains: "id missing not found"},
+		{name: "a missing second book", path: "/diff/a/gone", status: 404, contains: "id gone not found"},
+		{name: "one id", path: "/diff/a", status: 400},
+	}
+
+	s, ts := newTestServer(t)
+	for _, book := range []Book{{Id: "a", Author: "A", Name: "1"}, {Id: "b", Author: "B", Name: "2"}, {Id: "c", Author: "A", Name: "1"}, {Id: "d", Author: "A", Name: "3"}} {
+		s.store.AddBook(book)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := send(t, http.MethodGet, ts.URL+tt.path, "")
+			if status != tt.status {
+				t.Fatalf("status %d, want %d: %s", status, tt.status, body)
+			}
+			if !strings.Contains(body, tt.contains) {
+				t.Errorf("body %s, want it to contain %s", body, tt.contains)
+			}
+			if tt.want == nil {
+				return
+			}
+
+			var diff struct {
+				Changes map[string]FieldChange `json:"changes"`
+			}
+			if err := json.Unmarshal([]byte(body), &diff); err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(diff.Changes, tt.want) {
+				t.Errorf("changes %v, want %v", diff.Changes, tt.want)
+			}
+		})
+	}
+}
+
+func TestPutBody(t *testing.T) {
+	binary := make([]byte, 256)
+	for i := range binary {
+		binary[i] = byte(i)
+	}
+
+	tests := []struct {
+		name   string
+		book   Book
+		status int
+	}{
+		{name: "slashes", book: Book{Name: "a/b/../c/"}, status: 200},
+		{name: "spaces", book: Book{Author: " leading and trailing ", Name: "two  spaces"}, status: 200},
+		{name: "query and fragment characters", book: Book{Name: "?x=1&y=2#top"}, status: 200},
+		{name: "percent escapes", book: Book{Name: "%2F%20%zz"}, status: 200},
+		{name: "quotes and backslashes", book: Book{Name: `"quoted" \n 'single'`}, status: 200},
+		{name: "unicode", book: Book{Name: "ünïcödé 書 🙂"}, status: 200},
+		{name: "control characters", book: Book{Name: "line\nbreak\ttab\x00nul"}, status: 200},
+		{name: "binary content", book: Book{Name: "blob", Content: binary, ContentType: "application/octet-stream"}, status: 200},
+		{name: "at -max-value-bytes", book: Book{Name: strings.Repeat("x", 1024)}, status: 200},
+		{name: "over -max-value-bytes", book: Book{Name: strings.Repeat("x", 1025)}, status: 413},
+		// every NUL is escaped to six bytes, so the body breaks the limit
+		// before the value does
+		{name: "over -max-body-bytes", book: Book{Name: strings.Repeat("\x00", 1000)}, status: 413},
+	}
+
+	cfg := DefaultConfig()
+	cfg.MaxBodyBytes, cfg.MaxValueBytes = 4096, 1024
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ts := newTestServer(t, WithConfig(cfg))
+			s.store.AddBook(Book{Id: "a", Name: "1"})
+
+			body, _ := json.Marshal(tt.book)
+			if status, body := send(t, http.MethodPut, ts.URL+"/book/a", string(body)); status != tt.status {
+				t.Fatalf("status %d, want %d: %s", status, tt.status, body)
+			}
+
+			want := tt.book
+			if tt.status != http.StatusOK {
+				want = Book{Name: "1"}
+			}
+			got := s.store.FindBookById("a")
+			if got.Author != want.Author || got.Name != want.Name || !slices.Equal(got.Content, want.Content) {
+				t.Errorf("stored %q %q %v, want %q %q %v", got.Author, got.Name, got.Content, want.Author, want.Name, want.Content)
+			}
+		})
+	}
+}
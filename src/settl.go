@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+)
+
+// setTTLAttempts is how often POST /admin/set-ttl lists the books again
+// when writes to them got in between the listing and the transaction.
+const setTTLAttempts = 5
+
+// SetTTLRequest is the body of POST /admin/set-ttl: the books whose ids
+// match the glob pattern, e.g. session:*, expire ttl from now.
+type SetTTLRequest struct {
+	Pattern string `json:"pattern"`
+	TTL     string `json:"ttl"`
+}
+
+// HandleSetTTL gives every book matching the pattern of the request the
+// same expiry, in one transaction, and answers how many there were. The
+// books keep their value; only their expiry and version change.
+func (s *Server) HandleSetTTL(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	if reason := s.writesRefused(); reason != "" {
+		writeError(w, http.StatusForbidden, CodeReadOnly, reason)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.MaxBodyBytes)
+
+	var req SetTTLRequest
+
+	err := s.decodeBody(r, &req)
+	if err != nil {
+		writeError(w, badBodyStatus(err), "", err.Error())
+		return
+	}
+
+	if _, err := path.Match(req.Pattern, ""); err != nil || req.Pattern == "" {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("invalid pattern %q", req.Pattern))
+		return
+	}
+
+	ttl, err := time.ParseDuration(req.TTL)
+	if err != nil || ttl <= 0 {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("invalid ttl %s", req.TTL))
+		return
+	}
+
+	for range setTTLAttempts {
+		books, err := s.store.GetBooks(r.Context())
+		if !handleCanceled(w, err) {
+			return
+		}
+
+		expiresAt := time.Now().Add(ttl)
+		compare := make([]TxnCompare, 0)
+		puts := make([]BatchOp, 0)
+
+		for _, book := range withoutBuckets(books) {
+			if ok, _ := path.Match(req.Pattern, book.Id); !ok || s.cfg.isReservedId(book.Id) {
+				continue
+			}
+
+			compare = append(compare, TxnCompare{Id: book.Id, If: "version:" + strconv.FormatUint(book.Version, 10)})
+			book.ExpiresAt = &expiresAt
+			puts = append(puts, BatchOp{Op: "put", Book: book})
+		}
+
+		stop := startTiming(r, "store")
+		succeeded, _, err := s.store.Txn(compare, puts, nil, nil)
+		stop()
+
+		if !handleWriteError(w, err) {
+			return
+		}
+		if !succeeded {
+			continue
+		}
+
+		w.WriteHeader(http.StatusOK)
+		body, _ := json.Marshal(map[string]int{"updated": len(puts)})
+
+		w.Write(body)
+		return
+	}
+
+	writeError(w, http.StatusConflict, CodeConflict, fmt.Sprintf("the books matching %s kept changing; try again", req.Pattern))
+}
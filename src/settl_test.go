@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSetTTL(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		status   int
+		response string
+		expiring []string // ids that expire afterwards
+	}{
+		{
+			name:     "matching books",
+			body:     `{"pattern":"session:*","ttl":"1h"}`,
+			status:   http.StatusOK,
+			response: `{"updated":2}`,
+			expiring: []string{"session:1", "session:2"},
+		},
+		{
+			name:     "no matches",
+			body:     `{"pattern":"cart:*","ttl":"1h"}`,
+			status:   http.StatusOK,
+			response: `{"updated":0}`,
+		},
+		{name: "a bad pattern", body: `{"pattern":"[","ttl":"1h"}`, status: http.StatusBadRequest},
+		{name: "no pattern", body: `{"ttl":"1h"}`, status: http.StatusBadRequest},
+		{name: "a bad ttl", body: `{"pattern":"*","ttl":"soon"}`, status: http.StatusBadRequest},
+		{name: "a ttl of zero", body: `{"pattern":"*","ttl":"0s"}`, status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ts := newTestServer(t)
+			for _, id := range []string{"session:1", "session:2", "user:1"} {
+				s.store.AddBook(Book{Id: id, Name: id})
+			}
+			s.store.AddBook(Book{Id: bucketStoreId("b", "session:3"), Name: "in a bucket"})
+
+			status, body := send(t, http.MethodPost, ts.URL+"/admin/set-ttl", tt.body)
+			if status != tt.status || (tt.response != "" && body != tt.response) {
+				t.Fatalf("answered %d %s, want %d %s", status, body, tt.status, tt.response)
+			}
+
+			books, _ := s.store.GetBooks(t.Context())
+			for _, book := range books {
+				want := false
+				for _, id := range tt.expiring {
+					want = want || id == book.Id
+				}
+
+				if want && (book.ExpiresAt == nil || time.Until(*book.ExpiresAt) < 59*time.Minute) {
+					t.Errorf("%s expires at %v, want in an hour", book.Id, book.ExpiresAt)
+				}
+				if !want && book.ExpiresAt != nil {
+					t.Errorf("%s expires at %v, want never", book.Id, book.ExpiresAt)
+				}
+				if book.Name != book.Id && book.Name != "in a bucket" {
+					t.Errorf("%s is named %s after the TTL was set", book.Id, book.Name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// writeSnapshot writes the current books to a timestamped file in dir and
+// returns its path.
+func (s *Server) writeSnapshot(dir string) (string, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return "", err
+	}
+
+	all, _ := s.store.GetBooks(context.Background())
+	books, _ := json.Marshal(storedBooks(all))
+
+	name := fmt.Sprintf("books-%s.json", time.Now().UTC().Format("20060102T150405.000000000Z"))
+	path := filepath.Join(dir, name)
+
+	err = writeFileAtomic(path, s.store.Keyring().sealFile(books))
+	if err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+func (s *Server) readSnapshot(path string) ([]Book, error) {
+	return readStoredBooks(s.store.Keyring(), path)
+}
+
+// takeSnapshot writes a snapshot to -snapshot-dir and uploads it when
+// -s3-url is set, returning its path and its URL there.
+func (s *Server) takeSnapshot() (string, string, error) {
+	path, err := s.writeSnapshot(s.cfg.SnapshotDir)
+	if err != nil || !s.cfg.s3Enabled() {
+		return path, "", err
+	}
+
+	objectURL, err := s.cfg.uploadSnapshot(path)
+	if err != nil {
+		return path, "", errors.New(fmt.Sprintf("upload: %v", err))
+	}
+	return path, objectURL, nil
+}
+
+// snapshotEvery takes a snapshot every -snapshot-interval. A failed one is
+// logged and the next is tried on schedule.
+func (s *Server) snapshotEvery(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for range tick.C {
+		path, objectURL, err := s.takeSnapshot()
+		if err != nil {
+			log.Printf("scheduled snapshot: %v", err)
+			continue
+		}
+
+		if objectURL != "" {
+			log.Printf("scheduled snapshot %s uploaded to %s", filepath.Base(path), objectURL)
+		}
+	}
+}
+
+func (s *Server) HandleSnapshot(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	path, objectURL, err := s.takeSnapshot()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("Snapshot failed. %v", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	snapshot, _ := json.Marshal(map[string]string{"name": filepath.Base(path), "url": objectURL})
+
+	w.Write(snapshot)
+}
+
+// HandleRestore replaces every book with the contents of the snapshot
+// named by ?name=, which must be a file in -snapshot-dir.
+func (s *Server) HandleRestore(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("invalid snapshot name %s", name))
+		return
+	}
+
+	books, err := s.readSnapshot(filepath.Join(s.cfg.SnapshotDir, name))
+	if os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, CodeNotFound, fmt.Sprintf("Snapshot %s not found", name))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("Restore failed. %v", err))
+		return
+	}
+
+	if !s.handleBackup(w) {
+		return
+	}
+
+	s.store.ReplaceBooks(books)
+
+	s.HandleGetBooks(w, r)
+}
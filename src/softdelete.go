@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// EnableSoftDelete keeps the books behind tombstones until the tombstones
+// are swept.
+func (s *MemoryStore) EnableSoftDelete() {
+	unlock := s.lock(nil, true)
+	defer unlock()
+
+	for _, sh := range s.shards {
+		sh.deleted = make(map[string]Book)
+	}
+}
+
+// RestoreBook brings a soft-deleted book back under a new version.
+// prepare, when not nil, sees the book first, as for Txn.
+func (s *MemoryStore) RestoreBook(id string, prepare func(book *Book) error) error {
+	sh := s.shardFor(id)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	book, ok := sh.deleted[id]
+	if !ok || time.Since(sh.tombstones[id]) >= s.tombstoneTTL {
+		return errors.New(fmt.Sprintf("There is no deleted book with id %s", id))
+	}
+
+	if prepare != nil {
+		if err := prepare(&book); err != nil {
+			return err
+		}
+		book.Id = id
+	}
+
+	release, err := s.reserve([]Book{book}, time.Now())
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	book.Version = s.revision.Add(1)
+	book.UpdatedAt = time.Now().UTC()
+
+	if err := s.logWrites(BatchOp{Op: "put", Book: book}); err != nil {
+		return err
+	}
+	s.install(sh, book)
+
+	return nil
+}
+
+// PurgeDeleted drops the soft-deleted book with id, or every one when id
+// is empty, and returns how many went. Their tombstones stay.
+func (s *MemoryStore) PurgeDeleted(id string) int {
+	var ids []string
+	if id != "" {
+		ids = []string{id}
+	}
+
+	unlock := s.lock(ids, true)
+	defer unlock()
+
+	purged := 0
+
+	for _, sh := range s.shards {
+		for deletedId := range sh.deleted {
+			if id == "" || deletedId == id {
+				delete(sh.deleted, deletedId)
+				purged++
+			}
+		}
+	}
+	return purged
+}
+
+func (s *Server) HandleRestoreBook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	bookid := s.cfg.normalizeId(r.PathValue("id"))
+
+	if s.cfg.isReservedId(bookid) {
+		HandleReservedId(w, bookid)
+		return
+	}
+
+	stop := startTiming(r, "store")
+	var refused error
+	err := s.store.RestoreBook(bookid, func(book *Book) error {
+		if prepare := s.prepareBook(r); prepare != nil {
+			refused = prepare(book)
+		}
+		return refused
+	})
+	stop()
+
+	if refused != nil {
+		handleWriteError(w, refused)
+		return
+	}
+	if handleStoreError(w, err) {
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusNotFound, CodeBookNotFound, err.Error())
+		return
+	}
+
+	stored := s.store.FindBookById(bookid)
+	if stored != nil {
+		w.Header().Set("ETag", stored.ETag(s.cfg.ETagAlgo))
+	}
+
+	w.WriteHeader(http.StatusOK)
+	body, _ := json.Marshal(stored)
+
+	w.Write(body)
+}
+
+// HandlePurge drops soft-deleted books for good: the one named by ?id=,
+// or all of them.
+func (s *Server) HandlePurge(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	if reason := s.writesRefused(); reason != "" {
+		writeError(w, http.StatusForbidden, CodeReadOnly, reason)
+		return
+	}
+
+	purged := s.store.PurgeDeleted(s.cfg.normalizeId(r.URL.Query().Get("id")))
+
+	w.WriteHeader(http.StatusOK)
+	body, _ := json.Marshal(map[string]int{"purged": purged})
+
+	w.Write(body)
+}
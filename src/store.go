@@ -0,0 +1,1354 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/paxarpp/GO_lessons/src/store"
+)
+
+// BOOK
+
+type Book struct {
+	Id        string     `json:"id"`
+	Author    string     `json:"author"`
+	Name      string     `json:"name"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// Version is assigned by the store on every write and never repeats,
+	// so it doubles as the book's ETag.
+	Version uint64 `json:"version"`
+
+	// CreatedAt and UpdatedAt are set by the store: when the book was
+	// first stored and when it was last written.
+	CreatedAt time.Time `json:"created_at,omitzero"`
+	UpdatedAt time.Time `json:"updated_at,omitzero"`
+
+	// Content is an optional binary attachment, served as ContentType at
+	// /book/<id>/content.
+	Content     []byte `json:"content,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+
+	// List and Set are optional collections, at most one per book, kept
+	// by /book/<id>/list and /book/<id>/set. The set stays sorted.
+	List []string `json:"list,omitempty"`
+	Set  []string `json:"set,omitempty"`
+}
+
+func (b Book) expired(now time.Time) bool {
+	return b.ExpiresAt != nil && !now.Before(*b.ExpiresAt)
+}
+
+// valueSize is the number of bytes a book contributes to the store size.
+func (b Book) valueSize() int {
+	size := len(b.Author) + len(b.Name) + len(b.Content) + len(b.ContentType)
+
+	for _, item := range b.List {
+		size += len(item)
+	}
+	for _, item := range b.Set {
+		size += len(item)
+	}
+	return size
+}
+
+// Store is the book storage the handlers program against.
+type Store interface {
+	GetBooks(ctx context.Context) ([]Book, error)
+	SnapshotBooks(ctx context.Context) ([]Book, uint64, error)
+	CountBooks(ctx context.Context, match func(id string) bool) (int, error)
+	BookHistory(id string) []Book
+	BookAt(id string, at PointInTime) *Book
+	BooksAt(ctx context.Context, at PointInTime) ([]Book, error)
+	RestoreBook(id string, prepare func(book *Book) error) error
+	ArchivedBook(id string) *Book
+	PurgeDeleted(id string) int
+	FindBookById(id string) *Book
+	FindBooksByIds(ids []string) []*Book
+	BooksAfter(ctx context.Context, prefix string, after string, limit int) ([]Book, bool, error)
+	SizeBytes() (keyBytes int, valueBytes int)
+	RecentlyDeleted(id string) bool
+
+	AddBook(book Book) error
+	SetBook(book Book) error
+	SetBookIf(book Book, cond string) error
+	SwapBook(old Book, book Book) error
+	DelBook(id string) error
+	DelBookIf(id string, cond string) error
+	DrainBooks(ids []string, prepare func(ids []string) error) ([]Book, error)
+	ApplyBatch(ops []BatchOp) ([]BatchResult, bool)
+	Txn(compare []TxnCompare, success, failure []BatchOp, prepare func(writes []*BatchOp) error) (bool, []BatchResult, error)
+	ImportBooks(books []Book, keep func(id string) bool, prepare func(writes []*BatchOp) error) ([]BatchResult, error)
+	ReplaceBooks(books []Book)
+	ApplyChange(event ChangeEvent)
+	SearchBooks(ctx context.Context, match, value string) ([]Book, error)
+
+	// Check reports whether the backend can currently persist changes.
+	Check() error
+
+	// Watchers returns the watchers the changes are published to.
+	Watchers() *Watchers
+
+	// Keyring returns the keys the files of the store are sealed with.
+	Keyring() *Keyring
+
+	// Close flushes pending persistence work; no writes may follow.
+	Close() error
+}
+
+// MemoryStore keeps books in memory only; everything is lost on restart.
+// Books are spread over hash-sharded maps with a lock each, so writes to
+// different shards do not wait for one another.
+type MemoryStore struct {
+	shards       []*shard
+	tombstoneTTL time.Duration
+
+	// highest version and insertion sequence handed out so far
+	revision atomic.Uint64
+	sequence atomic.Uint64
+
+	// wakes the evictor after writes; nil unless eviction is enabled
+	evictions chan struct{}
+
+	// how many replaced versions each book keeps, 0 for none
+	historyDepth int
+
+	// what the etag: conditions hash the books with, see UseETagAlgo
+	etagAlgo string
+
+	// sees the writes under their locks before they are applied, and
+	// refuses them with an error; nil unless a WALStore logs the store
+	journal func(writes []BatchOp) error
+
+	sweeper expirySweeper
+
+	// the watchers of the changes, see Watchers
+	watchers *Watchers
+
+	// the keys its files are sealed with, see Keyring
+	keys Keyring
+
+	// books evicted by the limits and reads found corrupt, for /metrics
+	evicted      atomic.Uint64
+	corruptReads atomic.Uint64
+}
+
+// shard holds the books whose ids hash to it.
+type shard struct {
+	mu    sync.RWMutex
+	books map[string]*entry
+
+	// ids of books in sorted order, for prefix scans and paging
+	ids []string
+
+	// running totals kept in step with books so size queries are O(1)
+	keyBytes   int
+	valueBytes int
+
+	// the totals the byte limits check writes against, nil without limits
+	usage *storeUsage
+
+	// deletion times of recently deleted ids, kept for tombstoneTTL
+	tombstones map[string]time.Time
+
+	// the books behind the tombstones, nil unless soft delete is enabled
+	deleted map[string]Book
+
+	// the last book to expire under each id, nil unless archiving is
+	// enabled
+	archived map[string]Book
+
+	// ids by book name, nil unless the value index is enabled
+	names map[string]map[string]bool
+
+	// when the books expire, for the sweeper of the store
+	expiries expiryHeap
+	sweeper  *expirySweeper
+
+	// the watchers of the store, told of the changes, and its count of
+	// corrupt reads, kept while verifyReads is on
+	watchers     *Watchers
+	corruptReads *atomic.Uint64
+	verifyReads  bool
+
+	// books as shared with the listings reading them, nil when none does;
+	// see views and thaw
+	shared atomic.Pointer[shardView]
+}
+
+// shardView is the books of a shard as one or more listings read them.
+type shardView struct {
+	books   map[string]*entry
+	readers atomic.Int32
+}
+
+// entry is a stored book and its insertion sequence, which keeps GetBooks
+// in insertion order across shards.
+type entry struct {
+	book Book
+	seq  uint64
+	crc  uint32 // checksum of book when stored
+
+	// replaced versions, oldest first, up to historyDepth
+	history []Book
+
+	// point reads and writes, for the eviction policy
+	used atomic.Int64 // unix nanoseconds of the last one
+	hits atomic.Uint64
+}
+
+func (e *entry) touch(now time.Time) {
+	e.used.Store(now.UnixNano())
+	e.hits.Add(1)
+}
+
+// replace returns the entry holding book in e's place. Entries are never
+// changed in place, as a listing may still be reading e.
+func (e *entry) replace(book Book) *entry {
+	replaced := &entry{book: book, seq: e.seq, crc: book.checksum(), history: e.history}
+	replaced.used.Store(e.used.Load())
+	replaced.hits.Store(e.hits.Load())
+
+	return replaced
+}
+
+// touch records a point access to id. Callers hold at least the read lock.
+func (sh *shard) touch(id string, now time.Time) {
+	if e, ok := sh.books[id]; ok {
+		e.touch(now)
+	}
+}
+
+func NewMemoryStore(shards int, tombstoneTTL time.Duration) *MemoryStore {
+	s := &MemoryStore{
+		shards:       make([]*shard, shards),
+		tombstoneTTL: tombstoneTTL,
+		sweeper:      expirySweeper{wake: make(chan struct{}, 1)},
+		watchers:     NewWatchers(),
+	}
+
+	for i := range s.shards {
+		s.shards[i] = &shard{
+			books:        make(map[string]*entry),
+			ids:          make([]string, 0),
+			tombstones:   make(map[string]time.Time),
+			sweeper:      &s.sweeper,
+			watchers:     s.watchers,
+			corruptReads: &s.corruptReads,
+		}
+	}
+
+	return s
+}
+
+// Watchers returns the watchers of the changes of the store, its own so
+// that stores do not see each other's.
+func (s *MemoryStore) Watchers() *Watchers {
+	return s.watchers
+}
+
+// Keyring returns the keys of the store, which seal nothing until loaded.
+func (s *MemoryStore) Keyring() *Keyring {
+	return &s.keys
+}
+
+func (s *MemoryStore) shardIndex(id string) int {
+	return store.ShardIndex(id, len(s.shards))
+}
+
+func (s *MemoryStore) shardFor(id string) *shard {
+	return s.shards[s.shardIndex(id)]
+}
+
+// lock locks the shards holding ids, or every shard when ids is nil, and
+// returns the matching unlock. Shards are always taken in index order so
+// operations spanning several shards cannot deadlock.
+func (s *MemoryStore) lock(ids []string, write bool) func() {
+	indexes := make([]int, 0, len(s.shards))
+
+	if ids == nil {
+		for i := range s.shards {
+			indexes = append(indexes, i)
+		}
+	} else {
+		seen := make(map[int]bool)
+		for _, id := range ids {
+			i := s.shardIndex(id)
+			if !seen[i] {
+				seen[i] = true
+				indexes = append(indexes, i)
+			}
+		}
+		sort.Ints(indexes)
+	}
+
+	for _, i := range indexes {
+		if write {
+			s.shards[i].mu.Lock()
+		} else {
+			s.shards[i].mu.RLock()
+		}
+	}
+
+	return func() {
+		for _, i := range indexes {
+			if write {
+				s.shards[i].mu.Unlock()
+			} else {
+				s.shards[i].mu.RUnlock()
+			}
+		}
+	}
+}
+
+// views shares the books of every shard at one point in time and returns
+// them, so a listing can read them without holding any lock. A write to a
+// shard while the listing reads gives the shard a copy of its own first,
+// see thaw; the listing calls release once done, and writes after that
+// change the books in place again. The revision is the highest version
+// handed out when the views were taken, so every book in them has a version
+// up to it and every later write one above it.
+func (s *MemoryStore) views() (views []map[string]*entry, revision uint64, release func()) {
+	unlock := s.lock(nil, false)
+	defer unlock()
+
+	shared := make([]*shardView, 0, len(s.shards))
+
+	for _, sh := range s.shards {
+		view := sh.shared.Load()
+		if view == nil {
+			view = &shardView{books: sh.books}
+			if !sh.shared.CompareAndSwap(nil, view) {
+				view = sh.shared.Load()
+			}
+		}
+
+		view.readers.Add(1)
+		shared = append(shared, view)
+		views = append(views, view.books)
+	}
+
+	return views, s.revision.Load(), func() {
+		for _, view := range shared {
+			view.readers.Add(-1)
+		}
+	}
+}
+
+// thaw copies the books of a shard before they change while a listing
+// reads them, leaving the shared map to the listing. Callers hold the
+// write lock, so no listing starts meanwhile.
+func (sh *shard) thaw() {
+	view := sh.shared.Swap(nil)
+	if view == nil || view.readers.Load() == 0 {
+		return
+	}
+
+	books := make(map[string]*entry, len(sh.books))
+	for id, e := range sh.books {
+		books[id] = e
+	}
+
+	sh.books = books
+}
+
+// GetBooks returns every live book in insertion order, as of one point in
+// time. It reads a shared view of the shards, so a long listing never
+// holds up writers, and gives up with ctx's error once ctx is done,
+// checking between shards.
+func (s *MemoryStore) GetBooks(ctx context.Context) ([]Book, error) {
+	books, _, err := s.SnapshotBooks(ctx)
+	return books, err
+}
+
+// SnapshotBooks is GetBooks that also returns the revision of the store at
+// that point in time, see views.
+func (s *MemoryStore) SnapshotBooks(ctx context.Context) ([]Book, uint64, error) {
+	entries := make([]*entry, 0)
+	now := time.Now()
+
+	views, revision, release := s.views()
+	defer release()
+
+	for _, books := range views {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
+
+		for _, e := range books {
+			if !e.book.expired(now) {
+				entries = append(entries, e)
+			}
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+
+	books := make([]Book, 0, len(entries))
+	for _, e := range entries {
+		books = append(books, e.book)
+	}
+
+	return books, revision, nil
+}
+
+// CountBooks counts the live books whose id matches, from the same shared
+// view as GetBooks but without copying or ordering any book.
+func (s *MemoryStore) CountBooks(ctx context.Context, match func(id string) bool) (int, error) {
+	count := 0
+	now := time.Now()
+
+	views, _, release := s.views()
+	defer release()
+
+	for _, books := range views {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		for id, e := range books {
+			if match(id) && !e.book.expired(now) {
+				count++
+			}
+		}
+	}
+
+	return count, nil
+}
+
+func (s *MemoryStore) FindBookById(id string) *Book {
+	sh := s.shardFor(id)
+
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	now := time.Now()
+	sh.touch(id, now)
+
+	return sh.find(id, now)
+}
+
+// FindBooksByIds looks up several books under one set of read locks;
+// missing books are nil.
+func (s *MemoryStore) FindBooksByIds(ids []string) []*Book {
+	unlock := s.lock(ids, false)
+	defer unlock()
+
+	books := make([]*Book, len(ids))
+	now := time.Now()
+
+	for i, id := range ids {
+		s.shardFor(id).touch(id, now)
+		books[i] = s.shardFor(id).find(id, now)
+	}
+
+	return books
+}
+
+// find returns a copy of the live book with id, or nil. Callers hold at
+// least the read lock.
+func (sh *shard) find(id string, now time.Time) *Book {
+	e, ok := sh.books[id]
+	if !ok || e.book.expired(now) {
+		return nil
+	}
+
+	sh.verifyRead(e)
+
+	book := e.book
+	return &book
+}
+
+// live is find for writers: an expired book found on the way is dropped
+// first. Callers hold the write lock.
+func (sh *shard) live(id string, now time.Time) *Book {
+	e, ok := sh.books[id]
+	if ok && e.book.expired(now) {
+		sh.expire(id)
+	}
+
+	return sh.find(id, now)
+}
+
+func (sh *shard) indexAdd(id string) {
+	i := sort.SearchStrings(sh.ids, id)
+
+	sh.ids = append(sh.ids, "")
+	copy(sh.ids[i+1:], sh.ids[i:])
+	sh.ids[i] = id
+}
+
+func (sh *shard) indexRemove(id string) {
+	i := sort.SearchStrings(sh.ids, id)
+
+	if i < len(sh.ids) && sh.ids[i] == id {
+		sh.ids = append(sh.ids[:i], sh.ids[i+1:]...)
+	}
+}
+
+// remove drops the book with id without leaving a tombstone, as expiry is
+// not a delete. Callers hold the write lock.
+func (sh *shard) remove(id string) {
+	e, ok := sh.books[id]
+	if !ok {
+		return
+	}
+
+	sh.thaw()
+	delete(sh.books, id)
+	sh.indexRemove(id)
+	sh.unindexName(e.book)
+	sh.grow(id, -1, -len(id), -e.book.valueSize())
+}
+
+func (sh *shard) indexName(book Book) {
+	if sh.names == nil {
+		return
+	}
+
+	if sh.names[book.Name] == nil {
+		sh.names[book.Name] = make(map[string]bool)
+	}
+	sh.names[book.Name][book.Id] = true
+}
+
+func (sh *shard) unindexName(book Book) {
+	if sh.names == nil {
+		return
+	}
+
+	delete(sh.names[book.Name], book.Id)
+	if len(sh.names[book.Name]) == 0 {
+		delete(sh.names, book.Name)
+	}
+}
+
+// expire removes an expired book, archiving it when enabled, and tells
+// watchers. Callers hold the write lock.
+func (sh *shard) expire(id string) {
+	old := sh.books[id].book
+	sh.remove(id)
+
+	if sh.archived != nil {
+		sh.archived[id] = old
+	}
+
+	sh.watchers.Publish(ChangeEvent{Op: "expire", Id: id, Old: &old})
+}
+
+// put inserts or replaces book in sh under a new version and returns it,
+// once the journal took it. Callers hold the shard's write lock.
+func (s *MemoryStore) put(sh *shard, book Book) (uint64, error) {
+	book = s.stamp(sh, book)
+
+	if err := s.logWrites(BatchOp{Op: "put", Book: book}); err != nil {
+		return 0, err
+	}
+	s.install(sh, book)
+
+	return book.Version, nil
+}
+
+// stamp returns book under a new version, updated now. A replaced book
+// keeps its creation time. Callers hold the shard's write lock.
+func (s *MemoryStore) stamp(sh *shard, book Book) Book {
+	book.Version = s.revision.Add(1)
+	book.UpdatedAt = time.Now().UTC()
+	book.CreatedAt = book.UpdatedAt
+
+	if e, ok := sh.books[book.Id]; ok && !e.book.expired(book.UpdatedAt) {
+		book.CreatedAt = e.book.CreatedAt
+	}
+	return book
+}
+
+// logWrites hands writes to the journal before they are applied. Callers
+// hold the locks of every write.
+func (s *MemoryStore) logWrites(writes ...BatchOp) error {
+	if s.journal == nil || len(writes) == 0 {
+		return nil
+	}
+	return s.journal(writes)
+}
+
+// install stores book in sh under the version it already carries. Callers
+// hold the shard's write lock.
+func (s *MemoryStore) install(sh *shard, book Book) {
+	s.raiseRevision(book.Version)
+	sh.thaw()
+
+	if e, ok := sh.books[book.Id]; ok {
+		old := e.book
+		sh.grow(book.Id, 0, 0, book.valueSize()-e.book.valueSize())
+		sh.unindexName(e.book)
+		sh.indexName(book)
+		s.remember(e)
+
+		replaced := e.replace(book)
+		replaced.touch(time.Now())
+		sh.books[book.Id] = replaced
+		sh.scheduleExpiry(book)
+		s.wakeEvictor()
+
+		s.watchers.Publish(ChangeEvent{Op: "put", Id: book.Id, Old: &old, New: &book})
+		return
+	}
+
+	e := &entry{book: book, seq: s.sequence.Add(1), crc: book.checksum()}
+	e.touch(time.Now())
+
+	sh.books[book.Id] = e
+	sh.indexAdd(book.Id)
+	sh.indexName(book)
+	sh.grow(book.Id, 1, len(book.Id), book.valueSize())
+	sh.scheduleExpiry(book)
+	delete(sh.tombstones, book.Id)
+	delete(sh.deleted, book.Id)
+	s.wakeEvictor()
+
+	s.watchers.Publish(ChangeEvent{Op: "put", Id: book.Id, New: &book})
+}
+
+// raiseRevision makes sure later versions are above version.
+func (s *MemoryStore) raiseRevision(version uint64) {
+	for {
+		revision := s.revision.Load()
+		if version <= revision || s.revision.CompareAndSwap(revision, version) {
+			return
+		}
+	}
+}
+
+// ApplyChange applies a change streamed from a primary, keeping the
+// primary's versions. Changes older than the stored book are skipped, so
+// events that overlap the initial snapshot do no harm.
+func (s *MemoryStore) ApplyChange(event ChangeEvent) {
+	sh := s.shardFor(event.Id)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	stored := sh.live(event.Id, time.Now())
+
+	switch event.Op {
+	case "put":
+		if event.New != nil && (stored == nil || stored.Version < event.New.Version) {
+			if err := s.logWrites(BatchOp{Op: "put", Book: *event.New}); err != nil {
+				log.Printf("apply change to %s: %v", event.Id, err)
+				return
+			}
+			s.install(sh, *event.New)
+		}
+	case "delete", "evict":
+		if stored != nil && event.Old != nil && stored.Version <= event.Old.Version {
+			if err := s.logWrites(BatchOp{Op: "delete", Book: Book{Id: event.Id}}); err != nil {
+				log.Printf("apply change to %s: %v", event.Id, err)
+				return
+			}
+			s.del(sh, event.Id)
+		}
+	}
+}
+
+// del deletes the book with id from sh, leaving a tombstone. Callers hold
+// the shard's write lock.
+func (s *MemoryStore) del(sh *shard, id string) {
+	if e, ok := sh.books[id]; ok {
+		old := e.book
+		s.watchers.Publish(ChangeEvent{Op: "delete", Id: id, Old: &old})
+
+		if sh.deleted != nil {
+			sh.deleted[id] = old
+		}
+	}
+
+	sh.remove(id)
+
+	if s.tombstoneTTL > 0 {
+		sh.tombstones[id] = time.Now()
+	}
+}
+
+func (s *MemoryStore) Check() error {
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// SizeBytes returns the total length of all book ids and of all book values.
+func (s *MemoryStore) SizeBytes() (keyBytes int, valueBytes int) {
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		keyBytes += sh.keyBytes
+		valueBytes += sh.valueBytes
+		sh.mu.RUnlock()
+	}
+
+	return keyBytes, valueBytes
+}
+
+func (s *MemoryStore) AddBook(book Book) error {
+	sh := s.shardFor(book.Id)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	now := time.Now()
+	if sh.live(book.Id, now) != nil {
+		return errors.New(fmt.Sprintf("Book with id %s already exists", book.Id))
+
+	}
+
+	release, err := s.reserve([]Book{book}, now)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if _, err := s.put(sh, book); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) SetBook(book Book) error {
+	sh := s.shardFor(book.Id)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	now := time.Now()
+	if sh.live(book.Id, now) == nil {
+		return errors.New(fmt.Sprintf("There is no book with id %s", book.Id))
+	}
+
+	release, err := s.reserve([]Book{book}, now)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if _, err := s.put(sh, book); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SwapBook replaces the book only if its stored author and name still equal
+// those of old.
+func (s *MemoryStore) SwapBook(old Book, book Book) error {
+	sh := s.shardFor(book.Id)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	now := time.Now()
+	bk := sh.live(book.Id, now)
+	if bk == nil || bk.Author != old.Author || bk.Name != old.Name {
+		return errors.New(fmt.Sprintf("Book with id %s does not hold the expected value", book.Id))
+	}
+
+	release, err := s.reserve([]Book{book}, now)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if _, err := s.put(sh, book); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SetBookIf stores the book only if cond holds for the current state,
+// inserting it when it does not exist yet.
+func (s *MemoryStore) SetBookIf(book Book, cond string) error {
+	sh := s.shardFor(book.Id)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	now := time.Now()
+	if !s.conditionMet(sh.live(book.Id, now), cond) {
+		return errors.New(fmt.Sprintf("Condition %s not met for book with id %s", cond, book.Id))
+	}
+
+	release, err := s.reserve([]Book{book}, now)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if _, err := s.put(sh, book); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) DelBook(id string) error {
+	sh := s.shardFor(id)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if sh.live(id, time.Now()) == nil {
+		return errors.New(fmt.Sprintf("There is no book with id %s", id))
+	}
+
+	if err := s.logWrites(BatchOp{Op: "delete", Book: Book{Id: id}}); err != nil {
+		return err
+	}
+	s.del(sh, id)
+
+	return nil
+}
+
+// DelBookIf deletes the book only if cond holds for it.
+func (s *MemoryStore) DelBookIf(id string, cond string) error {
+	sh := s.shardFor(id)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	bk := sh.live(id, time.Now())
+	if !s.conditionMet(bk, cond) {
+		return errors.New(fmt.Sprintf("Condition %s not met for book with id %s", cond, id))
+	}
+
+	if bk != nil {
+		if err := s.logWrites(BatchOp{Op: "delete", Book: Book{Id: id}}); err != nil {
+			return err
+		}
+		s.del(sh, id)
+	}
+
+	return nil
+}
+
+// RecentlyDeleted reports whether the id was deleted within the tombstone TTL.
+func (s *MemoryStore) RecentlyDeleted(id string) bool {
+	sh := s.shardFor(id)
+
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	deletedAt, ok := sh.tombstones[id]
+
+	return ok && time.Since(deletedAt) < s.tombstoneTTL
+}
+
+// SweepTombstones drops expired tombstones every interval.
+func (s *MemoryStore) SweepTombstones(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, sh := range s.shards {
+			sh.mu.Lock()
+			for id, deletedAt := range sh.tombstones {
+				if time.Since(deletedAt) >= s.tombstoneTTL {
+					delete(sh.tombstones, id)
+					delete(sh.deleted, id)
+				}
+			}
+			sh.mu.Unlock()
+		}
+	}
+}
+
+// BooksAfter returns up to limit books whose ids start with prefix and are
+// greater than after, in id order, and whether more books follow. Each
+// shard reads its candidates off its sorted id index, and the candidates
+// are merged. Like GetBooks it gives up once ctx is done.
+func (s *MemoryStore) BooksAfter(ctx context.Context, prefix string, after string, limit int) ([]Book, bool, error) {
+	unlock := s.lock(nil, false)
+	defer unlock()
+
+	books := make([]Book, 0)
+	now := time.Now()
+
+	for _, sh := range s.shards {
+		if err := ctx.Err(); err != nil {
+			return nil, false, err
+		}
+
+		start := sort.SearchStrings(sh.ids, prefix)
+		if after >= prefix {
+			start = sort.Search(len(sh.ids), func(i int) bool { return sh.ids[i] > after })
+		}
+
+		found := 0
+
+		for _, id := range sh.ids[start:] {
+			if !strings.HasPrefix(id, prefix) || found > limit {
+				break
+			}
+
+			if bk := sh.find(id, now); bk != nil {
+				books = append(books, *bk)
+				found++
+			}
+		}
+	}
+
+	sort.Slice(books, func(i, j int) bool { return books[i].Id < books[j].Id })
+
+	if len(books) > limit {
+		return books[:limit], true, nil
+	}
+
+	return books, false, nil
+}
+
+// ReplaceBooks atomically swaps the whole content of the store for books,
+// keeping their versions. Later writes still get versions above any seen.
+// Watchers see a delete of every book that is gone or changed and then a
+// put of every book that is new or changed, so replicas, which skip older
+// versions, take a restored book even when it is older than theirs.
+func (s *MemoryStore) ReplaceBooks(books []Book) {
+	unlock := s.lock(nil, true)
+	defer unlock()
+
+	now := time.Now()
+	old := make(map[string]*entry)
+
+	for _, sh := range s.shards {
+		for id, e := range sh.books {
+			if !e.book.expired(now) {
+				old[id] = e
+			}
+		}
+
+		sh.books = make(map[string]*entry)
+		sh.shared.Store(nil)
+		sh.ids = make([]string, 0)
+		sh.expiries = nil
+		sh.keyBytes, sh.valueBytes = 0, 0
+		sh.usage.reset()
+		sh.tombstones = make(map[string]time.Time)
+
+		if sh.deleted != nil {
+			sh.deleted = make(map[string]Book)
+		}
+
+		if sh.names != nil {
+			sh.names = make(map[string]map[string]bool)
+		}
+	}
+
+	for _, book := range books {
+		sh := s.shardFor(book.Id)
+
+		if _, ok := sh.books[book.Id]; ok {
+			continue
+		}
+
+		sh.books[book.Id] = &entry{book: book, seq: s.sequence.Add(1), crc: book.checksum()}
+		sh.ids = append(sh.ids, book.Id)
+		sh.indexName(book)
+		sh.grow(book.Id, 1, len(book.Id), book.valueSize())
+		sh.scheduleExpiry(book)
+
+		s.raiseRevision(book.Version)
+	}
+
+	for _, sh := range s.shards {
+		sort.Strings(sh.ids)
+	}
+
+	kept := make(map[string]bool)
+	for _, sh := range s.shards {
+		for id, e := range sh.books {
+			if prev, ok := old[id]; ok && prev.book.Version == e.book.Version && prev.crc == e.crc {
+				kept[id] = true
+			}
+		}
+	}
+
+	for id, e := range old {
+		if !kept[id] {
+			gone := e.book
+			s.watchers.Publish(ChangeEvent{Op: "delete", Id: id, Old: &gone})
+		}
+	}
+
+	for _, book := range books {
+		if !kept[book.Id] {
+			kept[book.Id] = true
+			added := s.shardFor(book.Id).books[book.Id].book
+			s.watchers.Publish(ChangeEvent{Op: "put", Id: book.Id, New: &added})
+		}
+	}
+}
+
+// BatchOp is one put or delete of a batch. Deletes only use Book.Id.
+type BatchOp struct {
+	Op   string `json:"op"` // put or delete
+	Book Book   `json:"book"`
+}
+
+type BatchResult struct {
+	Op      string `json:"op"`
+	Id      string `json:"id"`
+	Version uint64 `json:"version,omitempty"`
+	Book    *Book  `json:"book,omitempty"`  // the book read by a txn get
+	Prior   *Book  `json:"prior,omitempty"` // the book a txn put or delete found before the txn ran
+	Error   string `json:"error,omitempty"`
+}
+
+// TxnCompare is one condition of a transaction, with the same forms as the
+// ?if= query parameter.
+type TxnCompare struct {
+	Id string `json:"id"`
+	If string `json:"if"`
+}
+
+// ApplyBatch applies all ops under the locks of every shard they touch, or
+// none of them if any would fail. Puts insert or replace; deletes fail for
+// books that are not there at that point of the batch. It reports whether
+// the batch was applied.
+func (s *MemoryStore) ApplyBatch(ops []BatchOp) ([]BatchResult, bool) {
+	ids := make([]string, 0, len(ops))
+	for _, op := range ops {
+		ids = append(ids, op.Book.Id)
+	}
+
+	unlock := s.lock(ids, true)
+	defer unlock()
+
+	results := make([]BatchResult, len(ops))
+	present := make(map[string]bool)
+	applied := true
+	now := time.Now()
+
+	for i, op := range ops {
+		results[i] = BatchResult{Op: op.Op, Id: op.Book.Id}
+
+		exists, seen := present[op.Book.Id]
+		if !seen {
+			exists = s.shardFor(op.Book.Id).live(op.Book.Id, now) != nil
+		}
+
+		switch op.Op {
+		case "put":
+			present[op.Book.Id] = true
+		case "delete":
+			if !exists {
+				results[i].Error = fmt.Sprintf("There is no book with id %s", op.Book.Id)
+				applied = false
+			}
+			present[op.Book.Id] = false
+		default:
+			results[i].Error = fmt.Sprintf("unknown op %s", op.Op)
+			applied = false
+		}
+	}
+
+	if !applied {
+		return results, false
+	}
+
+	release, err := s.reserve(opPuts(ops), now)
+	if err != nil {
+		for i, op := range ops {
+			if op.Op == "put" {
+				results[i].Error = err.Error()
+			}
+		}
+		return results, false
+	}
+	defer release()
+
+	writes := slices.Clone(ops)
+	for i, op := range writes {
+		if op.Op == "put" {
+			writes[i].Book = s.stamp(s.shardFor(op.Book.Id), op.Book)
+		}
+	}
+
+	if err := s.logWrites(writes...); err != nil {
+		for i := range results {
+			results[i].Error = err.Error()
+		}
+		return results, false
+	}
+
+	for i, op := range writes {
+		sh := s.shardFor(op.Book.Id)
+
+		if op.Op == "put" {
+			s.install(sh, op.Book)
+			results[i].Version = op.Book.Version
+		} else {
+			s.del(sh, op.Book.Id)
+		}
+	}
+
+	return results, true
+}
+
+// Txn evaluates every compare and then runs the success ops if all of
+// them hold, or the failure ops otherwise, all under the locks of every
+// shard involved. Branch ops are get, put and delete; deleting an absent
+// book does nothing. It reports which branch ran.
+//
+// prepare, when not nil, is called under those locks with the writes the
+// branch is about to make: its puts, and its deletes of books that are
+// there. It may change the books of the puts, and an error from it is
+// returned with nothing written. It must not use the store.
+func (s *MemoryStore) Txn(compare []TxnCompare, success, failure []BatchOp, prepare func(writes []*BatchOp) error) (bool, []BatchResult, error) {
+	ids := make([]string, 0, len(compare)+len(success)+len(failure))
+	for _, c := range compare {
+		ids = append(ids, c.Id)
+	}
+	for _, op := range slices.Concat(success, failure) {
+		ids = append(ids, op.Book.Id)
+	}
+
+	unlock := s.lock(ids, true)
+	defer unlock()
+
+	return s.txn(compare, success, failure, prepare, time.Now())
+}
+
+// txn is Txn for callers holding the locks of every id it touches.
+func (s *MemoryStore) txn(compare []TxnCompare, success, failure []BatchOp, prepare func(writes []*BatchOp) error, now time.Time) (bool, []BatchResult, error) {
+	succeeded := true
+
+	for _, c := range compare {
+		if !s.conditionMet(s.shardFor(c.Id).live(c.Id, now), c.If) {
+			succeeded = false
+			break
+		}
+	}
+
+	ops := success
+	if !succeeded {
+		ops = failure
+	}
+
+	if prepare != nil {
+		writes := make([]*BatchOp, 0, len(ops))
+		present := make(map[string]bool)
+
+		for i, op := range ops {
+			exists, seen := present[op.Book.Id]
+			if !seen {
+				exists = s.shardFor(op.Book.Id).live(op.Book.Id, now) != nil
+			}
+
+			switch {
+			case op.Op == "put":
+				writes = append(writes, &ops[i])
+				present[op.Book.Id] = true
+			case op.Op == "delete" && exists:
+				writes = append(writes, &ops[i])
+				present[op.Book.Id] = false
+			}
+		}
+
+		if err := prepare(writes); err != nil {
+			return succeeded, nil, err
+		}
+	}
+
+	release, err := s.reserve(opPuts(ops), now)
+	if err != nil {
+		return succeeded, nil, err
+	}
+	defer release()
+
+	stamped := slices.Clone(ops)
+	writes := make([]BatchOp, 0, len(ops))
+	present := make(map[string]bool)
+
+	for i, op := range stamped {
+		exists, seen := present[op.Book.Id]
+		if !seen {
+			exists = s.shardFor(op.Book.Id).live(op.Book.Id, now) != nil
+		}
+
+		switch {
+		case op.Op == "put":
+			stamped[i].Book = s.stamp(s.shardFor(op.Book.Id), op.Book)
+			writes = append(writes, stamped[i])
+			present[op.Book.Id] = true
+		case op.Op == "delete" && exists:
+			writes = append(writes, op)
+			present[op.Book.Id] = false
+		}
+	}
+
+	if err := s.logWrites(writes...); err != nil {
+		return succeeded, nil, err
+	}
+
+	// the books the writes find, as they were before the first of them
+	prior := make(map[string]*Book)
+	for _, op := range stamped {
+		if _, seen := prior[op.Book.Id]; !seen && op.Op != "get" {
+			if stored := s.shardFor(op.Book.Id).live(op.Book.Id, now); stored != nil {
+				book := *stored
+				prior[op.Book.Id] = &book
+			} else {
+				prior[op.Book.Id] = nil
+			}
+		}
+	}
+
+	results := make([]BatchResult, len(ops))
+
+	for i, op := range stamped {
+		sh := s.shardFor(op.Book.Id)
+		results[i] = BatchResult{Op: op.Op, Id: op.Book.Id, Prior: prior[op.Book.Id]}
+
+		switch op.Op {
+		case "get":
+			if stored := sh.live(op.Book.Id, now); stored != nil {
+				book := *stored
+				results[i].Book = &book
+				results[i].Version = book.Version
+			}
+		case "put":
+			s.install(sh, op.Book)
+			results[i].Version = op.Book.Version
+		case "delete":
+			if sh.live(op.Book.Id, now) != nil {
+				s.del(sh, op.Book.Id)
+			}
+		}
+	}
+
+	return succeeded, results, nil
+}
+
+// ImportBooks puts books and deletes every other book keep does not hold
+// on to, in one step under every shard lock, so no write slips in between
+// as POST /import?mode=replace would otherwise let it. Each put gets a new
+// version. prepare, when not nil, is called first as for Txn, with the
+// puts and the deletes of books that were present.
+func (s *MemoryStore) ImportBooks(books []Book, keep func(id string) bool, prepare func(writes []*BatchOp) error) ([]BatchResult, error) {
+	unlock := s.lock(nil, true)
+	defer unlock()
+
+	now := time.Now()
+	ops := make([]BatchOp, 0, len(books))
+	imported := make(map[string]bool, len(books))
+
+	for _, book := range books {
+		book.Version = 0
+		ops = append(ops, BatchOp{Op: "put", Book: book})
+		imported[book.Id] = true
+	}
+
+	gone := make([]string, 0)
+	for _, sh := range s.shards {
+		for _, id := range sh.ids {
+			if !imported[id] && !keep(id) && sh.live(id, now) != nil {
+				gone = append(gone, id)
+			}
+		}
+	}
+	slices.Sort(gone)
+
+	for _, id := range gone {
+		ops = append(ops, BatchOp{Op: "delete", Book: Book{Id: id}})
+	}
+
+	_, results, err := s.txn(nil, ops, nil, prepare, now)
+	return results, err
+}
+
+// DrainBooks removes the books with the given ids in one step and returns
+// the ones that were present, so concurrent drains never hand out a book twice.
+// prepare, when not nil, is called first with the ids of those books, as
+// for Txn, and an error from it drains nothing.
+func (s *MemoryStore) DrainBooks(ids []string, prepare func(ids []string) error) ([]Book, error) {
+	unlock := s.lock(ids, true)
+	defer unlock()
+
+	drained := make([]Book, 0)
+	now := time.Now()
+
+	if prepare != nil {
+		present := make([]string, 0, len(ids))
+		for _, id := range ids {
+			if s.shardFor(id).live(id, now) != nil && !slices.Contains(present, id) {
+				present = append(present, id)
+			}
+		}
+
+		if err := prepare(present); err != nil {
+			return nil, err
+		}
+	}
+
+	writes := make([]BatchOp, 0, len(ids))
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if !seen[id] && s.shardFor(id).live(id, now) != nil {
+			seen[id] = true
+			writes = append(writes, BatchOp{Op: "delete", Book: Book{Id: id}})
+		}
+	}
+
+	if err := s.logWrites(writes...); err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		sh := s.shardFor(id)
+
+		if bk := sh.live(id, now); bk != nil {
+			drained = append(drained, *bk)
+			s.del(sh, id)
+		}
+	}
+
+	return drained, nil
+}
+
+// validCondition reports whether cond is one of exists or its alias
+// present, absent, eq:<name>, ne:<name>, version:<n> or etag:<tag>, the
+// ETag without its quotes.
+func validCondition(cond string) bool {
+	if strings.HasPrefix(cond, "version:") {
+		_, err := strconv.ParseUint(strings.TrimPrefix(cond, "version:"), 10, 64)
+		return err == nil
+	}
+
+	return cond == "exists" || cond == "present" || cond == "absent" ||
+		strings.HasPrefix(cond, "eq:") || strings.HasPrefix(cond, "ne:") || strings.HasPrefix(cond, "etag:")
+}
+
+// conditionMet evaluates cond against the stored book, which is nil when
+// absent. eq and ne compare against the stored book name.
+func (s *MemoryStore) conditionMet(bk *Book, cond string) bool {
+	switch {
+	case cond == "exists" || cond == "present":
+		return bk != nil
+	case cond == "absent":
+		return bk == nil
+	case strings.HasPrefix(cond, "eq:"):
+		return bk != nil && bk.Name == strings.TrimPrefix(cond, "eq:")
+	case strings.HasPrefix(cond, "ne:"):
+		return bk == nil || bk.Name != strings.TrimPrefix(cond, "ne:")
+	case strings.HasPrefix(cond, "version:"):
+		return bk != nil && strconv.FormatUint(bk.Version, 10) == strings.TrimPrefix(cond, "version:")
+	case strings.HasPrefix(cond, "etag:"):
+		return bk != nil && bk.ETag(s.etagAlgo) == strconv.Quote(strings.TrimPrefix(cond, "etag:"))
+	}
+	return false
+}
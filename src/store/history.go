@@ -0,0 +1,122 @@
+package store
+
+import (
+	"slices"
+	"time"
+)
+
+// Point is a past state of the store: as of store version Version when it
+// is set, else as of Time.
+type Point struct {
+	Version uint64
+	Time    time.Time
+}
+
+// holds reports whether a version written at updatedAt had been written
+// by the point.
+func (at Point) holds(version uint64, updatedAt time.Time) bool {
+	if at.Version != 0 {
+		return version <= at.Version
+	}
+	return !updatedAt.After(at.Time)
+}
+
+// KeepHistory makes every put keep up to depth earlier versions of the
+// item it replaces, so GetAt and RangeAt can reach back that far. The
+// history lives with the key and goes when it is deleted or swept. With
+// the default of 0 a point only sees the items not replaced since.
+func (s *Store[V]) KeepHistory(depth int) {
+	s.historyDepth.Store(int64(max(depth, 0)))
+}
+
+// remember returns the history of e with e's item added, for the entry
+// that replaces it. Callers hold the shard's write lock.
+func (s *Store[V]) remember(e entry[V]) []Item[V] {
+	depth := int(s.historyDepth.Load())
+	if depth == 0 {
+		return nil
+	}
+
+	history := append(slices.Clone(e.history), e.Item)
+	if len(history) > depth {
+		history = history[len(history)-depth:]
+	}
+	return history
+}
+
+// History returns the earlier versions kept of the item with key, newest
+// first.
+func (s *Store[V]) History(key string) []Item[V] {
+	sh := s.shardFor(key)
+
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	history := slices.Clone(sh.items[key].history)
+	slices.Reverse(history)
+	return history
+}
+
+// at returns the version of e's item as of the point, and false when it
+// was not written yet, is older than the history kept or had expired by
+// then, or by now for a version.
+func (e entry[V]) at(at Point, now time.Time) (Item[V], bool) {
+	if !at.Time.IsZero() {
+		now = at.Time
+	}
+
+	for i := len(e.history); i >= 0; i-- {
+		it := e.Item
+		if i < len(e.history) {
+			it = e.history[i]
+		}
+
+		if at.holds(it.Version, it.UpdatedAt) {
+			if it.expired(now) {
+				return Item[V]{}, false
+			}
+			return it, true
+		}
+	}
+	return Item[V]{}, false
+}
+
+// GetAt returns the item with key as it was at the point: its newest
+// version written by then. It reaches back only as far as KeepHistory
+// keeps versions, and a deleted key, which takes its history with it, is
+// not seen at any point.
+func (s *Store[V]) GetAt(key string, at Point) (Item[V], bool) {
+	sh := s.shardFor(key)
+
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	e, ok := sh.items[key]
+	if !ok {
+		return Item[V]{}, false
+	}
+	return e.at(at, time.Now())
+}
+
+// RangeAt calls fn for every item as it was at the point, see GetAt, in
+// no particular order, until fn returns false. Like Range it copies each
+// shard under its lock and runs fn with no lock held.
+func (s *Store[V]) RangeAt(at Point, fn func(it Item[V]) bool) {
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		items := make([]Item[V], 0, len(sh.items))
+		now := time.Now()
+		for _, e := range sh.items {
+			if it, ok := e.at(at, now); ok {
+				items = append(items, it)
+			}
+		}
+		sh.mu.RUnlock()
+
+		for _, it := range items {
+			if !fn(it) {
+				return
+			}
+		}
+	}
+}
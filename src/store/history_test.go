@@ -0,0 +1,111 @@
+package store
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestGetAt(t *testing.T) {
+	s := New[string](4)
+	s.KeepHistory(2)
+
+	v1 := s.Put("a", "1")
+	v2 := s.Put("a", "2")
+	other := s.Put("b", "x")
+	v3 := s.Put("a", "3")
+	v4 := s.Put("a", "4")
+	s.Put("gone", "y")
+	s.Delete("gone")
+
+	tests := []struct {
+		name    string
+		key     string
+		at      Point
+		want    string
+		present bool
+	}{
+		{name: "newest", key: "a", at: Point{Version: v4}, want: "4", present: true},
+		{name: "between versions", key: "a", at: Point{Version: other}, want: "2", present: true},
+		{name: "oldest kept", key: "a", at: Point{Version: v2}, want: "2", present: true},
+		{name: "beyond the history depth", key: "a", at: Point{Version: v1}},
+		{name: "before the key", key: "b", at: Point{Version: v2}},
+		{name: "deleted key", key: "gone", at: Point{Version: v4 + 1}},
+		{name: "a later version", key: "a", at: Point{Version: v3}, want: "3", present: true},
+		{name: "by time now", key: "a", at: Point{Time: time.Now()}, want: "4", present: true},
+		{name: "by time before", key: "a", at: Point{Time: time.Now().Add(-time.Hour)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			it, ok := s.GetAt(tt.key, tt.at)
+			if ok != tt.present || it.Value != tt.want {
+				t.Errorf("GetAt(%q, %+v) = %q, %v, want %q, %v", tt.key, tt.at, it.Value, ok, tt.want, tt.present)
+			}
+		})
+	}
+}
+
+func TestGetAtWithoutHistory(t *testing.T) {
+	s := New[string](4)
+
+	v1 := s.Put("a", "1")
+	s.Put("a", "2")
+
+	if _, ok := s.GetAt("a", Point{Version: v1}); ok {
+		t.Error("GetAt saw a replaced version without KeepHistory")
+	}
+	if history := s.History("a"); len(history) != 0 {
+		t.Errorf("History = %v without KeepHistory", history)
+	}
+}
+
+func TestGetAtAnExpiredItem(t *testing.T) {
+	s := New[string](4)
+	s.KeepHistory(4)
+
+	v := s.PutTTL("a", "1", -time.Second)
+
+	if _, ok := s.GetAt("a", Point{Version: v}); ok {
+		t.Error("GetAt returned an item that has expired")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	s := New[string](4)
+	s.KeepHistory(2)
+
+	for _, value := range []string{"1", "2", "3", "4"} {
+		s.Put("a", value)
+	}
+
+	values := make([]string, 0)
+	for _, it := range s.History("a") {
+		values = append(values, it.Value)
+	}
+	if !slices.Equal(values, []string{"3", "2"}) {
+		t.Errorf("History = %v, want [3 2]", values)
+	}
+}
+
+func TestRangeAt(t *testing.T) {
+	s := New[string](4)
+	s.KeepHistory(4)
+
+	s.Put("a", "1")
+	s.Put("b", "1")
+	at := Point{Version: s.Put("c", "1")}
+	s.Put("a", "2")
+	s.Put("d", "1")
+
+	got := make([]string, 0)
+	s.RangeAt(at, func(it Item[string]) bool {
+		got = append(got, it.Key+"="+it.Value)
+		return true
+	})
+	slices.Sort(got)
+
+	if want := []string{"a=1", "b=1", "c=1"}; !slices.Equal(got, want) {
+		t.Errorf("RangeAt saw %v, want %v", got, want)
+	}
+}
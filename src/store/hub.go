@@ -0,0 +1,108 @@
+package store
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+// ShardIndex returns which of shards hash-sharded maps holds key.
+func ShardIndex(key string, shards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	return int(h.Sum32() % uint32(shards))
+}
+
+// Subscription is one reader of a Hub.
+type Subscription[E any] struct {
+	match  func(event E) bool
+	events chan E
+}
+
+// Events returns the events of the subscription. It is closed once the
+// subscription ends.
+func (sub *Subscription[E]) Events() <-chan E {
+	return sub.events
+}
+
+// Hub fans events out to its subscriptions without ever blocking the
+// publisher: a subscription whose buffer is full is dropped and sees its
+// channel closed. It is safe for concurrent use.
+type Hub[E any] struct {
+	mu   sync.Mutex
+	subs map[*Subscription[E]]bool
+
+	dropped atomic.Uint64
+}
+
+func NewHub[E any]() *Hub[E] {
+	return &Hub[E]{subs: make(map[*Subscription[E]]bool)}
+}
+
+// Subscribe returns a subscription to the events match accepts, falling up
+// to buffer events behind before it is dropped.
+func (h *Hub[E]) Subscribe(match func(event E) bool, buffer int) *Subscription[E] {
+	sub := &Subscription[E]{match: match, events: make(chan E, buffer)}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.subs[sub] = true
+
+	return sub
+}
+
+// Unsubscribe ends sub, unless it already ended.
+func (h *Hub[E]) Unsubscribe(sub *Subscription[E]) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.subs[sub] {
+		delete(h.subs, sub)
+		close(sub.events)
+	}
+}
+
+// Publish hands event to every subscription that matches it. Events
+// published in an order reach each subscription in that order.
+func (h *Hub[E]) Publish(event E) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subs {
+		if !sub.match(event) {
+			continue
+		}
+
+		select {
+		case sub.events <- event:
+		default:
+			h.dropped.Add(1)
+			delete(h.subs, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// Dropped returns how many events did not fit the buffer of a
+// subscription, each ending the subscription it was for.
+func (h *Hub[E]) Dropped() uint64 {
+	return h.dropped.Load()
+}
+
+// ResetDropped zeroes the count of Dropped.
+func (h *Hub[E]) ResetDropped() {
+	h.dropped.Store(0)
+}
+
+// CloseAll ends every subscription.
+func (h *Hub[E]) CloseAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subs {
+		delete(h.subs, sub)
+		close(sub.events)
+	}
+}
@@ -0,0 +1,231 @@
+// Package store is a sharded in-memory key-value store with versions,
+// expiry, history and change notifications, for embedding in other
+// programs. The book server builds its own store of books on the sharding
+// and the event Hub of this package, adding the indexes and multi-book
+// transactions it serves over HTTP.
+package store
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Item is one stored value. Every change gets a new Version, higher than
+// any before in the store.
+type Item[V any] struct {
+	Key       string
+	Value     V
+	Version   uint64
+	UpdatedAt time.Time
+	ExpiresAt time.Time // zero for never
+}
+
+func (it Item[V]) expired(now time.Time) bool {
+	return !it.ExpiresAt.IsZero() && !now.Before(it.ExpiresAt)
+}
+
+// Event describes one change. Old is nil for inserts and New is nil for
+// deletes and expiries.
+type Event[V any] struct {
+	Op  string // put, delete or expire
+	Key string
+	Old *Item[V]
+	New *Item[V]
+}
+
+// watchBuffer is how many events a watcher may fall behind before it is
+// dropped, so a slow reader never holds up writes.
+const watchBuffer = 64
+
+// Store maps string keys to values of type V. Keys are spread over
+// hash-sharded maps with a lock each, so writes to different shards do not
+// wait for one another. It is safe for concurrent use.
+type Store[V any] struct {
+	shards   []*shard[V]
+	revision atomic.Uint64
+	events   *Hub[Event[V]]
+
+	historyDepth atomic.Int64
+}
+
+type shard[V any] struct {
+	mu    sync.RWMutex
+	items map[string]entry[V]
+}
+
+// entry is an item and its replaced versions, oldest first.
+type entry[V any] struct {
+	Item[V]
+	history []Item[V]
+}
+
+// New returns an empty store with the given number of shards, at least 1.
+func New[V any](shards int) *Store[V] {
+	s := &Store[V]{
+		shards: make([]*shard[V], max(shards, 1)),
+		events: NewHub[Event[V]](),
+	}
+
+	for i := range s.shards {
+		s.shards[i] = &shard[V]{items: make(map[string]entry[V])}
+	}
+
+	return s
+}
+
+func (s *Store[V]) shardFor(key string) *shard[V] {
+	return s.shards[ShardIndex(key, len(s.shards))]
+}
+
+// Get returns the item with key, and false when there is none or it has
+// expired.
+func (s *Store[V]) Get(key string) (Item[V], bool) {
+	sh := s.shardFor(key)
+
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	e, ok := sh.items[key]
+	if !ok || e.expired(time.Now()) {
+		return Item[V]{}, false
+	}
+	return e.Item, true
+}
+
+// Put stores value under key without an expiry and returns its version.
+func (s *Store[V]) Put(key string, value V) uint64 {
+	return s.put(key, value, time.Time{})
+}
+
+// PutTTL stores value under key until ttl has passed and returns its
+// version.
+func (s *Store[V]) PutTTL(key string, value V, ttl time.Duration) uint64 {
+	return s.put(key, value, time.Now().Add(ttl))
+}
+
+func (s *Store[V]) put(key string, value V, expiresAt time.Time) uint64 {
+	sh := s.shardFor(key)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	now := time.Now()
+	it := Item[V]{Key: key, Value: value, Version: s.revision.Add(1), UpdatedAt: now, ExpiresAt: expiresAt}
+
+	event := Event[V]{Op: "put", Key: key, New: &it}
+	e := entry[V]{Item: it}
+
+	if old, ok := sh.items[key]; ok {
+		if !old.expired(now) {
+			event.Old = &old.Item
+		}
+		e.history = s.remember(old)
+	}
+
+	sh.items[key] = e
+	s.events.Publish(event)
+
+	return it.Version
+}
+
+// Delete removes the item with key and reports whether it was there.
+func (s *Store[V]) Delete(key string) bool {
+	sh := s.shardFor(key)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	old, ok := sh.items[key]
+	if !ok {
+		return false
+	}
+
+	delete(sh.items, key)
+
+	if old.expired(time.Now()) {
+		s.events.Publish(Event[V]{Op: "expire", Key: key, Old: &old.Item})
+		return false
+	}
+
+	s.events.Publish(Event[V]{Op: "delete", Key: key, Old: &old.Item})
+	return true
+}
+
+// Range calls fn for every unexpired item, in no particular order, until
+// fn returns false. Each shard is copied under its lock and fn runs with
+// no lock held, so it may change the store; such changes may or may not
+// be seen by the rest of the range.
+func (s *Store[V]) Range(fn func(it Item[V]) bool) {
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		items := make([]Item[V], 0, len(sh.items))
+		now := time.Now()
+		for _, e := range sh.items {
+			if !e.expired(now) {
+				items = append(items, e.Item)
+			}
+		}
+		sh.mu.RUnlock()
+
+		for _, it := range items {
+			if !fn(it) {
+				return
+			}
+		}
+	}
+}
+
+// Len returns the number of unexpired items.
+func (s *Store[V]) Len() int {
+	n := 0
+	now := time.Now()
+
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for _, e := range sh.items {
+			if !e.expired(now) {
+				n++
+			}
+		}
+		sh.mu.RUnlock()
+	}
+
+	return n
+}
+
+// Sweep removes the expired items, sending an expire event for each.
+// Expired items are never returned, but take memory until swept, so call
+// it periodically.
+func (s *Store[V]) Sweep() {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		now := time.Now()
+		for key, e := range sh.items {
+			if e.expired(now) {
+				delete(sh.items, key)
+				s.events.Publish(Event[V]{Op: "expire", Key: key, Old: &e.Item})
+			}
+		}
+		sh.mu.Unlock()
+	}
+}
+
+// Watch returns the changes to keys starting with prefix, from now on and
+// in the order of each key's changes. The channel is closed once ctx is
+// done, or when the reader falls more than a few dozen events behind.
+//
+// Events are published under the lock of the key's shard, so the events
+// of one key go out in order.
+func (s *Store[V]) Watch(ctx context.Context, prefix string) <-chan Event[V] {
+	sub := s.events.Subscribe(func(event Event[V]) bool { return strings.HasPrefix(event.Key, prefix) }, watchBuffer)
+
+	go func() {
+		<-ctx.Done()
+		s.events.Unsubscribe(sub)
+	}()
+
+	return sub.Events()
+}
@@ -0,0 +1,339 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGetPutDelete(t *testing.T) {
+	tests := []struct {
+		name    string
+		ops     func(s *Store[string])
+		key     string
+		want    string
+		present bool
+	}{
+		{
+			name:    "put then get",
+			ops:     func(s *Store[string]) { s.Put("a", "1") },
+			key:     "a",
+			want:    "1",
+			present: true,
+		},
+		{
+			name:    "put replaces",
+			ops:     func(s *Store[string]) { s.Put("a", "1"); s.Put("a", "2") },
+			key:     "a",
+			want:    "2",
+			present: true,
+		},
+		{
+			name: "missing key",
+			ops:  func(s *Store[string]) { s.Put("a", "1") },
+			key:  "b",
+		},
+		{
+			name: "deleted key",
+			ops:  func(s *Store[string]) { s.Put("a", "1"); s.Delete("a") },
+			key:  "a",
+		},
+		{
+			name:    "ttl not passed",
+			ops:     func(s *Store[string]) { s.PutTTL("a", "1", time.Hour) },
+			key:     "a",
+			want:    "1",
+			present: true,
+		},
+		{
+			name: "ttl passed",
+			ops:  func(s *Store[string]) { s.PutTTL("a", "1", -time.Second) },
+			key:  "a",
+		},
+		{
+			name:    "put clears a ttl",
+			ops:     func(s *Store[string]) { s.PutTTL("a", "1", -time.Second); s.Put("a", "2") },
+			key:     "a",
+			want:    "2",
+			present: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New[string](4)
+			tt.ops(s)
+
+			it, ok := s.Get(tt.key)
+			if ok != tt.present || it.Value != tt.want {
+				t.Errorf("Get(%q) = %q, %v, want %q, %v", tt.key, it.Value, ok, tt.want, tt.present)
+			}
+			if ok && it.Key != tt.key {
+				t.Errorf("Get(%q) returned the item of %q", tt.key, it.Key)
+			}
+		})
+	}
+}
+
+func TestVersionsIncrease(t *testing.T) {
+	s := New[int](4)
+
+	first := s.Put("a", 1)
+	second := s.Put("b", 2)
+	third := s.PutTTL("a", 3, time.Hour)
+
+	if !(first < second && second < third) {
+		t.Fatalf("versions %d, %d, %d do not increase", first, second, third)
+	}
+	if it, _ := s.Get("a"); it.Version != third {
+		t.Errorf("a has version %d, want %d", it.Version, third)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  func(s *Store[string])
+		want bool
+	}{
+		{name: "present", ops: func(s *Store[string]) { s.Put("a", "1") }, want: true},
+		{name: "missing", ops: func(s *Store[string]) {}, want: false},
+		{name: "expired", ops: func(s *Store[string]) { s.PutTTL("a", "1", -time.Second) }, want: false},
+		{name: "deleted twice", ops: func(s *Store[string]) { s.Put("a", "1"); s.Delete("a") }, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New[string](4)
+			tt.ops(s)
+
+			if got := s.Delete("a"); got != tt.want {
+				t.Errorf("Delete = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRange(t *testing.T) {
+	s := New[int](4)
+	for i := 0; i < 10; i++ {
+		s.Put(fmt.Sprintf("k%d", i), i)
+	}
+	s.PutTTL("expired", 99, -time.Second)
+
+	keys := make([]string, 0)
+	s.Range(func(it Item[int]) bool {
+		keys = append(keys, it.Key)
+		return true
+	})
+	slices.Sort(keys)
+
+	if len(keys) != 10 || slices.Contains(keys, "expired") {
+		t.Errorf("Range saw %v, want k0 to k9", keys)
+	}
+	if s.Len() != 10 {
+		t.Errorf("Len = %d, want 10", s.Len())
+	}
+
+	seen := 0
+	s.Range(func(it Item[int]) bool {
+		seen++
+		return seen < 3
+	})
+	if seen != 3 {
+		t.Errorf("Range went on for %d items after fn returned false at 3", seen)
+	}
+
+	// fn runs without a lock, so it may write.
+	s.Range(func(it Item[int]) bool {
+		s.Put(it.Key, it.Value+1)
+		return true
+	})
+}
+
+func TestSweep(t *testing.T) {
+	s := New[string](4)
+	s.PutTTL("gone", "1", -time.Second)
+	s.PutTTL("kept", "2", time.Hour)
+	s.Put("forever", "3")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := s.Watch(ctx, "")
+
+	s.Sweep()
+
+	select {
+	case event := <-events:
+		if event.Op != "expire" || event.Key != "gone" || event.Old == nil || event.Old.Value != "1" {
+			t.Errorf("Sweep sent %+v, want the expiry of gone", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Sweep sent no expire event")
+	}
+
+	select {
+	case event := <-events:
+		t.Errorf("Sweep sent another event %+v", event)
+	default:
+	}
+
+	if s.Len() != 2 {
+		t.Errorf("Len = %d after Sweep, want 2", s.Len())
+	}
+}
+
+func TestWatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		ops    func(s *Store[string])
+		want   []string
+	}{
+		{
+			name: "every change",
+			ops: func(s *Store[string]) {
+				s.Put("a", "1")
+				s.Put("a", "2")
+				s.Delete("a")
+			},
+			want: []string{"put a  1", "put a 1 2", "delete a 2 "},
+		},
+		{
+			name:   "by prefix",
+			prefix: "user/",
+			ops: func(s *Store[string]) {
+				s.Put("user/1", "x")
+				s.Put("group/1", "y")
+				s.Delete("user/1")
+			},
+			want: []string{"put user/1  x", "delete user/1 x "},
+		},
+		{
+			name: "expired on delete",
+			ops: func(s *Store[string]) {
+				s.PutTTL("a", "1", -time.Second)
+				s.Delete("a")
+			},
+			want: []string{"put a  1", "expire a 1 "},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New[string](4)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			events := s.Watch(ctx, tt.prefix)
+			tt.ops(s)
+			cancel()
+
+			got := make([]string, 0)
+			for event := range events {
+				old, value := "", ""
+				if event.Old != nil {
+					old = event.Old.Value
+				}
+				if event.New != nil {
+					value = event.New.Value
+				}
+				got = append(got, fmt.Sprintf("%s %s %s %s", event.Op, event.Key, old, value))
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("events %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatchDropsASlowReader(t *testing.T) {
+	s := New[int](4)
+	events := s.Watch(context.Background(), "")
+
+	for i := 0; i < watchBuffer+1; i++ {
+		s.Put("a", i)
+	}
+
+	n := 0
+	for range events {
+		n++
+	}
+	if n != watchBuffer {
+		t.Errorf("the reader got %d events before it was dropped, want %d", n, watchBuffer)
+	}
+}
+
+func TestHubIsolatesAStalledSubscriber(t *testing.T) {
+	h := NewHub[int]()
+	stalled := h.Subscribe(func(int) bool { return true }, 1)
+	other := h.Subscribe(func(int) bool { return true }, 100)
+
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		for i := range 100 {
+			h.Publish(i)
+		}
+	}()
+
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishing blocked on the stalled subscriber")
+	}
+
+	if n := len(stalled.Events()); n != 1 {
+		t.Errorf("the stalled subscriber kept %d events, want its buffer of 1", n)
+	}
+	if _, ok := <-stalled.Events(); !ok {
+		t.Error("the stalled subscriber lost the event it had buffered")
+	}
+	if _, ok := <-stalled.Events(); ok {
+		t.Error("the stalled subscriber was not dropped")
+	}
+	if n := len(other.Events()); n != 100 {
+		t.Errorf("the other subscriber got %d events, want 100", n)
+	}
+	if dropped := h.Dropped(); dropped != 1 {
+		t.Errorf("dropped %d events, want 1", dropped)
+	}
+}
+
+func TestConcurrentPuts(t *testing.T) {
+	s := New[int](8)
+
+	const writers, puts = 8, 200
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < puts; i++ {
+				s.Put(fmt.Sprintf("w%d/%d", w, i), i)
+				s.Get(fmt.Sprintf("w%d/%d", w, i/2))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if s.Len() != writers*puts {
+		t.Errorf("Len = %d, want %d", s.Len(), writers*puts)
+	}
+}
+
+func TestShardIndex(t *testing.T) {
+	for _, shards := range []int{1, 2, 7, 64} {
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key%d", i)
+			index := ShardIndex(key, shards)
+			if index < 0 || index >= shards || index != ShardIndex(key, shards) {
+				t.Fatalf("ShardIndex(%q, %d) = %d", key, shards, index)
+			}
+		}
+	}
+}
@@ -0,0 +1,874 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReplaceBooksReachesReplicas(t *testing.T) {
+	tests := []struct {
+		name    string
+		stored  []Book
+		replace func(stored []Book) []Book
+		events  []string
+	}{
+		{
+			name:    "flush",
+			stored:  []Book{{Id: "a", Name: "1"}, {Id: "b", Name: "2"}},
+			replace: func([]Book) []Book { return nil },
+			events:  []string{"delete a", "delete b"},
+		},
+		{
+			name:    "unchanged books",
+			stored:  []Book{{Id: "a", Name: "1"}},
+			replace: func(stored []Book) []Book { return stored },
+			events:  []string{},
+		},
+		{
+			name:   "restore of an older version",
+			stored: []Book{{Id: "a", Name: "1"}},
+			replace: func(stored []Book) []Book {
+				older := stored[0]
+				older.Name, older.Version = "0", stored[0].Version-1
+				return []Book{older, {Id: "c", Name: "3", Version: 1}}
+			},
+			events: []string{"delete a", "put a", "put c"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := NewMemoryStore(4, 0)
+			replica := NewMemoryStore(4, 0)
+
+			for _, book := range tt.stored {
+				if err := primary.AddBook(book); err != nil {
+					t.Fatal(err)
+				}
+			}
+			stored, _ := primary.GetBooks(context.Background())
+			replica.ReplaceBooks(stored)
+
+			wt := primary.Watchers().SubscribeAll(DefaultConfig().replicationBuffer())
+			primary.ReplaceBooks(tt.replace(stored))
+			primary.Watchers().Unsubscribe(wt)
+
+			events := make([]ChangeEvent, 0)
+			for event := range wt.Events() {
+				events = append(events, event)
+			}
+
+			seen := make([]string, 0, len(events))
+			for _, event := range events {
+				seen = append(seen, event.Op+" "+event.Id)
+				replica.ApplyChange(event)
+			}
+			slices.Sort(seen)
+			if !slices.Equal(seen, tt.events) {
+				t.Errorf("events %v, want %v", seen, tt.events)
+			}
+
+			want, _ := primary.GetBooks(context.Background())
+			got, _ := replica.GetBooks(context.Background())
+			if len(got) != len(want) {
+				t.Fatalf("replica holds %d books, want %d", len(got), len(want))
+			}
+			for _, book := range want {
+				if b := replica.FindBookById(book.Id); b == nil || b.Name != book.Name || b.Version != book.Version {
+					t.Errorf("replica has %v for %s, want %v", b, book.Id, book)
+				}
+			}
+		})
+	}
+}
+
+func TestReplicationKeepsUpWithABatch(t *testing.T) {
+	s, ts := newTestServer(t)
+
+	wt := s.store.Watchers().SubscribeAll(DefaultConfig().replicationBuffer())
+	defer s.store.Watchers().Unsubscribe(wt)
+
+	const ops = 5000
+
+	var body strings.Builder
+	body.WriteString("[")
+	for i := 0; i < ops; i++ {
+		if i > 0 {
+			body.WriteString(",")
+		}
+		fmt.Fprintf(&body, `{"op":"put","book":{"id":"b%d","name":"x"}}`, i)
+	}
+	body.WriteString("]")
+
+	if status, answer := send(t, http.MethodPost, ts.URL+"/batch", body.String()); status != http.StatusOK {
+		t.Fatalf("batch: %d %s", status, answer)
+	}
+
+	for i := 0; i < ops; i++ {
+		if _, ok := <-wt.Events(); !ok {
+			t.Fatalf("the replica was dropped after %d of %d changes", i, ops)
+		}
+	}
+}
+
+func TestWritesProceedDuringASlowList(t *testing.T) {
+	store := NewMemoryStore(4, 0)
+	for i := 0; i < 1000; i++ {
+		if err := store.AddBook(Book{Id: fmt.Sprintf("b%d", i), Name: "old"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A listing that has taken its views and not yet read them.
+	views, _, release := store.views()
+
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			if err := store.SetBook(Book{Id: fmt.Sprintf("b%d", i), Name: "new"}); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes waited on the listing")
+	}
+
+	listed := 0
+	for _, books := range views {
+		for _, e := range books {
+			listed++
+			if e.book.Name != "old" {
+				t.Fatalf("the listing saw %s change to %q", e.book.Id, e.book.Name)
+			}
+		}
+	}
+	if listed != 1000 {
+		t.Fatalf("the listing saw %d books, want 1000", listed)
+	}
+	release()
+
+	// Once no listing reads them, writes change the books in place.
+	for _, sh := range store.shards {
+		sh.mu.Lock()
+		before := reflect.ValueOf(sh.books).UnsafePointer()
+		for id := range sh.books {
+			store.install(sh, Book{Id: id, Name: "newer", Version: store.revision.Add(1)})
+			break
+		}
+		after := reflect.ValueOf(sh.books).UnsafePointer()
+		sh.mu.Unlock()
+
+		if before != after {
+			t.Error("a write after the listing copied the books of its shard")
+		}
+	}
+}
+
+// TestSizeBytesStaysAccurate checks the running totals of SizeBytes against
+// a count of the books left after each sequence of writes.
+func TestSizeBytesStaysAccurate(t *testing.T) {
+	tests := []struct {
+		name         string
+		writes       func(s *MemoryStore)
+		keys, values int
+	}{
+		{name: "empty", writes: func(s *MemoryStore) {}, keys: 0, values: 0},
+		{
+			name: "inserts",
+			writes: func(s *MemoryStore) {
+				s.AddBook(Book{Id: "a", Author: "AA", Name: "111"})
+				s.AddBook(Book{Id: "bb", Name: "2"})
+			},
+			keys: 3, values: 6,
+		},
+		{
+			name: "an update that grows and one that shrinks",
+			writes: func(s *MemoryStore) {
+				s.AddBook(Book{Id: "a", Name: "1"})
+				s.AddBook(Book{Id: "b", Name: "22222"})
+				s.SetBook(Book{Id: "a", Name: "1111"})
+				s.SetBook(Book{Id: "b", Name: "2"})
+			},
+			keys: 2, values: 5,
+		},
+		{
+			name: "a delete",
+			writes: func(s *MemoryStore) {
+				s.AddBook(Book{Id: "a", Name: "1"})
+				s.AddBook(Book{Id: "bb", Name: "22"})
+				s.DelBook("bb")
+			},
+			keys: 1, values: 1,
+		},
+		{
+			name: "a failed write changes nothing",
+			writes: func(s *MemoryStore) {
+				s.AddBook(Book{Id: "a", Name: "1"})
+				s.AddBook(Book{Id: "a", Name: "longer"})
+				s.DelBook("missing")
+			},
+			keys: 1, values: 1,
+		},
+		{
+			name: "a batch and a drain",
+			writes: func(s *MemoryStore) {
+				s.ApplyBatch([]BatchOp{{Op: "put", Book: Book{Id: "a", Name: "1"}}, {Op: "put", Book: Book{Id: "b", Name: "22"}}, {Op: "put", Book: Book{Id: "c", List: []string{"x", "yy"}}}})
+				s.DrainBooks([]string{"b"}, nil)
+			},
+			keys: 2, values: 4,
+		},
+		{
+			name: "a replace of every book",
+			writes: func(s *MemoryStore) {
+				s.AddBook(Book{Id: "a", Name: "1"})
+				s.ReplaceBooks([]Book{{Id: "xyz", Author: "Q", Name: "zz"}})
+			},
+			keys: 3, values: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemoryStore(4, 0)
+			tt.writes(s)
+
+			keys, values := s.SizeBytes()
+			if keys != tt.keys || values != tt.values {
+				t.Errorf("SizeBytes() = %d, %d, want %d, %d", keys, values, tt.keys, tt.values)
+			}
+
+			books, _ := s.GetBooks(context.Background())
+			counted := 0
+			for _, book := range books {
+				counted += book.valueSize()
+			}
+			if counted != values {
+				t.Errorf("the books hold %d value bytes, SizeBytes reports %d", counted, values)
+			}
+		})
+	}
+}
+
+func TestSizeBytesRoutes(t *testing.T) {
+	s, ts := newTestServer(t)
+	s.store.AddBook(Book{Id: "ab", Author: "A", Name: "123"})
+
+	for _, path := range []string{"/size-bytes", "/admin/stats"} {
+		status, body := send(t, http.MethodGet, ts.URL+path, "")
+		if status != http.StatusOK || !strings.Contains(body, `"key_bytes":2`) || !strings.Contains(body, `"value_bytes":4`) {
+			t.Errorf("%s = %d %s", path, status, body)
+		}
+	}
+}
+
+func TestShardedStore(t *testing.T) {
+	tests := []struct {
+		name   string
+		shards int
+	}{
+		{name: "one shard", shards: 1},
+		{name: "two shards", shards: 2},
+		{name: "the default", shards: 16},
+		{name: "more shards than books", shards: 1000},
+	}
+
+	const books = 200
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemoryStore(tt.shards, 0)
+
+			ids := make([]string, books)
+			for i := range ids {
+				ids[i] = fmt.Sprintf("book-%03d", i)
+				if err := s.AddBook(Book{Id: ids[i], Name: "0"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// writers on every shard at once, each writing every book
+			var wg sync.WaitGroup
+			for writer := range 8 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for _, id := range ids {
+						s.SetBook(Book{Id: id, Name: fmt.Sprint(writer)})
+					}
+				}()
+			}
+			wg.Wait()
+
+			listed, err := s.GetBooks(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			listedIds := make([]string, 0, len(listed))
+			for _, book := range listed {
+				listedIds = append(listedIds, book.Id)
+			}
+			if !slices.Equal(listedIds, ids) {
+				t.Fatalf("listed %d books out of insertion order", len(listed))
+			}
+
+			// a batch and a drain spanning the shards
+			ops := []BatchOp{{Op: "delete", Book: Book{Id: ids[0]}}, {Op: "put", Book: Book{Id: "new", Name: "x"}}}
+			if _, ok := s.ApplyBatch(ops); !ok {
+				t.Fatal("the batch failed")
+			}
+			drained, err := s.DrainBooks(ids[1:books/2], nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(drained) != books/2-1 {
+				t.Errorf("drained %d books, want %d", len(drained), books/2-1)
+			}
+
+			listed, _ = s.GetBooks(context.Background())
+			if len(listed) != books/2+1 || listed[0].Id != ids[books/2] || listed[len(listed)-1].Id != "new" {
+				t.Errorf("after the batch and the drain %d books are left, from %s to %s", len(listed), listed[0].Id, listed[len(listed)-1].Id)
+			}
+		})
+	}
+}
+
+func TestImportBooks(t *testing.T) {
+	refuse := func(writes []*BatchOp) error { return errors.New("refused") }
+	kept := bucketIdPrefix + "b/kept"
+
+	tests := []struct {
+		name    string
+		books   []Book
+		prepare func(writes []*BatchOp) error
+		want    []string // the stored books as id=name
+		deleted int
+		refused bool
+	}{
+		{name: "replace everything", books: []Book{{Id: "x", Name: "new"}}, want: []string{kept + "=1", "x=new"}, deleted: 2},
+		{name: "replace a stored book", books: []Book{{Id: "a", Name: "new"}}, want: []string{kept + "=1", "a=new"}, deleted: 1},
+		{name: "import nothing", want: []string{kept + "=1"}, deleted: 2},
+		{
+			name:  "prepare sees the puts and the present deletes",
+			books: []Book{{Id: "a", Name: "new"}},
+			prepare: func(writes []*BatchOp) error {
+				if len(writes) != 2 || writes[0].Op != "put" || writes[1].Op != "delete" || writes[1].Book.Id != "b" {
+					return errors.New("unexpected writes")
+				}
+				writes[0].Book.Name = "prepared"
+				return nil
+			},
+			want:    []string{kept + "=1", "a=prepared"},
+			deleted: 1,
+		},
+		{name: "a refused import writes nothing", books: []Book{{Id: "x", Name: "new"}}, prepare: refuse, want: []string{kept + "=1", "a=1", "b=2"}, refused: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemoryStore(4, 0)
+			for _, book := range []Book{{Id: "a", Name: "1"}, {Id: "b", Name: "2"}, {Id: kept, Name: "1"}} {
+				s.AddBook(book)
+			}
+			before := s.revision.Load()
+
+			results, err := s.ImportBooks(tt.books, inBucket, tt.prepare)
+			if (err != nil) != tt.refused {
+				t.Fatalf("ImportBooks = %v", err)
+			}
+
+			deleted := 0
+			for _, result := range results {
+				switch result.Op {
+				case "put":
+					if result.Version <= before {
+						t.Errorf("%s was put as version %d, want a new one", result.Id, result.Version)
+					}
+				case "delete":
+					deleted++
+				}
+			}
+			if deleted != tt.deleted {
+				t.Errorf("deleted %d books, want %d", deleted, tt.deleted)
+			}
+
+			books, _ := s.GetBooks(context.Background())
+			stored := make([]string, 0, len(books))
+			for _, book := range books {
+				stored = append(stored, book.Id+"="+book.Name)
+			}
+			slices.Sort(stored)
+			if !slices.Equal(stored, tt.want) {
+				t.Errorf("stored %v, want %v", stored, tt.want)
+			}
+		})
+	}
+}
+
+func TestImportBooksDuringWrites(t *testing.T) {
+	s := NewMemoryStore(16, 0)
+	for i := range 200 {
+		s.AddBook(Book{Id: fmt.Sprint("old-", i), Name: "x"})
+	}
+
+	// writers delete the books the import deletes and add books of their
+	// own while it runs
+	var wg sync.WaitGroup
+	for writer := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := writer; i < 200; i += 4 {
+				s.DelBook(fmt.Sprint("old-", i))
+				s.AddBook(Book{Id: fmt.Sprint("new-", i), Name: "x"})
+			}
+		}()
+	}
+
+	_, err := s.ImportBooks([]Book{{Id: "imported", Name: "x"}}, inBucket, nil)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	books, _ := s.GetBooks(context.Background())
+	for _, book := range books {
+		if strings.HasPrefix(book.Id, "old-") {
+			t.Errorf("%s survived the import", book.Id)
+		}
+	}
+	if s.FindBookById("imported") == nil {
+		t.Error("the imported book is missing")
+	}
+}
+
+func TestLimitBytesUnderConcurrentWrites(t *testing.T) {
+	// every book is a four byte id and a six byte name
+	tests := []struct {
+		name     string
+		maxBytes int64
+		quotas   map[string]Quota
+		bucket   bool // whether the books go into a bucket
+		want     int
+	}{
+		{name: "the store limit", maxBytes: 105, want: 10},
+		{name: "a bucket book quota", quotas: map[string]Quota{"b": {MaxBooks: 7}}, bucket: true, want: 7},
+		{name: "a bucket byte quota", quotas: map[string]Quota{"*": {MaxBytes: 55}}, bucket: true, want: 5},
+		{name: "a quota of another bucket", quotas: map[string]Quota{"other": {MaxBooks: 1}}, bucket: true, want: 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemoryStore(16, 0)
+			s.LimitBytes(tt.maxBytes, tt.quotas)
+
+			var stored atomic.Int64
+			var wg sync.WaitGroup
+			for writer := range 10 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := writer; i < 100; i += 10 {
+						id := fmt.Sprintf("b%03d", i)
+						if tt.bucket {
+							id = bucketStoreId("b", id)
+						}
+
+						err := s.AddBook(Book{Id: id, Name: "xxxxxx"})
+						var exceeded *limitExceeded
+						switch {
+						case err == nil:
+							stored.Add(1)
+						case !errors.As(err, &exceeded):
+							t.Errorf("AddBook = %v, want a limit error", err)
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			if stored.Load() != int64(tt.want) {
+				t.Errorf("stored %d books, want %d", stored.Load(), tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitBytesAccounting(t *testing.T) {
+	s := NewMemoryStore(4, 0)
+	s.AddBook(Book{Id: "a", Name: "xxxx"})
+	s.LimitBytes(9, nil)
+
+	steps := []struct {
+		name  string
+		write func() error
+		fails bool
+	}{
+		{name: "books stored before count", write: func() error { return s.AddBook(Book{Id: "b", Name: "xxxx"}) }, fails: true},
+		{name: "a smaller value fits", write: func() error { return s.SetBook(Book{Id: "a", Name: "x"}) }},
+		{name: "the bytes it freed are reused", write: func() error { return s.AddBook(Book{Id: "b", Name: "xxx"}) }},
+		{name: "a txn past the limit", write: func() error {
+			_, _, err := s.Txn(nil, []BatchOp{{Op: "put", Book: Book{Id: "c", Name: "xxx"}}}, nil, nil)
+			return err
+		}, fails: true},
+		{name: "a delete frees its bytes", write: func() error { return s.DelBook("b") }},
+		{name: "a batch of the freed bytes", write: func() error {
+			if results, ok := s.ApplyBatch([]BatchOp{{Op: "put", Book: Book{Id: "c", Name: "xx"}}}); !ok {
+				return errors.New(results[0].Error)
+			}
+			return nil
+		}},
+		{name: "the store is full", write: func() error { return s.SetBook(Book{Id: "a", Name: "xxxxxx"}) }, fails: true},
+	}
+
+	for _, step := range steps {
+		if err := step.write(); (err != nil) != step.fails {
+			t.Fatalf("%s: error %v", step.name, err)
+		}
+		if keyBytes, valueBytes := s.SizeBytes(); keyBytes+valueBytes > 9 {
+			t.Fatalf("%s: the store holds %d bytes", step.name, keyBytes+valueBytes)
+		}
+	}
+}
+
+// BenchmarkConcurrentWrites replaces books from GOMAXPROCS goroutines at
+// once. The shard counts only differ with several CPUs, e.g. -cpu 8.
+func BenchmarkConcurrentWrites(b *testing.B) {
+	for _, shards := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			s, ids := benchStore(b, shards, 4096, "0")
+
+			parallel(b, func(i int) {
+				s.SetBook(Book{Id: ids[i%len(ids)], Name: "x"})
+			})
+		})
+	}
+}
+
+// BenchmarkContendedGets reads one book, or books spread over the shards,
+// from GOMAXPROCS goroutines at once.
+func BenchmarkContendedGets(b *testing.B) {
+	for _, books := range []int{1, 4096} {
+		b.Run(fmt.Sprintf("books=%d", books), func(b *testing.B) {
+			s, ids := benchStore(b, 16, books, "x")
+
+			parallel(b, func(i int) {
+				s.FindBookById(ids[i%len(ids)])
+			})
+		})
+	}
+}
+
+// BenchmarkContendedPuts replaces one book, or books spread over the
+// shards, from GOMAXPROCS goroutines at once.
+func BenchmarkContendedPuts(b *testing.B) {
+	for _, books := range []int{1, 4096} {
+		b.Run(fmt.Sprintf("books=%d", books), func(b *testing.B) {
+			s, ids := benchStore(b, 16, books, "0")
+
+			parallel(b, func(i int) {
+				s.SetBook(Book{Id: ids[i%len(ids)], Name: "x"})
+			})
+		})
+	}
+}
+
+// BenchmarkMixed reads and replaces books from GOMAXPROCS goroutines at
+// once, reads making up the given percentage.
+func BenchmarkMixed(b *testing.B) {
+	for _, reads := range []int{50, 90, 99} {
+		b.Run(fmt.Sprintf("reads=%d%%", reads), func(b *testing.B) {
+			s, ids := benchStore(b, 16, 4096, "0")
+
+			parallel(b, func(i int) {
+				id := ids[i%len(ids)]
+				if i%100 < reads {
+					s.FindBookById(id)
+				} else {
+					s.SetBook(Book{Id: id, Name: "x"})
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkPutValueSize(b *testing.B) {
+	for _, size := range []int{16, 1 << 10, 16 << 10, 60 << 10} {
+		b.Run(fmt.Sprintf("bytes=%d", size), func(b *testing.B) {
+			s, ids := benchStore(b, 16, 4096, "0")
+			value := strings.Repeat("x", size)
+			b.SetBytes(int64(size))
+
+			parallel(b, func(i int) {
+				s.SetBook(Book{Id: ids[i%len(ids)], Name: value})
+			})
+		})
+	}
+}
+
+// benchStore returns a store of the given shards holding books named name,
+// and their ids.
+func benchStore(b *testing.B, shards, books int, name string) (*MemoryStore, []string) {
+	b.Helper()
+
+	s := NewMemoryStore(shards, 0)
+	ids := make([]string, books)
+
+	for i := range ids {
+		ids[i] = fmt.Sprintf("book-%d", i)
+		s.AddBook(Book{Id: ids[i], Name: name})
+	}
+
+	return s, ids
+}
+
+// parallel runs op from GOMAXPROCS goroutines with a counter, each
+// goroutine starting at another point so they spread over the books.
+func parallel(b *testing.B, op func(i int)) {
+	var next atomic.Uint64
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(next.Add(1)) * 7919
+		for pb.Next() {
+			op(i)
+			i++
+		}
+	})
+}
+
+// countingUpstream holds one book and counts the reads of each id, each
+// waiting for release.
+type countingUpstream struct {
+	mu      sync.Mutex
+	gets    map[string]int
+	release chan struct{}
+}
+
+func (cu *countingUpstream) Get(id string) (*Book, error) {
+	cu.mu.Lock()
+	cu.gets[id]++
+	cu.mu.Unlock()
+
+	<-cu.release
+	return &Book{Id: id, Name: "upstream"}, nil
+}
+
+func (cu *countingUpstream) List(ctx context.Context) ([]Book, error) { return nil, nil }
+func (cu *countingUpstream) Put(book Book) error                      { return nil }
+func (cu *countingUpstream) Delete(id string) error                   { return nil }
+func (cu *countingUpstream) Ping() error                              { return nil }
+func (cu *countingUpstream) Close() error                             { return nil }
+
+func TestCacheStoreCoalescesMisses(t *testing.T) {
+	tests := []struct {
+		name string
+		ids  []string // read by 20 clients each at once
+	}{
+		{name: "one id", ids: []string{"a"}},
+		{name: "two ids", ids: []string{"a", "b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &countingUpstream{gets: make(map[string]int), release: make(chan struct{})}
+			// a ttl of 0 reads every book through, so only coalescing
+			// saves fetches
+			cs := NewCacheStore(upstream, 0, NewMemoryStore(4, 0))
+
+			var wg sync.WaitGroup
+			var misses atomic.Int64
+			for _, id := range tt.ids {
+				for range 20 {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						if book := cs.FindBookById(id); book == nil || book.Name != "upstream" {
+							misses.Add(1)
+						}
+					}()
+				}
+			}
+
+			// let every client reach the fetch in flight before it returns
+			time.Sleep(100 * time.Millisecond)
+			close(upstream.release)
+			wg.Wait()
+
+			if n := misses.Load(); n != 0 {
+				t.Errorf("%d reads did not get the upstream book", n)
+			}
+			for _, id := range tt.ids {
+				if n := upstream.gets[id]; n != 1 {
+					t.Errorf("%s was fetched %d times, want once", id, n)
+				}
+			}
+		})
+	}
+}
+
+// expiring returns a book named name that expires at.
+func expiring(id, name string, at time.Time) Book {
+	return Book{Id: id, Name: name, ExpiresAt: &at}
+}
+
+func TestSweepExpiresInOrder(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		books   []Book
+		sweepAt time.Duration // after now
+		want    []string      // expired ids, in order
+	}{
+		{
+			name:    "due books",
+			books:   []Book{expiring("order/c", "x", now.Add(30*time.Millisecond)), expiring("order/a", "x", now.Add(10*time.Millisecond)), expiring("order/b", "x", now.Add(20*time.Millisecond))},
+			sweepAt: time.Hour,
+			want:    []string{"order/a", "order/b", "order/c"},
+		},
+		{
+			name:    "books not due yet",
+			books:   []Book{expiring("order/a", "x", now.Add(10*time.Millisecond)), expiring("order/b", "x", now.Add(time.Minute))},
+			sweepAt: time.Second,
+			want:    []string{"order/a"},
+		},
+		{
+			name: "a book written again without a ttl",
+			books: []Book{
+				expiring("order/a", "x", now.Add(10*time.Millisecond)),
+				{Id: "order/a", Name: "y"},
+				expiring("order/b", "x", now.Add(20*time.Millisecond)),
+			},
+			sweepAt: time.Hour,
+			want:    []string{"order/b"},
+		},
+		{
+			name: "a book written again with a later ttl",
+			books: []Book{
+				expiring("order/a", "x", now.Add(10*time.Millisecond)),
+				expiring("order/a", "y", now.Add(time.Minute)),
+			},
+			sweepAt: time.Second,
+			want:    []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemoryStore(1, 0)
+			for _, book := range tt.books {
+				if s.AddBook(book) != nil {
+					s.SetBook(book)
+				}
+			}
+
+			wt := s.Watchers().Subscribe("", "order/", len(tt.books))
+			defer s.Watchers().Unsubscribe(wt)
+
+			if wait := s.sweepDue(now.Add(tt.sweepAt), time.Hour); wait > time.Hour {
+				t.Errorf("the sweeper sleeps %v, longer than an hour", wait)
+			}
+
+			got := make([]string, 0)
+			for len(wt.Events()) > 0 {
+				event := <-wt.Events()
+				if event.Op != "expire" {
+					t.Errorf("event %s %s, want expire", event.Op, event.Id)
+				}
+				got = append(got, event.Id)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("expired %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSweeperWakesForTheNextExpiry(t *testing.T) {
+	s := NewMemoryStore(4, 0)
+	go s.SweepExpired(time.Hour)
+
+	// the sweeper went to sleep for an hour before the book was written
+	time.Sleep(10 * time.Millisecond)
+	s.AddBook(expiring("wake/a", "x", time.Now().Add(50*time.Millisecond)))
+
+	sh := s.shardFor("wake/a")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sh.mu.Lock()
+		_, stored := sh.books["wake/a"]
+		sh.mu.Unlock()
+
+		if !stored {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the book was not swept once it expired")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// BenchmarkExpirySweep sweeps a store where few of many books are due,
+// by the expiry heap and by a scan of every book as the sweeper did before.
+func BenchmarkExpirySweep(b *testing.B) {
+	const books, due = 100000, 10
+
+	sweeps := []struct {
+		name  string
+		sweep func(s *MemoryStore, now time.Time)
+	}{
+		{name: "heap", sweep: func(s *MemoryStore, now time.Time) { s.sweepDue(now, time.Hour) }},
+		{name: "scan", sweep: func(s *MemoryStore, now time.Time) {
+			for _, sh := range s.shards {
+				sh.mu.Lock()
+				for id, e := range sh.books {
+					if e.book.expired(now) {
+						sh.expire(id)
+					}
+				}
+				sh.mu.Unlock()
+			}
+		}},
+	}
+
+	for _, sweep := range sweeps {
+		b.Run(sweep.name, func(b *testing.B) {
+			s := NewMemoryStore(16, 0)
+			later := time.Now().Add(time.Hour)
+			for i := range books {
+				s.AddBook(expiring(fmt.Sprintf("bench/%d", i), "x", later))
+			}
+
+			b.ResetTimer()
+			for i := range b.N {
+				b.StopTimer()
+				now := time.Now()
+				for j := range due {
+					s.AddBook(expiring(fmt.Sprintf("due/%d/%d", i, j), "x", now))
+				}
+				b.StartTimer()
+
+				sweep.sweep(s, now)
+			}
+		})
+	}
+}
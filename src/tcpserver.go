@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+var errLineTooLong = errors.New("line too long")
+
+// tcpServer accepts the connections of one of the line protocols served
+// next to HTTP and keeps track of them, so shutdown can drop them all.
+type tcpServer struct {
+	ln net.Listener
+
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+}
+
+func serveTCP(name, addr string, handle func(conn net.Conn)) (*tcpServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ts := &tcpServer{ln: ln, conns: make(map[net.Conn]bool)}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			ts.mu.Lock()
+			ts.conns[conn] = true
+			ts.mu.Unlock()
+
+			go func() {
+				defer func() {
+					if err := recover(); err != nil {
+						log.Printf("panic serving %s connection from %s: %v", name, conn.RemoteAddr(), err)
+					}
+
+					ts.mu.Lock()
+					delete(ts.conns, conn)
+					ts.mu.Unlock()
+
+					conn.Close()
+				}()
+
+				handle(conn)
+			}()
+		}
+	}()
+
+	log.Printf("Serving %s on %s", name, ln.Addr())
+
+	return ts, nil
+}
+
+// isLoopbackAddr reports whether addr only listens on the loopback
+// interface; a missing host listens on every interface.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.IsLoopback()
+}
+
+// readLine reads one line of at most max bytes, without its line ending.
+func readLine(in *bufio.Reader, max int) (string, error) {
+	line, err := in.ReadSlice('\n')
+	if err == bufio.ErrBufferFull || len(line) > max {
+		return "", errLineTooLong
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// Close stops accepting and drops every connection.
+func (ts *tcpServer) Close() {
+	if ts == nil {
+		return
+	}
+
+	ts.ln.Close()
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	for conn := range ts.conns {
+		conn.Close()
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialTCP serves handle on a loopback port for the test and connects to it.
+func dialTCP(t *testing.T, handle func(conn net.Conn)) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	ts, err := serveTCP("test", "127.0.0.1:0", handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ts.Close)
+
+	conn, err := net.Dial("tcp", ts.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	return conn, bufio.NewReader(conn)
+}
+
+func TestTCPServerRecoversAPanic(t *testing.T) {
+	ts, err := serveTCP("test", "127.0.0.1:0", func(conn net.Conn) {
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		if line == "panic\n" {
+			panic("test panic")
+		}
+		conn.Write([]byte("ok\n"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	for _, line := range []string{"panic\n", "hello\n"} {
+		conn, err := net.Dial("tcp", ts.ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte(line))
+
+		answer, _ := bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+
+		if want := map[string]string{"panic\n": "", "hello\n": "ok\n"}[line]; answer != want {
+			t.Errorf("answer to %q = %q, want %q", line, answer, want)
+		}
+	}
+}
+
+func TestIsLoopbackAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"127.0.0.1:11211", true},
+		{"[::1]:11211", true},
+		{"localhost:11211", true},
+		{":11211", false},
+		{"0.0.0.0:11211", false},
+		{"10.0.0.1:11211", false},
+		{"example.com:11211", false},
+		{"11211", false},
+	}
+
+	for _, tt := range tests {
+		if got := isLoopbackAddr(tt.addr); got != tt.want {
+			t.Errorf("isLoopbackAddr(%q) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestRedisAuth(t *testing.T) {
+	tests := []struct {
+		name      string
+		authReads bool
+		commands  []string
+		want      []string
+	}{
+		{
+			name:      "no auth",
+			authReads: true,
+			commands:  []string{"GET a", "SET a 1", "PING"},
+			want:      []string{"-NOAUTH Authentication required.", "-NOAUTH Authentication required.", "-NOAUTH Authentication required."},
+		},
+		{
+			name:     "anonymous reads",
+			commands: []string{"GET a", "SET a 1"},
+			want:     []string{"$-1", "-NOAUTH Authentication required."},
+		},
+		{
+			name:      "write key",
+			authReads: true,
+			commands:  []string{"AUTH writer", "SET a 1", "GET a"},
+			want:      []string{"+OK", "+OK", "$1"},
+		},
+		{
+			name:      "user and password",
+			authReads: true,
+			commands:  []string{"AUTH test test", "SET a 1"},
+			want:      []string{"+OK", "+OK"},
+		},
+		{
+			name:      "read key",
+			authReads: true,
+			commands:  []string{"AUTH reader", "GET a", "SET a 1", "DEL a"},
+			want:      []string{"+OK", "$-1", "-NOPERM this user has no permissions to run the 'set' command", "-NOPERM this user has no permissions to run the 'del' command"},
+		},
+		{
+			name:      "wrong key",
+			authReads: true,
+			commands:  []string{"AUTH reader", "AUTH nobody", "GET a", "AUTH test wrong"},
+			want:      []string{"+OK", "-WRONGPASS invalid username-password pair or user is disabled.", "$-1", "-WRONGPASS invalid username-password pair or user is disabled."},
+		},
+		{
+			name:      "tenant key",
+			authReads: true,
+			commands:  []string{"AUTH tenant", "GET a"},
+			want:      []string{"-NOPERM keys confined to a tenant can not use RESP", "-NOAUTH Authentication required."},
+		},
+		{
+			name:      "arity",
+			authReads: true,
+			commands:  []string{"AUTH"},
+			want:      []string{"-ERR wrong number of arguments for 'auth' command"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.AuthReads = tt.authReads
+
+			s, _ := newTestServer(t, WithConfig(cfg))
+			s.apiKeys.Set([]APIKey{
+				{Key: "writer", Access: accessWrite},
+				{Key: "reader", Access: accessRead},
+				{Key: "tenant", Access: accessWrite, Tenant: "t"},
+			})
+			conn, in := dialTCP(t, s.serveRedisConn)
+
+			for i, command := range tt.commands {
+				conn.Write([]byte(command + "\r\n"))
+
+				reply, err := in.ReadString('\n')
+				if err != nil {
+					t.Fatalf("%s: %v", command, err)
+				}
+				if strings.HasPrefix(reply, "$") && reply != "$-1\r\n" {
+					in.ReadString('\n')
+				}
+
+				if reply = strings.TrimSuffix(reply, "\r\n"); reply != tt.want[i] {
+					t.Errorf("%s = %q, want %q", command, reply, tt.want[i])
+				}
+			}
+		})
+	}
+}
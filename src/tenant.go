@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// tenantPublicPaths are served to tenant keys as they are. None of them
+// reads or writes books.
+var tenantPublicPaths = map[string]bool{
+	"/":             true,
+	"/healthz":      true,
+	"/readyz":       true,
+	"/metrics":      true,
+	"/openapi.json": true,
+	"/docs":         true,
+	"/capabilities": true,
+}
+
+// requestTenant returns the tenant of the API key the request was sent
+// with, or "" when it is not confined to one.
+func (k *APIKeys) requestTenant(r *http.Request) string {
+	if _, _, ok := r.BasicAuth(); ok {
+		return ""
+	}
+
+	key, _ := k.requestAPIKey(r)
+	return key.Tenant
+}
+
+// tenantPath maps a path of the flat API onto the bucket of tenant, which
+// is the whole keyspace its keys see. It reports false for the paths a
+// tenant may not use.
+func tenantPath(tenant, path string) (string, bool) {
+	if tenantPublicPaths[path] {
+		return path, true
+	}
+
+	bucket := "/bucket/" + tenant + "/"
+
+	switch path {
+	case "/books/", "/stats", "/export":
+		return bucket + strings.TrimPrefix(path, "/"), true
+	}
+
+	// A slash in the id would name an operation like /book/<id>/history,
+	// which buckets do not have.
+	id, ok := strings.CutPrefix(path, "/book/")
+	if !ok || id == "" || strings.Contains(id, "/") {
+		return "", false
+	}
+
+	return bucket + "book/" + id, true
+}
+
+// Tenants confines the requests of tenant keys to the tenant's bucket:
+// /book/<id>, /books/, /stats and /export answer for the bucket as
+// /bucket/<tenant>/ does, so the stats, the export and the -bucket-quotas
+// of the bucket are the tenant's own. Every other route is refused, the
+// other buckets and the admin routes included. It runs ahead of the mux,
+// which then routes the rewritten path.
+func (s *Server) Tenants(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		tenant := s.apiKeys.requestTenant(r)
+		if tenant == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		path, ok := tenantPath(tenant, r.URL.Path)
+		if !ok {
+			w.Header().Set("Content-Type", "application/json")
+			writeError(w, http.StatusForbidden, CodeForbidden, "tenant keys only reach /book/<id>, /books/, /stats and /export of their tenant")
+			return
+		}
+
+		r.URL.Path, r.URL.RawPath = path, ""
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// tenantsEnabled reports whether any API key is confined to a tenant.
+func (k *APIKeys) tenantsEnabled() bool {
+	for _, key := range k.Current() {
+		if key.Tenant != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+)
+
+// LengthResult answers appends and strlen with the length of the book name
+// in characters, and collection writes with the number of items.
+type LengthResult struct {
+	Length  int    `json:"length"`
+	Version uint64 `json:"version,omitempty"`
+}
+
+// HandleBookText serves the string operations on a book name that save
+// clients a round trip of the whole book: POST /book/<id>/append appends
+// the JSON string in the body, GET /book/<id>/range?start=&end= returns a
+// part of it and GET /book/<id>/strlen its length. Range offsets count
+// characters, as handleRange describes.
+func (s *Server) HandleBookText(w http.ResponseWriter, r *http.Request) {
+	op := r.PathValue("op")
+	bookid := s.cfg.normalizeId(r.PathValue("id"))
+
+	if s.cfg.isReservedId(bookid) {
+		HandleReservedId(w, bookid)
+		return
+	}
+
+	method := http.MethodGet
+	if op == "append" {
+		method = http.MethodPost
+	}
+
+	if r.Method != method {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	if op == "append" {
+		var suffix string
+
+		err := s.decodeBody(r, &suffix)
+		if err != nil {
+			writeError(w, badBodyStatus(err), "", fmt.Sprintf("expected a JSON string. %v", err))
+			return
+		}
+
+		stored, ok := s.modifyBook(w, r, bookid, func(book *Book) bool {
+			book.Name += suffix
+			return true
+		})
+		if !ok {
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		length, _ := json.Marshal(LengthResult{Length: utf8.RuneCountInString(stored.Name), Version: stored.Version})
+
+		w.Write(length)
+		return
+	}
+
+	book := s.store.FindBookById(bookid)
+	if book == nil {
+		writeError(w, http.StatusNotFound, CodeBookNotFound, fmt.Sprintf("Book with id %s not found", bookid))
+		return
+	}
+
+	w.Header().Set("ETag", book.ETag(s.cfg.ETagAlgo))
+
+	if op == "strlen" {
+		w.WriteHeader(http.StatusOK)
+		length, _ := json.Marshal(LengthResult{Length: utf8.RuneCountInString(book.Name)})
+
+		w.Write(length)
+		return
+	}
+
+	name := []rune(book.Name)
+
+	start, end, ok := handleRange(w, r, len(name))
+	if !ok {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	body, _ := json.Marshal(string(name[start:end]))
+
+	w.Write(body)
+}
+
+// handleRange turns ?start= and ?end= into the slice bounds of n items.
+// The end is inclusive in the query, negative offsets count from the end
+// and the defaults 0 and -1 cover all items. It reports whether the
+// request may go ahead.
+func handleRange(w http.ResponseWriter, r *http.Request, n int) (int, int, bool) {
+	bounds := [2]int{0, -1}
+
+	for i, param := range []string{"start", "end"} {
+		value := r.URL.Query().Get(param)
+		if value == "" {
+			continue
+		}
+
+		offset, err := strconv.Atoi(value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("invalid %s %q", param, value))
+			return 0, 0, false
+		}
+		bounds[i] = offset
+	}
+
+	start, end := bounds[0], bounds[1]
+	if start < 0 {
+		start += n
+	}
+	if end < 0 {
+		end += n
+	}
+	start, end = max(start, 0), min(end, n-1)
+
+	if start > end {
+		return 0, 0, true
+	}
+	return start, end + 1, true
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// statusClientClosedRequest is the status nginx logs for a client that
+// hung up before the answer; it only shows in logs and metrics.
+const statusClientClosedRequest = 499
+
+// handleCanceled answers a request whose context ended before the store was
+// done with it and reports whether the request may go on. A client that
+// went away never sees the answer; one that ran out of time gets a 503.
+func handleCanceled(w http.ResponseWriter, err error) bool {
+	if err == nil {
+		return true
+	}
+
+	status := http.StatusServiceUnavailable
+	if errors.Is(err, context.Canceled) {
+		status = statusClientClosedRequest
+	}
+
+	writeError(w, status, "", fmt.Sprintf("Request abandoned: %v", err))
+	return false
+}
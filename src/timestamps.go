@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// setTimestampHeaders sends when the book was last written as
+// Last-Modified and when it was created as X-Created-At, so HEAD
+// /book/<id> answers with the metadata of a book without its body.
+func setTimestampHeaders(w http.ResponseWriter, book Book) {
+	if !book.UpdatedAt.IsZero() {
+		w.Header().Set("Last-Modified", book.UpdatedAt.UTC().Format(http.TimeFormat))
+	}
+	if !book.CreatedAt.IsZero() {
+		w.Header().Set("X-Created-At", book.CreatedAt.UTC().Format(time.RFC3339Nano))
+	}
+}
+
+// handleModifiedSince keeps the books written at or after the RFC 3339
+// time in ?modified_since=, if given, and reports whether the request may
+// go ahead.
+func handleModifiedSince(w http.ResponseWriter, r *http.Request, books []Book) ([]Book, bool) {
+	value := r.URL.Query().Get("modified_since")
+	if value == "" {
+		return books, true
+	}
+
+	since, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("invalid modified_since %s", value))
+		return nil, false
+	}
+
+	modified := books[:0]
+
+	for _, book := range books {
+		if !book.UpdatedAt.Before(since) {
+			modified = append(modified, book)
+		}
+	}
+	return modified, true
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type timingsKey struct{}
+
+// timings accumulates phase durations for one request.
+type timings struct {
+	mu     sync.Mutex
+	start  time.Time
+	names  []string
+	phases map[string]time.Duration
+}
+
+func (t *timings) add(name string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.phases[name]; !ok {
+		t.names = append(t.names, name)
+	}
+	t.phases[name] += d
+}
+
+func (t *timings) header() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	metrics := make([]string, 0, len(t.names)+1)
+
+	for _, name := range t.names {
+		metrics = append(metrics, formatTiming(name, t.phases[name]))
+	}
+	metrics = append(metrics, formatTiming("total", time.Since(t.start)))
+
+	return strings.Join(metrics, ", ")
+}
+
+func formatTiming(name string, d time.Duration) string {
+	return fmt.Sprintf("%s;dur=%.3f", name, float64(d)/float64(time.Millisecond))
+}
+
+// startTiming starts measuring a phase of the request and returns the
+// function that ends it. It is a no-op unless -server-timing is set or
+// tracing is enabled, which also traces the phase as a span.
+func startTiming(r *http.Request, name string) func() {
+	endSpan := startSpan(r, name)
+
+	t, ok := r.Context().Value(timingsKey{}).(*timings)
+	if !ok {
+		return endSpan
+	}
+
+	start := time.Now()
+
+	return func() {
+		t.add(name, time.Since(start))
+		endSpan()
+	}
+}
+
+// timingWriter adds the Server-Timing header just before the response
+// header is sent.
+type timingWriter struct {
+	http.ResponseWriter
+	timings     *timings
+	wroteHeader bool
+}
+
+func (tw *timingWriter) WriteHeader(status int) {
+	if !tw.wroteHeader {
+		tw.wroteHeader = true
+		tw.Header().Set("Server-Timing", tw.timings.header())
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *timingWriter) Write(b []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+func (tw *timingWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+func ServerTiming(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		t := &timings{start: time.Now(), phases: make(map[string]time.Duration)}
+		r = r.WithContext(context.WithValue(r.Context(), timingsKey{}, t))
+
+		next.ServeHTTP(&timingWriter{ResponseWriter: w, timings: t}, r)
+	}
+}
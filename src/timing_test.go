@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+var timingMetric = regexp.MustCompile(`^([a-z-]+);dur=\d+\.\d{3}$`)
+
+// timingNames returns the metric names of a Server-Timing header, and
+// false when a metric is malformed.
+func timingNames(header string) ([]string, bool) {
+	names := make([]string, 0)
+
+	for _, metric := range strings.Split(header, ", ") {
+		match := timingMetric.FindStringSubmatch(metric)
+		if match == nil {
+			return names, false
+		}
+		names = append(names, match[1])
+	}
+	return names, true
+}
+
+func TestServerTiming(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		method  string
+		path    string
+		body    string
+		want    []string // metric names, empty for no header
+	}{
+		{name: "a listing", enabled: true, method: "GET", path: "/books/", want: []string{"store", "serialize", "total"}},
+		{name: "a page", enabled: true, method: "GET", path: "/books/?limit=1", want: []string{"store", "serialize", "total"}},
+		{name: "a read", enabled: true, method: "GET", path: "/book/a", want: []string{"store", "serialize", "total"}},
+		{name: "a write", enabled: true, method: "PUT", path: "/book/a", body: `{"name":"9"}`, want: []string{"store", "serialize", "total"}},
+		{name: "an error", enabled: true, method: "GET", path: "/book/missing", want: []string{"store", "total"}},
+		{name: "disabled", enabled: false, method: "GET", path: "/books/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.ServerTiming = tt.enabled
+
+			s, ts := newTestServer(t, WithConfig(cfg))
+			s.store.AddBook(Book{Id: "a", Name: "1"})
+
+			req, _ := http.NewRequest(tt.method, ts.URL+tt.path, strings.NewReader(tt.body))
+			req.SetBasicAuth("test", "test")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			header := resp.Header.Get("Server-Timing")
+			if len(tt.want) == 0 {
+				if header != "" {
+					t.Errorf("Server-Timing %q, want none", header)
+				}
+				return
+			}
+
+			names, ok := timingNames(header)
+			if !ok || !slices.Equal(names, tt.want) {
+				t.Errorf("Server-Timing %q, want the metrics %v", header, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimingsAddUp(t *testing.T) {
+	timings := &timings{start: time.Now(), phases: make(map[string]time.Duration)}
+	timings.add("store", 2*time.Millisecond)
+	timings.add("serialize", time.Millisecond)
+	timings.add("store", 3*time.Millisecond)
+
+	header := timings.header()
+	if !strings.HasPrefix(header, "store;dur=5.000, serialize;dur=1.000, total;dur=") {
+		t.Errorf("header %q, want store then serialize, each summed, then total", header)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+func (c Config) tlsEnabled() bool {
+	return c.TLSCert != "" || c.TLSKey != ""
+}
+
+// serverTLSConfig loads the files into current and returns the config for
+// http.Server, which hands every new connection the settings in current,
+// the most recently loaded ones once reloads swap them.
+func (c Config) serverTLSConfig(current *atomic.Pointer[tls.Config]) (*tls.Config, error) {
+	config, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	current.Store(config)
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return current.Load(), nil
+		},
+	}, nil
+}
+
+// tlsConfig builds the server TLS settings from the flags.
+func (c Config) tlsConfig() (*tls.Config, error) {
+	if c.TLSCert == "" || c.TLSKey == "" {
+		return nil, errors.New("-tls-cert and -tls-key must be set together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   c.alpnProtocols(),
+	}
+
+	if c.ClientCA != "" {
+		pem, err := os.ReadFile(c.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New(fmt.Sprintf("no certificates found in %s", c.ClientCA))
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type RequestSummary struct {
+	Method   string `json:"method"`
+	Path     string `json:"path"`
+	Status   int    `json:"status"`
+	Duration string `json:"duration"`
+
+	RequestID string `json:"request_id"`
+}
+
+// RequestRing is a fixed size buffer of the most recent request summaries.
+type RequestRing struct {
+	mu      sync.Mutex
+	entries []RequestSummary
+	next    int
+}
+
+func NewRequestRing(size int) *RequestRing {
+	return &RequestRing{
+		entries: make([]RequestSummary, 0, size),
+	}
+}
+
+func (rr *RequestRing) Add(summary RequestSummary) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	if cap(rr.entries) == 0 {
+		return
+	}
+
+	if len(rr.entries) < cap(rr.entries) {
+		rr.entries = append(rr.entries, summary)
+	} else {
+		rr.entries[rr.next] = summary
+	}
+
+	rr.next = (rr.next + 1) % cap(rr.entries)
+}
+
+// Recent returns the buffered summaries newest first.
+func (rr *RequestRing) Recent() []RequestSummary {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	recent := make([]RequestSummary, 0, len(rr.entries))
+
+	for i := 1; i <= len(rr.entries); i++ {
+		idx := (rr.next - i + len(rr.entries)) % len(rr.entries)
+		recent = append(recent, rr.entries[idx])
+	}
+
+	return recent
+}
+
+// statusRecorder remembers the status code written by the wrapped handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	n, err := sr.ResponseWriter.Write(b)
+	sr.written += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+func (s *Server) Trace(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r)
+
+		s.recentRequests.Add(RequestSummary{
+			Method:   r.Method,
+			Path:     r.URL.Path,
+			Status:   rec.status,
+			Duration: time.Since(start).String(),
+
+			RequestID: requestID(r.Context()),
+		})
+	}
+}
+
+func (s *Server) HandleRecentRequests(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	requests, _ := json.Marshal(s.recentRequests.Recent())
+
+	w.Write(requests)
+}
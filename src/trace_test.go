@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestRequestRing(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		adds int
+		want []string // paths, newest first
+	}{
+		{name: "disabled", size: 0, adds: 3, want: []string{}},
+		{name: "empty", size: 3, adds: 0, want: []string{}},
+		{name: "below the cap", size: 3, adds: 2, want: []string{"/1", "/0"}},
+		{name: "at the cap", size: 3, adds: 3, want: []string{"/2", "/1", "/0"}},
+		{name: "past the cap", size: 3, adds: 7, want: []string{"/6", "/5", "/4"}},
+		{name: "a cap of one", size: 1, adds: 4, want: []string{"/3"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ring := NewRequestRing(tt.size)
+			for i := range tt.adds {
+				ring.Add(RequestSummary{Path: fmt.Sprintf("/%d", i)})
+			}
+
+			got := make([]string, 0)
+			for _, summary := range ring.Recent() {
+				got = append(got, summary.Path)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestRingIsConcurrencySafe(t *testing.T) {
+	ring := NewRequestRing(16)
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				ring.Add(RequestSummary{Path: "/"})
+				ring.Recent()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := len(ring.Recent()); got != 16 {
+		t.Errorf("holds %d summaries, want 16", got)
+	}
+}
+
+func TestRecentRequests(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.TraceRequests = 3
+
+	_, ts := newTestServer(t, WithConfig(cfg))
+
+	for _, path := range []string{"/books/", "/book/missing", "/size-bytes", "/book/a", "/capabilities"} {
+		send(t, http.MethodGet, ts.URL+path, "")
+	}
+
+	status, body := send(t, http.MethodGet, ts.URL+"/debug/requests", "")
+	if status != http.StatusOK {
+		t.Fatalf("status %d: %s", status, body)
+	}
+
+	var recent []RequestSummary
+	if err := json.Unmarshal([]byte(body), &recent); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []RequestSummary{{Path: "/capabilities", Status: 200}, {Path: "/book/a", Status: 404}, {Path: "/size-bytes", Status: 200}}
+	if len(recent) != len(want) {
+		t.Fatalf("got %+v, want %d summaries", recent, len(want))
+	}
+	for i, summary := range recent {
+		if summary.Method != http.MethodGet || summary.Path != want[i].Path || summary.Status != want[i].Status || summary.Duration == "" || summary.RequestID == "" {
+			t.Errorf("summary %d = %+v, want %s answered %d", i, summary, want[i].Path, want[i].Status)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func (c Config) tracingEnabled() bool {
+	return c.OTLPEndpoint != ""
+}
+
+type spanKey struct{}
+
+// span is one timed operation of a trace. Request spans come from Tracing
+// and their phases, like store and serialize, from startTiming.
+type span struct {
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	name    string
+	kind    int // 1 internal, 2 server
+	start   time.Time
+	end     time.Time
+	attrs   map[string]any
+	failed  bool
+
+	// the exporter of the server whose request the span is part of
+	exporter *spanExporter
+}
+
+func newSpan(ctx context.Context, name string, kind int) *span {
+	sp := &span{name: name, kind: kind, start: time.Now(), attrs: make(map[string]any)}
+	rand.Read(sp.spanID[:])
+
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok {
+		sp.traceID, sp.parent, sp.exporter = parent.traceID, parent.spanID, parent.exporter
+	} else {
+		rand.Read(sp.traceID[:])
+	}
+
+	return sp
+}
+
+// parseTraceparent reads a W3C traceparent header,
+// 00-<trace id>-<parent id>-<flags>, so the request joins the caller's
+// trace.
+func parseTraceparent(header string) (traceID [16]byte, parent [8]byte, ok bool) {
+	parts := strings.Split(header, "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return traceID, parent, false
+	}
+
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return traceID, parent, false
+	}
+	if _, err := hex.Decode(parent[:], []byte(parts[2])); err != nil || parent == [8]byte{} {
+		return traceID, parent, false
+	}
+
+	return traceID, parent, true
+}
+
+// Tracing wraps the request in a server span, joining the trace of an
+// incoming traceparent header, and echoes the header back with the span's
+// id.
+func (s *Server) Tracing(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		sp := newSpan(r.Context(), r.Method+" "+r.Pattern, 2)
+		sp.exporter = s.spans
+		if traceID, parent, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+			sp.traceID, sp.parent = traceID, parent
+		}
+
+		w.Header().Set("traceparent", fmt.Sprintf("00-%x-%x-01", sp.traceID, sp.spanID))
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), spanKey{}, sp)))
+
+		sp.attrs["http.request.method"] = r.Method
+		sp.attrs["http.route"] = r.Pattern
+		sp.attrs["url.path"] = r.URL.Path
+		sp.attrs["http.response.status_code"] = rec.status
+		sp.attrs["request.id"] = requestID(r.Context())
+		sp.failed = rec.status >= 500
+
+		s.spans.finish(sp)
+	}
+}
+
+// startSpan starts an internal span below the request's one and returns
+// the function that ends it. It is a no-op unless tracing is enabled.
+func startSpan(r *http.Request, name string) func() {
+	if _, ok := r.Context().Value(spanKey{}).(*span); !ok {
+		return func() {}
+	}
+
+	sp := newSpan(r.Context(), name, 1)
+
+	return func() {
+		sp.exporter.finish(sp)
+	}
+}
+
+// spanBatchSize is how many spans go to the collector in one export; the
+// exporter also sends whatever it holds every few seconds.
+const spanBatchSize = 512
+
+// spanExporter queues finished spans and posts them to the collector in
+// batches. When the collector falls behind, new spans are dropped rather
+// than slowing requests down. endpoint and service are -otlp-endpoint and
+// -otel-service-name.
+type spanExporter struct {
+	endpoint string
+	service  string
+	queue    chan *span
+	done     chan struct{}
+	once     sync.Once
+}
+
+func (se *spanExporter) finish(sp *span) {
+	sp.end = time.Now()
+
+	select {
+	case se.queue <- sp:
+	default:
+	}
+}
+
+func (se *spanExporter) run() {
+	defer close(se.done)
+
+	batch := make([]*span, 0, spanBatchSize)
+	tick := time.NewTicker(5 * time.Second)
+	defer tick.Stop()
+
+	for {
+		select {
+		case sp, ok := <-se.queue:
+			if !ok {
+				se.export(batch)
+				return
+			}
+
+			batch = append(batch, sp)
+			if len(batch) < spanBatchSize {
+				continue
+			}
+
+		case <-tick.C:
+		}
+
+		se.export(batch)
+		batch = batch[:0]
+	}
+}
+
+// Close sends the queued spans and stops the exporter. Only call it once
+// no more requests are served.
+func (se *spanExporter) Close() {
+	se.once.Do(func() {
+		close(se.queue)
+		<-se.done
+	})
+}
+
+func (se *spanExporter) export(batch []*span) {
+	if len(batch) == 0 {
+		return
+	}
+
+	if err := se.post(batch); err != nil {
+		log.Printf("otlp export of %d spans: %v", len(batch), err)
+	}
+}
+
+// OTLP/HTTP JSON encoding of the trace service's ExportTraceServiceRequest.
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            struct {
+		Code int `json:"code,omitempty"` // 2 is error
+	} `json:"status"`
+}
+
+func otlpAttributes(attrs map[string]any) []otlpAttribute {
+	list := make([]otlpAttribute, 0, len(attrs))
+
+	for key, value := range attrs {
+		var v otlpValue
+
+		switch value := value.(type) {
+		case int:
+			s := strconv.Itoa(value)
+			v.IntValue = &s
+		default:
+			s := fmt.Sprint(value)
+			v.StringValue = &s
+		}
+
+		list = append(list, otlpAttribute{Key: key, Value: v})
+	}
+
+	return list
+}
+
+func (se *spanExporter) post(batch []*span) error {
+	encoded := make([]otlpSpan, 0, len(batch))
+
+	for _, sp := range batch {
+		o := otlpSpan{
+			TraceId:           hex.EncodeToString(sp.traceID[:]),
+			SpanId:            hex.EncodeToString(sp.spanID[:]),
+			Name:              sp.name,
+			Kind:              sp.kind,
+			StartTimeUnixNano: strconv.FormatInt(sp.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(sp.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(sp.attrs),
+		}
+		if sp.parent != [8]byte{} {
+			o.ParentSpanId = hex.EncodeToString(sp.parent[:])
+		}
+		if sp.failed {
+			o.Status.Code = 2
+		}
+
+		encoded = append(encoded, o)
+	}
+
+	request := map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": otlpAttributes(map[string]any{"service.name": se.service}),
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]string{"name": "books"},
+				"spans": encoded,
+			}},
+		}},
+	}
+
+	body, _ := json.Marshal(request)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(se.endpoint, "/")+"/v1/traces", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(fmt.Sprintf("collector answered %s", resp.Status))
+	}
+	return nil
+}
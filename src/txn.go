@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// TxnRequest is the body of POST /txn: when every compare holds the
+// success ops run, otherwise the failure ops do.
+type TxnRequest struct {
+	Compare []TxnCompare `json:"compare"`
+	Success []BatchOp    `json:"success"`
+	Failure []BatchOp    `json:"failure"`
+}
+
+type TxnResponse struct {
+	Succeeded bool          `json:"succeeded"`
+	Results   []BatchResult `json:"results"`
+}
+
+// HandleTxn runs a transaction atomically. The response says which branch
+// ran and holds one result per op of that branch, with the book for gets
+// and, for puts and deletes, the prior book as it was before the
+// transaction, read under the same locks.
+// The hooks only see the writes of the branch that runs.
+func (s *Server) HandleTxn(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	w, ok := s.handleFenceToken(w, r)
+	if !ok {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.MaxBodyBytes)
+
+	var txn TxnRequest
+
+	err := s.decodeBody(r, &txn)
+	if err != nil {
+		writeError(w, badBodyStatus(err), "", err.Error())
+		return
+	}
+
+	for i, c := range txn.Compare {
+		txn.Compare[i].Id = s.cfg.normalizeId(c.Id)
+
+		if s.cfg.isReservedId(txn.Compare[i].Id) {
+			HandleReservedId(w, txn.Compare[i].Id)
+			return
+		}
+
+		if !validCondition(c.If) {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("invalid condition %q for %s", c.If, c.Id))
+			return
+		}
+	}
+
+	for _, op := range slices.Concat(txn.Success, txn.Failure) {
+		if op.Op != "get" && op.Op != "put" && op.Op != "delete" {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("unknown op %s", op.Op))
+			return
+		}
+	}
+
+	if !s.normalizeOps(w, txn.Success) || !s.normalizeOps(w, txn.Failure) {
+		return
+	}
+
+	if !s.handleLimits(w, opPuts(txn.Success)...) || !s.handleLimits(w, opPuts(txn.Failure)...) {
+		return
+	}
+
+	if (bulkDelete(txn.Success) || bulkDelete(txn.Failure)) && !s.handleBackup(w) {
+		return
+	}
+
+	stop := startTiming(r, "store")
+	succeeded, results, err := s.store.Txn(txn.Compare, txn.Success, txn.Failure, s.prepareWrites(r))
+	stop()
+
+	if !handleWriteError(w, err) {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	body, _ := json.Marshal(TxnResponse{Succeeded: succeeded, Results: results})
+
+	w.Write(body)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestTxnPriorValues(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		succeeded bool
+		prior     []string // per result, the prior book as id=name, "" for none
+	}{
+		{
+			name:      "a committed txn",
+			body:      `{"compare":[{"id":"a","if":"exists"}],"success":[{"op":"put","book":{"id":"a","name":"3"}},{"op":"put","book":{"id":"c","name":"3"}},{"op":"delete","book":{"id":"b"}},{"op":"put","book":{"id":"a","name":"4"}}]}`,
+			succeeded: true,
+			prior:     []string{"a=1", "", "b=2", "a=1"},
+		},
+		{
+			name:  "the failure branch",
+			body:  `{"compare":[{"id":"a","if":"absent"}],"success":[{"op":"delete","book":{"id":"a"}}],"failure":[{"op":"put","book":{"id":"b","name":"3"}},{"op":"get","book":{"id":"a"}}]}`,
+			prior: []string{"b=2", ""},
+		},
+		{
+			name:      "a delete of a missing book",
+			body:      `{"success":[{"op":"delete","book":{"id":"missing"}}]}`,
+			succeeded: true,
+			prior:     []string{""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ts := newTestServer(t)
+			s.store.AddBook(Book{Id: "a", Name: "1"})
+			s.store.AddBook(Book{Id: "b", Name: "2"})
+
+			status, body := send(t, http.MethodPost, ts.URL+"/txn", tt.body)
+			if status != http.StatusOK {
+				t.Fatalf("status %d %s", status, body)
+			}
+
+			var resp TxnResponse
+			if err := json.Unmarshal([]byte(body), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Succeeded != tt.succeeded {
+				t.Errorf("succeeded = %v, want %v", resp.Succeeded, tt.succeeded)
+			}
+
+			prior := make([]string, 0, len(resp.Results))
+			for _, result := range resp.Results {
+				if result.Prior == nil {
+					prior = append(prior, "")
+				} else {
+					prior = append(prior, result.Prior.Id+"="+result.Prior.Name)
+				}
+			}
+			if !slices.Equal(prior, tt.prior) {
+				t.Errorf("prior books %q, want %q", prior, tt.prior)
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+//go:embed ui.html
+var uiPage []byte
+
+// HandleUI serves the browser UI at / for listing, searching and editing
+// books through the JSON API. Every other path the mux has no route for
+// ends up here too and gets a 404.
+func (s *Server) HandleUI(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		writeError(w, http.StatusNotFound, CodeNotFound, "no route for "+r.URL.Path)
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	w.Write(uiPage)
+}
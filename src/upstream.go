@@ -0,0 +1,543 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Upstream is the external backend a CacheStore is a cache of.
+type Upstream interface {
+	// Get returns the book with id, or nil when there is none.
+	Get(id string) (*Book, error)
+	List(ctx context.Context) ([]Book, error)
+	Put(book Book) error
+	Delete(id string) error
+	Ping() error
+	Close() error
+}
+
+// CacheStore is a MemoryStore that caches the books of an upstream backend.
+// A book older than ttl is read from the upstream again when it is next
+// used, and a listing first fetches all books; writes go to the upstream
+// once applied to the cache. As with the wal backend, a failed upstream
+// write is only logged, and the book is read back from the upstream next.
+// History, tombstones and soft deleted books live in the cache alone.
+type CacheStore struct {
+	*MemoryStore
+
+	upstream Upstream
+	ttl      time.Duration
+
+	mu      sync.Mutex // orders upstream reads and writes the same way as the changes
+	fetched sync.Map   // id to when the cached book was read from the upstream
+	listed  time.Time
+
+	fetches fetchGroup
+
+	// queues upstream writes instead, nil unless write behind is enabled
+	behind *writeBehind
+}
+
+// fetchGroup coalesces the misses of one id: a read that finds a fetch of
+// the id in flight waits for it rather than starting its own, so many
+// clients missing one book at once cost the upstream a single Get.
+type fetchGroup struct {
+	mu      sync.Mutex
+	flights map[string]*sync.WaitGroup
+}
+
+// do runs fetch for id, or waits for the run of it already in flight.
+func (g *fetchGroup) do(id string, fetch func()) {
+	g.mu.Lock()
+	if flight, ok := g.flights[id]; ok {
+		g.mu.Unlock()
+		flight.Wait()
+		return
+	}
+
+	if g.flights == nil {
+		g.flights = make(map[string]*sync.WaitGroup)
+	}
+	flight := &sync.WaitGroup{}
+	flight.Add(1)
+	g.flights[id] = flight
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.flights, id)
+		g.mu.Unlock()
+		flight.Done()
+	}()
+
+	fetch()
+}
+
+func NewCacheStore(upstream Upstream, ttl time.Duration, memory *MemoryStore) *CacheStore {
+	return &CacheStore{MemoryStore: memory, upstream: upstream, ttl: ttl}
+}
+
+// WriteBehind stops writing each change through: the changed books are
+// written to the upstream in batches as they are then cached. Until then
+// they are not read from the upstream again.
+func (cs *CacheStore) WriteBehind(interval time.Duration, size int) {
+	cs.behind = newWriteBehind(interval, size, func(ids []string) {
+		cs.mu.Lock()
+		defer cs.mu.Unlock()
+
+		cs.write(ids)
+	})
+}
+
+func (cs *CacheStore) fresh(id string) bool {
+	fetched, ok := cs.fetched.Load(id)
+	return ok && time.Since(fetched.(time.Time)) < cs.ttl
+}
+
+// refresh reads the books with ids that are not fresh from the upstream.
+// An upstream error keeps serving the cached book. Callers hold cs.mu.
+func (cs *CacheStore) refresh(ids ...string) {
+	for _, id := range ids {
+		if cs.fresh(id) || cs.behind.queued(id) {
+			continue
+		}
+
+		book, err := cs.upstream.Get(id)
+		if err != nil {
+			log.Printf("upstream get %s: %v", id, err)
+			continue
+		}
+
+		if book == nil {
+			cs.MemoryStore.Forget(id)
+		} else {
+			cs.MemoryStore.Load(*book)
+		}
+		cs.fetched.Store(id, time.Now())
+	}
+}
+
+// writeThrough writes the books with ids to the upstream as the cache now
+// holds them, put or gone, or queues them for write behind. Callers hold
+// cs.mu.
+func (cs *CacheStore) writeThrough(ids ...string) {
+	if !cs.behind.add(ids...) {
+		cs.write(ids)
+	}
+}
+
+func (cs *CacheStore) write(ids []string) {
+	for _, id := range ids {
+		var err error
+
+		if book := cs.MemoryStore.FindBookById(id); book != nil {
+			err = cs.upstream.Put(*book)
+		} else {
+			err = cs.upstream.Delete(id)
+		}
+
+		if err != nil {
+			log.Printf("upstream write %s: %v", id, err)
+			cs.fetched.Delete(id)
+		}
+	}
+}
+
+// sync brings the cache in line with every book of the upstream, at most
+// once per ttl, so listings and searches see the books not yet cached.
+func (cs *CacheStore) sync(ctx context.Context) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	return cs.syncLocked(ctx)
+}
+
+// syncLocked is sync for callers holding cs.mu.
+func (cs *CacheStore) syncLocked(ctx context.Context) error {
+	if time.Since(cs.listed) < cs.ttl {
+		return nil
+	}
+
+	books, err := cs.upstream.List(ctx)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		log.Printf("upstream list: %v", err)
+		return nil
+	}
+
+	cs.load(books)
+	cs.listed = time.Now()
+
+	return nil
+}
+
+// load makes books the whole content of the cache, but for the changes
+// still queued for write behind. Callers hold cs.mu.
+func (cs *CacheStore) load(books []Book) {
+	present := make(map[string]bool, len(books))
+	loaded := make([]Book, 0, len(books))
+	now := time.Now()
+
+	for _, book := range books {
+		present[book.Id] = true
+
+		if !cs.behind.queued(book.Id) {
+			loaded = append(loaded, book)
+			cs.fetched.Store(book.Id, now)
+		}
+	}
+
+	cached, _ := cs.MemoryStore.GetBooks(context.Background())
+	for _, book := range cached {
+		if !present[book.Id] && !cs.behind.queued(book.Id) {
+			cs.MemoryStore.Forget(book.Id)
+		}
+	}
+
+	cs.MemoryStore.Load(loaded...)
+}
+
+func (cs *CacheStore) Check() error {
+	return cs.upstream.Ping()
+}
+
+func (cs *CacheStore) Close() error {
+	cs.behind.Close()
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	return cs.upstream.Close()
+}
+
+func (cs *CacheStore) FindBookById(id string) *Book {
+	if !cs.fresh(id) {
+		cs.fetches.do(id, func() {
+			cs.mu.Lock()
+			defer cs.mu.Unlock()
+
+			cs.refresh(id)
+		})
+	}
+
+	return cs.MemoryStore.FindBookById(id)
+}
+
+func (cs *CacheStore) FindBooksByIds(ids []string) []*Book {
+	cs.mu.Lock()
+	cs.refresh(ids...)
+	cs.mu.Unlock()
+
+	return cs.MemoryStore.FindBooksByIds(ids)
+}
+
+func (cs *CacheStore) GetBooks(ctx context.Context) ([]Book, error) {
+	if err := cs.sync(ctx); err != nil {
+		return nil, err
+	}
+	return cs.MemoryStore.GetBooks(ctx)
+}
+
+func (cs *CacheStore) SnapshotBooks(ctx context.Context) ([]Book, uint64, error) {
+	if err := cs.sync(ctx); err != nil {
+		return nil, 0, err
+	}
+	return cs.MemoryStore.SnapshotBooks(ctx)
+}
+
+func (cs *CacheStore) CountBooks(ctx context.Context, match func(id string) bool) (int, error) {
+	if err := cs.sync(ctx); err != nil {
+		return 0, err
+	}
+	return cs.MemoryStore.CountBooks(ctx, match)
+}
+
+func (cs *CacheStore) BooksAfter(ctx context.Context, prefix string, after string, limit int) ([]Book, bool, error) {
+	if err := cs.sync(ctx); err != nil {
+		return nil, false, err
+	}
+	return cs.MemoryStore.BooksAfter(ctx, prefix, after, limit)
+}
+
+func (cs *CacheStore) SearchBooks(ctx context.Context, match, value string) ([]Book, error) {
+	if err := cs.sync(ctx); err != nil {
+		return nil, err
+	}
+	return cs.MemoryStore.SearchBooks(ctx, match, value)
+}
+
+func (cs *CacheStore) AddBook(book Book) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.refresh(book.Id)
+	err := cs.MemoryStore.AddBook(book)
+	if err == nil {
+		cs.writeThrough(book.Id)
+	}
+	return err
+}
+
+func (cs *CacheStore) SetBook(book Book) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.refresh(book.Id)
+	err := cs.MemoryStore.SetBook(book)
+	if err == nil {
+		cs.writeThrough(book.Id)
+	}
+	return err
+}
+
+func (cs *CacheStore) SetBookIf(book Book, cond string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.refresh(book.Id)
+	err := cs.MemoryStore.SetBookIf(book, cond)
+	if err == nil {
+		cs.writeThrough(book.Id)
+	}
+	return err
+}
+
+func (cs *CacheStore) SwapBook(old Book, book Book) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.refresh(book.Id)
+	err := cs.MemoryStore.SwapBook(old, book)
+	if err == nil {
+		cs.writeThrough(book.Id)
+	}
+	return err
+}
+
+func (cs *CacheStore) RestoreBook(id string, prepare func(book *Book) error) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.refresh(id)
+	err := cs.MemoryStore.RestoreBook(id, prepare)
+	if err == nil {
+		cs.writeThrough(id)
+	}
+	return err
+}
+
+func (cs *CacheStore) DelBook(id string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.refresh(id)
+	err := cs.MemoryStore.DelBook(id)
+	if err == nil {
+		cs.writeThrough(id)
+	}
+	return err
+}
+
+func (cs *CacheStore) DelBookIf(id string, cond string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.refresh(id)
+	err := cs.MemoryStore.DelBookIf(id, cond)
+	if err == nil {
+		cs.writeThrough(id)
+	}
+	return err
+}
+
+func (cs *CacheStore) ApplyBatch(ops []BatchOp) ([]BatchResult, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	ids := make([]string, 0, len(ops))
+	for _, op := range ops {
+		ids = append(ids, op.Book.Id)
+	}
+
+	cs.refresh(ids...)
+	results, applied := cs.MemoryStore.ApplyBatch(ops)
+	if applied {
+		cs.writeThrough(ids...)
+	}
+	return results, applied
+}
+
+func (cs *CacheStore) Txn(compare []TxnCompare, success, failure []BatchOp, prepare func(writes []*BatchOp) error) (bool, []BatchResult, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	ids := make([]string, 0, len(compare)+len(success)+len(failure))
+	for _, c := range compare {
+		ids = append(ids, c.Id)
+	}
+	for _, op := range success {
+		ids = append(ids, op.Book.Id)
+	}
+	for _, op := range failure {
+		ids = append(ids, op.Book.Id)
+	}
+
+	cs.refresh(ids...)
+	succeeded, results, err := cs.MemoryStore.Txn(compare, success, failure, prepare)
+	if err != nil {
+		return succeeded, nil, err
+	}
+
+	ops := success
+	if !succeeded {
+		ops = failure
+	}
+
+	written := make([]string, 0, len(ops))
+	for _, op := range ops {
+		if op.Op == "put" || op.Op == "delete" {
+			written = append(written, op.Book.Id)
+		}
+	}
+
+	cs.writeThrough(written...)
+	return succeeded, results, nil
+}
+
+// ImportBooks syncs the cache first, so the import also deletes the books
+// of the upstream not cached yet.
+func (cs *CacheStore) ImportBooks(books []Book, keep func(id string) bool, prepare func(writes []*BatchOp) error) ([]BatchResult, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if err := cs.syncLocked(context.Background()); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(books))
+	for _, book := range books {
+		ids = append(ids, book.Id)
+	}
+	cs.refresh(ids...)
+
+	results, err := cs.MemoryStore.ImportBooks(books, keep, prepare)
+	if err != nil {
+		return nil, err
+	}
+
+	written := make([]string, 0, len(results))
+	for _, result := range results {
+		written = append(written, result.Id)
+	}
+
+	cs.writeThrough(written...)
+	return results, nil
+}
+
+func (cs *CacheStore) ApplyChange(event ChangeEvent) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.refresh(event.Id)
+	cs.MemoryStore.ApplyChange(event)
+	cs.writeThrough(event.Id)
+}
+
+func (cs *CacheStore) DrainBooks(ids []string, prepare func(ids []string) error) ([]Book, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.refresh(ids...)
+	drained, err := cs.MemoryStore.DrainBooks(ids, prepare)
+
+	for _, book := range drained {
+		cs.writeThrough(book.Id)
+	}
+	return drained, err
+}
+
+// ReplaceBooks swaps the books of the upstream, deleting the ones not in
+// books, and of the cache.
+func (cs *CacheStore) ReplaceBooks(books []Book) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	present := make(map[string]bool, len(books))
+	for _, book := range books {
+		present[book.Id] = true
+
+		if err := cs.upstream.Put(book); err != nil {
+			log.Printf("upstream write %s: %v", book.Id, err)
+		}
+	}
+
+	stored, err := cs.upstream.List(context.Background())
+	if err != nil {
+		log.Printf("upstream list: %v", err)
+	}
+	for _, book := range stored {
+		if !present[book.Id] {
+			if err := cs.upstream.Delete(book.Id); err != nil {
+				log.Printf("upstream write %s: %v", book.Id, err)
+			}
+		}
+	}
+
+	cs.MemoryStore.ReplaceBooks(books)
+
+	now := time.Now()
+	cs.fetched.Clear()
+	for _, book := range books {
+		cs.fetched.Store(book.Id, now)
+	}
+	cs.listed = now
+}
+
+// Load stores books under the versions they carry without telling
+// watchers, as they are not changes, e.g. books read from an upstream
+// backend. A stored book with the same id is replaced.
+func (s *MemoryStore) Load(books ...Book) {
+	now := time.Now()
+
+	for _, book := range books {
+		sh := s.shardFor(book.Id)
+		sh.mu.Lock()
+		sh.thaw()
+
+		seq := uint64(0)
+		if e, ok := sh.books[book.Id]; ok {
+			seq = e.seq
+			sh.remove(book.Id)
+		} else {
+			seq = s.sequence.Add(1)
+		}
+
+		e := &entry{book: book, seq: seq}
+		e.touch(now)
+
+		sh.books[book.Id] = e
+		sh.indexAdd(book.Id)
+		sh.indexName(book)
+		sh.grow(book.Id, 1, len(book.Id), book.valueSize())
+		sh.scheduleExpiry(book)
+		delete(sh.tombstones, book.Id)
+		s.raiseRevision(book.Version)
+
+		sh.mu.Unlock()
+	}
+}
+
+// Forget drops the book with id without a tombstone or a change event, as
+// it is only gone from a cache.
+func (s *MemoryStore) Forget(id string) {
+	sh := s.shardFor(id)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	sh.remove(id)
+}
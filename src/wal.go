@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// WALRecord is one line of the write-ahead log.
+type WALRecord struct {
+	Op   string `json:"op"` // put or del
+	Book Book   `json:"book"`
+	CRC  uint32 `json:"crc,omitempty"` // checksum of Book, missing in older logs
+}
+
+// parseWALRecord decrypts one line of the log with keys, decodes it and
+// checks its checksum.
+func parseWALRecord(keys *Keyring, line []byte) (WALRecord, error) {
+	var record WALRecord
+
+	data, err := keys.openLine(line)
+	if err == nil {
+		err = json.Unmarshal(data, &record)
+	}
+	if err == nil && record.CRC != 0 && record.CRC != record.Book.checksum() {
+		err = errors.New(fmt.Sprintf("checksum mismatch for book %s", record.Book.Id))
+	}
+	return record, err
+}
+
+// persistError is a write refused because the log could not take it.
+type persistError struct {
+	err error
+}
+
+func (e *persistError) Error() string {
+	return e.err.Error()
+}
+
+// WALStore is a MemoryStore that appends every change to a log file before
+// applying it and rebuilds its books by replaying the log on startup. Once the log grows
+// past maxBytes it is compacted down to one put per book.
+type WALStore struct {
+	*MemoryStore
+
+	mu       sync.Mutex // orders log appends the same way as the changes
+	path     string
+	file     *os.File
+	size     int64
+	maxBytes int64
+
+	// queues appends instead, nil unless write behind is enabled
+	behind *writeBehind
+
+	// why appends are refused, once a failed one could not be cut off
+	broken error
+}
+
+func NewWALStore(path string, maxBytes int64, memory *MemoryStore) (*WALStore, error) {
+	ws := &WALStore{MemoryStore: memory, path: path, maxBytes: maxBytes}
+
+	err := ws.replay()
+	if err != nil {
+		return nil, err
+	}
+
+	ws.file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := ws.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	ws.size = info.Size()
+
+	memory.journal = ws.journal
+
+	return ws, nil
+}
+
+// replay folds the log into the final set of books and loads them with
+// their logged versions. Replayed deletes leave no tombstones. A last
+// record that does not decode was torn by a crash in the middle of its
+// append, whose change was never applied, so it is cut off the log; one
+// anywhere else is corruption and fails the replay.
+func (ws *WALStore) replay() error {
+	file, err := os.Open(ws.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	books := make(map[string]Book)
+	order := make([]string, 0)
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1<<30)
+
+	var torn error
+	var tornAt, offset int64
+
+	for line := 1; scanner.Scan(); line++ {
+		if torn != nil {
+			return torn
+		}
+
+		record, err := parseWALRecord(&ws.keys, scanner.Bytes())
+		if err != nil {
+			torn, tornAt = errors.New(fmt.Sprintf("line %d: %v", line, err)), offset
+		}
+		offset += int64(len(scanner.Bytes())) + 1
+
+		if err != nil {
+			continue
+		}
+
+		switch record.Op {
+		case "put":
+			if _, ok := books[record.Book.Id]; !ok {
+				order = append(order, record.Book.Id)
+			}
+			books[record.Book.Id] = record.Book
+		case "del":
+			delete(books, record.Book.Id)
+		default:
+			return errors.New(fmt.Sprintf("line %d: unknown op %s", line, record.Op))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if torn != nil {
+		log.Printf("wal %s: cutting off the torn last record, %v", ws.path, torn)
+		if err := os.Truncate(ws.path, tornAt); err != nil {
+			return err
+		}
+	}
+
+	replayed := make([]Book, 0, len(books))
+	for _, id := range order {
+		if book, ok := books[id]; ok {
+			replayed = append(replayed, book)
+		}
+	}
+
+	ws.MemoryStore.ReplaceBooks(replayed)
+
+	return nil
+}
+
+// WriteBehind stops syncing the log on every change: changes are appended
+// in batches of the books as they are then stored.
+func (ws *WALStore) WriteBehind(interval time.Duration, size int) {
+	ws.behind = newWriteBehind(interval, size, ws.flushBehind)
+}
+
+func (ws *WALStore) flushBehind(ids []string) {
+	unlock := ws.lock()
+	defer unlock()
+
+	records := make([]WALRecord, 0, len(ids))
+	for _, id := range ids {
+		if book := ws.MemoryStore.FindBookById(id); book != nil {
+			records = append(records, WALRecord{Op: "put", Book: *book})
+		} else {
+			records = append(records, WALRecord{Op: "del", Book: Book{Id: id}})
+		}
+	}
+
+	if err := ws.appendRecords(records...); err != nil {
+		log.Printf("%v", err)
+	}
+}
+
+// journal logs writes before the MemoryStore applies them, or queues
+// their ids for write behind. Callers hold ws.mu.
+func (ws *WALStore) journal(writes []BatchOp) error {
+	records := make([]WALRecord, 0, len(writes))
+	ids := make([]string, 0, len(writes))
+
+	for _, op := range writes {
+		if op.Op == "put" {
+			records = append(records, WALRecord{Op: "put", Book: op.Book})
+		} else {
+			records = append(records, WALRecord{Op: "del", Book: Book{Id: op.Book.Id}})
+		}
+		ids = append(ids, op.Book.Id)
+	}
+
+	if ws.behind.add(ids...) {
+		return nil
+	}
+	return ws.appendRecords(records...)
+}
+
+// appendRecords writes records to the log and syncs it. A failed write or
+// sync is cut off the log again, as the change it carries is refused; if
+// that fails too, the log refuses every later append. Callers hold ws.mu.
+func (ws *WALStore) appendRecords(records ...WALRecord) error {
+	if ws.broken != nil {
+		return ws.broken
+	}
+
+	data := make([]byte, 0)
+
+	for _, record := range records {
+		record.CRC = record.Book.checksum()
+		line, _ := json.Marshal(record)
+		data = append(data, ws.keys.sealLine(line)...)
+		data = append(data, '\n')
+	}
+
+	_, err := ws.file.Write(data)
+	if err == nil {
+		err = ws.file.Sync()
+	}
+
+	if err != nil {
+		if truncateErr := ws.file.Truncate(ws.size); truncateErr != nil {
+			ws.broken = &persistError{errors.New(fmt.Sprintf("wal %s holds a partial record: %v", ws.path, truncateErr))}
+		}
+		return &persistError{errors.New(fmt.Sprintf("wal append %s: %v", ws.path, err))}
+	}
+
+	ws.size += int64(len(data))
+	return nil
+}
+
+// lock takes ws.mu for a write. unlock compacts the log first once it
+// grew past maxBytes, which it can not under the store locks the journal
+// is called with.
+func (ws *WALStore) lock() (unlock func()) {
+	ws.mu.Lock()
+
+	return func() {
+		defer ws.mu.Unlock()
+
+		if ws.maxBytes > 0 && ws.size > ws.maxBytes {
+			if err := ws.compact(); err != nil {
+				log.Printf("wal compact %s: %v", ws.path, err)
+			}
+		}
+	}
+}
+
+// compact replaces the log with one put record per current book. Callers
+// hold ws.mu, so no change can slip in between the snapshot and the swap.
+func (ws *WALStore) compact() error {
+	data := make([]byte, 0)
+
+	books, _ := ws.GetBooks(context.Background())
+
+	for _, book := range books {
+		line, _ := json.Marshal(WALRecord{Op: "put", Book: book, CRC: book.checksum()})
+		data = append(data, ws.keys.sealLine(line)...)
+		data = append(data, '\n')
+	}
+
+	err := writeFileAtomic(ws.path, data)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(ws.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	ws.file.Close()
+	ws.file = file
+	ws.size = int64(len(data))
+	ws.broken = nil
+
+	return nil
+}
+
+// VerifyFiles reads the whole log back and reports the lines that do not
+// decode or whose checksum does not match.
+func (ws *WALStore) VerifyFiles() ([]CorruptEntry, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	file, err := os.Open(ws.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	corrupt := make([]CorruptEntry, 0)
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1<<30)
+
+	for line := 1; scanner.Scan(); line++ {
+		if record, err := parseWALRecord(&ws.keys, scanner.Bytes()); err != nil {
+			corrupt = append(corrupt, CorruptEntry{Source: ws.path, Id: record.Book.Id, Line: line, Error: err.Error()})
+		}
+	}
+
+	return corrupt, scanner.Err()
+}
+
+// Reencrypt compacts the log, which writes every line with the current
+// encryption key.
+func (ws *WALStore) Reencrypt() error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	return ws.compact()
+}
+
+// Check verifies the open log file is still usable.
+func (ws *WALStore) Check() error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if ws.broken != nil {
+		return ws.broken
+	}
+
+	_, err := ws.file.Stat()
+	return err
+}
+
+func (ws *WALStore) Close() error {
+	ws.behind.Close()
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	return ws.file.Close()
+}
+
+// The writes below only lock around the MemoryStore ones, whose journal,
+// ws.journal, logs them before they are applied.
+
+func (ws *WALStore) AddBook(book Book) error {
+	unlock := ws.lock()
+	defer unlock()
+
+	return ws.MemoryStore.AddBook(book)
+}
+
+func (ws *WALStore) SetBook(book Book) error {
+	unlock := ws.lock()
+	defer unlock()
+
+	return ws.MemoryStore.SetBook(book)
+}
+
+func (ws *WALStore) SetBookIf(book Book, cond string) error {
+	unlock := ws.lock()
+	defer unlock()
+
+	return ws.MemoryStore.SetBookIf(book, cond)
+}
+
+func (ws *WALStore) SwapBook(old Book, book Book) error {
+	unlock := ws.lock()
+	defer unlock()
+
+	return ws.MemoryStore.SwapBook(old, book)
+}
+
+func (ws *WALStore) RestoreBook(id string, prepare func(book *Book) error) error {
+	unlock := ws.lock()
+	defer unlock()
+
+	return ws.MemoryStore.RestoreBook(id, prepare)
+}
+
+func (ws *WALStore) DelBook(id string) error {
+	unlock := ws.lock()
+	defer unlock()
+
+	return ws.MemoryStore.DelBook(id)
+}
+
+func (ws *WALStore) DelBookIf(id string, cond string) error {
+	unlock := ws.lock()
+	defer unlock()
+
+	return ws.MemoryStore.DelBookIf(id, cond)
+}
+
+// ApplyBatch logs the whole batch with a single append and sync.
+func (ws *WALStore) ApplyBatch(ops []BatchOp) ([]BatchResult, bool) {
+	unlock := ws.lock()
+	defer unlock()
+
+	return ws.MemoryStore.ApplyBatch(ops)
+}
+
+// Txn logs the writes of the branch that ran with a single append.
+func (ws *WALStore) Txn(compare []TxnCompare, success, failure []BatchOp, prepare func(writes []*BatchOp) error) (bool, []BatchResult, error) {
+	unlock := ws.lock()
+	defer unlock()
+
+	return ws.MemoryStore.Txn(compare, success, failure, prepare)
+}
+
+// ImportBooks logs the puts and deletes of the import with a single append.
+func (ws *WALStore) ImportBooks(books []Book, keep func(id string) bool, prepare func(writes []*BatchOp) error) ([]BatchResult, error) {
+	unlock := ws.lock()
+	defer unlock()
+
+	return ws.MemoryStore.ImportBooks(books, keep, prepare)
+}
+
+func (ws *WALStore) ApplyChange(event ChangeEvent) {
+	unlock := ws.lock()
+	defer unlock()
+
+	ws.MemoryStore.ApplyChange(event)
+}
+
+func (ws *WALStore) DrainBooks(ids []string, prepare func(ids []string) error) ([]Book, error) {
+	unlock := ws.lock()
+	defer unlock()
+
+	return ws.MemoryStore.DrainBooks(ids, prepare)
+}
+
+// ReplaceBooks swaps the books and compacts the log, which then holds
+// exactly the new content.
+func (ws *WALStore) ReplaceBooks(books []Book) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	ws.MemoryStore.ReplaceBooks(books)
+
+	if err := ws.compact(); err != nil {
+		log.Printf("wal compact %s: %v", ws.path, err)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// walLine is the log line of a put of book, with the checksum crc or the
+// right one when crc is 0.
+func walLine(book Book, crc uint32) string {
+	if crc == 0 {
+		crc = book.checksum()
+	}
+	line, _ := json.Marshal(WALRecord{Op: "put", Book: book, CRC: crc})
+	return string(line) + "\n"
+}
+
+func TestWALReplay(t *testing.T) {
+	a, b := walLine(Book{Id: "a", Name: "1", Version: 1}, 0), walLine(Book{Id: "b", Name: "2", Version: 2}, 0)
+
+	tests := []struct {
+		name string
+		log  string
+		want []string // the books replayed as id=name, nil when the replay fails
+		kept string   // the log left afterwards
+	}{
+		{name: "whole records", log: a + b, want: []string{"a=1", "b=2"}, kept: a + b},
+		{name: "a torn last record", log: a + b[:len(b)/2], want: []string{"a=1"}, kept: a},
+		{name: "a torn last record ending in a newline", log: a + b[:len(b)/2] + "\n", want: []string{"a=1"}, kept: a},
+		{name: "a last record with a bad checksum", log: a + walLine(Book{Id: "b", Name: "2", Version: 2}, 1), want: []string{"a=1"}, kept: a},
+		{name: "a torn record in the middle", log: a[:len(a)/2] + "\n" + b},
+		{name: "an unknown op", log: a + `{"op":"nope","book":{"id":"c"}}` + "\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "books.wal")
+			if err := os.WriteFile(path, []byte(tt.log), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			ws, err := NewWALStore(path, 0, NewMemoryStore(4, 0))
+			if tt.want == nil {
+				if err == nil {
+					t.Fatal("replayed a corrupt log")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ws.Close()
+
+			replayed := make([]string, 0)
+			for _, id := range []string{"a", "b"} {
+				if book := ws.FindBookById(id); book != nil {
+					replayed = append(replayed, book.Id+"="+book.Name)
+				}
+			}
+			if !slices.Equal(replayed, tt.want) {
+				t.Errorf("replayed %v, want %v", replayed, tt.want)
+			}
+
+			if kept, _ := os.ReadFile(path); string(kept) != tt.kept {
+				t.Errorf("the log holds %q, want %q", kept, tt.kept)
+			}
+		})
+	}
+}
+
+func TestWALAppendsBeforeApplying(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "books.wal")
+
+	ws, err := NewWALStore(path, 0, NewMemoryStore(4, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.AddBook(Book{Id: "a", Name: "1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a log that can not take appends any more
+	ws.file.Close()
+
+	writes := []struct {
+		name  string
+		write func() error
+	}{
+		{name: "add", write: func() error { return ws.AddBook(Book{Id: "b", Name: "2"}) }},
+		{name: "set", write: func() error { return ws.SetBook(Book{Id: "a", Name: "changed"}) }},
+		{name: "delete", write: func() error { return ws.DelBook("a") }},
+		{name: "batch", write: func() error {
+			if results, ok := ws.ApplyBatch([]BatchOp{{Op: "put", Book: Book{Id: "b", Name: "2"}}}); !ok {
+				return errors.New(results[0].Error)
+			}
+			return nil
+		}},
+		{name: "txn", write: func() error {
+			_, _, err := ws.Txn(nil, []BatchOp{{Op: "delete", Book: Book{Id: "a"}}}, nil, nil)
+			return err
+		}},
+		{name: "drain", write: func() error {
+			_, err := ws.DrainBooks([]string{"a"}, nil)
+			return err
+		}},
+	}
+
+	for _, write := range writes {
+		if err := write.write(); err == nil {
+			t.Errorf("%s succeeded without its log append", write.name)
+		}
+	}
+
+	if book := ws.FindBookById("a"); book == nil || book.Name != "1" {
+		t.Errorf("a is %v after the failed writes, want it unchanged", book)
+	}
+	if ws.FindBookById("b") != nil {
+		t.Error("b was stored without its log append")
+	}
+	if ws.Check() == nil {
+		t.Error("the check passes on a log that refuses appends")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// streamRoutes are the routes that stay open by design, so their duration
+// says nothing about how slow they are.
+var streamRoutes = map[string]bool{
+	"/export":             true,
+	"/watch":              true,
+	"/watch/":             true,
+	"/ws":                 true,
+	"/subscribe/":         true,
+	"/replication/stream": true,
+}
+
+// countingBody counts the bytes a handler reads of the request body.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// Warnings counts the slow requests and large values logged, by route and
+// method. The thresholds are those of -slow-request-threshold and
+// -large-value-threshold, zero for no warning.
+type Warnings struct {
+	mu    sync.Mutex
+	slow  map[[2]string]uint64
+	large map[[2]string]uint64
+
+	slowAfter  time.Duration
+	largeAfter int64
+}
+
+// warningKey is the book or bucket path a request is about, empty for the
+// other routes.
+func warningKey(r *http.Request) string {
+	switch r.Pattern {
+	case "/book/", "/bucket/":
+		return strings.TrimPrefix(r.URL.Path, r.Pattern)
+	}
+	return ""
+}
+
+// Observe logs and counts a request past -slow-request-threshold, or whose
+// body or answer is past -large-value-threshold.
+func (wn *Warnings) Observe(r *http.Request, status int, d time.Duration, read, written int64) {
+	route := [2]string{r.Pattern, r.Method}
+	stream := streamRoutes[r.Pattern] || strings.HasSuffix(r.URL.Path, "/export")
+
+	if wn.slowAfter > 0 && d > wn.slowAfter && !stream {
+		wn.mu.Lock()
+		wn.slow[route]++
+		wn.mu.Unlock()
+
+		slog.Warn("slow request",
+			"op", r.Method+" "+r.Pattern,
+			"key", warningKey(r),
+			"status", status,
+			"latency", d,
+			"threshold", wn.slowAfter,
+			"request_id", requestID(r.Context()),
+		)
+	}
+
+	if wn.largeAfter > 0 && max(read, written) > wn.largeAfter {
+		wn.mu.Lock()
+		wn.large[route]++
+		wn.mu.Unlock()
+
+		slog.Warn("large value",
+			"op", r.Method+" "+r.Pattern,
+			"key", warningKey(r),
+			"status", status,
+			"request_bytes", read,
+			"response_bytes", written,
+			"threshold", wn.largeAfter,
+			"request_id", requestID(r.Context()),
+		)
+	}
+}
+
+// Render renders the warning counters in the Prometheus text format.
+// Reset zeroes the counts.
+func (wn *Warnings) Reset() {
+	wn.mu.Lock()
+	defer wn.mu.Unlock()
+
+	wn.slow = make(map[[2]string]uint64)
+	wn.large = make(map[[2]string]uint64)
+}
+
+func (wn *Warnings) Render(buf *bytes.Buffer) {
+	wn.mu.Lock()
+	defer wn.mu.Unlock()
+
+	counters := []struct {
+		name, help string
+		counts     map[[2]string]uint64
+	}{
+		{"bookstore_slow_requests_total", "Requests slower than -slow-request-threshold, by route and method.", wn.slow},
+		{"bookstore_large_values_total", "Requests with a body or answer larger than -large-value-threshold, by route and method.", wn.large},
+	}
+
+	for _, counter := range counters {
+		routes := make([][2]string, 0, len(counter.counts))
+		for route := range counter.counts {
+			routes = append(routes, route)
+		}
+		sort.Slice(routes, func(i, j int) bool {
+			if routes[i][0] != routes[j][0] {
+				return routes[i][0] < routes[j][0]
+			}
+			return routes[i][1] < routes[j][1]
+		})
+
+		fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s counter\n", counter.name, counter.help, counter.name)
+		for _, route := range routes {
+			fmt.Fprintf(buf, "%s{route=%q,method=%q} %d\n", counter.name, route[0], route[1], counter.counts[route])
+		}
+	}
+}
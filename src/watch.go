@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/paxarpp/GO_lessons/src/store"
+)
+
+// watchBuffer is how many events a watcher may fall behind before it is
+// dropped, so a slow client never holds up writes.
+const watchBuffer = 64
+
+// ChangeEvent describes one change to a book. Old is nil for inserts and
+// New is nil for deletes and expiries.
+type ChangeEvent struct {
+	Op  string `json:"op"` // put, delete, expire or evict
+	Id  string `json:"id"`
+	Old *Book  `json:"old,omitempty"`
+	New *Book  `json:"new,omitempty"`
+}
+
+type watcher = store.Subscription[ChangeEvent]
+
+// Watchers fans change events out to the subscribed watchers, on the Hub
+// of the store package.
+type Watchers struct {
+	hub *store.Hub[ChangeEvent]
+}
+
+func NewWatchers() *Watchers {
+	return &Watchers{
+		hub: store.NewHub[ChangeEvent](),
+	}
+}
+
+// Subscribe watches one book by id, or the ids starting with prefix but
+// not kept in a bucket, and falls up to buffer events behind before it is
+// dropped.
+func (wh *Watchers) Subscribe(id, prefix string, buffer int) *watcher {
+	return wh.hub.Subscribe(func(event ChangeEvent) bool {
+		if id != "" {
+			return event.Id == id
+		}
+		return strings.HasPrefix(event.Id, prefix) && !inBucket(event.Id)
+	}, buffer)
+}
+
+// SubscribeAll watches every change in the store, bucket books included,
+// for replicas, falling up to buffer events behind before it is dropped.
+func (wh *Watchers) SubscribeAll(buffer int) *watcher {
+	return wh.hub.Subscribe(func(ChangeEvent) bool { return true }, buffer)
+}
+
+func (wh *Watchers) Unsubscribe(wt *watcher) {
+	wh.hub.Unsubscribe(wt)
+}
+
+// Publish hands the event to every matching watcher without blocking;
+// watchers whose buffer is full are dropped and see their stream end.
+func (wh *Watchers) Publish(event ChangeEvent) {
+	wh.hub.Publish(event)
+}
+
+// Dropped returns how many events were not delivered to a watcher that had
+// fallen behind, each dropping the watcher.
+func (wh *Watchers) Dropped() uint64 {
+	return wh.hub.Dropped()
+}
+
+// ResetDropped zeroes the count of Dropped.
+func (wh *Watchers) ResetDropped() {
+	wh.hub.ResetDropped()
+}
+
+// CloseAll ends every stream, so shutdown does not wait on watchers.
+func (wh *Watchers) CloseAll() {
+	wh.hub.CloseAll()
+}
+
+// HandleWatch streams changes as Server-Sent Events, either for one book
+// at /watch/<id> or for every id with a prefix at /watch?prefix=.
+func (s *Server) HandleWatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		HandleMethodIsNotAllowed(w, r)
+		return
+	}
+
+	id := s.cfg.normalizeId(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/watch"), "/"))
+	prefix := r.URL.Query().Get("prefix")
+
+	defer s.streaming()()
+
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	wt := s.store.Watchers().Subscribe(id, prefix, watchBuffer)
+	defer s.store.Watchers().Unsubscribe(wt)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case event, ok := <-wt.Events():
+			if !ok {
+				return
+			}
+
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Op, data)
+
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+
+		case <-r.Context().Done():
+			return
+		}
+
+		if rc.Flush() != nil {
+			return
+		}
+	}
+}
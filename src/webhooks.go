@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// webhookQueue is how many changes a webhook may fall behind before new
+// ones go to the dead letters instead. Its watcher holds as many, and when
+// even that falls behind the webhook resyncs from the store.
+const webhookQueue = 4096
+
+const webhookMaxBackoff = 30 * time.Second
+
+// DeadLetter is one line of -webhook-dead-letter-file.
+type DeadLetter struct {
+	URL   string      `json:"url"`
+	Event ChangeEvent `json:"event"`
+	Error string      `json:"error"`
+	Time  time.Time   `json:"time"`
+}
+
+// webhook delivers the changes of the ids starting with prefix to url, one
+// at a time and in order. It watches like /watch?prefix= does, so books
+// kept in buckets are left out.
+type webhook struct {
+	prefix string
+	url    string
+	queue  chan ChangeEvent
+	done   chan struct{}
+	seen   map[string]uint64 // versions of the books it was told about
+}
+
+func (hook *webhook) matches(id string) bool {
+	return strings.HasPrefix(id, hook.prefix) && !inBucket(id)
+}
+
+// Webhooks runs the webhooks of -webhooks, retrying and writing the dead
+// letters as -webhook-retries, -webhook-backoff and
+// -webhook-dead-letter-file say.
+type Webhooks struct {
+	store   Store
+	hooks   []*webhook
+	ready   *atomic.Bool // the readiness of the server, quiet once not ready
+	retries int
+	backoff time.Duration
+	letters string
+	client  *http.Client
+	closing atomic.Bool
+	stop    chan struct{}
+	wg      sync.WaitGroup
+
+	mu   sync.Mutex // guards dead
+	dead *os.File
+}
+
+// parseWebhooks reads -webhooks. A part is a prefix and a URL when it has
+// a "=" before any "://".
+func parseWebhooks(value string) ([]*webhook, error) {
+	hooks := make([]*webhook, 0)
+
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		hook := &webhook{url: part}
+		if prefix, url, ok := strings.Cut(part, "="); ok && !strings.Contains(prefix, "://") {
+			hook.prefix, hook.url = prefix, url
+		}
+
+		if !strings.HasPrefix(hook.url, "http://") && !strings.HasPrefix(hook.url, "https://") {
+			return nil, errors.New(fmt.Sprintf("webhook %q is not an http or https URL", hook.url))
+		}
+
+		hooks = append(hooks, hook)
+	}
+
+	return hooks, nil
+}
+
+// StartWebhooks subscribes every hook to the changes of store and starts
+// sending, with the retries and dead letters of cfg.
+func StartWebhooks(store Store, hooks []*webhook, ready *atomic.Bool, cfg Config) *Webhooks {
+	wh := &Webhooks{
+		store:   store,
+		hooks:   hooks,
+		ready:   ready,
+		retries: cfg.WebhookRetries,
+		backoff: cfg.WebhookBackoff,
+		letters: cfg.WebhookDeadLetterFile,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		stop:    make(chan struct{}),
+	}
+
+	for _, hook := range hooks {
+		hook.queue = make(chan ChangeEvent, webhookQueue)
+		hook.done = make(chan struct{})
+
+		wh.wg.Add(1)
+		go wh.pump(hook)
+		go wh.deliver(hook)
+	}
+
+	return wh
+}
+
+// pump moves the changes into the hook's queue until the webhooks close.
+// Watchers are dropped when they fall behind, and all of them when the
+// server shuts down, so it subscribes again each time.
+func (wh *Webhooks) pump(hook *webhook) {
+	defer wh.wg.Done()
+
+	for wh.follow(hook) {
+		if wh.ready.Load() {
+			log.Printf("webhook %s fell behind; resyncing from the store", hook.url)
+		}
+	}
+}
+
+// follow queues the changes seen by one watcher. It reports whether the
+// watcher was dropped rather than the webhooks closed.
+//
+// The watcher is subscribed before the store is read, like the
+// replication stream does. The first time that read only fills in the
+// versions the hook was told about; after a drop every book that changed
+// since is queued as a put, and every book gone as a delete whose Old
+// holds only its id and version. Events the read already covered are
+// then skipped by their versions.
+func (wh *Webhooks) follow(hook *webhook) bool {
+	wt := wh.store.Watchers().Subscribe("", hook.prefix, webhookQueue)
+	defer wh.store.Watchers().Unsubscribe(wt)
+
+	if !wh.resync(hook) {
+		return false
+	}
+
+	for {
+		select {
+		case event, ok := <-wt.Events():
+			if !ok {
+				return true
+			}
+			wh.queue(hook, event)
+
+		case <-wh.stop:
+			return false
+		}
+	}
+}
+
+// resync compares the store with what hook was told and queues the
+// difference. It reports false when the webhooks closed meanwhile.
+func (wh *Webhooks) resync(hook *webhook) bool {
+	books, err := wh.store.GetBooks(context.Background())
+	for err != nil {
+		log.Printf("webhook %s: reading the store to resync: %v", hook.url, err)
+
+		select {
+		case <-time.After(wh.backoff):
+		case <-wh.stop:
+			return false
+		}
+		books, err = wh.store.GetBooks(context.Background())
+	}
+
+	first := hook.seen == nil
+	present := make(map[string]uint64)
+
+	for _, book := range books {
+		if !hook.matches(book.Id) {
+			continue
+		}
+		present[book.Id] = book.Version
+
+		if !first && hook.seen[book.Id] != book.Version {
+			delete(hook.seen, book.Id)
+			wh.queue(hook, ChangeEvent{Op: "put", Id: book.Id, New: &book})
+		}
+	}
+
+	if !first {
+		for id, version := range hook.seen {
+			if _, ok := present[id]; !ok {
+				wh.queue(hook, ChangeEvent{Op: "delete", Id: id, Old: &Book{Id: id, Version: version}})
+			}
+		}
+	}
+
+	hook.seen = present
+	return true
+}
+
+// queue hands event to the delivery of hook, skipping the changes it was
+// already told about, or makes it a dead letter when the queue is full.
+func (wh *Webhooks) queue(hook *webhook, event ChangeEvent) {
+	if event.New != nil {
+		if hook.seen[event.Id] >= event.New.Version {
+			return
+		}
+		hook.seen[event.Id] = event.New.Version
+	} else {
+		if _, ok := hook.seen[event.Id]; !ok {
+			return
+		}
+		delete(hook.seen, event.Id)
+	}
+
+	select {
+	case hook.queue <- event:
+	default:
+		wh.deadLetter(hook, event, errors.New("queue full"))
+	}
+}
+
+// deliver posts the queued changes. Once the webhooks close, whatever is
+// still queued or being retried goes to the dead letters.
+func (wh *Webhooks) deliver(hook *webhook) {
+	defer close(hook.done)
+
+	for event := range hook.queue {
+		if wh.closing.Load() {
+			wh.deadLetter(hook, event, errors.New("server shut down"))
+			continue
+		}
+
+		backoff := wh.backoff
+		err := wh.post(hook, event)
+
+		for retry := 0; err != nil && retry < wh.retries; retry++ {
+			select {
+			case <-time.After(backoff):
+			case <-wh.stop:
+			}
+			if wh.closing.Load() {
+				break
+			}
+
+			backoff = min(2*backoff, webhookMaxBackoff)
+			err = wh.post(hook, event)
+		}
+
+		if err != nil {
+			wh.deadLetter(hook, event, err)
+		}
+	}
+}
+
+func (wh *Webhooks) post(hook *webhook, event ChangeEvent) error {
+	body, _ := json.Marshal(event)
+
+	req, err := http.NewRequest(http.MethodPost, hook.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", event.Op)
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(fmt.Sprintf("webhook answered %s", resp.Status))
+	}
+	return nil
+}
+
+// deadLetter appends the undelivered change to -webhook-dead-letter-file,
+// or only logs it when the file can not be written.
+func (wh *Webhooks) deadLetter(hook *webhook, event ChangeEvent, cause error) {
+	log.Printf("webhook %s: %s of %s not delivered: %v", hook.url, event.Op, event.Id, cause)
+
+	line, _ := json.Marshal(DeadLetter{URL: hook.url, Event: event, Error: cause.Error(), Time: time.Now()})
+
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+
+	if wh.dead == nil {
+		file, err := os.OpenFile(wh.letters, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			log.Printf("open -webhook-dead-letter-file %s: %v", wh.letters, err)
+			return
+		}
+		wh.dead = file
+	}
+
+	if _, err := wh.dead.Write(append(line, '\n')); err != nil {
+		log.Printf("write -webhook-dead-letter-file %s: %v", wh.letters, err)
+	}
+}
+
+// Close stops the webhooks once the server no longer takes writes; the
+// changes not delivered by then are dead letters. A nil Webhooks does
+// nothing.
+func (wh *Webhooks) Close() {
+	if wh == nil {
+		return
+	}
+
+	wh.closing.Store(true)
+	close(wh.stop)
+	wh.wg.Wait()
+
+	for _, hook := range wh.hooks {
+		close(hook.queue)
+		<-hook.done
+	}
+
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+
+	if wh.dead != nil {
+		wh.dead.Close()
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestWebhookResync(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		change func(t *testing.T, s *MemoryStore)
+		queued []string
+	}{
+		{
+			name:   "nothing changed",
+			change: func(t *testing.T, s *MemoryStore) {},
+			queued: []string{},
+		},
+		{
+			name: "missed puts and deletes",
+			change: func(t *testing.T, s *MemoryStore) {
+				if err := s.SetBook(Book{Id: "a", Name: "9"}); err != nil {
+					t.Fatal(err)
+				}
+				if err := s.AddBook(Book{Id: "c", Name: "3"}); err != nil {
+					t.Fatal(err)
+				}
+				if err := s.DelBook("b"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			queued: []string{"delete b", "put a", "put c"},
+		},
+		{
+			name:   "only the prefix",
+			prefix: "a",
+			change: func(t *testing.T, s *MemoryStore) {
+				if err := s.AddBook(Book{Id: "ab", Name: "3"}); err != nil {
+					t.Fatal(err)
+				}
+				if err := s.AddBook(Book{Id: "c", Name: "3"}); err != nil {
+					t.Fatal(err)
+				}
+				if err := s.AddBook(Book{Id: bucketIdPrefix + "shelf/a", Name: "3"}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			queued: []string{"put ab"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemoryStore(4, 0)
+			for _, book := range []Book{{Id: "a", Name: "1"}, {Id: "b", Name: "2"}} {
+				if err := store.AddBook(book); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			hook := &webhook{prefix: tt.prefix, url: "http://localhost/", queue: make(chan ChangeEvent, 16)}
+			wh := &Webhooks{store: store, hooks: []*webhook{hook}, stop: make(chan struct{})}
+
+			if !wh.resync(hook) || len(hook.queue) != 0 {
+				t.Fatalf("the first resync queued %d changes, want none", len(hook.queue))
+			}
+
+			tt.change(t, store)
+			if !wh.resync(hook) {
+				t.Fatal("resync stopped")
+			}
+			close(hook.queue)
+
+			events := make([]ChangeEvent, 0)
+			queued := make([]string, 0)
+			for event := range hook.queue {
+				events = append(events, event)
+				queued = append(queued, event.Op+" "+event.Id)
+			}
+			slices.Sort(queued)
+
+			// The new watcher hands over the same changes after the resync.
+			hook.queue = make(chan ChangeEvent, len(events))
+			for _, event := range events {
+				wh.queue(hook, event)
+			}
+			if len(hook.queue) != 0 {
+				t.Errorf("%d changes were queued again", len(hook.queue))
+			}
+
+			if !slices.Equal(queued, tt.queued) {
+				t.Errorf("queued %v, want %v", queued, tt.queued)
+			}
+		})
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// websocketGUID is the fixed suffix of the handshake key, from RFC 6455.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// WSRequest is one client message on /ws. Ref is echoed back so clients can
+// pipeline requests.
+type WSRequest struct {
+	Op     string `json:"op"` // get, put, delete or subscribe
+	Ref    string `json:"ref,omitempty"`
+	Id     string `json:"id"`
+	Book   Book   `json:"book"`
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// WSResponse answers a WSRequest, or carries a change event for an earlier
+// subscribe when Op is event.
+type WSResponse struct {
+	Op    string       `json:"op"`
+	Ref   string       `json:"ref,omitempty"`
+	Id    string       `json:"id,omitempty"`
+	Book  *Book        `json:"book,omitempty"`
+	Event *ChangeEvent `json:"event,omitempty"`
+	Error string       `json:"error,omitempty"`
+}
+
+// wsConn is a server side WebSocket connection. Writes are serialized
+// because subscriptions push events while requests are answered.
+type wsConn struct {
+	conn     net.Conn
+	rw       *bufio.ReadWriter
+	maxBytes int64 // of a message, see -max-body-bytes
+	mu       sync.Mutex
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	header := []byte{0x80 | opcode}
+
+	switch {
+	case len(payload) < 126:
+		header = append(header, byte(len(payload)))
+	case len(payload) <= 0xffff:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(len(payload)))
+	}
+
+	c.rw.Write(header)
+	c.rw.Write(payload)
+
+	return c.rw.Flush()
+}
+
+func (c *wsConn) writeJSON(v any) error {
+	data, _ := json.Marshal(v)
+	return c.writeFrame(opText, data)
+}
+
+// readFrame reads one client frame and unmasks its payload.
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.rw, head[:]); err != nil {
+		return
+	}
+
+	fin = head[0]&0x80 != 0
+	opcode = head[0] & 0x0f
+
+	if head[1]&0x80 == 0 {
+		err = errors.New("client frames must be masked")
+		return
+	}
+
+	length := uint64(head[1] & 0x7f)
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.rw, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.rw, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if length > uint64(c.maxBytes) {
+		err = errors.New(fmt.Sprintf("frame of %d bytes is over -max-body-bytes", length))
+		return
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(c.rw, mask[:]); err != nil {
+		return
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.rw, payload); err != nil {
+		return
+	}
+
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return
+}
+
+// readMessage returns the next text message, answering pings and joining
+// fragments on the way. It returns io.EOF once the client closes.
+func (c *wsConn) readMessage() ([]byte, error) {
+	message := make([]byte, 0)
+
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case opPing:
+			c.writeFrame(opPong, payload)
+			continue
+		case opPong:
+			continue
+		case opClose:
+			c.writeFrame(opClose, payload)
+			return nil, io.EOF
+		case opText, opContinuation:
+			message = append(message, payload...)
+		default:
+			return nil, errors.New(fmt.Sprintf("unsupported opcode %d", opcode))
+		}
+
+		if int64(len(message)) > c.maxBytes {
+			return nil, errors.New("message is over -max-body-bytes")
+		}
+
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+// wsMessageRequest is the upgrade request r as the audit log records a
+// message of op sent over it.
+func wsMessageRequest(r *http.Request, op string) *http.Request {
+	r = r.Clone(r.Context())
+	r.Method, r.Proto, r.ProtoMajor, r.ProtoMinor = strings.ToUpper(op), "websocket", 0, 0
+	return r
+}
+
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") && r.Header.Get("Sec-WebSocket-Key") != ""
+}
+
+// acceptWebSocket takes over the connection of an upgrade request and
+// completes the handshake. It returns nil when that fails; otherwise the
+// caller closes the connection.
+func (s *Server) acceptWebSocket(w http.ResponseWriter, r *http.Request) *wsConn {
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, err.Error())
+		return nil
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + websocketGUID))
+
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if rw.Flush() != nil {
+		conn.Close()
+		return nil
+	}
+
+	return &wsConn{conn: conn, rw: rw, maxBytes: s.cfg.MaxBodyBytes}
+}
+
+// HandleWebSocket upgrades the request and then serves get, put, delete
+// and subscribe messages on the one connection. Writes need write access
+// even where plain HTTP reads are open, as the upgrade itself is a GET.
+func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet || !isWebSocketUpgrade(r) {
+		w.Header().Set("Content-Type", "application/json")
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "expected a WebSocket upgrade")
+		return
+	}
+
+	access, ok := s.apiKeys.authenticate(r)
+	canWrite := ok && access == accessWrite
+
+	c := s.acceptWebSocket(w, r)
+	if c == nil {
+		return
+	}
+	defer c.conn.Close()
+
+	subscriptions := make([]*watcher, 0)
+	defer func() {
+		for _, wt := range subscriptions {
+			s.store.Watchers().Unsubscribe(wt)
+		}
+	}()
+
+	for {
+		message, err := c.readMessage()
+		if err != nil {
+			return
+		}
+
+		var req WSRequest
+
+		if err := json.Unmarshal(message, &req); err != nil {
+			c.writeJSON(WSResponse{Op: "error", Error: fmt.Sprintf("Bad request. %v", err)})
+			continue
+		}
+
+		if req.Op == "subscribe" {
+			wt := s.store.Watchers().Subscribe(s.cfg.normalizeId(req.Id), req.Prefix, watchBuffer)
+			subscriptions = append(subscriptions, wt)
+
+			go func() {
+				for event := range wt.Events() {
+					c.writeJSON(WSResponse{Op: "event", Ref: req.Ref, Event: &event})
+				}
+			}()
+
+			c.writeJSON(WSResponse{Op: req.Op, Ref: req.Ref, Id: req.Id})
+			continue
+		}
+
+		c.writeJSON(s.handleWSRequest(r, req, canWrite))
+	}
+}
+
+// handleWSRequest serves one get, put or delete message. r is the upgrade
+// request, which the hooks see.
+func (s *Server) handleWSRequest(r *http.Request, req WSRequest, canWrite bool) (resp WSResponse) {
+	if req.Id == "" {
+		req.Id = req.Book.Id
+	}
+
+	id := s.cfg.normalizeId(req.Id)
+	resp = WSResponse{Op: req.Op, Ref: req.Ref, Id: id}
+
+	if s.audit != nil && req.Op != "get" {
+		audited := s.auditWrite(wsMessageRequest(r, req.Op), []string{id})
+		defer func() { audited(0, cmp.Or(resp.Error, "OK")) }()
+	}
+
+	if req.Op != "get" && !canWrite {
+		resp.Error = "credentials do not allow writes"
+		return resp
+	}
+
+	if reason := s.writesRefused(); req.Op != "get" && reason != "" {
+		resp.Error = reason
+		return resp
+	}
+
+	if s.cfg.isReservedId(id) {
+		resp.Error = fmt.Sprintf("Book id %s is reserved", id)
+		return resp
+	}
+
+	book := req.Book
+	book.Id, book.ExpiresAt, book.Version = id, nil, 0
+
+	if req.Op == "put" && book.Author == "" && book.Name == "" {
+		switch s.cfg.EmptyValuePolicy {
+		case "reject":
+			resp.Error = fmt.Sprintf("Bad request. book %s has no author and name", id)
+			return resp
+		case "delete":
+			req.Op = "delete"
+		}
+	}
+
+	var err error
+	switch req.Op {
+	case "put":
+		err = s.runPutHooks(r, &book)
+	case "delete":
+		err = s.runDeleteHooks(r, id)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+
+	if req.Op == "put" {
+		if _, limitError := s.checkLimits(book); limitError != nil {
+			resp.Error = limitError.Message
+			return resp
+		}
+	}
+
+	switch req.Op {
+	case "get":
+		resp.Book = s.store.FindBookById(id)
+		if resp.Book == nil {
+			resp.Error = fmt.Sprintf("Book with id %s not found", id)
+		}
+
+	case "put":
+		results, _ := s.store.ApplyBatch([]BatchOp{{Op: "put", Book: book}})
+		resp.Book = s.store.FindBookById(id)
+		if results[0].Error != "" {
+			resp.Error = results[0].Error
+		}
+
+	case "delete":
+		if err := s.store.DelBook(id); err != nil {
+			resp.Error = fmt.Sprintf("%v", err)
+		}
+
+	default:
+		resp.Error = fmt.Sprintf("unknown op %s", req.Op)
+	}
+
+	return resp
+}
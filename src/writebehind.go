@@ -0,0 +1,138 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// writeBehind collects the ids of changed books and hands them to flush
+// in batches from a background worker. An id changed several times before
+// a flush is flushed once, so flush persists each book as it is stored at
+// that point, put or gone. A nil *writeBehind queues nothing, so backends
+// can call it unconditionally.
+type writeBehind struct {
+	interval time.Duration
+	size     int
+	flush    func(ids []string)
+
+	mu       sync.Mutex
+	pending  map[string]bool
+	order    []string
+	flushing map[string]bool // the ids of the flush under way
+
+	flushMu sync.Mutex // one flush at a time
+	kick    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newWriteBehind(interval time.Duration, size int, flush func(ids []string)) *writeBehind {
+	wb := &writeBehind{
+		interval: interval,
+		size:     size,
+		flush:    flush,
+		pending:  make(map[string]bool),
+		kick:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go wb.run()
+
+	return wb
+}
+
+// add queues ids and reports whether they were queued, false when write
+// behind is off and the caller persists them itself.
+func (wb *writeBehind) add(ids ...string) bool {
+	if wb == nil {
+		return false
+	}
+
+	wb.mu.Lock()
+	for _, id := range ids {
+		if !wb.pending[id] {
+			wb.pending[id] = true
+			wb.order = append(wb.order, id)
+		}
+	}
+	full := len(wb.order) >= wb.size
+	wb.mu.Unlock()
+
+	if full {
+		select {
+		case wb.kick <- struct{}{}:
+		default:
+		}
+	}
+
+	return true
+}
+
+// queued reports whether a change of id is not persisted yet.
+func (wb *writeBehind) queued(id string) bool {
+	if wb == nil {
+		return false
+	}
+
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	return wb.pending[id] || wb.flushing[id]
+}
+
+// Flush persists everything queued so far.
+func (wb *writeBehind) Flush() {
+	if wb == nil {
+		return
+	}
+
+	wb.flushMu.Lock()
+	defer wb.flushMu.Unlock()
+
+	wb.mu.Lock()
+	ids := wb.order
+	wb.flushing = wb.pending
+	wb.pending, wb.order = make(map[string]bool), nil
+	wb.mu.Unlock()
+
+	if len(ids) > 0 {
+		wb.flush(ids)
+	}
+
+	wb.mu.Lock()
+	wb.flushing = nil
+	wb.mu.Unlock()
+}
+
+func (wb *writeBehind) run() {
+	defer close(wb.done)
+
+	tick := time.NewTicker(wb.interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-wb.stop:
+			wb.Flush()
+			return
+		case <-wb.kick:
+		case <-tick.C:
+		}
+
+		wb.Flush()
+	}
+}
+
+// Close flushes what is left and stops the worker.
+func (wb *writeBehind) Close() {
+	if wb == nil {
+		return
+	}
+
+	wb.once.Do(func() {
+		close(wb.stop)
+		<-wb.done
+	})
+}